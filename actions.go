@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// operatorAction is an action of an operator controlling an audit, such as
+// suppressing mismatches or putting the audit in maintenance. Actions are
+// logged, and recorded in an append-only log in the state directory, which
+// is the trail of who changed what in the audit.
+type operatorAction struct {
+	At time.Time `json:"at"`
+	// By is the operator: the user running a command, or the credentials
+	// of a request to the HTTP endpoint.
+	By      string     `json:"by"`
+	Action  string     `json:"action"`
+	Details log.Fields `json:"details,omitempty"`
+}
+
+func (s stateDir) appendAction(a operatorAction) error {
+	f, err := os.OpenFile(s.path(actionsFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(a)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readActions returns the actions of operators, oldest first.
+func (s stateDir) readActions() ([]operatorAction, error) {
+	f, err := os.Open(s.path(actionsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var actions []operatorAction
+	scan := bufio.NewScanner(f)
+	scan.Buffer(nil, 1<<20)
+	for scan.Scan() {
+		var a operatorAction
+		if err := json.Unmarshal(scan.Bytes(), &a); err != nil {
+			return nil, fmt.Errorf("corrupted actions log: %v", err)
+		}
+		actions = append(actions, a)
+	}
+	return actions, scan.Err()
+}
+
+// recordAction logs the action of an operator, and records it in the state
+// directory if there's one.
+func recordAction(state stateDir, a operatorAction) error {
+	fields := log.Fields{"by": a.By, "action": a.Action}
+	for name, value := range a.Details {
+		fields[name] = value
+	}
+	log.WithFields(fields).Warn("operator action")
+	if state == "" {
+		return nil
+	}
+	return state.appendAction(a)
+}
+
+// currentUser is the user running jag, from the environment of Unix or of
+// Windows.
+func currentUser() string {
+	if user := os.Getenv("USER"); user != "" {
+		return user
+	}
+	return os.Getenv("USERNAME")
+}
+
+// actionState is the state directory of the audit served on the HTTP
+// endpoint, where the actions of operators on the endpoint are recorded.
+var actionState struct {
+	mu    sync.Mutex
+	state stateDir
+}
+
+func setActionState(state stateDir) {
+	actionState.mu.Lock()
+	defer actionState.mu.Unlock()
+	actionState.state = state
+}
+
+// recordRequestAction records the action of the operator who made a
+// request to the HTTP endpoint.
+func recordRequestAction(r *http.Request, action string, detail log.Fields) {
+	recordServerAction(requestPrincipal(r), action, detail)
+}
+
+// recordServerAction records the action of an operator on the audit being
+// served, such as a request to the HTTP endpoint or a signal.
+func recordServerAction(by, action string, detail log.Fields) {
+	actionState.mu.Lock()
+	defer actionState.mu.Unlock()
+	err := recordAction(actionState.state, operatorAction{
+		At:      time.Now().UTC(),
+		By:      by,
+		Action:  action,
+		Details: detail,
+	})
+	if err != nil {
+		log.WithField("error", err).Error("couldn't record operator action")
+	}
+}
+
+// principalKey is the key of the principal in the context of requests.
+type principalKey struct{}
+
+func withPrincipal(r *http.Request, principal string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+}
+
+// requestPrincipal tells who made a request: the credentials it carried,
+// or where it came from if the endpoint doesn't authenticate requests.
+func requestPrincipal(r *http.Request) string {
+	if principal, ok := r.Context().Value(principalKey{}).(string); ok {
+		return principal
+	}
+	return "anonymous@" + r.RemoteAddr
+}
+
+func stateActionsCommand() cli.Command {
+	cfgFlag := cli.StringFlag{
+		Name:  "cfg",
+		Usage: "path to the JSON config file",
+	}
+	sinceFlag := cli.DurationFlag{
+		Name:  "since",
+		Usage: "only list the actions more recent than this, all of them by default",
+	}
+
+	doActions := func(ctx *cli.Context) {
+		cfg := mustConfig(ctx, cfgFlag)
+		if cfg.StateDir == "" {
+			fail(ctx, "error: config doesn't have a state_dir, actions aren't recorded")
+		}
+		actions, err := stateDir(cfg.StateDir).readActions()
+		if err != nil {
+			fail(ctx, "error: can't read actions: %v", err)
+		}
+		var since time.Time
+		if d := ctx.Duration(sinceFlag.Name); d > 0 {
+			since = time.Now().Add(-d)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "AT\tBY\tACTION\tDETAILS")
+		for _, a := range actions {
+			if a.At.Before(since) {
+				continue
+			}
+			details := make([]string, 0, len(a.Details))
+			for name, value := range a.Details {
+				details = append(details, fmt.Sprintf("%s=%v", name, value))
+			}
+			sort.Strings(details)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.At.Format(time.RFC3339), a.By, a.Action, strings.Join(details, " "))
+		}
+		if err := tw.Flush(); err != nil {
+			fail(ctx, "error: can't write actions: %v", err)
+		}
+	}
+
+	return cli.Command{
+		Name:  "actions",
+		Usage: "Lists the actions of operators on the audit.",
+		Description: strings.TrimSpace(`
+Lists the actions of operators controlling the audit, oldest first: who
+suppressed or acknowledged mismatches, put the audit in maintenance, changed
+its log levels or imported its state, and when.`),
+		Flags:  []cli.Flag{cfgFlag, sinceFlag},
+		Action: doActions,
+	}
+}
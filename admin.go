@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultAdminListen is where the HTTP endpoint of the audit command listens,
+// serving pprof, metrics and the endpoints changing the audit, unless the
+// config says otherwise.
+const DefaultAdminListen = "127.0.0.1:6060"
+
+// AdminReadHeaderTimeout is how long clients of the HTTP endpoint can take
+// to send the headers of their requests.
+const AdminReadHeaderTimeout = 10 * time.Second
+
+// adminConfig configures the HTTP endpoint of the audit command. It can only
+// listen beyond the loopback interface if requests are authenticated, with a
+// bearer token or basic auth, and should then be served over TLS.
+//
+// Requests are in one of two scopes: reading, which GETs what the endpoint
+// serves but pprof, and controlling, which changes the audit, or profiles it
+// and so can read its memory. The token and basic auth grant both scopes,
+// the read token only reading, so that dashboards polling the endpoint
+// can't change the audit.
+type adminConfig struct {
+	Listen string `json:"listen,omitempty"`
+	// Token, if set, is a token requests can carry as
+	// "Authorization: Bearer <token>".
+	Token string `json:"token,omitempty"`
+	// ReadToken, if set, is a token of requests that only read.
+	ReadToken string          `json:"read_token,omitempty"`
+	BasicAuth *adminBasicAuth `json:"basic_auth,omitempty"`
+	TLS       *adminTLS       `json:"tls,omitempty"`
+}
+
+type adminBasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// adminTLS serves the endpoint over TLS, with the certificate and key of
+// files, or with a certificate generated at startup, whose fingerprint is
+// logged for clients to pin.
+type adminTLS struct {
+	CertFile   string `json:"cert_file,omitempty"`
+	KeyFile    string `json:"key_file,omitempty"`
+	SelfSigned bool   `json:"self_signed,omitempty"`
+}
+
+func loadAdmin(a *adminConfig) error {
+	if a.Listen == "" {
+		a.Listen = DefaultAdminListen
+	}
+	host, _, err := net.SplitHostPort(a.Listen)
+	if err != nil {
+		return fmt.Errorf("listen: %v", err)
+	}
+	if a.ReadToken != "" && a.ReadToken == a.Token {
+		return fmt.Errorf("read_token must differ from token")
+	}
+	if a.BasicAuth != nil && (a.BasicAuth.Username == "" || a.BasicAuth.Password == "") {
+		return fmt.Errorf("basic_auth: username and password are required")
+	}
+	if !isLoopback(host) && !a.authenticates() {
+		return fmt.Errorf("listening on %q beyond the loopback interface requires a token or basic_auth", a.Listen)
+	}
+	if t := a.TLS; t != nil {
+		files := t.CertFile != "" || t.KeyFile != ""
+		switch {
+		case files && t.SelfSigned:
+			return fmt.Errorf("tls: cert_file and key_file can't be given with self_signed")
+		case files && (t.CertFile == "" || t.KeyFile == ""):
+			return fmt.Errorf("tls: cert_file and key_file are required together")
+		case !files && !t.SelfSigned:
+			return fmt.Errorf("tls: cert_file and key_file, or self_signed, are required")
+		}
+	}
+	return nil
+}
+
+// isLoopback tells if a host only listens on the loopback interface.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (a *adminConfig) authenticates() bool {
+	return a.Token != "" || a.ReadToken != "" || a.BasicAuth != nil
+}
+
+// adminScope is what a request to the endpoint can do.
+type adminScope int
+
+const (
+	adminScopeNone adminScope = iota
+	adminScopeRead
+	adminScopeControl
+)
+
+// requiredScope is the scope a request needs.
+func requiredScope(r *http.Request) adminScope {
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && !strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+		return adminScopeRead
+	}
+	return adminScopeControl
+}
+
+// scope is the scope granted by the token or the basic auth credentials of
+// the config a request carries, and the principal they identify.
+func (a *adminConfig) scope(r *http.Request) (adminScope, string) {
+	equal := func(got, want string) bool {
+		return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		switch {
+		case equal(token, a.Token):
+			return adminScopeControl, "token"
+		case equal(token, a.ReadToken):
+			return adminScopeRead, "read_token"
+		}
+	}
+	if a.BasicAuth != nil {
+		if user, password, ok := r.BasicAuth(); ok && equal(user, a.BasicAuth.Username) && equal(password, a.BasicAuth.Password) {
+			return adminScopeControl, user
+		}
+	}
+	return adminScopeNone, ""
+}
+
+// handler returns the handler of the endpoint, which authenticates the
+// requests to the default mux if the config says so.
+func (a *adminConfig) handler() http.Handler {
+	if !a.authenticates() {
+		return http.DefaultServeMux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope, principal := a.scope(r)
+		switch {
+		case scope == adminScopeNone:
+			if a.BasicAuth != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="jag"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="jag"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		case scope < requiredScope(r):
+			http.Error(w, "forbidden, the read token can't control the audit", http.StatusForbidden)
+			return
+		}
+		http.DefaultServeMux.ServeHTTP(w, withPrincipal(r, principal))
+	})
+}
+
+// addr is the address the endpoint listens on.
+func (a *adminConfig) addr() string {
+	if a.Listen == "" {
+		return DefaultAdminListen
+	}
+	return a.Listen
+}
+
+// url is the base URL of the endpoint.
+func (a *adminConfig) url() string {
+	if a.TLS != nil {
+		return "https://" + a.addr()
+	}
+	return "http://" + a.addr()
+}
+
+// serve serves the endpoint until it fails.
+func (a *adminConfig) serve() error {
+	srv := &http.Server{
+		Addr:              a.addr(),
+		Handler:           a.handler(),
+		ReadHeaderTimeout: AdminReadHeaderTimeout,
+	}
+	host, _, _ := net.SplitHostPort(a.addr())
+	if a.TLS == nil {
+		if !isLoopback(host) {
+			log.WithField("listen", a.addr()).Warn("credentials of the HTTP endpoint are sent in the clear, without tls")
+		}
+		return srv.ListenAndServe()
+	}
+	if a.TLS.SelfSigned {
+		cert, err := selfSignedCert(host, time.Now())
+		if err != nil {
+			return fmt.Errorf("can't generate certificate: %v", err)
+		}
+		fingerprint := sha256.Sum256(cert.Certificate[0])
+		log.WithField("sha256", fmt.Sprintf("%x", fingerprint)).Info("serving HTTP endpoint with a self-signed certificate")
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServeTLS(a.TLS.CertFile, a.TLS.KeyFile)
+}
+
+// selfSignedCert generates a certificate for a host and the loopback
+// interface, valid for a year.
+func selfSignedCert(host string, now time.Time) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "jag"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	} else if host != "" && host != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
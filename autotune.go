@@ -0,0 +1,109 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// DefaultMaxErrorRate is the share of verifications that can fail because S3
+// is overwhelmed before the concurrency is lowered, if the config doesn't say
+// otherwise.
+const DefaultMaxErrorRate = 0.05
+
+// autotuneConfig configures the adjustment of the concurrency of audits.
+type autotuneConfig struct {
+	// TargetRound is how long rounds should take.
+	TargetRound time.Duration
+	// MaxErrorRate is the share of verifications that can fail because S3
+	// is overwhelmed.
+	MaxErrorRate float64
+	// MaxWorkers bounds the concurrency.
+	MaxWorkers int
+}
+
+// autotuner adjusts the number of concurrent walks and verifications after
+// each round, raising them slowly while rounds take longer than the target,
+// and halving them when S3 pushes back.
+type autotuner struct {
+	cfg autotuneConfig
+
+	mu      sync.Mutex
+	walks   int
+	workers int
+}
+
+func newAutotuner(cfg autotuneConfig, walks, workers int) *autotuner {
+	t := &autotuner{cfg: cfg}
+	t.walks, t.workers = t.bound(walks), t.bound(workers)
+	return t
+}
+
+func (t *autotuner) bound(n int) int {
+	if n < 1 {
+		return 1
+	}
+	if n > t.cfg.MaxWorkers {
+		return t.cfg.MaxWorkers
+	}
+	return n
+}
+
+// concurrency returns the number of walks and of verifications to run
+// concurrently.
+func (t *autotuner) concurrency() (walks, workers int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.walks, t.workers
+}
+
+// isPushback tells if a verification failed because S3 is overwhelmed.
+func isPushback(res Result) bool {
+	switch res.ErrorKind {
+	case "throttled", "unavailable", "timeout":
+		return true
+	}
+	return false
+}
+
+// adjust changes the concurrency given how the last round went.
+func (t *autotuner) adjust(report *RoundReport) {
+	pushbacks := 0
+	for _, res := range report.Results {
+		if isPushback(res) {
+			pushbacks++
+		}
+	}
+	errorRate := 0.0
+	if len(report.Results) != 0 {
+		errorRate = float64(pushbacks) / float64(len(report.Results))
+	}
+	duration := report.Finished.Sub(report.Started)
+
+	var change func(n int) int
+	switch {
+	case errorRate > t.cfg.MaxErrorRate:
+		change = func(n int) int { return n / 2 }
+	case duration > t.cfg.TargetRound:
+		change = func(n int) int { return n + 1 }
+	case duration < t.cfg.TargetRound/2:
+		// no need to hit S3 that hard
+		change = func(n int) int { return n - 1 }
+	default:
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	walks, workers := t.bound(change(t.walks)), t.bound(change(t.workers))
+	if walks == t.walks && workers == t.workers {
+		return
+	}
+	log.WithFields(log.Fields{
+		"walks":      walks,
+		"workers":    workers,
+		"duration":   duration,
+		"error_rate": errorRate,
+	}).Info("adjusting concurrency of audits")
+	t.walks, t.workers = walks, workers
+}
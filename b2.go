@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultB2APIURL is where B2 accounts are authorized.
+const DefaultB2APIURL = "https://api.backblazeb2.com"
+
+// MaxB2FileCount is the most files B2 lists in a single transaction.
+const MaxB2FileCount = 10000
+
+// b2UnsupportedChecks are the checks that can't verify keys in B2, which
+// has no MD5 ETags nor tags, and whose retention isn't S3's.
+var b2UnsupportedChecks = map[string]bool{
+	"etag":      true,
+	"tags":      true,
+	"retention": true,
+}
+
+// errB2Unsupported is returned when asking B2 for what it doesn't have.
+var errB2Unsupported = errors.New("not supported by B2")
+
+// b2Config is set on a bucket of Backblaze B2 reached with its native API.
+// The access key and the secret key of the bucket are the ID and the value
+// of an application key.
+type b2Config struct {
+	APIURL string `json:"api_url,omitempty"`
+}
+
+func loadB2(c *config, a awsConfig) error {
+	if a.B2.APIURL == "" {
+		a.B2.APIURL = DefaultB2APIURL
+	}
+	if len(a.Fallbacks) != 0 || a.DualStack || a.FIPS {
+		return fmt.Errorf("fallbacks, dual_stack and fips only apply to S3")
+	}
+	if c.Reconcile {
+		return fmt.Errorf("buckets keep no statistics to reconcile")
+	}
+	for _, name := range c.Checks {
+		if b2UnsupportedChecks[name] {
+			return fmt.Errorf("check %q can't verify keys in B2", name)
+		}
+	}
+	return nil
+}
+
+// b2Bucket is a bucket of B2. Its keys have no ETag, but B2 records the
+// SHA-1 of their content, see checksumOf.
+type b2Bucket struct {
+	name   string
+	keyID  string
+	appKey string
+	cfg    b2Config
+	// session is shared by the copies of the bucket.
+	session *b2Session
+}
+
+type b2Session struct {
+	mu      sync.Mutex
+	account b2Account
+}
+
+// b2Account is what authorizing an account tells: the token of the
+// requests, where to send them, and the ID of the bucket.
+type b2Account struct {
+	token       string
+	apiURL      string
+	downloadURL string
+	accountID   string
+	bucketID    string
+}
+
+func newB2Bucket(a awsConfig) b2Bucket {
+	return b2Bucket{
+		name:    a.Bucket,
+		keyID:   a.AccessKey,
+		appKey:  a.SecretKey,
+		cfg:     *a.B2,
+		session: &b2Session{},
+	}
+}
+
+// b2Error is the error of an unsuccessful response of B2.
+type b2Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *b2Error) Error() string {
+	return fmt.Sprintf("B2 error %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// responseB2Error wraps the error of an unsuccessful response into the kind
+// of error it represents. The B2 error stays in the chain.
+func responseB2Error(resp *http.Response) error {
+	berr := &b2Error{Status: resp.StatusCode}
+	if err := json.NewDecoder(resp.Body).Decode(berr); err != nil || berr.Message == "" {
+		berr.Message = resp.Status
+	}
+	switch {
+	case berr.Status == http.StatusTooManyRequests || berr.Status == http.StatusServiceUnavailable:
+		return fmt.Errorf("%w: %w", ErrThrottled, berr)
+	case berr.Status == http.StatusNotFound:
+		return fmt.Errorf("%w: %w", ErrKeyMissing, berr)
+	case berr.Status == http.StatusUnauthorized || berr.Status == http.StatusForbidden:
+		return fmt.Errorf("%w: %w", ErrAccessDenied, berr)
+	case berr.Status >= 500:
+		return fmt.Errorf("%w: %w", ErrUnavailable, berr)
+	}
+	return berr
+}
+
+// authorize authorizes the account, replacing the token that was rejected
+// if any, and looks up the ID of the bucket.
+func (b b2Bucket) authorize(rejected string) (b2Account, error) {
+	b.session.mu.Lock()
+	defer b.session.mu.Unlock()
+	if b.session.account.token != "" && b.session.account.token != rejected {
+		return b.session.account, nil
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(b.cfg.APIURL, "/")+"/b2api/v2/b2_authorize_account", nil)
+	if err != nil {
+		return b2Account{}, err
+	}
+	req.SetBasicAuth(b.keyID, b.appKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return b2Account{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= 300 {
+		return b2Account{}, fmt.Errorf("can't authorize B2 account: %w", responseB2Error(resp))
+	}
+	var auth struct {
+		AccountID          string `json:"accountId"`
+		AuthorizationToken string `json:"authorizationToken"`
+		APIURL             string `json:"apiUrl"`
+		DownloadURL        string `json:"downloadUrl"`
+		Allowed            struct {
+			BucketID   string `json:"bucketId"`
+			BucketName string `json:"bucketName"`
+		} `json:"allowed"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return b2Account{}, fmt.Errorf("invalid authorization of B2 account: %v", err)
+	}
+	account := b2Account{
+		token:       auth.AuthorizationToken,
+		apiURL:      auth.APIURL,
+		downloadURL: auth.DownloadURL,
+		accountID:   auth.AccountID,
+		bucketID:    b.session.account.bucketID,
+	}
+	if auth.Allowed.BucketName == b.name {
+		account.bucketID = auth.Allowed.BucketID
+	}
+	if account.bucketID == "" {
+		var buckets struct {
+			Buckets []struct {
+				BucketID string `json:"bucketId"`
+			} `json:"buckets"`
+		}
+		req := map[string]string{"accountId": account.accountID, "bucketName": b.name}
+		if err := b.post(context.Background(), account, "b2_list_buckets", req, &buckets); err != nil {
+			return b2Account{}, fmt.Errorf("can't look up B2 bucket %q: %w", b.name, err)
+		}
+		if len(buckets.Buckets) == 0 {
+			return b2Account{}, fmt.Errorf("%w: B2 bucket %q", ErrKeyMissing, b.name)
+		}
+		account.bucketID = buckets.Buckets[0].BucketID
+	}
+	b.session.account = account
+	return account, nil
+}
+
+// post calls an operation of the API, decoding its JSON response in v.
+func (b b2Bucket) post(ctx context.Context, account b2Account, op string, body, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", account.apiURL+"/b2api/v2/"+op, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", account.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= 300 {
+		return responseB2Error(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// do performs a request made with the authorization of the account, and
+// authorizes it again if the token expired.
+func (b b2Bucket) do(request func(account b2Account) error) error {
+	account, err := b.authorize("")
+	if err != nil {
+		return err
+	}
+	err = request(account)
+	var berr *b2Error
+	if errors.As(err, &berr) && berr.Status == http.StatusUnauthorized && berr.Code == "expired_auth_token" {
+		if account, err = b.authorize(account.token); err != nil {
+			return err
+		}
+		err = request(account)
+	}
+	return err
+}
+
+// call calls an operation of the API on the bucket.
+func (b b2Bucket) call(ctx context.Context, op string, body map[string]interface{}, v interface{}) error {
+	return b.do(func(account b2Account) error {
+		body["bucketId"] = account.bucketID
+		return b.post(ctx, account, op, body, v)
+	})
+}
+
+// download requests the content of a key, or of a version of it.
+func (b b2Bucket) download(ctx context.Context, method, key, version string) (*http.Response, error) {
+	var resp *http.Response
+	err := b.do(func(account b2Account) error {
+		u := account.downloadURL + "/file/" + b.name + "/" + (&url.URL{Path: key}).EscapedPath()
+		if version != "" {
+			u = account.downloadURL + "/b2api/v2/b2_download_file_by_id?" + url.Values{"fileId": {version}}.Encode()
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", account.token)
+		if resp, err = http.DefaultClient.Do(req); err != nil {
+			return err
+		}
+		if resp.StatusCode >= 300 {
+			defer func() { _ = resp.Body.Close() }()
+			return responseB2Error(resp)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s on key %q in B2 bucket %q: %w", method, key, b.name, err)
+	}
+	return resp, nil
+}
+
+// b2File is a version of a key, or a folder, in a listing.
+type b2File struct {
+	// Action is upload for versions of keys, hide for their deletions,
+	// start for large files being uploaded, and folder for prefixes.
+	Action          string `json:"action"`
+	FileID          string `json:"fileId"`
+	FileName        string `json:"fileName"`
+	ContentLength   int64  `json:"contentLength"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+}
+
+func (f b2File) lastModified() string {
+	return time.UnixMilli(f.UploadTimestamp).UTC().Format(time.RFC3339Nano)
+}
+
+// b2Listing is a page of the listing of the keys, or of their versions.
+type b2Listing struct {
+	Files        []b2File `json:"files"`
+	NextFileName string   `json:"nextFileName"`
+	NextFileID   string   `json:"nextFileId"`
+}
+
+// list lists up to max files after the markers, from as many pages as
+// needed. B2 starts listings at their markers rather than after them, so the
+// files at the markers are skipped, and so are all the versions of the key
+// at the marker unless a version is given. It tells if there are more.
+func (b b2Bucket) list(ctx context.Context, op, prefix, delim, keyMarker, versionMarker string, max int) ([]b2File, bool, error) {
+	var files []b2File
+	start, startID := keyMarker, versionMarker
+	for {
+		count := max + 1 - len(files)
+		if count > MaxB2FileCount {
+			count = MaxB2FileCount
+		}
+		body := map[string]interface{}{"prefix": prefix, "maxFileCount": count}
+		if delim != "" {
+			body["delimiter"] = delim
+		}
+		if start != "" {
+			body["startFileName"] = start
+		}
+		if startID != "" {
+			body["startFileId"] = startID
+		}
+		var page b2Listing
+		if err := b.call(ctx, op, body, &page); err != nil {
+			return nil, false, err
+		}
+		for _, f := range page.Files {
+			atMarker := f.FileName == keyMarker && (versionMarker == "" || f.FileID == versionMarker)
+			if keyMarker != "" && atMarker || f.Action == "start" {
+				continue
+			}
+			files = append(files, f)
+		}
+		if len(files) > max {
+			return files[:max], true, nil
+		}
+		if page.NextFileName == "" {
+			return files, false, nil
+		}
+		start, startID = page.NextFileName, page.NextFileID
+	}
+}
+
+func (b b2Bucket) Name() string { return b.name }
+
+func (b b2Bucket) List(ctx context.Context, prefix, delim, marker string, max int) (*listResp, error) {
+	files, truncated, err := b.list(ctx, "b2_list_file_names", prefix, delim, marker, "", max)
+	if err != nil {
+		return nil, err
+	}
+	resp := &listResp{
+		Name:        b.name,
+		Prefix:      prefix,
+		Delimiter:   delim,
+		Marker:      marker,
+		MaxKeys:     max,
+		IsTruncated: truncated,
+	}
+	for _, f := range files {
+		if f.Action == "folder" {
+			resp.CommonPrefixes = append(resp.CommonPrefixes, f.FileName)
+		} else {
+			resp.Contents = append(resp.Contents, listedKey{
+				Key:          f.FileName,
+				LastModified: f.lastModified(),
+				Size:         f.ContentLength,
+			})
+		}
+		resp.NextMarker = f.FileName
+	}
+	return resp, nil
+}
+
+// ListVersions lists the versions of keys, newest first, their deletions
+// being the versions hiding them.
+func (b b2Bucket) ListVersions(ctx context.Context, prefix, delim, keyMarker, versionMarker string, max int) (*listVersionsResp, error) {
+	files, truncated, err := b.list(ctx, "b2_list_file_versions", prefix, delim, keyMarker, versionMarker, max)
+	if err != nil {
+		return nil, err
+	}
+	resp := &listVersionsResp{
+		Name:            b.name,
+		Prefix:          prefix,
+		Delimiter:       delim,
+		KeyMarker:       keyMarker,
+		VersionIdMarker: versionMarker,
+		MaxKeys:         max,
+		IsTruncated:     truncated,
+	}
+	previous := keyMarker
+	for _, f := range files {
+		latest := f.FileName != previous
+		previous = f.FileName
+		switch f.Action {
+		case "folder":
+			resp.CommonPrefixes = append(resp.CommonPrefixes, f.FileName)
+		case "hide":
+			resp.DeleteMarkers = append(resp.DeleteMarkers, deleteMarker{
+				Key:          f.FileName,
+				VersionId:    f.FileID,
+				IsLatest:     latest,
+				LastModified: f.lastModified(),
+			})
+		default:
+			resp.Versions = append(resp.Versions, keyVersion{
+				Key:          f.FileName,
+				VersionId:    f.FileID,
+				IsLatest:     latest,
+				LastModified: f.lastModified(),
+				Size:         f.ContentLength,
+			})
+		}
+		resp.NextKeyMarker, resp.NextVersionIdMarker = f.FileName, f.FileID
+	}
+	return resp, nil
+}
+
+func (b b2Bucket) GetReader(ctx context.Context, key, version string) (io.ReadCloser, error) {
+	resp, err := b.download(ctx, "GET", key, version)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// b2ReservedInfo are the file infos that B2 and its clients keep for
+// themselves, rather than user metadata.
+var b2ReservedInfo = map[string]bool{
+	"src_last_modified_millis": true,
+	"large_file_sha1":          true,
+}
+
+// Head returns the content type and the file infos of a key, named as S3
+// names user metadata so that they can be compared with the metadata of
+// keys in S3.
+func (b b2Bucket) Head(ctx context.Context, key, version string) (http.Header, error) {
+	resp, err := b.download(ctx, "HEAD", key, version)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	meta := http.Header{}
+	for name := range resp.Header {
+		if name == "Content-Type" {
+			meta.Set(name, resp.Header.Get(name))
+		}
+		info, ok := strings.CutPrefix(name, "X-Bz-Info-")
+		if !ok || b2ReservedInfo[strings.ToLower(info)] || strings.HasPrefix(strings.ToLower(info), "b2-") {
+			continue
+		}
+		meta.Set("X-Amz-Meta-"+info, resp.Header.Get(name))
+	}
+	return meta, nil
+}
+
+func (b b2Bucket) Tags(ctx context.Context, key, version string) (map[string]string, error) {
+	return nil, errB2Unsupported
+}
+
+func (b b2Bucket) Retention(ctx context.Context, key, version string) (*retention, error) {
+	return nil, errB2Unsupported
+}
+
+// Lifecycle returns no rules, B2's lifecycle rules only delete old versions.
+func (b b2Bucket) Lifecycle(ctx context.Context) ([]lifecycleRule, error) { return nil, nil }
+
+// SignedURL returns a URL with a download authorization of the key, or an
+// empty URL if it can't be had. Versions can't be downloaded this way.
+func (b b2Bucket) SignedURL(key, version string, expires time.Time) string {
+	if version != "" {
+		return ""
+	}
+	var resp struct {
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+	seconds := int(time.Until(expires).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	body := map[string]interface{}{"fileNamePrefix": key, "validDurationInSeconds": seconds}
+	if err := b.call(context.Background(), "b2_get_download_authorization", body, &resp); err != nil {
+		return ""
+	}
+	account, err := b.authorize("")
+	if err != nil {
+		return ""
+	}
+	return account.downloadURL + "/file/" + b.name + "/" + (&url.URL{Path: key}).EscapedPath() +
+		"?" + url.Values{"Authorization": {resp.AuthorizationToken}}.Encode()
+}
+
+// put writes a key.
+func (b b2Bucket) put(key string, data []byte) error {
+	var upload struct {
+		UploadURL          string `json:"uploadUrl"`
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+	if err := b.call(context.Background(), "b2_get_upload_url", map[string]interface{}{}, &upload); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", upload.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum(data)
+	req.Header.Set("Authorization", upload.AuthorizationToken)
+	req.Header.Set("X-Bz-File-Name", (&url.URL{Path: key}).EscapedPath())
+	req.Header.Set("Content-Type", "b2/x-auto")
+	req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+	req.ContentLength = int64(len(data))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= 300 {
+		return responseB2Error(resp)
+	}
+	return nil
+}
+
+// checksumOf returns the SHA-1 of the content of a key as recorded by B2,
+// or an empty checksum if B2 doesn't know it, as for large files uploaded
+// without it. B2 records no other checksum.
+func (b b2Bucket) checksumOf(ctx context.Context, o object, algorithm string) (string, error) {
+	if algorithm != "sha1" {
+		return "", nil
+	}
+	resp, err := b.download(ctx, "HEAD", o.Key, o.VersionID)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+	sum := resp.Header.Get("X-Bz-Content-Sha1")
+	if sum == "none" {
+		sum = resp.Header.Get("X-Bz-Info-Large_file_sha1")
+	}
+	// checksums given by clients but not verified by B2 can't be trusted
+	if len(sum) != sha1.Size*2 {
+		return "", nil
+	}
+	return strings.ToLower(sum), nil
+}
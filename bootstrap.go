@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"math"
+	"math/rand"
+)
+
+// DefaultBootstrapListings is how many listings a model bootstrapped without
+// a listing of the bucket is estimated from at startup, and refined with
+// after each round.
+const DefaultBootstrapListings = 100
+
+// modelBootstrap estimates the model of a bucket from a random subset of its
+// prefixes, for audits started without a listing of the bucket. Prefixes are
+// listed breadth first, at most a budget of them at a time, half of what's
+// left of the budget going to each depth so that deep buckets are reached.
+// The keys and prefixes at each depth are extrapolated from those found in
+// the prefixes listed at that depth, and the estimates get closer to the
+// bucket as more of its prefixes are listed, until all of them are. Listings
+// are a single page, so the keys of prefixes wider than MaxList are
+// undercounted.
+type modelBootstrap struct {
+	bkt  bucket
+	name string
+	// budget is how many prefixes are listed at a time.
+	budget int
+	r      *rand.Rand
+	// frontier are the prefixes found but not listed yet, by depth.
+	frontier [][]string
+	levels   []bootstrapLevel
+	// listings is how many listings the model was estimated from.
+	listings int
+}
+
+// bootstrapLevel counts what was found in the prefixes listed at a depth.
+type bootstrapLevel struct {
+	listed       int
+	keys         int
+	placeholders int
+	children     int
+}
+
+func newModelBootstrap(bkt bucket, name string, budget int, seed int64) *modelBootstrap {
+	return &modelBootstrap{
+		bkt:      bkt,
+		name:     name,
+		budget:   budget,
+		r:        rand.New(rand.NewSource(seed)),
+		frontier: [][]string{{""}},
+	}
+}
+
+// done tells if all the prefixes of the bucket were listed.
+func (b *modelBootstrap) done() bool {
+	for _, prefixes := range b.frontier {
+		if len(prefixes) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// refine lists at most the budget of prefixes more, and estimates the model
+// of the bucket from all those listed so far.
+func (b *modelBootstrap) refine(abort <-chan struct{}) (*bucketModel, error) {
+	depth := 0
+	for remaining := b.budget; remaining > 0; {
+		select {
+		case <-abort:
+			return nil, fmt.Errorf("aborted")
+		default:
+		}
+		// the next depth with prefixes to list, starting over from the
+		// shallowest once the deepest is reached
+		next := -1
+		for d := depth; d < len(b.frontier) && next < 0; d++ {
+			if len(b.frontier[d]) != 0 {
+				next = d
+			}
+		}
+		for d := 0; d < depth && next < 0; d++ {
+			if len(b.frontier[d]) != 0 {
+				next = d
+			}
+		}
+		if next < 0 {
+			break
+		}
+		depth = next
+
+		prefixes := b.frontier[depth]
+		quota := (remaining + 1) / 2
+		if quota > len(prefixes) {
+			quota = len(prefixes)
+		}
+		for i := 0; i < quota; i++ {
+			j := i + b.r.Intn(len(prefixes)-i)
+			prefixes[i], prefixes[j] = prefixes[j], prefixes[i]
+			if err := b.list(depth, prefixes[i]); err != nil {
+				return nil, err
+			}
+		}
+		b.frontier[depth] = prefixes[quota:]
+		remaining -= quota
+		depth++
+	}
+	return b.model(), nil
+}
+
+// list lists a prefix at a depth, counting what's found in it.
+func (b *modelBootstrap) list(depth int, prefix string) error {
+	resp, err := listBkt(context.Background(), b.bkt, prefix, MaxList)
+	if err != nil {
+		return fmt.Errorf("can't list prefix %q of bucket %q: %w", prefix, b.bkt.Name(), err)
+	}
+	b.listings++
+	for len(b.levels) <= depth {
+		b.levels = append(b.levels, bootstrapLevel{})
+	}
+	for len(b.frontier) <= depth+1 {
+		b.frontier = append(b.frontier, nil)
+	}
+	level := &b.levels[depth]
+	level.listed++
+	level.keys += len(resp.Contents)
+	for _, k := range resp.Contents {
+		if isPlaceholder(k.Key, k.Size) {
+			level.placeholders++
+		}
+	}
+	level.children += len(resp.CommonPrefixes)
+	b.frontier[depth+1] = append(b.frontier[depth+1], resp.CommonPrefixes...)
+	return nil
+}
+
+// model extrapolates the keys and prefixes at each depth from those found in
+// the prefixes listed there. Depths none of whose prefixes were listed yet
+// are left out.
+func (b *modelBootstrap) model() *bucketModel {
+	m := &bucketModel{name: b.name}
+	prefixes := 1.0
+	var keys, placeholders float64
+	for _, level := range b.levels {
+		if level.listed == 0 {
+			break
+		}
+		scale := prefixes / float64(level.listed)
+		atDepth := math.Round(float64(level.keys) * scale)
+		if atDepth == 0 && level.keys > 0 {
+			atDepth = 1
+		}
+		m.depths = append(m.depths, int(atDepth))
+		m.prefixes = append(m.prefixes, int(math.Round(prefixes)))
+		keys += atDepth
+		placeholders += float64(level.placeholders) * scale
+		prefixes = float64(level.children) * scale
+	}
+	m.keyCount = int(keys)
+	m.placeholders = int(math.Round(placeholders))
+	return m
+}
+
+// refineModel refines the model the audit bootstrapped, sampling the next
+// rounds with it and saving it to a file of the state, if any. The model is
+// kept if it can't be refined. The verifier of the destination of
+// bidirectional audits has no state of its own, and is handed the state of
+// the audit.
+func (v *verifier) refineModel(state stateDir, name string) {
+	if v.bootstrap.done() {
+		return
+	}
+	model, err := v.bootstrap.refine(v.abort)
+	if err != nil {
+		log.WithField("error", err).Warn("couldn't refine model of bucket, keeping it")
+		return
+	}
+	if err := v.useModel(*model); err != nil {
+		log.WithField("error", err).Warn("couldn't sample with refined model of bucket, keeping the previous one")
+		return
+	}
+	log.WithFields(log.Fields{
+		"bucket":   model.name,
+		"keys":     model.keyCount,
+		"depths":   len(model.depths),
+		"listings": v.bootstrap.listings,
+		"complete": v.bootstrap.done(),
+	}).Info("refined model of bucket")
+	if state != "" {
+		if err := state.saveModel(name, model); err != nil {
+			log.WithField("error", err).Error("couldn't save refined model in state directory")
+		}
+	}
+}
+
+// useModel has the verifier, and those sampling keys on its behalf from the
+// same bucket, sample keys with a model.
+func (v *verifier) useModel(model bucketModel) error {
+	sampler, err := lookupSampler(v.cfg, samplerSource{bkt: v.src, model: model, abort: v.abort})
+	if err != nil {
+		return err
+	}
+	v.model, v.sampler = model, sampler
+	for _, na := range v.namespaces {
+		if err := na.v.useModel(model); err != nil {
+			return err
+		}
+	}
+	if v.hot != nil {
+		return v.hot.v.useModel(model)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerFailures is how many requests in a row must fail on an
+	// endpoint before its circuit breaker opens, if the config doesn't say
+	// otherwise.
+	DefaultBreakerFailures = 5
+	// DefaultBreakerOpenFor is how long a circuit breaker stays open before
+	// probing the endpoint again, if the config doesn't say otherwise.
+	DefaultBreakerOpenFor = 30 * time.Second
+)
+
+// breakerConfig puts a circuit breaker in front of each endpoint of the
+// source and of the destination, so that a dead endpoint isn't hammered by
+// the walks of the sampler and the verifications. Once Failures requests in a
+// row failed on an endpoint, the breaker opens: requests fail right away,
+// which fails over to the next endpoint of buckets that have some. After
+// OpenFor, the breaker is half-open and lets Probes requests through, closing
+// once one succeeds, or opening again once one fails.
+type breakerConfig struct {
+	Failures int
+	OpenFor  time.Duration
+	Probes   int
+}
+
+type breakerFile struct {
+	Failures uint   `json:"failures,omitempty"`
+	OpenFor  string `json:"open_for,omitempty"`
+	Probes   uint   `json:"probes,omitempty"`
+}
+
+func loadBreaker(f *breakerFile) (*breakerConfig, error) {
+	c := &breakerConfig{
+		Failures: int(f.Failures),
+		OpenFor:  DefaultBreakerOpenFor,
+		Probes:   int(f.Probes),
+	}
+	if c.Failures == 0 {
+		c.Failures = DefaultBreakerFailures
+	}
+	if c.Probes == 0 {
+		c.Probes = 1
+	}
+	if f.OpenFor != "" {
+		var err error
+		if c.OpenFor, err = time.ParseDuration(f.OpenFor); err != nil {
+			return nil, fmt.Errorf("open_for: %v", err)
+		}
+		if c.OpenFor <= 0 {
+			return nil, fmt.Errorf("open_for must be positive")
+		}
+	}
+	return c, nil
+}
+
+func (c *breakerConfig) file() *breakerFile {
+	return &breakerFile{
+		Failures: uint(c.Failures),
+		OpenFor:  c.OpenFor.String(),
+		Probes:   uint(c.Probes),
+	}
+}
+
+// The states of a breaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// circuitBreaker is the breaker of an endpoint, see breakerConfig.
+type circuitBreaker struct {
+	cfg breakerConfig
+	// fields name the endpoint in logs.
+	fields log.Fields
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	opened   time.Time
+	// probing is how many requests are let through while half-open.
+	probing int
+	// trips counts how many times the breaker opened.
+	trips int
+}
+
+func newCircuitBreaker(cfg breakerConfig, fields log.Fields) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg, fields: fields, state: breakerClosed}
+}
+
+// allow tells if a request can be sent to the endpoint, and if so whether
+// it probes an endpoint whose breaker is half-open.
+func (b *circuitBreaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.opened) >= b.cfg.OpenFor {
+		log.WithFields(b.fields).Info("circuit breaker is half-open, probing endpoint")
+		b.state, b.probing = breakerHalfOpen, 0
+	}
+	switch b.state {
+	case breakerClosed:
+		return false, nil
+	case breakerHalfOpen:
+		if b.probing < b.cfg.Probes {
+			b.probing++
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("%w: circuit breaker of %s endpoint %q is open", ErrUnavailable, b.fields["side"], b.fields["endpoint"])
+}
+
+// record accounts for the outcome of a request sent to the endpoint,
+// returning whether the breaker is closed after it.
+func (b *circuitBreaker) record(probe bool, err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing--
+	}
+	if !isEndpointFailure(err) {
+		if b.state != breakerClosed {
+			log.WithFields(b.fields).Info("endpoint recovered, closing circuit breaker")
+		}
+		b.state, b.failures = breakerClosed, 0
+		return true
+	}
+	b.failures++
+	if b.state == breakerOpen || (b.state == breakerClosed && b.failures < b.cfg.Failures) {
+		return b.state == breakerClosed
+	}
+	log.WithFields(b.fields).WithFields(log.Fields{
+		"failures": b.failures,
+		"error":    err,
+	}).Warn("endpoint keeps failing, opening circuit breaker")
+	b.state, b.opened = breakerOpen, time.Now()
+	b.trips++
+	return false
+}
+
+// breakerStatus is the state of the breaker of an endpoint.
+type breakerStatus struct {
+	State string `json:"state"`
+	// Failures is how many requests in a row failed.
+	Failures int `json:"failures"`
+	// Opened is when the breaker last opened, if it did.
+	Opened *time.Time `json:"opened,omitempty"`
+	Trips  int        `json:"trips"`
+}
+
+func (b *circuitBreaker) status() *breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := &breakerStatus{
+		State:    b.state,
+		Failures: b.failures,
+		Trips:    b.trips,
+	}
+	if !b.opened.IsZero() {
+		opened := b.opened.UTC()
+		st.Opened = &opened
+	}
+	return st
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A bucket is a store of keys that can be audited. Listings have the same
+// semantics as S3's. Methods taking a version operate on the latest version
+// of the key if the version is empty. Requests are given up once their ctx is
+// canceled.
+type bucket interface {
+	Name() string
+	List(ctx context.Context, prefix, delim, marker string, max int) (*listResp, error)
+	ListVersions(ctx context.Context, prefix, delim, keyMarker, versionMarker string, max int) (*listVersionsResp, error)
+	GetReader(ctx context.Context, key, version string) (io.ReadCloser, error)
+	// Head returns the content type and the user metadata of a key.
+	Head(ctx context.Context, key, version string) (http.Header, error)
+	// Tags returns the tag set of a key.
+	Tags(ctx context.Context, key, version string) (map[string]string, error)
+	// Retention returns the Object Lock retention of a key, or nil if it
+	// has none.
+	Retention(ctx context.Context, key, version string) (*retention, error)
+	// Lifecycle returns the enabled lifecycle rules of the bucket.
+	Lifecycle(ctx context.Context) ([]lifecycleRule, error)
+	// SignedURL returns a URL where the key can be downloaded without
+	// credentials until it expires.
+	SignedURL(key, version string, expires time.Time) string
+}
+
+// A segmentedBucket stores large keys as manifests of segments, whose ETag
+// isn't the MD5 of their content, and whose listings don't always tell the
+// size of the whole key.
+type segmentedBucket interface {
+	// resolveSegments tells if a key is stored as segments, and returns it
+	// with the size and the ETag of the whole key if so.
+	resolveSegments(ctx context.Context, o object) (object, bool, error)
+}
+
+// A checksummedBucket records checksums of the content of its keys, which
+// can then be verified without downloading them.
+type checksummedBucket interface {
+	// checksumOf returns the hex encoded checksum of a key computed with
+	// one of contentHashes, or an empty checksum if the bucket didn't
+	// record it.
+	checksumOf(ctx context.Context, o object, algorithm string) (string, error)
+}
+
+// listedKey is a key as listed in a bucket. Listings saved to files are
+// made of them.
+type listedKey struct {
+	Key          string
+	LastModified string
+	Size         int64
+	ETag         string
+	StorageClass string
+	Owner        keyOwner
+}
+
+// keyOwner is the account owning a key.
+type keyOwner struct {
+	ID          string
+	DisplayName string
+}
+
+// listResp is a page of the listing of a bucket. If it's truncated, the next
+// page is listed after NextMarker.
+type listResp struct {
+	Name           string
+	Prefix         string
+	Delimiter      string
+	Marker         string
+	NextMarker     string
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []listedKey
+	CommonPrefixes []string
+}
+
+// object is a key of a bucket, or a specific version of it.
+type object struct {
+	Key          string
+	LastModified string
+	Size         int64
+	ETag         string
+	StorageClass string
+	Owner        keyOwner
+	// VersionID is empty when the object is the latest version of the key.
+	VersionID string `json:",omitempty"`
+}
+
+func objectOf(k listedKey) object {
+	return object{
+		Key:          k.Key,
+		LastModified: k.LastModified,
+		Size:         k.Size,
+		ETag:         k.ETag,
+		StorageClass: k.StorageClass,
+		Owner:        k.Owner,
+	}
+}
+
+// listVersionsResp is the result of listing the versions of keys.
+type listVersionsResp struct {
+	Name                string
+	Prefix              string
+	Delimiter           string
+	KeyMarker           string
+	VersionIdMarker     string
+	NextKeyMarker       string
+	NextVersionIdMarker string
+	MaxKeys             int
+	IsTruncated         bool
+	Versions            []keyVersion
+	DeleteMarkers       []deleteMarker
+	CommonPrefixes      []string
+}
+
+// keyVersion is a version of a key.
+type keyVersion struct {
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+	Owner        keyOwner
+}
+
+func (kv keyVersion) object() object {
+	return object{
+		Key:          kv.Key,
+		LastModified: kv.LastModified,
+		Size:         kv.Size,
+		ETag:         kv.ETag,
+		StorageClass: kv.StorageClass,
+		Owner:        kv.Owner,
+		VersionID:    kv.VersionId,
+	}
+}
+
+// deleteMarker is a version of a key marking its deletion.
+type deleteMarker struct {
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	Owner        keyOwner
+}
+
+// versionChain returns the versions of a key, oldest first, ignoring delete
+// markers.
+func versionChain(ctx context.Context, bkt bucket, key string) ([]keyVersion, error) {
+	var chain []keyVersion
+	keyMarker, versionMarker := "", ""
+	for {
+		resp, err := bkt.ListVersions(ctx, key, "", keyMarker, versionMarker, MaxList)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Versions {
+			if kv.Key == key {
+				chain = append(chain, kv)
+			}
+		}
+		if !resp.IsTruncated {
+			break
+		}
+		keyMarker, versionMarker = resp.NextKeyMarker, resp.NextVersionIdMarker
+	}
+	sort.SliceStable(chain, func(i, j int) bool {
+		return chain[i].LastModified < chain[j].LastModified
+	})
+	return chain, nil
+}
+
+// s3Bucket is a bucket on S3.
+type s3Bucket struct {
+	client *s3.Client
+	name   string
+	// region is the region of the bucket, whose FIPS or dual-stack endpoint
+	// the client picks if so configured.
+	region s3Region
+	// cfg is the config of the clients of the SDK accessing the bucket.
+	cfg aws.Config
+}
+
+// newS3Bucket returns the bucket of a in a region, accessed with the clients
+// of cfg, see awsSDKConfig.
+func newS3Bucket(a awsConfig, region s3Region, cfg aws.Config) s3Bucket {
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.Region = region.signingName()
+		if region.custom() {
+			// S3 compatible stores seldom serve buckets on their own
+			// host names, nor have FIPS or dual-stack endpoints, nor
+			// all take the checksums the SDK adds to uploads
+			o.BaseEndpoint = aws.String(region.S3Endpoint)
+			o.UsePathStyle = true
+			o.EndpointOptions.UseFIPSEndpoint = aws.FIPSEndpointStateUnset
+			o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateUnset
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		}
+	})
+	return s3Bucket{client: client, name: a.Bucket, region: region, cfg: cfg}
+}
+
+// awsBucket returns the bucket of a, which is a container of Swift, a
+// directory served over SFTP or a bucket of B2 if so configured. The role of
+// a bucket on S3, if any, is assumed on its first request.
+func awsBucket(a awsConfig) (bucket, error) {
+	switch {
+	case a.Swift != nil:
+		return newSwiftBucket(a), nil
+	case a.SFTP != nil:
+		return newSFTPBucket(a), nil
+	case a.B2 != nil:
+		return newB2Bucket(a), nil
+	}
+	cfg, err := awsSDKConfig(a, s3HTTPClient(a))
+	if err != nil {
+		return nil, err
+	}
+	primary := newS3Bucket(a, a.region(), cfg)
+	if len(a.Fallbacks) == 0 {
+		return primary, nil
+	}
+	endpoints := []bucket{primary}
+	names := []string{a.Region}
+	for _, fallback := range a.Fallbacks {
+		region, _ := regionOf(fallback)
+		endpoints = append(endpoints, newS3Bucket(a, region, cfg))
+		names = append(names, fallback)
+	}
+	return newFailoverBucket(endpoints, names), nil
+}
+
+// s3Region is a region of AWS, or the custom region of an S3 compatible
+// store, with the endpoint of S3 in it.
+type s3Region struct {
+	Name       string
+	S3Endpoint string
+}
+
+// custom tells if the region is that of an S3 compatible store.
+func (r s3Region) custom() bool {
+	std, _ := awsRegion(r.Name)
+	return std.S3Endpoint != r.S3Endpoint
+}
+
+// signingName is the region requests are signed for. S3 compatible stores
+// take it to be us-east-1.
+func (r s3Region) signingName() string {
+	if _, ok := awsRegion(r.Name); ok {
+		return r.Name
+	}
+	return "us-east-1"
+}
+
+// region returns the region of the bucket.
+func (a awsConfig) region() s3Region {
+	region, _ := awsRegion(a.Region)
+	return region
+}
+
+// regionName matches the names of the regions of AWS, such as eu-central-1
+// or us-gov-west-1.
+var regionName = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// awsRegion returns the region of AWS with this name.
+func awsRegion(name string) (s3Region, bool) {
+	if !regionName.MatchString(name) {
+		return s3Region{}, false
+	}
+	domain := "amazonaws.com"
+	if strings.HasPrefix(name, "cn-") {
+		domain += ".cn"
+	}
+	return s3Region{Name: name, S3Endpoint: "https://s3." + name + "." + domain}, true
+}
+
+// endpoint returns the region to use for the bucket, which is the FIPS or
+// dual-stack variant of a region if so configured. Custom endpoints are left
+// as is.
+func (a awsConfig) endpoint(region s3Region) s3Region {
+	if region.custom() {
+		return region
+	}
+	host := "s3"
+	if a.FIPS {
+		host += "-fips"
+	}
+	if a.DualStack {
+		host += ".dualstack"
+	}
+	if host != "s3" {
+		region.S3Endpoint = "https://" + host + "." + region.Name + ".amazonaws.com"
+	}
+	return region
+}
+
+// prepareEndpoints sets up the connections to the endpoints of a bucket, as
+// configured. Every bucket of S3 jag accesses is prepared before it is.
+func prepareEndpoints(a awsConfig) error {
+	if a.FIPS {
+		if _, err := fipsClient(); err != nil {
+			return fmt.Errorf("bucket %q is configured for FIPS: %v", a.Bucket, err)
+		}
+	}
+	if a.DualStack {
+		if err := checkIPv6(a); err != nil {
+			return fmt.Errorf("bucket %q is configured for dual-stack: %v", a.Bucket, err)
+		}
+	}
+	return nil
+}
+
+// fipsTLSConfig only allows the versions of TLS, cipher suites and curves
+// approved by FIPS 140-2. TLS 1.3 is left out: its cipher suites can't be
+// restricted.
+func fipsTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+	}
+}
+
+// fipsClient is the HTTP client of the requests to the buckets configured
+// for FIPS, whose transport is a copy of the default one with the TLS
+// settings of fipsTLSConfig. Other requests are left alone.
+var fipsClient = sync.OnceValues(func() (*http.Client, error) {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("HTTP transport %T can't be configured for FIPS", http.DefaultTransport)
+	}
+	fips := transport.Clone()
+	fips.TLSClientConfig = fipsTLSConfig()
+	if _, ok := http.DefaultClient.Transport.(debugTransport); ok {
+		return &http.Client{Transport: debugTransport{next: fips}}, nil
+	}
+	return &http.Client{Transport: fips}, nil
+})
+
+// s3HTTPClient returns the HTTP client of the requests to the bucket of a:
+// the default one, whose transport is set up for debugging, or fipsClient if
+// the bucket is configured for FIPS. prepareEndpoints tells why the latter
+// can't be made, if so.
+func s3HTTPClient(a awsConfig) *http.Client {
+	if a.FIPS {
+		if client, err := fipsClient(); err == nil {
+			return client
+		}
+	}
+	return http.DefaultClient
+}
+
+// checkIPv6 verifies that the endpoints of a bucket can be reached from an
+// IPv6-only network, which requires them to resolve to IPv6 addresses.
+func checkIPv6(a awsConfig) error {
+	regions := []s3Region{a.endpoint(a.region())}
+	for _, fallback := range a.Fallbacks {
+		region, err := regionOf(fallback)
+		if err != nil {
+			return err
+		}
+		regions = append(regions, a.endpoint(region))
+	}
+	for _, region := range regions {
+		u, err := url.Parse(region.S3Endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint %q: %v", region.S3Endpoint, err)
+		}
+		ips, err := net.LookupIP(u.Hostname())
+		if err != nil {
+			return fmt.Errorf("can't resolve endpoint %q: %v", u.Hostname(), err)
+		}
+		hasIPv6 := false
+		for _, ip := range ips {
+			hasIPv6 = hasIPv6 || ip.To4() == nil
+		}
+		if !hasIPv6 {
+			return fmt.Errorf("endpoint %q has no IPv6 address, it can't be reached from IPv6-only networks", u.Hostname())
+		}
+	}
+	return nil
+}
+
+// regionOf returns the region with this name, or a custom region whose S3
+// endpoint is this URL.
+func regionOf(nameOrURL string) (s3Region, error) {
+	if region, ok := awsRegion(nameOrURL); ok {
+		return region, nil
+	}
+	u, err := url.Parse(nameOrURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return s3Region{}, fmt.Errorf("%q is neither a region nor an endpoint URL", nameOrURL)
+	}
+	return s3Region{Name: u.Host, S3Endpoint: nameOrURL}, nil
+}
+
+func (b s3Bucket) Name() string { return b.name }
+
+// optional returns nil for an empty parameter, which the SDK leaves out of
+// requests.
+func optional(param string) *string {
+	if param == "" {
+		return nil
+	}
+	return aws.String(param)
+}
+
+// s3TimeLayout is how S3 formats the times of keys in its listings.
+const s3TimeLayout = "2006-01-02T15:04:05.000Z"
+
+func s3Time(t *time.Time) string {
+	return aws.ToTime(t).UTC().Format(s3TimeLayout)
+}
+
+func ownerOf(o *types.Owner) keyOwner {
+	if o == nil {
+		return keyOwner{}
+	}
+	return keyOwner{ID: aws.ToString(o.ID), DisplayName: aws.ToString(o.DisplayName)}
+}
+
+func (b s3Bucket) List(ctx context.Context, prefix, delim, marker string, max int) (*listResp, error) {
+	out, err := b.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:     aws.String(b.name),
+		Prefix:     optional(prefix),
+		Delimiter:  optional(delim),
+		StartAfter: optional(marker),
+		MaxKeys:    aws.Int32(int32(max)),
+		FetchOwner: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	resp := &listResp{
+		Name:        b.name,
+		Prefix:      prefix,
+		Delimiter:   delim,
+		Marker:      marker,
+		MaxKeys:     max,
+		IsTruncated: aws.ToBool(out.IsTruncated),
+	}
+	for _, o := range out.Contents {
+		resp.Contents = append(resp.Contents, listedKey{
+			Key:          aws.ToString(o.Key),
+			LastModified: s3Time(o.LastModified),
+			Size:         aws.ToInt64(o.Size),
+			ETag:         aws.ToString(o.ETag),
+			StorageClass: string(o.StorageClass),
+			Owner:        ownerOf(o.Owner),
+		})
+	}
+	for _, p := range out.CommonPrefixes {
+		resp.CommonPrefixes = append(resp.CommonPrefixes, aws.ToString(p.Prefix))
+	}
+	if resp.IsTruncated {
+		// the next page starts after the key or the prefix listed last
+		if n := len(resp.Contents); n > 0 {
+			resp.NextMarker = resp.Contents[n-1].Key
+		}
+		if n := len(resp.CommonPrefixes); n > 0 && resp.CommonPrefixes[n-1] > resp.NextMarker {
+			resp.NextMarker = resp.CommonPrefixes[n-1]
+		}
+	}
+	return resp, nil
+}
+
+func (b s3Bucket) ListVersions(ctx context.Context, prefix, delim, keyMarker, versionMarker string, max int) (*listVersionsResp, error) {
+	out, err := b.client.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{
+		Bucket:          aws.String(b.name),
+		Prefix:          optional(prefix),
+		Delimiter:       optional(delim),
+		KeyMarker:       optional(keyMarker),
+		VersionIdMarker: optional(versionMarker),
+		MaxKeys:         aws.Int32(int32(max)),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	resp := &listVersionsResp{
+		Name:                b.name,
+		Prefix:              prefix,
+		Delimiter:           delim,
+		KeyMarker:           keyMarker,
+		VersionIdMarker:     versionMarker,
+		NextKeyMarker:       aws.ToString(out.NextKeyMarker),
+		NextVersionIdMarker: aws.ToString(out.NextVersionIdMarker),
+		MaxKeys:             max,
+		IsTruncated:         aws.ToBool(out.IsTruncated),
+	}
+	for _, v := range out.Versions {
+		resp.Versions = append(resp.Versions, keyVersion{
+			Key:          aws.ToString(v.Key),
+			VersionId:    aws.ToString(v.VersionId),
+			IsLatest:     aws.ToBool(v.IsLatest),
+			LastModified: s3Time(v.LastModified),
+			ETag:         aws.ToString(v.ETag),
+			Size:         aws.ToInt64(v.Size),
+			StorageClass: string(v.StorageClass),
+			Owner:        ownerOf(v.Owner),
+		})
+	}
+	for _, dm := range out.DeleteMarkers {
+		resp.DeleteMarkers = append(resp.DeleteMarkers, deleteMarker{
+			Key:          aws.ToString(dm.Key),
+			VersionId:    aws.ToString(dm.VersionId),
+			IsLatest:     aws.ToBool(dm.IsLatest),
+			LastModified: s3Time(dm.LastModified),
+			Owner:        ownerOf(dm.Owner),
+		})
+	}
+	for _, p := range out.CommonPrefixes {
+		resp.CommonPrefixes = append(resp.CommonPrefixes, aws.ToString(p.Prefix))
+	}
+	return resp, nil
+}
+
+func (b s3Bucket) GetReader(ctx context.Context, key, version string) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(b.name),
+		Key:       aws.String(key),
+		VersionId: optional(version),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return out.Body, nil
+}
+
+func (b s3Bucket) Head(ctx context.Context, key, version string) (http.Header, error) {
+	out, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(b.name),
+		Key:       aws.String(key),
+		VersionId: optional(version),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("HEAD on key %q in bucket %q: %w", key, b.Name(), s3Error(err))
+	}
+	header := responseHeader(out.ResultMetadata)
+	meta := http.Header{}
+	for name := range header {
+		if name == "Content-Type" || strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			meta.Set(name, header.Get(name))
+		}
+	}
+	return meta, nil
+}
+
+// s3ChecksumHeaders are the headers of the checksums S3 records for the
+// keys uploaded with one, by algorithm of contentHashes.
+var s3ChecksumHeaders = map[string]string{
+	"sha1":   "X-Amz-Checksum-Sha1",
+	"sha256": "X-Amz-Checksum-Sha256",
+	"crc32c": "X-Amz-Checksum-Crc32c",
+}
+
+// checksumOf returns the checksum S3 recorded for a key uploaded with one,
+// or an empty checksum otherwise. The checksums of keys uploaded in parts
+// are checksums of the checksums of their parts, not of their content, and
+// are ignored.
+func (b s3Bucket) checksumOf(ctx context.Context, o object, algorithm string) (string, error) {
+	name, ok := s3ChecksumHeaders[algorithm]
+	if !ok {
+		return "", nil
+	}
+	out, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(b.name),
+		Key:          aws.String(o.Key),
+		VersionId:    optional(o.VersionID),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return "", fmt.Errorf("HEAD on key %q in bucket %q: %w", o.Key, b.Name(), s3Error(err))
+	}
+	header := responseHeader(out.ResultMetadata)
+	sum := header.Get(name)
+	if sum == "" || strings.Contains(sum, "-") || header.Get("X-Amz-Checksum-Type") == "COMPOSITE" {
+		return "", nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(sum)
+	if err != nil {
+		return "", fmt.Errorf("key %q: invalid %s checksum %q: %v", o.Key, algorithm, sum, err)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func (b s3Bucket) Tags(ctx context.Context, key, version string) (map[string]string, error) {
+	out, err := b.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:    aws.String(b.name),
+		Key:       aws.String(key),
+		VersionId: optional(version),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GET tagging on key %q in bucket %q: %w", key, b.Name(), s3Error(err))
+	}
+	tags := make(map[string]string, len(out.TagSet))
+	for _, tag := range out.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags, nil
+}
+
+func (b s3Bucket) Retention(ctx context.Context, key, version string) (*retention, error) {
+	out, err := b.client.GetObjectRetention(ctx, &s3.GetObjectRetentionInput{
+		Bucket:    aws.String(b.name),
+		Key:       aws.String(key),
+		VersionId: optional(version),
+	})
+	if errorCode(err) == "NoSuchObjectLockConfiguration" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GET retention on key %q in bucket %q: %w", key, b.Name(), s3Error(err))
+	}
+	if out.Retention == nil {
+		return nil, nil
+	}
+	return &retention{
+		Mode:            string(out.Retention.Mode),
+		RetainUntilDate: aws.ToTime(out.Retention.RetainUntilDate),
+	}, nil
+}
+
+func (b s3Bucket) Lifecycle(ctx context.Context) ([]lifecycleRule, error) {
+	out, err := b.client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(b.name),
+	})
+	if errorCode(err) == "NoSuchLifecycleConfiguration" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GET lifecycle of bucket %q: %w", b.Name(), s3Error(err))
+	}
+	return enabledRules(out.Rules), nil
+}
+
+// SignedURL presigns the URL for at most MaxPresignTTL. It stops working
+// sooner if the credentials it's signed with expire, and is empty if there
+// are no credentials.
+func (b s3Bucket) SignedURL(key, version string, expires time.Time) string {
+	ttl := time.Until(expires)
+	switch {
+	case ttl > MaxPresignTTL:
+		ttl = MaxPresignTTL
+	case ttl < time.Second:
+		ttl = time.Second
+	}
+	req, err := s3.NewPresignClient(b.client).PresignGetObject(context.Background(), &s3.GetObjectInput{
+		Bucket:    aws.String(b.name),
+		Key:       aws.String(key),
+		VersionId: optional(version),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		log.WithField("error", err).Warn("can't presign URL without credentials")
+		return ""
+	}
+	return req.URL
+}
+
+// put writes a key.
+func (b s3Bucket) put(key string, data []byte) error {
+	_, err := b.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	return s3Error(err)
+}
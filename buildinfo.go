@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version, Commit and BuildDate tell what jag was built from. Releases set
+// Commit and BuildDate with the linker, e.g.
+//
+//	go build -ldflags "-X main.Commit=$(git rev-parse HEAD) -X main.BuildDate=$(date -u +%FT%TZ)"
+//
+// otherwise they're the revision and time of the commit that go build
+// embeds when building a git checkout.
+var (
+	Version   = "0.1"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// buildInfo is what jag was built from, reported with the results of rounds
+// so that they can be tied to the version that produced them.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// build is what this jag was built from.
+var build = readBuildInfo()
+
+func readBuildInfo() buildInfo {
+	b := buildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	var revision, at string
+	var modified bool
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.time":
+			at = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if b.Commit == "" && revision != "" {
+		b.Commit = revision
+		if modified {
+			b.Commit += "-dirty"
+		}
+	}
+	if b.BuildDate == "" {
+		b.BuildDate = at
+	}
+	return b
+}
+
+// String is the version as --version prints it.
+func (b buildInfo) String() string {
+	s := b.Version
+	if b.Commit != "" {
+		s += fmt.Sprintf(", commit %s", b.Commit)
+	}
+	if b.BuildDate != "" {
+		s += fmt.Sprintf(", built %s", b.BuildDate)
+	}
+	return s + ", " + b.GoVersion
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultChangeRateWindow is how far back writes are counted to estimate the
+// rate of change of the source bucket, if the config doesn't leave young keys
+// out of audits.
+const DefaultChangeRateWindow = time.Hour
+
+// MaxChangeRatePrefixes is how many prefixes the rate of change is reported
+// for, those written to the most.
+const MaxChangeRatePrefixes = 20
+
+// changeRate estimates how fast the source bucket is written to, and how many
+// of the keys written are likely not replicated yet. Its JSON form is part of
+// reports.
+type changeRate struct {
+	// WindowSeconds is how far back writes are counted.
+	WindowSeconds float64 `json:"window_seconds"`
+	// Seen is how many keys the sampler looked at, and Recent how many of
+	// them were written within the window.
+	Seen          int     `json:"seen"`
+	Recent        int     `json:"recent"`
+	WritesPerHour float64 `json:"writes_per_hour"`
+	// LagSeconds is the mean replication lag of the keys that matched: how
+	// much later their copy in the destination was modified.
+	LagSeconds float64 `json:"lag_seconds"`
+	// AtRisk is how many keys are likely written but not replicated yet:
+	// the rate of writes times the replication lag.
+	AtRisk float64 `json:"at_risk"`
+	// Prefixes are the rates of change under the first level of prefixes,
+	// "" being the keys at the root of the bucket.
+	Prefixes map[string]prefixChangeRate `json:"prefixes,omitempty"`
+}
+
+type prefixChangeRate struct {
+	Seen          int     `json:"seen"`
+	Recent        int     `json:"recent"`
+	WritesPerHour float64 `json:"writes_per_hour"`
+	AtRisk        float64 `json:"at_risk"`
+}
+
+// changeRateEstimator counts the keys looked at by the sampler in a round
+// that were written recently, and the replication lag of the keys that
+// matched. Keys are looked at uniformly by a fair sampler, so the share of
+// recent keys among them is the share of recent keys in the bucket.
+type changeRateEstimator struct {
+	since  time.Time
+	window time.Duration
+	// skipPlaceholders leaves placeholders out of the keys looked at, the
+	// rate being scaled to the keys that aren't placeholders.
+	skipPlaceholders bool
+
+	mu       sync.Mutex
+	seen     map[string]int
+	recent   map[string]int
+	lagSum   time.Duration
+	lagCount int
+}
+
+func newChangeRateEstimator(now time.Time, window time.Duration, skipPlaceholders bool) *changeRateEstimator {
+	if window <= 0 {
+		window = DefaultChangeRateWindow
+	}
+	return &changeRateEstimator{
+		since:            now.Add(-window),
+		window:           window,
+		skipPlaceholders: skipPlaceholders,
+		seen:             make(map[string]int),
+		recent:           make(map[string]int),
+	}
+}
+
+// changePrefix is the first level of prefix of a key.
+func changePrefix(key string) string {
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[:i+1]
+	}
+	return ""
+}
+
+// observe counts a key looked at by the sampler.
+func (e *changeRateEstimator) observe(k object) {
+	if e.skipPlaceholders && isPlaceholder(k.Key, k.Size) {
+		return
+	}
+	modtime, err := time.Parse(time.RFC3339Nano, k.LastModified)
+	if err != nil {
+		return
+	}
+	prefix := changePrefix(k.Key)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seen[prefix]++
+	if modtime.After(e.since) {
+		e.recent[prefix]++
+	}
+}
+
+// observeLag counts the replication lag of a key that matched, if its copy
+// was modified after it.
+func (e *changeRateEstimator) observeLag(want, got object) {
+	wantTime, werr := time.Parse(time.RFC3339Nano, want.LastModified)
+	gotTime, gerr := time.Parse(time.RFC3339Nano, got.LastModified)
+	if werr != nil || gerr != nil || gotTime.Before(wantTime) {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lagSum += gotTime.Sub(wantTime)
+	e.lagCount++
+}
+
+// estimate scales the counts to a bucket of keyCount keys. It's nil if no
+// key was looked at.
+func (e *changeRateEstimator) estimate(keyCount int) *changeRate {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rate := &changeRate{WindowSeconds: e.window.Seconds()}
+	for prefix, n := range e.seen {
+		rate.Seen += n
+		rate.Recent += e.recent[prefix]
+	}
+	if rate.Seen == 0 {
+		return nil
+	}
+	var lag time.Duration
+	if e.lagCount > 0 {
+		lag = e.lagSum / time.Duration(e.lagCount)
+	}
+	rate.LagSeconds = lag.Seconds()
+	writesPerHour := func(recent int) float64 {
+		return float64(keyCount) * float64(recent) / float64(rate.Seen) / e.window.Hours()
+	}
+	rate.WritesPerHour = writesPerHour(rate.Recent)
+	rate.AtRisk = rate.WritesPerHour * lag.Hours()
+
+	prefixes := make([]string, 0, len(e.seen))
+	for prefix := range e.seen {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		ri, rj := e.recent[prefixes[i]], e.recent[prefixes[j]]
+		if ri != rj {
+			return ri > rj
+		}
+		return prefixes[i] < prefixes[j]
+	})
+	if len(prefixes) > MaxChangeRatePrefixes {
+		prefixes = prefixes[:MaxChangeRatePrefixes]
+	}
+	rate.Prefixes = make(map[string]prefixChangeRate, len(prefixes))
+	for _, prefix := range prefixes {
+		pr := prefixChangeRate{
+			Seen:          e.seen[prefix],
+			Recent:        e.recent[prefix],
+			WritesPerHour: writesPerHour(e.recent[prefix]),
+		}
+		pr.AtRisk = pr.WritesPerHour * lag.Hours()
+		rate.Prefixes[prefix] = pr
+	}
+	return rate
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"math/rand"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ChaosEnv is the environment variable enabling the chaos command, which
+// tests jag itself and is left out of its help otherwise.
+const ChaosEnv = "JAG_CHAOS"
+
+// fillBucket puts n keys in a bucket, at random depths up to maxDepth, with
+// fanout subprefixes per prefix. The keys were last modified at a random
+// time between oldest and youngest.
+func fillBucket(b *memBucket, r *rand.Rand, n, maxDepth, fanout int, oldest, youngest time.Time) {
+	window := youngest.Sub(oldest)
+	for i := 0; i < n; i++ {
+		depth := r.Intn(maxDepth + 1)
+		var key string
+		for d := 0; d < depth; d++ {
+			key += fmt.Sprintf("p%d/", r.Intn(fanout))
+		}
+		key += fmt.Sprintf("k%d", i)
+		data := []byte(fmt.Sprintf("content of %s", key))
+		modtime := oldest.Add(time.Duration(r.Int63n(int64(window))))
+		b.put(key, data, modtime)
+	}
+}
+
+// modelOfBucket builds the model of a bucket from all its keys.
+func modelOfBucket(b *memBucket) *bucketModel {
+	keys := make(chan interface{})
+	go func() {
+		for _, k := range b.keys() {
+			k := k
+			keys <- &k
+		}
+		close(keys)
+	}()
+	return buildModel(b.Name(), keys, nil)
+}
+
+// chaosScenario is a set of faults injected in the destination.
+type chaosScenario struct {
+	name  string
+	rates faultRates
+}
+
+var chaosScenarios = []chaosScenario{
+	{name: "clean"},
+	{name: "drop", rates: faultRates{Drop: 0.2}},
+	{name: "etag", rates: faultRates{CorruptETag: 0.2}},
+	{name: "delay", rates: faultRates{DelayRate: 0.2, Delay: time.Hour}},
+}
+
+// chaosScore tells how well the auditor caught the injected faults.
+type chaosScore struct {
+	faulted        int
+	caught         int
+	missed         int
+	falsePositives int
+}
+
+func (s chaosScore) ok() bool { return s.missed == 0 && s.falsePositives == 0 }
+
+// runChaos audits a synthetic bucket against a faulty copy of itself, and
+// scores whether the faults sampled in the round were detected.
+func runChaos(sc chaosScenario, keys, samples int, seed int64) (chaosScore, error) {
+	now := time.Now()
+	cfg := &config{
+		RandomSeed:     seed,
+		CheckCount:     samples,
+		CheckYoungest:  time.Hour * 24 * 2,
+		CheckOldest:    time.Hour * 24 * 14,
+		CheckFrequency: time.Minute,
+		KeyTimeout:     DefaultKeyTimeout,
+		Checks:         DefaultChecks,
+		Source:         awsConfig{Bucket: "chaos-source"},
+		Destination:    awsConfig{Bucket: "chaos-destination"},
+	}
+	cfg.SampleWorkers, cfg.VerifyWorkers = defaultWorkers(samples)
+
+	r := rand.New(rand.NewSource(seed))
+	src := newMemBucket(cfg.Source.Bucket)
+	fillBucket(src, r, keys, 3, 4, now.Add(-cfg.CheckOldest/2), now.Add(-cfg.CheckYoungest*2))
+	copied := newMemBucket(cfg.Destination.Bucket)
+	src.copyTo(copied)
+	dst := newFaultyBucket(copied, sc.rates, seed)
+
+	v, err := newVerifier(cfg, *modelOfBucket(src), src, dst, nil)
+	if err != nil {
+		return chaosScore{}, err
+	}
+	report, err := v.round(newRoundID(time.Now(), r.Int63()))
+	if err != nil {
+		return chaosScore{}, err
+	}
+
+	var score chaosScore
+	for _, res := range report.Results {
+		detected := res.Outcome == outcomeMismatch
+		switch {
+		case dst.faultOf(res.Key) == noFault && detected:
+			score.falsePositives++
+		case dst.faultOf(res.Key) == noFault:
+		case detected:
+			score.faulted++
+			score.caught++
+		default:
+			score.faulted++
+			score.missed++
+		}
+	}
+	return score, nil
+}
+
+func chaosCommand() cli.Command {
+	keysFlag := cli.IntFlag{
+		Name:  "keys",
+		Usage: "number of keys in the synthetic bucket",
+		Value: 2000,
+	}
+	samplesFlag := cli.IntFlag{
+		Name:  "samples",
+		Usage: "number of keys to sample in each scenario",
+		Value: 100,
+	}
+	seedFlag := cli.IntFlag{
+		Name:  "seed",
+		Usage: "seed of the synthetic bucket, faults and sampler",
+		Value: 42,
+	}
+	dropFlag := cli.Float64Flag{
+		Name:  "drop",
+		Usage: "probability that a key is missing in the destination",
+	}
+	etagFlag := cli.Float64Flag{
+		Name:  "corrupt-etag",
+		Usage: "probability that a key has a corrupted ETag in the destination",
+	}
+	delayRateFlag := cli.Float64Flag{
+		Name:  "delay-rate",
+		Usage: "probability that a key isn't visible yet in the destination",
+	}
+	delayFlag := cli.DurationFlag{
+		Name:  "delay",
+		Usage: "how long delayed keys stay invisible in the destination",
+		Value: time.Hour,
+	}
+
+	doChaos := func(ctx *cli.Context) {
+		if !ctx.GlobalBool("debug") {
+			log.SetLevel(log.FatalLevel)
+		}
+		scenarios := chaosScenarios
+		custom := faultRates{
+			Drop:        ctx.Float64(dropFlag.Name),
+			CorruptETag: ctx.Float64(etagFlag.Name),
+			DelayRate:   ctx.Float64(delayRateFlag.Name),
+			Delay:       ctx.Duration(delayFlag.Name),
+		}
+		if custom.Drop+custom.CorruptETag+custom.DelayRate > 0 {
+			scenarios = []chaosScenario{{name: "custom", rates: custom}}
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "SCENARIO\tFAULTED\tCAUGHT\tMISSED\tFALSE POSITIVES\tRESULT")
+		failed := false
+		for _, sc := range scenarios {
+			score, err := runChaos(sc, ctx.Int(keysFlag.Name), ctx.Int(samplesFlag.Name), int64(ctx.Int(seedFlag.Name)))
+			if err != nil {
+				fail(ctx, "error: scenario %q: %v", sc.name, err)
+			}
+			result := "PASS"
+			if !score.ok() {
+				result = "FAIL"
+				failed = true
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\n", sc.name, score.faulted, score.caught, score.missed, score.falsePositives, result)
+		}
+		_ = tw.Flush()
+		if failed {
+			os.Exit(1)
+		}
+	}
+
+	return cli.Command{
+		Name:  "chaos",
+		Usage: "Verifies that audits catch faults injected in a fake destination.",
+		Description: strings.TrimSpace(`
+Audits a synthetic bucket held in memory against a copy of itself in which
+faults are injected: missing keys, corrupted ETags and keys whose visibility is
+delayed. Each class of fault is injected in its own scenario, unless specific
+fault rates are given. The command fails if a sampled fault isn't caught, or if
+a key without fault is reported as a mismatch.`),
+		Flags: []cli.Flag{
+			keysFlag, samplesFlag, seedFlag,
+			dropFlag, etagFlag, delayRateFlag, delayFlag,
+		},
+		Action: doChaos,
+	}
+}
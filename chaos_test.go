@@ -0,0 +1,49 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.SetLevel(log.FatalLevel)
+}
+
+// TestChaosScenarios audits a fake destination in which each class of fault
+// is injected, and checks that the round catches every sampled fault without
+// reporting keys that weren't faulted.
+func TestChaosScenarios(t *testing.T) {
+	for _, sc := range chaosScenarios {
+		sc := sc
+		t.Run(sc.name, func(t *testing.T) {
+			for _, seed := range []int64{1, 42} {
+				score, err := runChaos(sc, 2000, 100, seed)
+				if err != nil {
+					t.Fatalf("seed %d: %v", seed, err)
+				}
+				if !score.ok() {
+					t.Errorf("seed %d: missed %d of %d faults, %d false positives", seed, score.missed, score.faulted, score.falsePositives)
+				}
+				if sc.name != "clean" && score.faulted == 0 {
+					t.Errorf("seed %d: no fault was sampled", seed)
+				}
+			}
+		})
+	}
+}
+
+// TestChaosMixedFaults injects all classes of faults at once.
+func TestChaosMixedFaults(t *testing.T) {
+	sc := chaosScenario{
+		name:  "mixed",
+		rates: faultRates{Drop: 0.1, CorruptETag: 0.1, DelayRate: 0.1, Delay: time.Hour},
+	}
+	score, err := runChaos(sc, 2000, 200, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !score.ok() || score.faulted == 0 {
+		t.Errorf("faulted %d, caught %d, missed %d, false positives %d", score.faulted, score.caught, score.missed, score.falsePositives)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultChecks are the checks performed on each sampled key when the config
+// doesn't specify any. They only require a LIST on the destination bucket.
+var DefaultChecks = []string{"existence", "etag", "size"}
+
+// checksByName are all the checks that can be selected in the config.
+var checksByName = map[string]func(*config) (Check, error){
+	"existence":     func(*config) (Check, error) { return ExistenceCheck{}, nil },
+	"etag":          func(*config) (Check, error) { return ETagCheck{}, nil },
+	"size":          func(*config) (Check, error) { return SizeCheck{}, nil },
+	"metadata":      func(*config) (Check, error) { return MetadataCheck{}, nil },
+	"content":       newContentCheck,
+	"sha1":          func(*config) (Check, error) { return SHA1Check{}, nil },
+	"versions":      func(*config) (Check, error) { return VersionsCheck{}, nil },
+	"tags":          func(*config) (Check, error) { return TagsCheck{}, nil },
+	"retention":     newRetentionCheck,
+	"last_modified": newLastModifiedCheck,
+	"hook":          newHookCheck,
+	"fixity":        newFixityCheck,
+}
+
+// keyPair is a key sampled from the source bucket and its counterpart in the
+// destination bucket.
+type keyPair struct {
+	// ctx is canceled once the verification of the key times out, along
+	// with the requests the checks make with it.
+	ctx  context.Context
+	src  bucket
+	dst  bucket
+	want object
+	// got is nil if the key wasn't found in the destination.
+	got *object
+	// wantSegmented and gotSegmented are set if the key is stored as
+	// segments in the source and in the destination, see segmentedBucket.
+	wantSegmented bool
+	gotSegmented  bool
+}
+
+// resolveSegments gives the keys of the pair the size and the ETag of the
+// whole key, in the buckets storing them as segments.
+func (p *keyPair) resolveSegments() error {
+	if sb, ok := p.src.(segmentedBucket); ok {
+		want, segmented, err := sb.resolveSegments(p.ctx, p.want)
+		if err != nil {
+			return err
+		}
+		p.want, p.wantSegmented = want, segmented
+	}
+	if sb, ok := p.dst.(segmentedBucket); ok && p.got != nil {
+		got, segmented, err := sb.resolveSegments(p.ctx, *p.got)
+		if err != nil {
+			return err
+		}
+		p.got, p.gotSegmented = &got, segmented
+	}
+	return nil
+}
+
+// errNotApplicable is returned by checks that can't verify a key, which is
+// then verified by the other checks alone.
+var errNotApplicable = errors.New("check doesn't apply to key")
+
+// A Check verifies one property of a key in the destination bucket against
+// the same key in the source bucket. A check returns fields describing the
+// mismatch if the property differs, or nil if it matches.
+type Check interface {
+	Name() string
+	Check(p *keyPair) (log.Fields, error)
+}
+
+// lookupChecks returns the checks named in the config, in the same order.
+func lookupChecks(cfg *config) ([]Check, error) {
+	checks := make([]Check, 0, len(cfg.Checks))
+	for _, name := range cfg.Checks {
+		mkCheck, ok := checksByName[name]
+		if !ok {
+			return nil, configErrorf("unknown check %q, valid checks are %s", name, checkNames())
+		}
+		check, err := mkCheck(cfg)
+		if err != nil {
+			return nil, configErrorf("check %q: %v", name, err)
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+func checkNames() string {
+	names := make([]string, 0, len(checksByName))
+	for name := range checksByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// missingFields is the mismatch reported by all checks when the key doesn't
+// exist in the destination, since nothing else can be compared.
+func missingFields(p *keyPair) log.Fields {
+	if p.got != nil {
+		return nil
+	}
+	return log.Fields{"got": "no match in destination"}
+}
+
+// ExistenceCheck verifies that the key exists in the destination.
+type ExistenceCheck struct{}
+
+func (ExistenceCheck) Name() string { return "existence" }
+
+func (ExistenceCheck) Check(p *keyPair) (log.Fields, error) {
+	return missingFields(p), nil
+}
+
+// ETagCheck verifies that the ETag of the key is the same in both buckets.
+// The ETags of keys stored as segments are digests of their manifest, not of
+// their content: they're compared if both buckets store the key as segments,
+// and the check doesn't apply if only one of them does.
+type ETagCheck struct{}
+
+func (ETagCheck) Name() string { return "etag" }
+
+func (ETagCheck) Check(p *keyPair) (log.Fields, error) {
+	if p.got == nil {
+		return missingFields(p), nil
+	}
+	if p.wantSegmented != p.gotSegmented {
+		return nil, fmt.Errorf("%w: key is stored as segments in one bucket only", errNotApplicable)
+	}
+	if p.want.ETag == p.got.ETag {
+		return nil, nil
+	}
+	return log.Fields{
+		"want.etag": p.want.ETag,
+		"got.etag":  p.got.ETag,
+	}, nil
+}
+
+// SizeCheck verifies that the size of the key is the same in both buckets.
+type SizeCheck struct{}
+
+func (SizeCheck) Name() string { return "size" }
+
+func (SizeCheck) Check(p *keyPair) (log.Fields, error) {
+	if p.got == nil {
+		return missingFields(p), nil
+	}
+	if p.want.Size == p.got.Size {
+		return nil, nil
+	}
+	return log.Fields{
+		"want.size": p.want.Size,
+		"got.size":  p.got.Size,
+	}, nil
+}
+
+// LastModifiedCheck verifies that the key isn't older in the destination
+// than in the source, give or take a tolerance for clock skew. Copies are
+// always made after the original, so an older copy is a stale one that
+// overwrote a newer copy.
+type LastModifiedCheck struct {
+	tolerance time.Duration
+}
+
+func newLastModifiedCheck(cfg *config) (Check, error) {
+	return LastModifiedCheck{tolerance: cfg.LastModifiedTolerance}, nil
+}
+
+func (LastModifiedCheck) Name() string { return "last_modified" }
+
+func (c LastModifiedCheck) Check(p *keyPair) (log.Fields, error) {
+	if p.got == nil {
+		return missingFields(p), nil
+	}
+	want, err := time.Parse(time.RFC3339Nano, p.want.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("invalid last modification time of key %q in source: %v", p.want.Key, err)
+	}
+	got, err := time.Parse(time.RFC3339Nano, p.got.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("invalid last modification time of key %q in destination: %v", p.got.Key, err)
+	}
+	if !got.Before(want.Add(-c.tolerance)) {
+		return nil, nil
+	}
+	return log.Fields{
+		"want.last_modified": p.want.LastModified,
+		"got.last_modified":  p.got.LastModified,
+		"tolerance":          c.tolerance,
+	}, nil
+}
+
+// VersionsCheck verifies that the destination has as many versions of the
+// key as the source, and that the versions match in ETag and size when
+// matched oldest first. It costs a LIST of versions on each bucket.
+type VersionsCheck struct{}
+
+func (VersionsCheck) Name() string { return "versions" }
+
+func (VersionsCheck) Check(p *keyPair) (log.Fields, error) {
+	if p.got == nil {
+		return missingFields(p), nil
+	}
+	want, err := versionChain(p.ctx, p.src, p.want.Key)
+	if err != nil {
+		return nil, err
+	}
+	got, err := versionChain(p.ctx, p.dst, p.got.Key)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(want) && i < len(got); i++ {
+		if want[i].ETag != got[i].ETag || want[i].Size != got[i].Size {
+			return log.Fields{
+				"version.position": i,
+				"want.version":     want[i].VersionId,
+				"got.version":      got[i].VersionId,
+				"want.etag":        want[i].ETag,
+				"got.etag":         got[i].ETag,
+				"want.size":        want[i].Size,
+				"got.size":         got[i].Size,
+			}, nil
+		}
+	}
+	if len(want) != len(got) {
+		return log.Fields{
+			"want.versions": len(want),
+			"got.versions":  len(got),
+		}, nil
+	}
+	return nil, nil
+}
+
+// MetadataCheck verifies that the content type and the user metadata
+// (x-amz-meta-*) of the key are the same in both buckets. It costs a HEAD
+// request on each bucket.
+type MetadataCheck struct{}
+
+func (MetadataCheck) Name() string { return "metadata" }
+
+func (MetadataCheck) Check(p *keyPair) (log.Fields, error) {
+	if p.got == nil {
+		return missingFields(p), nil
+	}
+	want, err := p.src.Head(p.ctx, p.want.Key, p.want.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	got, err := p.dst.Head(p.ctx, p.got.Key, p.got.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	fields := log.Fields{}
+	for name := range want {
+		if want.Get(name) != got.Get(name) {
+			fields["want."+name] = want.Get(name)
+			fields["got."+name] = got.Get(name)
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			fields["want."+name] = ""
+			fields["got."+name] = got.Get(name)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// TagsCheck verifies that the tag set of the key is the same in both buckets,
+// since lifecycle rules often depend on it. It costs a GET of the tagging on
+// each bucket.
+type TagsCheck struct{}
+
+func (TagsCheck) Name() string { return "tags" }
+
+func (TagsCheck) Check(p *keyPair) (log.Fields, error) {
+	if p.got == nil {
+		return missingFields(p), nil
+	}
+	want, err := p.src.Tags(p.ctx, p.want.Key, p.want.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	got, err := p.dst.Tags(p.ctx, p.got.Key, p.got.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	fields := log.Fields{}
+	for name, value := range want {
+		if gotValue, ok := got[name]; !ok || gotValue != value {
+			fields["want.tag."+name] = value
+			fields["got.tag."+name] = gotValue
+		}
+	}
+	for name, value := range got {
+		if _, ok := want[name]; !ok {
+			fields["want.tag."+name] = ""
+			fields["got.tag."+name] = value
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// ContentCheck verifies that the content of the key is the same in both
+// buckets, by comparing its checksums. The checksums are those recorded by
+// the buckets if they record the configured hash, and are otherwise
+// computed by downloading the key from each bucket, which makes it the most
+// expensive check.
+type ContentCheck struct {
+	hash string
+}
+
+func newContentCheck(cfg *config) (Check, error) {
+	if cfg.ContentHash == "" {
+		return ContentCheck{hash: DefaultContentHash}, nil
+	}
+	return ContentCheck{hash: cfg.ContentHash}, nil
+}
+
+func (ContentCheck) Name() string { return "content" }
+
+func (c ContentCheck) Check(p *keyPair) (log.Fields, error) {
+	if p.got == nil {
+		return missingFields(p), nil
+	}
+	want, err := digestKey(p.ctx, p.src, p.want, c.hash)
+	if err != nil {
+		return nil, err
+	}
+	got, err := digestKey(p.ctx, p.dst, *p.got, c.hash)
+	if err != nil {
+		return nil, err
+	}
+	if want == got {
+		return nil, nil
+	}
+	return log.Fields{
+		"want." + c.hash: want,
+		"got." + c.hash:  got,
+	}, nil
+}
+
+// SHA1Check verifies that the SHA-1 of the content of the key is the same in
+// both buckets, whatever the hash of the content check.
+type SHA1Check struct{}
+
+func (SHA1Check) Name() string { return "sha1" }
+
+func (SHA1Check) Check(p *keyPair) (log.Fields, error) {
+	return ContentCheck{hash: "sha1"}.Check(p)
+}
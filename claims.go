@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"time"
+)
+
+// DefaultClaimsDelay is how long after a key is claimed to be copied it's
+// verified, leaving the copy time to be visible in the destination.
+const DefaultClaimsDelay = time.Minute
+
+// claimsPollInterval is how often the claims file is read for new lines.
+const claimsPollInterval = time.Second
+
+// claimsConfig verifies the keys a syncer, such as brigade, claims to have
+// copied, shortly after it copied them. The syncer writes the keys to a file,
+// its output log or a file of recently synced keys, one per line: either the
+// key itself, or a JSON object with the key in a field. The file is tailed
+// from its end when the audit starts, following it when it's rotated or
+// truncated.
+type claimsConfig struct {
+	// File is the file tailed.
+	File string
+	// KeyField is the field of the key in lines that are JSON objects.
+	KeyField string
+	// Delay is how long after a key is claimed it's verified.
+	Delay time.Duration
+	// MaxPerRound is how many claimed keys are verified in a round, at
+	// most. Claims beyond are verified in the next rounds.
+	MaxPerRound int
+}
+
+type claimsFile struct {
+	File        string `json:"file"`
+	KeyField    string `json:"key_field,omitempty"`
+	Delay       string `json:"delay,omitempty"`
+	MaxPerRound uint   `json:"max_per_round,omitempty"`
+}
+
+func loadClaims(f *claimsFile, checkCount int) (*claimsConfig, error) {
+	if f.File == "" {
+		return nil, fmt.Errorf("file is required")
+	}
+	c := &claimsConfig{
+		File:        f.File,
+		KeyField:    f.KeyField,
+		Delay:       DefaultClaimsDelay,
+		MaxPerRound: int(f.MaxPerRound),
+	}
+	if c.KeyField == "" {
+		c.KeyField = "key"
+	}
+	if f.Delay != "" {
+		var err error
+		if c.Delay, err = time.ParseDuration(f.Delay); err != nil {
+			return nil, fmt.Errorf("delay: %v", err)
+		}
+		if c.Delay < 0 {
+			return nil, fmt.Errorf("delay can't be negative")
+		}
+	}
+	if c.MaxPerRound == 0 {
+		c.MaxPerRound = checkCount
+	}
+	return c, nil
+}
+
+func (c *claimsConfig) file() *claimsFile {
+	return &claimsFile{
+		File:        c.File,
+		KeyField:    c.KeyField,
+		Delay:       c.Delay.String(),
+		MaxPerRound: uint(c.MaxPerRound),
+	}
+}
+
+// claimTailer tails the claims file, queueing the keys claimed until
+// they're due to be verified.
+type claimTailer struct {
+	*keyQueue
+	cfg claimsConfig
+
+	// file is the claims file, offset how much of it was read, and partial
+	// the last line read if it isn't terminated yet.
+	file    *os.File
+	offset  int64
+	partial []byte
+}
+
+func newClaimTailer(cfg claimsConfig) *claimTailer {
+	t := &claimTailer{cfg: cfg, keyQueue: newKeyQueue(cfg.Delay)}
+	// only the claims made once the audit started are verified
+	if f, err := os.Open(cfg.File); err == nil {
+		t.file = f
+		if info, err := f.Stat(); err == nil {
+			t.offset = info.Size()
+		}
+	} else {
+		log.WithFields(log.Fields{
+			"file":  cfg.File,
+			"error": err,
+		}).Warn("can't open claims file, waiting for it")
+	}
+	return t
+}
+
+// tail reads the claims file until abort is closed.
+func (t *claimTailer) tail(abort <-chan struct{}) {
+	tick := time.NewTicker(claimsPollInterval)
+	defer tick.Stop()
+	for {
+		if err := t.poll(); err != nil {
+			log.WithFields(log.Fields{
+				"file":  t.cfg.File,
+				"error": err,
+			}).Warn("can't read claims file")
+		}
+		select {
+		case <-abort:
+			if t.file != nil {
+				_ = t.file.Close()
+			}
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// poll reads the lines appended to the claims file since it was last read.
+// Once the file is rotated, the rest of the old file is read, then the new
+// one from its start. Once it's truncated, it's read again from its start.
+func (t *claimTailer) poll() error {
+	if t.file != nil {
+		if err := t.readLines(); err != nil {
+			return err
+		}
+	}
+	info, err := os.Stat(t.cfg.File)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if t.file != nil {
+		current, err := t.file.Stat()
+		if err != nil {
+			return err
+		}
+		if os.SameFile(info, current) {
+			if info.Size() < t.offset {
+				log.WithField("file", t.cfg.File).Info("claims file was truncated, reading it from its start")
+				t.offset, t.partial = 0, nil
+				return t.readLines()
+			}
+			return nil
+		}
+		log.WithField("file", t.cfg.File).Info("claims file was rotated, reading the new one")
+		_ = t.file.Close()
+	}
+	if t.file, err = os.Open(t.cfg.File); err != nil {
+		t.file = nil
+		return err
+	}
+	t.offset, t.partial = 0, nil
+	return t.readLines()
+}
+
+// readLines queues the claims of the complete lines of the file past the
+// offset.
+func (t *claimTailer) readLines() error {
+	if _, err := t.file.Seek(t.offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(t.file)
+	for {
+		line, err := r.ReadBytes('\n')
+		t.offset += int64(len(line))
+		if err == io.EOF {
+			t.partial = append(t.partial, line...)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(t.partial) != 0 {
+			line = append(t.partial, line...)
+			t.partial = nil
+		}
+		if key, ok := t.parse(line); ok {
+			t.add(key, time.Now())
+		}
+	}
+}
+
+// parse returns the key claimed by a line, either the line itself or the key
+// field of the JSON object it is.
+func (t *claimTailer) parse(line []byte) (string, bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(bytes.TrimSpace(line)) == 0 {
+		return "", false
+	}
+	if line[0] != '{' {
+		return string(line), true
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		log.WithField("line", string(line)).Debug("ignoring claim, not a JSON object")
+		return "", false
+	}
+	key, ok := fields[t.cfg.KeyField].(string)
+	if !ok || key == "" {
+		log.WithField("line", string(line)).Debug("ignoring claim, no key")
+		return "", false
+	}
+	return key, true
+}
+
+// verifyClaims verifies n of the keys claimed to be copied that are due.
+func (v *verifier) verifyClaims(report *RoundReport, n int) {
+	v.verifyQueued(report, v.claims.keyQueue, n, "claimed to be copied", func(res *Result) { res.Claimed = true })
+}
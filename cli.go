@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
 	"fmt"
@@ -8,12 +9,11 @@ import (
 	"github.com/aybabtme/parajson"
 	"github.com/codegangsta/cli"
 	"io"
-	"launchpad.net/goamz/s3"
-	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"strings"
 	"time"
 )
@@ -24,19 +24,85 @@ func newApp(abort <-chan struct{}) *cli.App {
 	app.Author = "Antoine Grondin"
 	app.Email = "antoinegrondin@gmail.com"
 	app.Usage = "Audits brigade to see if it does its work properly."
-	app.Version = "0.1"
-	app.Flags = []cli.Flag{cli.BoolFlag{Name: "debug"}}
+	app.Version = build.String()
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{Name: "debug"},
+		cli.BoolFlag{
+			Name:  "debug-requests",
+			Usage: "log the method, URL, status, request IDs and timing of every S3 request",
+		},
+		cli.StringFlag{
+			Name:  "log-levels",
+			Usage: "levels of subsystems logging apart from the others, e.g. sampler=debug,verifier=warn",
+		},
+		cli.IntFlag{
+			Name:  "max-procs",
+			Usage: "how many CPUs to use, by default as many as the CPU quota of the container allows",
+		},
+		cli.StringFlag{
+			Name:  "memory-limit",
+			Usage: "memory to stay under, e.g. 2GiB, by default the memory limit of the container if any",
+		},
+	}
 	app.Before = func(ctx *cli.Context) error {
 		if ctx.GlobalBool("debug") {
 			log.SetLevel(log.DebugLevel)
 			log.Debug("debug mode enabled")
 		}
+		if spec := ctx.GlobalString("log-levels"); spec != "" {
+			levels, err := parseLogLevels(spec)
+			if err == nil {
+				err = setLogLevels(levels)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if ctx.GlobalBool("debug-requests") {
+			debugRequests()
+			log.Info("logging S3 requests")
+		}
+		procs := ctx.GlobalInt("max-procs")
+		if procs <= 0 {
+			procs = defaultMaxProcs()
+		}
+		runtime.GOMAXPROCS(procs)
+		limit, err := memoryLimit(ctx)
+		if err != nil {
+			return err
+		}
+		if limit > 0 {
+			debug.SetMemoryLimit(limit)
+		}
+		log.WithFields(log.Fields{
+			"max_procs":    procs,
+			"memory_limit": limit,
+		}).Debug("resource limits")
 		return nil
 	}
 	app.Commands = []cli.Command{
 		createConfigCommand(),
 		auditCommand(abort),
 		printModelCommand(abort),
+		listingCommand(),
+		sampleCommand(abort),
+		stateCommand(),
+		suppressCommand(),
+		mismatchesCommand(),
+		ackCommand(),
+		migrationStatusCommand(abort),
+		fixityCommand(abort),
+		planRepairCommand(),
+		reportCommand(),
+		schemaCommand(),
+		dashboardsCommand(),
+		serviceCommand(abort),
+		updateCommand(),
+		selftestCommand(),
+	}
+	// injecting faults is for testing jag, not for audits
+	if os.Getenv(ChaosEnv) != "" {
+		app.Commands = append(app.Commands, chaosCommand())
 	}
 
 	return app
@@ -57,6 +123,10 @@ func createConfigCommand() cli.Command {
 			CheckYoungest:  time.Hour * 24 * 2,
 			CheckOldest:    time.Hour * 24 * 14,
 			CheckFrequency: time.Minute * 20,
+			SampleWorkers:  30,
+			VerifyWorkers:  7,
+			KeyTimeout:     DefaultKeyTimeout,
+			Checks:         DefaultChecks,
 			Source: awsConfig{
 				Bucket:    "my_bucket",
 				Region:    "us-east-1",
@@ -105,31 +175,290 @@ func auditCommand(abort <-chan struct{}) cli.Command {
 		Name:  "model",
 		Usage: "path to a JSON file representing model of the keys in the source bucket",
 	}
+	buildReverseModelFlag := cli.StringFlag{
+		Name:  "build-reverse-model",
+		Usage: "path to a gzip'd JSON file representing all the keys in the destination bucket, for bidirectional audits",
+	}
+	bootstrapModelFlag := cli.BoolFlag{
+		Name:  "bootstrap-model",
+		Usage: "estimate a rough model of the source, and of the destination in bidirectional audits, from some of its prefixes instead of a listing, refining it after each round",
+	}
+	bootstrapListingsFlag := cli.IntFlag{
+		Name:  "bootstrap-listings",
+		Usage: "how many prefixes are listed to bootstrap a model, and to refine it after each round",
+		Value: DefaultBootstrapListings,
+	}
+	saveModelFlag := cli.StringFlag{
+		Name:  "save-model",
+		Usage: "path where the model built with --build-model is saved, for later runs to use with --model, by default next to the listing",
+	}
+	saveReverseModelFlag := cli.StringFlag{
+		Name:  "save-reverse-model",
+		Usage: "path where the model built with --build-reverse-model is saved, for later runs to use with --reverse-model, by default next to the listing",
+	}
+	reverseModelFlag := cli.StringFlag{
+		Name:  "reverse-model",
+		Usage: "path to a JSON file representing model of the keys in the destination bucket, for bidirectional audits",
+	}
+	reportFlag := cli.StringFlag{
+		Name:  "report",
+		Usage: "path to a JSON file where the report of the last round is written",
+	}
+	statusFileFlag := cli.StringFlag{
+		Name:  "status-file",
+		Usage: "path to a JSON file where a summary of the last round is written: its ID, status, exit status and counts of outcomes",
+	}
+	replayFlag := cli.StringFlag{
+		Name:  "replay-round",
+		Usage: "ID of a past round whose sample of keys is verified again, once",
+	}
+	runModeFlag := cli.StringFlag{
+		Name:  "run-mode",
+		Usage: "daemon, to audit rounds continuously, or k8s-job, to audit a single round and exit with its status",
+		Value: RunModeDaemon,
+	}
+	reportS3Flag := cli.StringFlag{
+		Name:  "report-s3",
+		Usage: "s3://bucket/key where the report of a k8s-job is uploaded, with the credentials of the destination",
+	}
+	snapshotFlag := cli.StringFlag{
+		Name:  "snapshot",
+		Usage: "path to the manifest.json of a CSV S3 inventory of the source, to audit the destination against instead of the live source",
+	}
+	manifestFlag := cli.StringFlag{
+		Name:  "manifest",
+		Usage: "path to a manifest of the checksums of the keys of the source, as written by sha256sum, to verify the content of the destination against instead of the live source",
+	}
+	presetFlag := cli.StringFlag{
+		Name:  "preset",
+		Usage: "name of a preset of the config to spot audit, instead of the rounds of the config",
+	}
+	onceFlag := cli.BoolFlag{
+		Name:  "once",
+		Usage: "audit a single round, then exit",
+	}
+	partitionIndexFlag := cli.StringFlag{
+		Name:  "partition-index",
+		Usage: "index of this instance in a partitioned audit, overriding the index of the partition of the config",
+	}
+	planFlag := cli.BoolFlag{
+		Name:  "plan",
+		Usage: "print a JSON description of what the audit would do, and exit without running it",
+	}
 
 	doAudit := func(ctx *cli.Context) {
+		runMode := ctx.String(runModeFlag.Name)
+		if runMode != RunModeDaemon && runMode != RunModeJob {
+			fail(ctx, "error: unknown run mode %q, valid modes are %s, %s", runMode, RunModeDaemon, RunModeJob)
+		}
+		reportS3 := ctx.String(reportS3Flag.Name)
+		if reportS3 != "" {
+			if runMode != RunModeJob {
+				fail(ctx, "error: --%s is only for --%s %s", reportS3Flag.Name, runModeFlag.Name, RunModeJob)
+			}
+			if _, _, err := parseS3URL(reportS3); err != nil {
+				fail(ctx, "error: %v", err)
+			}
+		}
+
+		cfg := mustConfig(ctx, cfgFlag)
+		if index := ctx.String(partitionIndexFlag.Name); index != "" {
+			part, err := cfg.withPartitionIndex(index)
+			if err != nil {
+				fail(ctx, "error: %v", err)
+			}
+			cfg = part
+		}
+		if name := ctx.String(presetFlag.Name); name != "" {
+			spot, err := cfg.withPreset(name)
+			if err != nil {
+				fail(ctx, "error: %v", err)
+			}
+			cfg = spot
+		}
+		if cfg.Flapping != nil && cfg.StateDir == "" && (runMode == RunModeJob || ctx.Bool(onceFlag.Name)) {
+			fail(ctx, "error: flapping debounces alerts over rounds, a single round needs a state_dir to remember the previous ones")
+		}
+		if ctx.Bool(planFlag.Name) {
+			plan := newAuditPlan(cfg, planSchedule{
+				RunMode:    runMode,
+				Once:       runMode == RunModeJob || ctx.Bool(onceFlag.Name),
+				Report:     ctx.String(reportFlag.Name),
+				ReportS3:   reportS3,
+				StatusFile: ctx.String(statusFileFlag.Name),
+			})
+			data, err := json.MarshalIndent(plan, "", "   ")
+			if err != nil {
+				fail(ctx, "bug: can't create plan JSON: %v", err)
+			}
+			if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+				fail(ctx, "error: can't write plan to stdout: %v", err)
+			}
+			return
+		}
 
+		setActionState(stateDir(cfg.StateDir))
+		observeAudit(cfg)
+		log.WithFields(log.Fields{
+			"version": build.Version,
+			"commit":  build.Commit,
+		}).Info("starting audit")
 		go func() {
 			time.Sleep(time.Second)
-			// exposes pprof
-			addr := "127.0.0.1:6060"
-			log.Infof("listening on http://%s/debug/pprof", addr)
-			http.ListenAndServe(addr, nil)
+			// exposes pprof, metrics, and the endpoints changing the audit
+			base := cfg.Admin.url()
+			log.Infof("listening on %s/debug/pprof, %s%s, %s%s, %s%s, %s%s, %s%s, %s%s, %s%s and %s%s",
+				base, base, LogLevelsPath, base, MaintenancePath, base, SyncsPath, base, QueuePath, base, TriggerPath, base, ResultsPath, base, MetricsPath, base, StatusPath)
+			if err := cfg.Admin.serve(); err != nil {
+				log.WithField("error", err).Error("couldn't serve HTTP endpoint")
+			}
 		}()
 
-		cfg := mustConfig(ctx, cfgFlag)
+		var snapshot *inventory
+		if manifest := ctx.String(snapshotFlag.Name); manifest != "" {
+			inv, err := readInventory(manifest)
+			if err != nil {
+				fail(ctx, "error: can't read inventory %q: %v", manifest, err)
+			}
+			if inv.bucket != cfg.Source.Bucket {
+				fail(ctx, "error: inventory %q is of bucket %q, not of the source bucket %q", manifest, inv.bucket, cfg.Source.Bucket)
+			}
+			snap, err := cfg.withSnapshot(inv.at)
+			if err != nil {
+				fail(ctx, "error: %v", err)
+			}
+			log.WithFields(log.Fields{
+				"keys":     len(inv.keys),
+				"snapshot": inv.at,
+			}).Info("auditing destination against a snapshot of the source")
+			cfg, snapshot = snap, inv
+		}
+		var manifest *checksumManifest
+		if filename := ctx.String(manifestFlag.Name); filename != "" {
+			if snapshot != nil {
+				fail(ctx, "error: --%s and --%s are exclusive", snapshotFlag.Name, manifestFlag.Name)
+			}
+			m, err := readChecksumManifest(filename, cfg.Source.Bucket, cfg.ContentHash)
+			if err != nil {
+				fail(ctx, "error: can't read checksum manifest %q: %v", filename, err)
+			}
+			log.WithFields(log.Fields{
+				"keys": len(m.keys),
+				"hash": m.hash,
+			}).Info("auditing destination against a checksum manifest")
+			cfg, manifest = cfg.withManifest(m.at), m
+		}
+		bootstrap, bootstrapListings := ctx.Bool(bootstrapModelFlag.Name), ctx.Int(bootstrapListingsFlag.Name)
+		if bootstrap {
+			for _, f := range []cli.StringFlag{modelFlag, buildModelFlag, snapshotFlag, manifestFlag} {
+				if ctx.String(f.Name) != "" {
+					fail(ctx, "error: --%s and --%s are exclusive", bootstrapModelFlag.Name, f.Name)
+				}
+			}
+			if bootstrapListings <= 0 {
+				fail(ctx, "error: --%s must be positive", bootstrapListingsFlag.Name)
+			}
+		}
 		var model *bucketModel
-		if ctx.String(buildModelFlag.Name) != "" {
+		if snapshot != nil {
+			model = snapshot.model(abort)
+		} else if manifest != nil {
+			model = manifest.model(abort)
+		} else if ctx.String(buildModelFlag.Name) != "" {
 			model = mustBuildModel(ctx, cfg.Source.Bucket, buildModelFlag, abort)
-		} else {
+			saveBuiltModel(model, ctx.String(buildModelFlag.Name), ctx.String(saveModelFlag.Name), modelFlag.Name)
+		} else if !bootstrap {
 			model = mustRetrieveModel(ctx, modelFlag)
 		}
 
-		v, err := newVerifier(cfg, *model, abort)
+		mustPrepareEndpoints(ctx, cfg.Source, cfg.Destination)
+		src, dst := mustAWSBucket(ctx, cfg.Source), mustAWSBucket(ctx, cfg.Destination)
+		if snapshot != nil {
+			src = snapshotBucket{snapshot}
+		}
+		if manifest != nil {
+			src = newManifestBucket(manifest)
+		}
+		if snapshot == nil && manifest == nil {
+			src = wrapEndpoints(cfg, "source", cfg.Source, src)
+		}
+		dst = wrapEndpoints(cfg, "destination", cfg.Destination, dst)
+		var srcBootstrap *modelBootstrap
+		if model == nil {
+			srcBootstrap = newModelBootstrap(src, cfg.Source.Bucket, bootstrapListings, cfg.RandomSeed^time.Now().UnixNano())
+			model = mustBootstrapModel(ctx, srcBootstrap, abort)
+		}
+
+		var state stateDir
+		if cfg.StateDir != "" {
+			var err error
+			if state, err = openStateDir(cfg.StateDir); err != nil {
+				fail(ctx, "error: can't open state directory %q: %v", cfg.StateDir, err)
+			}
+			if err := state.saveModel(modelFile, model); err != nil {
+				fail(ctx, "error: can't save model in state directory: %v", err)
+			}
+		}
+
+		v, err := newVerifier(cfg, *model, src, dst, abort)
 		if err != nil {
 			fail(ctx, "error: can't create verifier, %v", err)
 		}
+		v.onResult(publishResult)
+		v.bootstrap = srcBootstrap
+		v.acceptManual(manualKeys)
+		if snapshot != nil {
+			v.auditSnapshot(snapshot.at)
+		}
+		if cfg.Bidirectional {
+			var reverseModel *bucketModel
+			var dstBootstrap *modelBootstrap
+			if ctx.String(buildReverseModelFlag.Name) != "" {
+				reverseModel = mustBuildModel(ctx, cfg.Destination.Bucket, buildReverseModelFlag, abort)
+				saveBuiltModel(reverseModel, ctx.String(buildReverseModelFlag.Name), ctx.String(saveReverseModelFlag.Name), reverseModelFlag.Name)
+			} else if bootstrap && ctx.String(reverseModelFlag.Name) == "" {
+				dstBootstrap = newModelBootstrap(dst, cfg.Destination.Bucket, bootstrapListings, cfg.RandomSeed^time.Now().UnixNano())
+				reverseModel = mustBootstrapModel(ctx, dstBootstrap, abort)
+			} else {
+				reverseModel = mustRetrieveModel(ctx, reverseModelFlag)
+			}
+			if state != "" {
+				if err := state.saveModel(reverseModelFile, reverseModel); err != nil {
+					fail(ctx, "error: can't save reverse model in state directory: %v", err)
+				}
+			}
+			if err := v.makeBidirectional(*reverseModel); err != nil {
+				fail(ctx, "error: can't create verifier, %v", err)
+			}
+			v.reverse.bootstrap = dstBootstrap
+		}
+		v.reportFile = ctx.String(reportFlag.Name)
+		v.statusFile = ctx.String(statusFileFlag.Name)
+		if id := ctx.String(replayFlag.Name); id != "" {
+			report, err := v.replay(roundID(id))
+			if err != nil {
+				log.WithField("kind", errorKind(err)).Fatal(err)
+			}
+			if runMode == RunModeJob {
+				mustFinishJob(ctx, cfg, report, reportS3)
+			}
+			return
+		}
+		if err := v.warmUp(); err != nil {
+			log.WithField("kind", errorKind(err)).Fatal(err)
+		}
+		if runMode == RunModeJob || ctx.Bool(onceFlag.Name) {
+			report, err := v.once()
+			if err != nil {
+				log.WithField("kind", errorKind(err)).Fatal(err)
+			}
+			if runMode == RunModeJob {
+				mustFinishJob(ctx, cfg, report, reportS3)
+			}
+			return
+		}
 		if err := v.execute(); err != nil {
-			log.Fatalln(err)
+			log.WithField("kind", errorKind(err)).Fatal(err)
 		}
 	}
 
@@ -138,8 +467,224 @@ func auditCommand(abort <-chan struct{}) cli.Command {
 		Usage: "Continuously samples keys in two buckets, check that they match.",
 		Description: strings.TrimSpace(`
 Audits the keys of two buckets match, picking keys to audit randomly based on
-a model built from an existing list of the source bucket.`),
-		Flags:  []cli.Flag{cfgFlag, modelFlag, buildModelFlag},
+a model built from an existing list of the source bucket. Each round has an
+ID, found in its report, with which --replay-round verifies the same sample of
+keys again.
+
+Bidirectional audits also sample keys from the destination bucket, based on a
+model of the destination, and verify them against the source bucket.
+
+Models built from a listing with --build-model and --build-reverse-model are
+saved for later runs to load with --model and --reverse-model rather than read
+the listing again: next to the listing, listing.json.gz having its model saved
+to listing.model.json, or to --save-model and --save-reverse-model.
+
+Without a list of the bucket, --bootstrap-model estimates a rough model from a
+random subset of its prefixes, listing --bootstrap-listings of them breadth
+first and extrapolating the keys at each depth, and starts auditing with it.
+After each round, as many prefixes more are listed to refine the model, until
+all of them are, the refined model being saved in the state directory for
+later runs to use with --model, as model.json, and that of the destination
+of bidirectional audits with --reverse-model, as reverse-model.json.
+Prefixes with more keys than a listing returns are undercounted.
+
+With skip_placeholders in the config, empty keys and keys ending with a slash,
+such as the folder markers consoles create, aren't sampled, and the rate of
+change and the jag_model_keys metric are scaled to the keys of the model that
+aren't placeholders. Keys can also be sampled by size, with min_size and
+max_size, like 1MB or 5GiB, e.g. to focus on large keys or leave huge ones out
+of rounds verifying content. In buckets shared by writers with accounts of their
+own, the owners field of the config includes or excludes the keys of owners, by
+canonical ID.
+
+With hot_prefixes in the config, a share of the keys of each round, half by
+default, is sampled under the prefixes written to the most, where sync bugs
+are most likely to show, rather than in cold archival prefixes. The rate of
+change of each prefix is estimated by the rounds and recorded in the history
+of the state directory, and the prefixes written to the most over the last
+rounds are hot, at most prefixes of them and only those written at least
+min_writes_per_hour times an hour. Reports list the hot prefixes of each round,
+and mark the keys sampled under them.
+
+With risk in the config, mismatches are scored by the size and age of their
+keys, weighed by prefix, and rounds are alerted on and exit with 2 only if
+their score exceeds max_score, rather than as soon as any key mismatched.
+
+With export in the config, each round and its results are written as
+newline-delimited JSON to a prefix of a bucket, partitioned by day in the Hive
+layout, e.g. rounds/dt=2006-01-02/ and results/dt=2006-01-02/, for Athena or
+BigQuery to query as external tables.
+
+The metrics of rounds are served to Prometheus on
+http://127.0.0.1:6060/metrics, and graphed by the dashboard the dashboards
+command prints. The status of the audit and of its last round is served on
+/status, with the version, commit and build date of jag that reports, exports
+and the jag_build_info metric carry too. It also tells the health of each
+endpoint of the source and of the destination, apart: its success rate and
+mean latency over its last requests, and its last error, also served as the
+jag_endpoint_* metrics, so that a failing audit is attributed to a side. The
+admin field of the config changes the address listened on, authenticates requests with a bearer token or basic auth, which listening
+beyond the loopback interface requires, and serves them over TLS with the
+certificate of files or a self-signed one. Its read_token only lets requests
+GET what the endpoint serves, such as metrics, and not change the audit or
+profile it.
+
+With --run-mode k8s-job, a single round is audited, its report is written to
+stdout and, with --report-s3, uploaded to S3, under a key named after the round
+if the given key ends with a slash. The exit status tells the worst result of
+the round: 0 if every key matched, 2 if keys mismatched, 3 if keys couldn't be
+verified, and 1 if the round failed, which is the only status worth retrying.
+
+With --status-file, a summary of each round is written to a JSON file, replaced
+atomically once the round completes or fails, for health checks and wrappers
+that can't parse the output of jag: the ID of the round, its status, one of
+ok, mismatch, inconclusive or failed, the exit status a job auditing it exits
+with, and how many keys were verified with each outcome.
+
+In maintenance, such as during a planned migration, keys are still verified and
+their results recorded, but rounds exit with 0 and namespaces don't alert.
+Maintenance is set by the maintenance field of the config, which is only read
+when the audit starts: changing it takes a restart. While the audit runs,
+maintenance is turned on or off on the /debug/maintenance endpoint instead.
+
+Syncers such as brigade can announce a backfill of a prefix by POSTing
+{"prefix": "photos/", "until": "2006-01-02T15:04:05Z"} to /debug/syncs. Until
+then, keys under the prefix aren't sampled, and their mismatches are pending
+instead of alerted on. Windows last at most a week, and are closed early with
+DELETE /debug/syncs?prefix=photos/.
+
+With the in_flight_uploads field of the config, the multipart uploads in
+progress on the source are listed for each key mismatching, and the mismatches
+of keys being uploaded are pending instead of alerted on, since the
+destination can't have them before their upload completes. Uploads started
+more than max_upload_age ago, 24h by default, are abandoned and don't keep
+mismatches pending. The source must be an S3 bucket.
+
+With the claims field of the config, the keys a syncer claims to have copied
+are verified shortly after: the file of its claims, such as its output log, is
+tailed for keys, one per line or in the key_field of JSON lines, and each round
+first verifies those claimed at least delay ago. Claims are kept in memory
+only, those pending when the audit stops aren't verified.
+
+With the events field of the config, the keys written to the source are
+verified too, besides those sampled: the S3 event notifications of the source
+are consumed from an SQS queue, which an SNS topic can feed, a Kinesis stream,
+or a Kafka topic through a Kafka REST proxy, and a fraction of the keys
+written are verified a delay after, 15 minutes by default. Prefixes can be
+sampled with their own fraction, and capped to max_per_minute keys, so that a
+backfill writing millions of keys doesn't verify millions of keys.
+
+Besides the keys sampled, each round verifies the keys queued by operators,
+POSTing {"keys": ["photos/a.jpg"]} to /debug/queue, the follow-ups of keys
+inconclusive, the keys whose mismatches are debounced, and the keys claimed to
+be copied or written according to events, in this order. With the queue field
+of the config, rounds verify at most max_per_round of them, shared fairly by
+these sources so that none starves the others, each at most its quota. Keys
+left out are verified in the next rounds. GET /debug/queue tells how many keys
+of each source are queued, and how many the last round verified. With a state
+directory, the keys queued by operators, claimed to be copied or written
+according to events are journaled in it until the results of their round are
+saved, and queued again once the audit restarts, as follow-ups are. Keys a
+round dequeued but didn't verify before it was aborted are queued again.
+
+With the degradation field of the config, the audit degrades while the
+destination fails: once rounds in a row see more than max_error_rate of their
+verifications throttled, unavailable or timing out by the destination, the
+checks reading content are left out, then all but the existence check, and
+finally sampled keys are only recorded as follow-ups, but for a few probes, and
+the queue waits. Once the destination recovers for recover_rounds rounds, the
+audit climbs back a level at a time, up to the checks of the config. The level
+is in the report of each round, /status and the jag_degradation_level metric,
+and is kept in the state directory across restarts.
+
+With the circuit_breaker field of the config, each endpoint of the source and
+of the destination is requested through a circuit breaker: once failures
+requests in a row failed on it, 5 by default, requests fail right away instead
+of reaching it, failing over to the fallbacks of the bucket if any, until
+open_for passed and a probe succeeds. /status lists the state of the breaker of
+each endpoint by side, and jag_circuit_breaker_open tells which are open.
+
+The actions of operators, such as turning maintenance on, changing log levels,
+acknowledging or suppressing mismatches and importing the state, are logged
+with who made them and recorded in the state directory, for 'state actions' to
+list.
+
+SIGTERM aborts the audit, as do CTRL_C and CTRL_BREAK on Windows. There, jag
+runs as a service when the service control manager starts it, as installed by
+'jag service install', stopping the audit when the service stops and logging
+to the Event Log.
+
+SIGUSR1 has the audit run a round right away, outside of its schedule, as does
+a POST to /debug/round on the HTTP endpoint, on Windows too, optionally given
+a reason like {"reason": "deployed the fix of brigade"}. Triggers arriving
+while a round is already pending are coalesced into it. The next scheduled
+round runs a full check_frequency after the triggered one. Rounds are only
+triggered when auditing continuously, not with --once or in a k8s-job, where
+the POST answers 409 Conflict.
+
+With the warm_up_keys field of the config, as many keys are verified at
+startup, before the first round, in both directions of bidirectional audits.
+If any of them can't be verified, or no key can be sampled with the model, the
+audit exits right away with what to look into, such as the credentials or the
+endpoints of the buckets, rather than at the end of its first round. Their
+mismatches are left to the rounds: nothing is reported or alerted on.
+
+Buckets on S3 whose access_key and secret_key are empty are accessed with the
+credentials the AWS SDKs find: those of AWS_ACCESS_KEY_ID,
+AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, of the profile AWS_PROFILE or
+default of the shared config and credentials files, of the web identity of
+AWS_WEB_IDENTITY_TOKEN_FILE, of the role of the ECS task or EKS pod, or of the
+instance profile of the EC2 instance, in that order. Credentials of roles are
+refreshed before they expire, and looked up again 30s after failing to be.
+The same goes for the sources of events.
+
+With the role_arn field of a bucket, the bucket is accessed through that role,
+assumed with STS using the credentials the bucket would be accessed with
+otherwise, e.g. to reach a destination only reachable through a role of
+another account. The external_id field is the external ID the role requires if
+any, and session_name names its sessions, "jag" by default. The role is
+assumed on the first request to the bucket, and again before its credentials
+expire.
+
+With --preset, a preset of the config is spot audited: only the keys matching
+its patterns are sampled, as many as its check_count, and verified with its
+checks. Spot audits leave out the namespaces, bidirectional sampling and audit
+of deletions of the config, and don't record their rounds in its state
+directory. With --once, a single round is audited.
+
+With --snapshot, keys are sampled from an S3 inventory of the source instead of
+the live source, to verify that every key that existed when the inventory was
+taken is in the destination, e.g. once a migration is backfilled. Keys of any
+age are sampled, but for those younger than check_youngest when the inventory
+was taken. Only the existence, etag, size and last_modified checks can verify
+keys against an inventory, and no model is needed.
+
+With --manifest, keys are sampled from a manifest of their checksums, such as
+written by an uploader with sha256sum or in a BagIt bag, instead of the live
+source, and the content of the destination is verified against it to check the
+fixity of an archive. The checksums are of the content_hash of the config, and
+only the content check is performed. No model is needed.
+
+Audits can be partitioned between instances of jag auditing the same buckets
+for throughput, with the partition field of their config: each instance
+verifies the keys whose names hash to its index, with seeds of its own, so that
+instances never sample the same keys. Instances can share a config, each given
+its index with --partition-index, but not a state directory.
+
+With --plan, the audit isn't run: a JSON description of what it would do is
+printed instead, with its buckets and their endpoints, schedule, sample sizes,
+filters and checks, to review changes to its config. No model is needed.
+
+GET /debug/results streams the result of each key as soon as it's verified,
+one JSON object per line, ?outcome=mismatch streaming only the mismatches.
+Results are dropped for clients too slow to keep up, rather than slowing down
+the audit.`),
+		Flags: []cli.Flag{
+			cfgFlag, modelFlag, buildModelFlag, reverseModelFlag, buildReverseModelFlag, bootstrapModelFlag, bootstrapListingsFlag,
+			saveModelFlag, saveReverseModelFlag,
+			reportFlag, statusFileFlag, replayFlag, runModeFlag, reportS3Flag, presetFlag, onceFlag, snapshotFlag,
+			manifestFlag, partitionIndexFlag, planFlag,
+		},
 		Action: doAudit,
 	}
 }
@@ -154,9 +699,25 @@ func printModelCommand(abort <-chan struct{}) cli.Command {
 		Usage: "name of the bucket this model will represent",
 	}
 
+	formatFlag := cli.StringFlag{
+		Name:  "format",
+		Usage: "json, to use the model in audits, or table, to read its summary",
+		Value: "json",
+	}
+
 	doPrintModel := func(ctx *cli.Context) {
 		bucketName := mustString(ctx, bucketFlag)
+		format := ctx.String(formatFlag.Name)
+		if format != "json" && format != "table" {
+			fail(ctx, "error: unknown format %q, valid formats are json, table", format)
+		}
 		model := mustBuildModel(ctx, bucketName, fileFlag, abort)
+		if format == "table" {
+			if err := model.writeSummary(os.Stdout); err != nil {
+				fail(ctx, "bug: can't write model summary to stdout: %v", err)
+			}
+			return
+		}
 		data, err := model.MarshalJSON()
 		if err != nil {
 			fail(ctx, "bug: can't create model JSON: %v", err)
@@ -171,9 +732,222 @@ func printModelCommand(abort <-chan struct{}) cli.Command {
 		Usage: "Computes and prints a model for the given bucket listing.",
 		Description: strings.TrimSpace(`
 Takes the listing of a bucket, in JSON form, and computes statistical data
-about it, then prints them.`),
-		Flags:  []cli.Flag{fileFlag, bucketFlag},
+about it, then prints them. The table format summarizes the model: its count of
+keys, a histogram of their depths and an estimate of the count of prefixes at
+each depth.`),
+		Flags:  []cli.Flag{fileFlag, bucketFlag, formatFlag},
 		Action: doPrintModel,
+		Subcommands: []cli.Command{
+			checkModelCommand(abort),
+			diffModelCommand(),
+		},
+	}
+}
+
+func checkModelCommand(abort <-chan struct{}) cli.Command {
+	listingFlag := cli.StringFlag{
+		Name:  "listing",
+		Usage: "path to a gzip'd JSON file representing all the keys in the source bucket",
+	}
+	modelFlag := cli.StringFlag{
+		Name:  "model",
+		Usage: "path to a JSON file representing model of the keys in the source bucket",
+	}
+	toleranceFlag := cli.Float64Flag{
+		Name:  "tolerance",
+		Usage: "how much the counts of keys can differ, relative to the larger count",
+		Value: 0.05,
+	}
+
+	doCheckModel := func(ctx *cli.Context) {
+		model := mustRetrieveModel(ctx, modelFlag)
+		listing := mustBuildModel(ctx, model.name, listingFlag, abort)
+		diffs := model.drift(*listing, ctx.Float64(toleranceFlag.Name))
+		if len(diffs) == 0 {
+			log.WithField("bucket", model.name).Info("model is consistent with the listing")
+			return
+		}
+		for _, diff := range diffs {
+			fmt.Fprintln(os.Stderr, diff)
+		}
+		fail(ctx, "error: model of bucket %q doesn't match the listing", model.name)
+	}
+
+	return cli.Command{
+		Name:  "check",
+		Usage: "Verifies that a model matches a bucket listing.",
+		Description: strings.TrimSpace(`
+Builds a model from a listing and compares it with an existing model, failing
+if their counts of keys, overall or at any depth, differ beyond a tolerance.
+This catches a model and a listing taken at very different times.`),
+		Flags:  []cli.Flag{listingFlag, modelFlag, toleranceFlag},
+		Action: doCheckModel,
+	}
+}
+
+func diffModelCommand() cli.Command {
+	doDiffModel := func(ctx *cli.Context) {
+		if len(ctx.Args()) != 2 {
+			fail(ctx, "error: need the paths of an old and of a new model")
+		}
+		older := mustRetrieveModelFile(ctx, ctx.Args().Get(0))
+		newer := mustRetrieveModelFile(ctx, ctx.Args().Get(1))
+		if older.name != newer.name {
+			fail(ctx, "error: can't compare a model of bucket %q with a model of bucket %q", older.name, newer.name)
+		}
+		if err := older.writeGrowth(os.Stdout, *newer); err != nil {
+			fail(ctx, "bug: can't write model diff to stdout: %v", err)
+		}
+	}
+
+	return cli.Command{
+		Name:  "diff",
+		Usage: "Compares two models of a bucket: jag model diff old.json new.json",
+		Description: strings.TrimSpace(`
+Reports how the keys of a bucket grew between two models, depth by depth, in
+count of keys and estimated count of prefixes. Since keys are sampled based on
+the model, a bucket whose shape changed needs a new model.`),
+		Action: doDiffModel,
+	}
+}
+
+func stateCommand() cli.Command {
+	return cli.Command{
+		Name:  "state",
+		Usage: "Exports or imports the state of an audit, or lists its operator actions.",
+		Subcommands: []cli.Command{
+			stateExportCommand(),
+			stateImportCommand(),
+			stateActionsCommand(),
+		},
+	}
+}
+
+func stateExportCommand() cli.Command {
+	cfgFlag := cli.StringFlag{
+		Name:  "cfg",
+		Usage: "path to the JSON config file",
+	}
+	outFlag := cli.StringFlag{
+		Name:  "out",
+		Usage: "path where to write the state archive",
+		Value: "jag-state.tar.gz",
+	}
+	secretsFlag := cli.BoolFlag{
+		Name:  "include-secrets",
+		Usage: "keep the AWS credentials in the archived config",
+	}
+
+	doExport := func(ctx *cli.Context) {
+		cfg := mustConfig(ctx, cfgFlag)
+		if cfg.StateDir == "" {
+			fail(ctx, "error: config doesn't have a state_dir, there's no state to export")
+		}
+		if !ctx.Bool(secretsFlag.Name) {
+			for _, a := range []*awsConfig{&cfg.Source, &cfg.Destination} {
+				a.AccessKey = ""
+				a.SecretKey = ""
+			}
+		}
+		filename := mustString(ctx, outFlag)
+		file, err := os.Create(filename)
+		if err != nil {
+			fail(ctx, "error: can't create file %q: %v", filename, err)
+		}
+		defer func() { _ = file.Close() }()
+		if err := exportState(file, cfg, stateDir(cfg.StateDir)); err != nil {
+			fail(ctx, "error: can't export state: %v", err)
+		}
+		log.Infof("state exported to %q", filename)
+	}
+
+	return cli.Command{
+		Name:  "export",
+		Usage: "Bundles the config, model, checkpoint and history of an audit in an archive.",
+		Description: strings.TrimSpace(`
+Bundles the effective config, the model, the checkpoint and the history of
+rounds of an audit in a single archive, to debug it or to move it to another
+host, along with the fixity records, model and checkpoint of its fixity audit.
+The AWS credentials are removed from the config unless asked otherwise.`),
+		Flags:  []cli.Flag{cfgFlag, outFlag, secretsFlag},
+		Action: doExport,
+	}
+}
+
+func stateImportCommand() cli.Command {
+	inFlag := cli.StringFlag{
+		Name:  "in",
+		Usage: "path to a state archive made by 'state export'",
+	}
+	stateDirFlag := cli.StringFlag{
+		Name:  "state-dir",
+		Usage: "path to the state directory to restore, the one in the archived config by default",
+	}
+	cfgFlag := cli.StringFlag{
+		Name:  "cfg",
+		Usage: "path where to write the archived config",
+		Value: "config.json",
+	}
+
+	doImport := func(ctx *cli.Context) {
+		filename := mustString(ctx, inFlag)
+		cfgFilename := mustString(ctx, cfgFlag)
+		if _, err := os.Stat(cfgFilename); err == nil {
+			fail(ctx, "error: config file %q already exists", cfgFilename)
+		}
+
+		file := mustOpen(ctx, filename)
+		files, err := readStateArchive(file)
+		_ = file.Close()
+		if err != nil {
+			fail(ctx, "error: can't read state archive %q: %v", filename, err)
+		}
+		cfgData, ok := files[configFileName]
+		if !ok {
+			fail(ctx, "error: state archive %q has no config", filename)
+		}
+		cfg, err := loadConfig(bytes.NewReader(cfgData))
+		if err != nil {
+			fail(ctx, "error: invalid config in state archive: %v", err)
+		}
+		if dir := ctx.String(stateDirFlag.Name); dir != "" {
+			cfg.StateDir = dir
+		}
+		if cfg.StateDir == "" {
+			fail(ctx, "required: flag %q must have a value", stateDirFlag.Name)
+		}
+
+		state, err := openStateDir(cfg.StateDir)
+		if err != nil {
+			fail(ctx, "error: can't open state directory %q: %v", cfg.StateDir, err)
+		}
+		if err := state.restore(files); err != nil {
+			fail(ctx, "error: can't restore state in %q: %v", cfg.StateDir, err)
+		}
+		err = recordAction(state, operatorAction{
+			At:      time.Now().UTC(),
+			By:      currentUser(),
+			Action:  "state_import",
+			Details: log.Fields{"archive": filename},
+		})
+		if err != nil {
+			fail(ctx, "error: can't record action: %v", err)
+		}
+		data, err := cfg.MarshalJSON()
+		if err != nil {
+			fail(ctx, "bug: can't create config JSON: %v", err)
+		}
+		if err := os.WriteFile(cfgFilename, data, 0600); err != nil {
+			fail(ctx, "error: can't write config to %q: %v", cfgFilename, err)
+		}
+		log.Infof("state restored in %q, config written to %q", cfg.StateDir, cfgFilename)
+	}
+
+	return cli.Command{
+		Name:   "import",
+		Usage:  "Restores an archive made by 'state export'.",
+		Flags:  []cli.Flag{inFlag, stateDirFlag, cfgFlag},
+		Action: doImport,
 	}
 }
 
@@ -201,9 +975,49 @@ func mustConfig(ctx *cli.Context, f cli.StringFlag) *config {
 	if err != nil {
 		fail(ctx, "can't create config from file %q: %v", filename, err)
 	}
+	labelLogs(cfg)
 	return cfg
 }
 
+// mustFinishJob writes the report of a round audited as a job to stdout,
+// uploads it if s3url is set, and exits with the status of the round.
+func mustFinishJob(ctx *cli.Context, cfg *config, report *RoundReport, s3url string) {
+	data, err := json.MarshalIndent(report, "", "   ")
+	if err != nil {
+		fail(ctx, "bug: can't create report JSON: %v", err)
+	}
+	if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+		fail(ctx, "error: can't write report to stdout: %v", err)
+	}
+	if s3url != "" {
+		where, err := uploadReport(cfg.Destination, s3url, report)
+		if err != nil {
+			fail(ctx, "error: can't upload report to %q: %v", s3url, err)
+		}
+		log.WithField("where", where).Info("uploaded report")
+	}
+	os.Exit(report.exitStatus())
+}
+
+// mustPrepareEndpoints sets up the connections to the endpoints of the
+// buckets, as configured.
+func mustPrepareEndpoints(ctx *cli.Context, buckets ...awsConfig) {
+	for _, a := range buckets {
+		if err := prepareEndpoints(a); err != nil {
+			fail(ctx, "error: %v", err)
+		}
+	}
+}
+
+// mustAWSBucket returns the bucket of a, see awsBucket.
+func mustAWSBucket(ctx *cli.Context, a awsConfig) bucket {
+	bkt, err := awsBucket(a)
+	if err != nil {
+		fail(ctx, "error: %v", err)
+	}
+	return bkt
+}
+
 func mustBuildModel(ctx *cli.Context, bucketName string, f cli.StringFlag, abort <-chan struct{}) *bucketModel {
 	filename := mustString(ctx, f)
 	file := mustOpen(ctx, filename)
@@ -220,7 +1034,7 @@ func mustBuildModel(ctx *cli.Context, bucketName string, f cli.StringFlag, abort
 	}
 
 	ifaceC, errc := parajson.Decode(rd, runtime.NumCPU(), func() interface{} {
-		return &s3.Key{}
+		return &listedKey{}
 	})
 
 	sem := make(chan struct{}, 1)
@@ -235,8 +1049,55 @@ func mustBuildModel(ctx *cli.Context, bucketName string, f cli.StringFlag, abort
 	return model
 }
 
+// saveBuiltModel saves the model built from a listing to filename, or next to
+// the listing if it's empty, for later runs to use with the flag loading it
+// rather than build it again. The audit goes on if it can't be saved.
+func saveBuiltModel(model *bucketModel, listing, filename, flag string) {
+	if filename == "" {
+		filename = modelPathOf(listing)
+	}
+	if err := model.writeFile(filename); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"file":  filename,
+		}).Error("couldn't save model built from listing")
+		return
+	}
+	log.WithFields(log.Fields{
+		"bucket": model.name,
+		"file":   filename,
+	}).Infof("saved model built from listing, use it with --%s to skip building it", flag)
+}
+
+// mustBootstrapModel estimates the model of a bucket from some of its
+// prefixes, see modelBootstrap.
+func mustBootstrapModel(ctx *cli.Context, b *modelBootstrap, abort <-chan struct{}) *bucketModel {
+	log.WithFields(log.Fields{
+		"bucket":   b.name,
+		"listings": b.budget,
+	}).Info("bootstrapping model of bucket")
+	model, err := b.refine(abort)
+	if err != nil {
+		fail(ctx, "error: can't bootstrap model of bucket %q: %v", b.name, err)
+	}
+	if model.keyCount == 0 {
+		fail(ctx, "error: no key found in the %d prefixes of bucket %q listed to bootstrap its model, list more with --%s",
+			b.listings, b.name, "bootstrap-listings")
+	}
+	log.WithFields(log.Fields{
+		"bucket":   b.name,
+		"keys":     model.keyCount,
+		"depths":   len(model.depths),
+		"complete": b.done(),
+	}).Info("bootstrapped model of bucket")
+	return model
+}
+
 func mustRetrieveModel(ctx *cli.Context, f cli.StringFlag) *bucketModel {
-	filename := mustString(ctx, f)
+	return mustRetrieveModelFile(ctx, mustString(ctx, f))
+}
+
+func mustRetrieveModelFile(ctx *cli.Context, filename string) *bucketModel {
 	file := mustOpen(ctx, filename)
 	defer func() { _ = file.Close() }()
 	var model bucketModel
@@ -247,6 +1108,19 @@ func mustRetrieveModel(ctx *cli.Context, f cli.StringFlag) *bucketModel {
 	return &model
 }
 
+// memoryLimit is how much memory jag should stay under, or 0 if it isn't
+// limited.
+func memoryLimit(ctx *cli.Context) (int64, error) {
+	if size := ctx.GlobalString("memory-limit"); size != "" {
+		limit, err := parseBytes(size)
+		if err != nil {
+			return 0, fmt.Errorf("--memory-limit: %v", err)
+		}
+		return limit, nil
+	}
+	return cgroupMemoryLimit(), nil
+}
+
 func fail(c *cli.Context, format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
 	cli.ShowCommandHelp(c, c.Command.Name)
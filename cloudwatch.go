@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"math"
+	"time"
+)
+
+// CloudWatchLookback is how far back the daily storage metrics of buckets
+// are looked for, since CloudWatch publishes them a day or so late.
+const CloudWatchLookback = 3 * 24 * time.Hour
+
+// s3MetricsStats returns the latest daily storage metrics of a bucket in
+// CloudWatch: its number of objects, and their size in all storage classes.
+// The client must be of the region of the bucket, whose storage metrics are
+// only published there.
+func s3MetricsStats(client *cloudwatch.Client, bucket string, now time.Time) (*bucketStats, error) {
+	search := func(metric string) *string {
+		return aws.String(fmt.Sprintf(`SUM(SEARCH('{AWS/S3,BucketName,StorageType} MetricName="%s" BucketName="%s"', 'Average', 86400))`, metric, bucket))
+	}
+	out, err := client.GetMetricData(context.Background(), &cloudwatch.GetMetricDataInput{
+		StartTime: aws.Time(now.Add(-CloudWatchLookback)),
+		EndTime:   aws.Time(now),
+		ScanBy:    types.ScanByTimestampDescending,
+		MetricDataQueries: []types.MetricDataQuery{
+			{Id: aws.String("keys"), Expression: search("NumberOfObjects")},
+			{Id: aws.String("bytes"), Expression: search("BucketSizeBytes")},
+		},
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	stats := &bucketStats{}
+	found := 0
+	for _, res := range out.MetricDataResults {
+		// the values are the newest first
+		if len(res.Values) == 0 || len(res.Timestamps) == 0 {
+			continue
+		}
+		value := math.Round(res.Values[0])
+		switch aws.ToString(res.Id) {
+		case "keys":
+			stats.Keys = int64(value)
+		case "bytes":
+			stats.Bytes = int64(value)
+		default:
+			continue
+		}
+		found++
+		if at := res.Timestamps[0]; stats.At.IsZero() || at.Before(stats.At) {
+			stats.At = at
+		}
+	}
+	if found != 2 {
+		return nil, errors.New("no storage metrics of the bucket in CloudWatch, which only has metrics of buckets a day or so old")
+	}
+	return stats, nil
+}
@@ -2,84 +2,793 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"io"
+	"strconv"
 	"time"
 )
 
+// DefaultKeyTimeout is how long the verification of a key can take, if the
+// config doesn't say otherwise.
+const DefaultKeyTimeout = 5 * time.Minute
+
 type awsConfig struct {
-	Bucket    string `json:"bucket"`
-	Region    string `json:"region"`
+	Bucket string `json:"bucket"`
+	Region string `json:"region"`
+	// AccessKey and SecretKey are the credentials of the bucket, looked up
+	// like the AWS SDKs do if empty, see awsSDKConfig.
 	AccessKey string `json:"access_key"`
 	SecretKey string `json:"secret_key"`
+	// RoleARN is a role the bucket is accessed through, assumed with the
+	// credentials of the bucket, such as a role of the account of the bucket
+	// for audits from another account. ExternalID is the external ID the
+	// role may require, and SessionName names the sessions of the role,
+	// DefaultSessionName if empty.
+	RoleARN     string `json:"role_arn,omitempty"`
+	ExternalID  string `json:"external_id,omitempty"`
+	SessionName string `json:"session_name,omitempty"`
+	// Fallbacks are regions or endpoint URLs serving the bucket when its
+	// region fails.
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	// DualStack uses the endpoints of the regions reachable over IPv6.
+	DualStack bool `json:"dual_stack,omitempty"`
+	// FIPS uses the FIPS endpoints of the regions, and restricts TLS to
+	// FIPS approved settings.
+	FIPS bool `json:"fips,omitempty"`
+	// Swift is set if the bucket is a container of OpenStack Swift rather
+	// than an S3 bucket.
+	Swift *swiftConfig `json:"swift,omitempty"`
+	// SFTP is set if the bucket is a directory of a host served over SFTP
+	// rather than an S3 bucket.
+	SFTP *sftpConfig `json:"sftp,omitempty"`
+	// B2 is set if the bucket is a bucket of Backblaze B2 reached with its
+	// native API rather than its S3 compatible API.
+	B2 *b2Config `json:"b2,omitempty"`
+}
+
+// hookConfig is the program invoked by the hook check.
+type hookConfig struct {
+	Command string
+	Args    []string
+	Timeout time.Duration
+}
+
+// deleteMarkersConfig configures the audit of deletions in versioned
+// buckets.
+type deleteMarkersConfig struct {
+	// Count is the number of deleted keys sampled each round.
+	Count int
+	// SLA is how long a deletion can take to be propagated.
+	SLA time.Duration
+}
+
+// retentionPolicy is the Object Lock retention that keys in the destination
+// must have at least, whatever the retention in the source.
+type retentionPolicy struct {
+	Mode string
+	// Period is how long after their last modification keys must be
+	// retained.
+	Period time.Duration
 }
 
 type config struct {
+	// AuditName and Labels tell this audit apart from the others, in its
+	// logs, reports and hook inputs.
+	AuditName      string
+	Labels         map[string]string
 	RandomSeed     int64
 	CheckCount     int
 	CheckYoungest  time.Duration
 	CheckOldest    time.Duration
 	CheckFrequency time.Duration
-	Source         awsConfig
-	Destination    awsConfig
+	// SampleWorkers and VerifyWorkers are the number of concurrent walks
+	// sampling keys, and of concurrent verifications of keys.
+	SampleWorkers int
+	VerifyWorkers int
+	// KeyTimeout is how long the verification of a key can take before it
+	// is deemed inconclusive.
+	KeyTimeout time.Duration
+	// WarmUpKeys are verified at startup, before the first round, for
+	// the audit to fail right away if it can't work, see warmUp. None are
+	// if it's 0.
+	WarmUpKeys int
+	Checks     []string
+	// LastModifiedTolerance is how much older a key can be in the
+	// destination than in the source, for clocks that aren't in sync.
+	LastModifiedTolerance time.Duration
+	Hook                  hookConfig
+	// Retention is the policy enforced by the retention check, if any.
+	Retention retentionPolicy
+	// Sampler names the sampler picking keys, configured by
+	// SamplerOptions.
+	Sampler        string
+	SamplerOptions json.RawMessage
+	// Constraint is an expression that sampled keys must satisfy.
+	Constraint string
+	// MinSize and MaxSize bound the size in bytes of the keys sampled,
+	// MaxSize being 0 if they aren't bounded from above.
+	MinSize int64
+	MaxSize int64
+	// Owners is nil unless the keys sampled are restricted by owner.
+	Owners *ownersConfig
+	// IgnoreMismatch is an expression selecting mismatches that are
+	// tolerated.
+	IgnoreMismatch string
+	// Ignore are the known divergences whose mismatches are ignored.
+	Ignore []ignoreRule
+	// KeyNormalization are the normalizations applied in order to the
+	// names of keys by the destination store, see keyNormalizations.
+	KeyNormalization []string
+	// ContentHash is the algorithm the content check digests keys with, one
+	// of contentHashes.
+	ContentHash string
+	// SampleVersions makes the audit sample random versions of the keys,
+	// rather than their latest version.
+	SampleVersions bool
+	// Bidirectional makes the audit also sample keys from the destination
+	// and verify them against the source, catching keys deleted from the
+	// source but not from the destination. CheckCount is split between both
+	// directions.
+	Bidirectional bool
+	// Reconcile makes the audit compare the statistics of both buckets each
+	// round, see reconciliation.
+	Reconcile bool
+	// InFlightUploads has the mismatches of keys being uploaded in parts
+	// to the source pending rather than alerted on.
+	InFlightUploads bool
+	// MaxUploadAge is how long after it started an upload in parts is
+	// still in flight, older ones being abandoned.
+	MaxUploadAge  time.Duration
+	DeleteMarkers deleteMarkersConfig
+	// InventoryDiff is nil unless the inventories of the buckets are
+	// diffed on a schedule.
+	InventoryDiff *inventoryDiffConfig
+	// Flapping is nil unless alerts on keys are debounced.
+	Flapping *flappingConfig
+	// Export is nil unless the results of rounds are exported for SQL
+	// engines.
+	Export *exportConfig
+	// Risk is nil unless rounds are alerted on by the score of their
+	// mismatches rather than by their count.
+	Risk *riskConfig
+	// Claims is nil unless the keys syncers claim to have copied are
+	// verified.
+	Claims *claimsConfig
+	// Events is nil unless keys written according to the event
+	// notifications of the source are verified.
+	Events *eventsConfig
+	// Queue is nil unless the keys verified in a round besides those
+	// sampled are bounded.
+	Queue *queueConfig
+	// Maintenance puts the audit in maintenance, see maintenance. It's
+	// read once when the audit starts, the endpoint changing maintenance
+	// while it runs.
+	Maintenance bool
+	// SkipPlaceholders leaves placeholder keys, see isPlaceholder, out of
+	// the keys sampled and of the keys the rate of change is scaled to.
+	SkipPlaceholders bool
+	// Partition is nil unless the audit is partitioned between instances.
+	Partition *partitionConfig
+	// Autotune is nil unless the concurrency is adjusted automatically.
+	Autotune *autotuneConfig
+	// Degradation is nil unless the checks are degraded while the
+	// destination fails.
+	Degradation *degradationConfig
+	// CircuitBreaker is nil unless the endpoints of the buckets are
+	// requested through circuit breakers.
+	CircuitBreaker *breakerConfig
+	Lifecycle      lifecycleConfig
+	// Admin is the HTTP endpoint of the audit command.
+	Admin adminConfig
+	// Namespaces are groups of prefixes audited apart from the whole
+	// bucket.
+	Namespaces []namespace
+	// HotPrefixes is nil unless the prefixes written to the most are
+	// prioritized.
+	HotPrefixes *hotConfig
+	// Presets are spot audits of parts of the key space, run on demand.
+	Presets []preset
+	// Preset is the preset being audited, if any, see withPreset.
+	Preset *preset
+	// Profiling keeps profiles of slow rounds, if SlowRound is set.
+	Profiling profilingConfig
+	// StateDir is where the state of the audit is persisted, if set.
+	StateDir    string
+	Source      awsConfig
+	Destination awsConfig
 }
 
-func loadConfig(r io.Reader) (*config, error) {
-	var d struct {
-		RandomSeed     int64     `json:"random_seed"`
-		CheckCount     uint      `json:"check_count"`
-		CheckYoungest  string    `json:"check_youngest"`
-		CheckOldest    string    `json:"check_oldest"`
-		CheckFrequency string    `json:"check_frequency"`
-		Source         awsConfig `json:"source"`
-		Destination    awsConfig `json:"destination"`
+// configFile is the representation of a config in JSON.
+type configFile struct {
+	AuditName             string             `json:"audit_name,omitempty"`
+	Labels                map[string]string  `json:"labels,omitempty"`
+	RandomSeed            int64              `json:"random_seed"`
+	CheckCount            uint               `json:"check_count"`
+	CheckYoungest         string             `json:"check_youngest"`
+	CheckOldest           string             `json:"check_oldest"`
+	CheckFrequency        string             `json:"check_frequency"`
+	SampleWorkers         uint               `json:"sample_workers,omitempty"`
+	VerifyWorkers         uint               `json:"verify_workers,omitempty"`
+	KeyTimeout            string             `json:"key_timeout,omitempty"`
+	WarmUpKeys            uint               `json:"warm_up_keys,omitempty"`
+	Checks                []string           `json:"checks,omitempty"`
+	LastModifiedTolerance string             `json:"last_modified_tolerance,omitempty"`
+	Hook                  *hookFile          `json:"hook,omitempty"`
+	Retention             *retentionFile     `json:"retention,omitempty"`
+	Sampler               string             `json:"sampler,omitempty"`
+	SamplerOptions        json.RawMessage    `json:"sampler_options,omitempty"`
+	Constraint            string             `json:"constraint,omitempty"`
+	MinSize               string             `json:"min_size,omitempty"`
+	MaxSize               string             `json:"max_size,omitempty"`
+	Owners                *ownersConfig      `json:"owners,omitempty"`
+	IgnoreMismatch        string             `json:"ignore_mismatch,omitempty"`
+	Ignore                []ignoreRuleFile   `json:"ignore,omitempty"`
+	KeyNormalization      []string           `json:"key_normalization,omitempty"`
+	ContentHash           string             `json:"content_hash,omitempty"`
+	SampleVersions        bool               `json:"sample_versions,omitempty"`
+	Bidirectional         bool               `json:"bidirectional,omitempty"`
+	Reconcile             bool               `json:"reconcile,omitempty"`
+	InFlightUploads       bool               `json:"in_flight_uploads,omitempty"`
+	MaxUploadAge          string             `json:"max_upload_age,omitempty"`
+	DeleteMarkers         *deleteMarkersFile `json:"delete_markers,omitempty"`
+	InventoryDiff         *inventoryDiffFile `json:"inventory_diff,omitempty"`
+	Flapping              *flappingConfig    `json:"flapping,omitempty"`
+	Export                *exportConfig      `json:"export,omitempty"`
+	Risk                  *riskConfig        `json:"risk,omitempty"`
+	Claims                *claimsFile        `json:"claims,omitempty"`
+	Events                *eventsFile        `json:"events,omitempty"`
+	Queue                 *queueConfig       `json:"queue,omitempty"`
+	Maintenance           bool               `json:"maintenance,omitempty"`
+	SkipPlaceholders      bool               `json:"skip_placeholders,omitempty"`
+	Partition             *partitionConfig   `json:"partition,omitempty"`
+	Autotune              *autotuneFile      `json:"autotune,omitempty"`
+	Degradation           *degradationConfig `json:"degradation,omitempty"`
+	CircuitBreaker        *breakerFile       `json:"circuit_breaker,omitempty"`
+	Lifecycle             *lifecycleConfig   `json:"lifecycle,omitempty"`
+	Admin                 *adminConfig       `json:"admin,omitempty"`
+	Namespaces            []namespace        `json:"namespaces,omitempty"`
+	HotPrefixes           *hotConfig         `json:"hot_prefixes,omitempty"`
+	Presets               []preset           `json:"presets,omitempty"`
+	Profiling             *profilingFile     `json:"profiling,omitempty"`
+	StateDir              string             `json:"state_dir,omitempty"`
+	Source                awsConfig          `json:"source"`
+	Destination           awsConfig          `json:"destination"`
+}
+
+type deleteMarkersFile struct {
+	Count uint   `json:"count"`
+	SLA   string `json:"sla,omitempty"`
+}
+
+type retentionFile struct {
+	Mode   string `json:"mode,omitempty"`
+	Period string `json:"period,omitempty"`
+}
+
+type autotuneFile struct {
+	TargetRound  string  `json:"target_round"`
+	MaxErrorRate float64 `json:"max_error_rate,omitempty"`
+	MaxWorkers   uint    `json:"max_workers,omitempty"`
+}
+
+type hookFile struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	Timeout string   `json:"timeout,omitempty"`
+}
+
+// defaultWorkers returns the number of concurrent walks and verifications
+// for rounds sampling count keys. Walks are cheap, so most of them can run at
+// once, whereas verifications can be expensive.
+func defaultWorkers(count int) (walks, workers int) {
+	walks, workers = count, count/4
+	if walks > MaxSampleWorkers {
+		walks = MaxSampleWorkers
+	}
+	if workers > MaxVerifyWorkers {
+		workers = MaxVerifyWorkers
+	}
+	if walks < 1 {
+		walks = 1
+	}
+	if workers < 1 {
+		workers = 1
 	}
+	return walks, workers
+}
+
+func loadConfig(r io.Reader) (*config, error) {
+	var d configFile
 	err := json.NewDecoder(r).Decode(&d)
 	if err != nil {
-		return nil, err
+		return nil, configErrorf("can't decode JSON: %v", err)
 	}
 
 	c := &config{
-		CheckCount:  int(d.CheckCount),
-		Source:      d.Source,
-		Destination: d.Destination,
+		AuditName:      d.AuditName,
+		Labels:         d.Labels,
+		RandomSeed:     d.RandomSeed,
+		CheckCount:     int(d.CheckCount),
+		WarmUpKeys:     int(d.WarmUpKeys),
+		Checks:         d.Checks,
+		Sampler:        d.Sampler,
+		SamplerOptions: d.SamplerOptions,
+		Constraint:     d.Constraint,
+		IgnoreMismatch: d.IgnoreMismatch,
+		SampleVersions: d.SampleVersions,
+		Bidirectional:  d.Bidirectional,
+		StateDir:       d.StateDir,
+		Source:         d.Source,
+		Destination:    d.Destination,
+	}
+	if err := validateLabels(c.Labels); err != nil {
+		return nil, configErrorf("labels: %v", err)
+	}
+	if c.Bidirectional && c.CheckCount < 2 {
+		return nil, configErrorf("bidirectional: check_count must be at least 2 to sample both buckets")
+	}
+	c.KeyNormalization = d.KeyNormalization
+	if err := loadKeyNormalization(c.KeyNormalization); err != nil {
+		return nil, configErrorf("key_normalization: %v", err)
+	}
+	if c.Bidirectional && len(c.KeyNormalization) != 0 {
+		// keys of the destination can't be mapped back to the source
+		return nil, configErrorf("bidirectional: can't sample the destination with a key_normalization")
+	}
+	c.Reconcile = d.Reconcile
+	c.InFlightUploads = d.InFlightUploads
+	if s := c.Source; c.InFlightUploads && (s.Swift != nil || s.SFTP != nil || s.B2 != nil) {
+		return nil, configErrorf("in_flight_uploads: only the uploads of S3 sources are listed")
+	}
+	if c.InFlightUploads {
+		c.MaxUploadAge = DefaultMaxUploadAge
+	}
+	if d.MaxUploadAge != "" {
+		if !c.InFlightUploads {
+			return nil, configErrorf("max_upload_age: only applies with in_flight_uploads")
+		}
+		c.MaxUploadAge, err = time.ParseDuration(d.MaxUploadAge)
+		if err != nil {
+			return nil, configErrorf("max_upload_age: %v", err)
+		}
+		if c.MaxUploadAge <= 0 {
+			return nil, configErrorf("max_upload_age must be positive")
+		}
+	}
+	if d.Export != nil {
+		c.Export = d.Export
+		if err := loadExport(c.Export); err != nil {
+			return nil, configErrorf("export: %v", err)
+		}
+	}
+	if d.Risk != nil {
+		c.Risk = d.Risk
+		if err := loadRisk(c.Risk); err != nil {
+			return nil, configErrorf("risk: %v", err)
+		}
+	}
+	if d.Claims != nil {
+		if c.Claims, err = loadClaims(d.Claims, c.CheckCount); err != nil {
+			return nil, configErrorf("claims: %v", err)
+		}
+	}
+	if d.Events != nil {
+		if c.Events, err = loadEvents(d.Events, c); err != nil {
+			return nil, configErrorf("events: %v", err)
+		}
+	}
+	if d.Queue != nil {
+		c.Queue = d.Queue
+		if err := loadQueue(c.Queue); err != nil {
+			return nil, configErrorf("queue: %v", err)
+		}
+	}
+	c.Maintenance = d.Maintenance
+	c.SkipPlaceholders = d.SkipPlaceholders
+	c.ContentHash = d.ContentHash
+	if c.ContentHash == "" {
+		c.ContentHash = DefaultContentHash
+	}
+	if err := loadContentHash(c.ContentHash); err != nil {
+		return nil, configErrorf("content_hash: %v", err)
 	}
 	c.CheckYoungest, err = time.ParseDuration(d.CheckYoungest)
 	if err != nil {
-		return nil, err
+		return nil, configErrorf("check_youngest: %v", err)
 	}
 	c.CheckOldest, err = time.ParseDuration(d.CheckOldest)
 	if err != nil {
-		return nil, err
+		return nil, configErrorf("check_oldest: %v", err)
 	}
 	if c.CheckOldest <= c.CheckYoungest {
-		return nil, errors.New("cannot look for events where oldest is less or equal to youngest")
+		return nil, configErrorf("cannot look for events where oldest is less or equal to youngest")
 	}
 
 	c.CheckFrequency, err = time.ParseDuration(d.CheckFrequency)
 	if err != nil {
+		return nil, configErrorf("check_frequency: %v", err)
+	}
+
+	c.SampleWorkers, c.VerifyWorkers = defaultWorkers(c.CheckCount)
+	if d.SampleWorkers != 0 {
+		c.SampleWorkers = int(d.SampleWorkers)
+	}
+	if d.VerifyWorkers != 0 {
+		c.VerifyWorkers = int(d.VerifyWorkers)
+	}
+
+	c.KeyTimeout = DefaultKeyTimeout
+	if d.KeyTimeout != "" {
+		c.KeyTimeout, err = time.ParseDuration(d.KeyTimeout)
+		if err != nil {
+			return nil, configErrorf("key_timeout: %v", err)
+		}
+		if c.KeyTimeout <= 0 {
+			return nil, configErrorf("key_timeout must be positive")
+		}
+	}
+
+	for _, a := range []awsConfig{c.Source, c.Destination} {
+		for _, fallback := range a.Fallbacks {
+			if _, err := regionOf(fallback); err != nil {
+				return nil, configErrorf("fallbacks of bucket %q: %v", a.Bucket, err)
+			}
+		}
+	}
+
+	if d.MinSize != "" {
+		c.MinSize, err = parseBytes(d.MinSize)
+		if err != nil {
+			return nil, configErrorf("min_size: %v", err)
+		}
+	}
+	if d.MaxSize != "" {
+		c.MaxSize, err = parseBytes(d.MaxSize)
+		if err != nil {
+			return nil, configErrorf("max_size: %v", err)
+		}
+		if c.MaxSize < c.MinSize {
+			return nil, configErrorf("max_size must be at least min_size")
+		}
+	}
+
+	if d.Owners != nil {
+		c.Owners = d.Owners
+		if err := loadOwners(c.Owners); err != nil {
+			return nil, configErrorf("owners: %v", err)
+		}
+	}
+
+	if d.LastModifiedTolerance != "" {
+		c.LastModifiedTolerance, err = time.ParseDuration(d.LastModifiedTolerance)
+		if err != nil {
+			return nil, configErrorf("last_modified_tolerance: %v", err)
+		}
+	}
+
+	if d.Hook != nil {
+		c.Hook.Command = d.Hook.Command
+		c.Hook.Args = d.Hook.Args
+		if d.Hook.Timeout != "" {
+			c.Hook.Timeout, err = time.ParseDuration(d.Hook.Timeout)
+			if err != nil {
+				return nil, configErrorf("hook.timeout: %v", err)
+			}
+		}
+	}
+
+	if d.Retention != nil {
+		c.Retention.Mode = d.Retention.Mode
+		if _, ok := retentionModes[c.Retention.Mode]; !ok {
+			return nil, configErrorf("retention.mode: unknown mode %q", c.Retention.Mode)
+		}
+		if d.Retention.Period != "" {
+			c.Retention.Period, err = time.ParseDuration(d.Retention.Period)
+			if err != nil {
+				return nil, configErrorf("retention.period: %v", err)
+			}
+		}
+	}
+
+	c.Ignore, err = loadIgnoreRules(d.Ignore)
+	if err != nil {
+		return nil, configErrorf("ignore: %v", err)
+	}
+
+	if d.Lifecycle != nil {
+		c.Lifecycle = *d.Lifecycle
+	}
+	if d.Admin != nil {
+		c.Admin = *d.Admin
+	}
+	if err := loadAdmin(&c.Admin); err != nil {
+		return nil, configErrorf("admin: %v", err)
+	}
+
+	c.Namespaces, err = loadNamespaces(d.Namespaces)
+	if err != nil {
+		return nil, configErrorf("namespaces: %v", err)
+	}
+	if d.HotPrefixes != nil {
+		c.HotPrefixes = d.HotPrefixes
+		if err := loadHot(c.HotPrefixes); err != nil {
+			return nil, configErrorf("hot_prefixes: %v", err)
+		}
+		if c.CheckCount < 2 {
+			return nil, configErrorf("hot_prefixes: check_count must be at least 2 to sample the whole bucket too")
+		}
+	}
+
+	if d.Profiling != nil {
+		c.Profiling.Dir = d.Profiling.Dir
+		c.Profiling.UploadURL = d.Profiling.UploadURL
+		c.Profiling.SlowRound, err = time.ParseDuration(d.Profiling.SlowRound)
+		if err != nil {
+			return nil, configErrorf("profiling.slow_round: %v", err)
+		}
+		if c.Profiling.SlowRound <= 0 {
+			return nil, configErrorf("profiling.slow_round must be positive")
+		}
+	}
+
+	if d.Autotune != nil {
+		c.Autotune = &autotuneConfig{
+			MaxErrorRate: d.Autotune.MaxErrorRate,
+			MaxWorkers:   int(d.Autotune.MaxWorkers),
+		}
+		c.Autotune.TargetRound, err = time.ParseDuration(d.Autotune.TargetRound)
+		if err != nil {
+			return nil, configErrorf("autotune.target_round: %v", err)
+		}
+		if c.Autotune.TargetRound <= 0 {
+			return nil, configErrorf("autotune.target_round must be positive")
+		}
+		if c.Autotune.MaxErrorRate == 0 {
+			c.Autotune.MaxErrorRate = DefaultMaxErrorRate
+		}
+		if c.Autotune.MaxWorkers == 0 {
+			c.Autotune.MaxWorkers = c.CheckCount
+		}
+	}
+	if d.Degradation != nil {
+		c.Degradation = d.Degradation
+		if err := loadDegradation(c.Degradation); err != nil {
+			return nil, configErrorf("degradation: %v", err)
+		}
+	}
+	if d.CircuitBreaker != nil {
+		if c.CircuitBreaker, err = loadBreaker(d.CircuitBreaker); err != nil {
+			return nil, configErrorf("circuit_breaker: %v", err)
+		}
+	}
+
+	if d.DeleteMarkers != nil {
+		c.DeleteMarkers.Count = int(d.DeleteMarkers.Count)
+		c.DeleteMarkers.SLA = DefaultDeleteMarkerSLA
+		if d.DeleteMarkers.SLA != "" {
+			c.DeleteMarkers.SLA, err = time.ParseDuration(d.DeleteMarkers.SLA)
+			if err != nil {
+				return nil, configErrorf("delete_markers.sla: %v", err)
+			}
+		}
+	}
+
+	if d.InventoryDiff != nil {
+		if c.InventoryDiff, err = loadInventoryDiff(c, d.InventoryDiff); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.Partition != nil {
+		c.Partition = d.Partition
+		if err := loadPartition(c.Partition); err != nil {
+			return nil, configErrorf("partition: %v", err)
+		}
+	}
+
+	if d.Flapping != nil {
+		c.Flapping = d.Flapping
+		if err := loadFlapping(c.Flapping); err != nil {
+			return nil, configErrorf("flapping: %v", err)
+		}
+	}
+
+	if _, ok := samplersByName[c.Sampler]; c.Sampler != "" && !ok {
+		return nil, configErrorf("unknown sampler %q, valid samplers are %s", c.Sampler, samplerNames())
+	}
+
+	for _, src := range []string{c.Constraint, c.IgnoreMismatch} {
+		if src == "" {
+			continue
+		}
+		if _, err := compileExpr(src); err != nil {
+			return nil, configErrorf("%v", err)
+		}
+	}
+
+	if len(c.Checks) == 0 {
+		c.Checks = DefaultChecks
+	}
+	if _, err := lookupChecks(c); err != nil {
 		return nil, err
 	}
 
+	for _, a := range []awsConfig{c.Source, c.Destination} {
+		backends := 0
+		for _, set := range []bool{a.Swift != nil, a.SFTP != nil, a.B2 != nil} {
+			if set {
+				backends++
+			}
+		}
+		switch {
+		case backends > 1:
+			return nil, configErrorf("bucket %q can only be in one of Swift, SFTP and B2", a.Bucket)
+		case a.Swift != nil:
+			if err := loadSwift(c, a); err != nil {
+				return nil, configErrorf("swift of bucket %q: %v", a.Bucket, err)
+			}
+		case a.SFTP != nil:
+			if err := loadSFTP(c, a); err != nil {
+				return nil, configErrorf("sftp of bucket %q: %v", a.Bucket, err)
+			}
+		case a.B2 != nil:
+			if err := loadB2(c, a); err != nil {
+				return nil, configErrorf("b2 of bucket %q: %v", a.Bucket, err)
+			}
+		}
+		if err := validateRole(a); err != nil {
+			return nil, configErrorf("bucket %q: %v", a.Bucket, err)
+		}
+	}
+
+	c.Presets, err = loadPresets(c, d.Presets)
+	if err != nil {
+		return nil, configErrorf("presets: %v", err)
+	}
+
 	return c, err
 }
 
 func (c *config) MarshalJSON() ([]byte, error) {
-	return json.MarshalIndent(struct {
-		RandomSeed     int64     `json:"random_seed"`
-		CheckCount     uint      `json:"check_count"`
-		CheckYoungest  string    `json:"check_youngest"`
-		CheckOldest    string    `json:"check_oldest"`
-		CheckFrequency string    `json:"check_frequency"`
-		Source         awsConfig `json:"source"`
-		Destination    awsConfig `json:"destination"`
-	}{
-		RandomSeed:     c.RandomSeed,
-		CheckCount:     uint(c.CheckCount),
-		CheckYoungest:  c.CheckYoungest.String(),
-		CheckOldest:    c.CheckOldest.String(),
-		CheckFrequency: c.CheckFrequency.String(),
-		Source:         c.Source,
-		Destination:    c.Destination,
+	var lastModifiedTolerance string
+	if c.LastModifiedTolerance != 0 {
+		lastModifiedTolerance = c.LastModifiedTolerance.String()
+	}
+	var minSize, maxSize string
+	if c.MinSize != 0 {
+		minSize = strconv.FormatInt(c.MinSize, 10)
+	}
+	if c.MaxSize != 0 {
+		maxSize = strconv.FormatInt(c.MaxSize, 10)
+	}
+	var hook *hookFile
+	if c.Hook.Command != "" {
+		hook = &hookFile{
+			Command: c.Hook.Command,
+			Args:    c.Hook.Args,
+		}
+		if c.Hook.Timeout != 0 {
+			hook.Timeout = c.Hook.Timeout.String()
+		}
+	}
+	var ret *retentionFile
+	if c.Retention != (retentionPolicy{}) {
+		ret = &retentionFile{Mode: c.Retention.Mode}
+		if c.Retention.Period != 0 {
+			ret.Period = c.Retention.Period.String()
+		}
+	}
+	var deleteMarkers *deleteMarkersFile
+	if c.DeleteMarkers.Count != 0 {
+		deleteMarkers = &deleteMarkersFile{
+			Count: uint(c.DeleteMarkers.Count),
+			SLA:   c.DeleteMarkers.SLA.String(),
+		}
+	}
+	var inventoryDiff *inventoryDiffFile
+	if c.InventoryDiff != nil {
+		inventoryDiff = &inventoryDiffFile{
+			Source:      c.InventoryDiff.Source,
+			Destination: c.InventoryDiff.Destination,
+			Frequency:   c.InventoryDiff.Frequency.String(),
+		}
+	}
+	var ignore []ignoreRuleFile
+	for _, rule := range c.Ignore {
+		ignore = append(ignore, rule.file())
+	}
+	var autotune *autotuneFile
+	if c.Autotune != nil {
+		autotune = &autotuneFile{
+			TargetRound:  c.Autotune.TargetRound.String(),
+			MaxErrorRate: c.Autotune.MaxErrorRate,
+			MaxWorkers:   uint(c.Autotune.MaxWorkers),
+		}
+	}
+	var profiling *profilingFile
+	if c.Profiling.SlowRound != 0 {
+		profiling = &profilingFile{
+			SlowRound: c.Profiling.SlowRound.String(),
+			Dir:       c.Profiling.Dir,
+			UploadURL: c.Profiling.UploadURL,
+		}
+	}
+	var lifecycle *lifecycleConfig
+	if c.Lifecycle.Fetch || len(c.Lifecycle.Rules) != 0 {
+		lifecycle = &c.Lifecycle
+	}
+	var claims *claimsFile
+	if c.Claims != nil {
+		claims = c.Claims.file()
+	}
+	var maxUploadAge string
+	if c.InFlightUploads {
+		maxUploadAge = c.MaxUploadAge.String()
+	}
+	var events *eventsFile
+	if c.Events != nil {
+		events = c.Events.file()
+	}
+	var breaker *breakerFile
+	if c.CircuitBreaker != nil {
+		breaker = c.CircuitBreaker.file()
+	}
+	var admin *adminConfig
+	if c.Admin.addr() != DefaultAdminListen || c.Admin.authenticates() || c.Admin.TLS != nil {
+		admin = &c.Admin
+	}
+	return json.MarshalIndent(configFile{
+		AuditName:             c.AuditName,
+		Labels:                c.Labels,
+		RandomSeed:            c.RandomSeed,
+		CheckCount:            uint(c.CheckCount),
+		CheckYoungest:         c.CheckYoungest.String(),
+		CheckOldest:           c.CheckOldest.String(),
+		CheckFrequency:        c.CheckFrequency.String(),
+		SampleWorkers:         uint(c.SampleWorkers),
+		VerifyWorkers:         uint(c.VerifyWorkers),
+		KeyTimeout:            c.KeyTimeout.String(),
+		WarmUpKeys:            uint(c.WarmUpKeys),
+		Checks:                c.Checks,
+		LastModifiedTolerance: lastModifiedTolerance,
+		Hook:                  hook,
+		Sampler:               c.Sampler,
+		SamplerOptions:        c.SamplerOptions,
+		Retention:             ret,
+		Constraint:            c.Constraint,
+		MinSize:               minSize,
+		MaxSize:               maxSize,
+		Owners:                c.Owners,
+		IgnoreMismatch:        c.IgnoreMismatch,
+		Ignore:                ignore,
+		KeyNormalization:      c.KeyNormalization,
+		ContentHash:           c.ContentHash,
+		SampleVersions:        c.SampleVersions,
+		Bidirectional:         c.Bidirectional,
+		Reconcile:             c.Reconcile,
+		InFlightUploads:       c.InFlightUploads,
+		MaxUploadAge:          maxUploadAge,
+		DeleteMarkers:         deleteMarkers,
+		InventoryDiff:         inventoryDiff,
+		Flapping:              c.Flapping,
+		Export:                c.Export,
+		Risk:                  c.Risk,
+		Claims:                claims,
+		Events:                events,
+		Queue:                 c.Queue,
+		Maintenance:           c.Maintenance,
+		SkipPlaceholders:      c.SkipPlaceholders,
+		Partition:             c.Partition,
+		Autotune:              autotune,
+		Degradation:           c.Degradation,
+		CircuitBreaker:        breaker,
+		Lifecycle:             lifecycle,
+		Admin:                 admin,
+		Namespaces:            c.Namespaces,
+		HotPrefixes:           c.HotPrefixes,
+		Presets:               c.Presets,
+		Profiling:             profiling,
+		StateDir:              c.StateDir,
+		Source:                c.Source,
+		Destination:           c.Destination,
 	}, "", "   ")
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// CredentialsRefreshWindow is how long before they expire the credentials
+// of a role are refreshed, so that no request is signed with credentials
+// expiring on their way.
+const CredentialsRefreshWindow = 5 * time.Minute
+
+// CredentialsRetryInterval is how long a failed lookup of the credentials
+// is remembered, requests failing with its error meanwhile rather than each
+// looking them up again, e.g. from an unreachable metadata service.
+const CredentialsRetryInterval = 30 * time.Second
+
+// DefaultSessionName names the sessions of the roles jag assumes, if the
+// config doesn't say otherwise.
+const DefaultSessionName = "jag"
+
+// RoleSessionDuration is how long the credentials of an assumed role last
+// before they're refreshed.
+const RoleSessionDuration = time.Hour
+
+var (
+	// roleARN matches the ARNs of IAM roles, in any partition.
+	roleARN = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/.+$`)
+	// sessionName matches the names STS accepts for the sessions of roles.
+	sessionName = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+)
+
+// awsSDKConfig returns the config of the clients of the AWS SDK accessing the
+// bucket of a, or the sources of its events, whose requests go through
+// client. Requests are signed with the access_key and secret_key of a if set,
+// with the credentials the AWS SDKs find otherwise: those of the environment,
+// of the profiles of the shared config and credentials files, of web
+// identities, and of the roles of ECS tasks, EKS pods and EC2 instances. With
+// the role_arn of a, they're those of the role, assumed with the credentials
+// found otherwise. Failed requests aren't retried by the SDK: jag retries
+// them itself, see isRetryable.
+func awsSDKConfig(a awsConfig, client *http.Client) (aws.Config, error) {
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(a.region().signingName()),
+		awsconfig.WithHTTPClient(client),
+		awsconfig.WithRetryer(func() aws.Retryer { return aws.NopRetryer{} }),
+	}
+	if a.AccessKey != "" || a.SecretKey != "" {
+		creds := credentials.NewStaticCredentialsProvider(a.AccessKey, a.SecretKey, "")
+		opts = append(opts, awsconfig.WithCredentialsProvider(aws.NewCredentialsCache(creds)))
+	}
+	if a.FIPS {
+		opts = append(opts, awsconfig.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if a.DualStack {
+		opts = append(opts, awsconfig.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("can't load AWS config of bucket %q: %w", a.Bucket, err)
+	}
+	if a.RoleARN != "" {
+		role := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), a.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = a.SessionName
+			if o.RoleSessionName == "" {
+				o.RoleSessionName = DefaultSessionName
+			}
+			if a.ExternalID != "" {
+				o.ExternalID = aws.String(a.ExternalID)
+			}
+			o.Duration = RoleSessionDuration
+		})
+		cfg.Credentials = aws.NewCredentialsCache(role, func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = CredentialsRefreshWindow
+		})
+	}
+	cfg.Credentials = &retryCredentials{provider: cfg.Credentials}
+	return cfg, nil
+}
+
+// retryCredentials remembers why the credentials of its provider couldn't be
+// retrieved for CredentialsRetryInterval, failing requests with the error
+// meanwhile.
+type retryCredentials struct {
+	provider aws.CredentialsProvider
+
+	mu      sync.Mutex
+	err     error
+	retryAt time.Time
+}
+
+func (c *retryCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	c.mu.Lock()
+	err, retryAt := c.err, c.retryAt
+	c.mu.Unlock()
+	if err != nil && time.Now().Before(retryAt) {
+		return aws.Credentials{}, err
+	}
+	creds, err := c.provider.Retrieve(ctx)
+	if ctx.Err() != nil {
+		// the request was canceled, not the lookup failed
+		return creds, err
+	}
+	c.mu.Lock()
+	c.err, c.retryAt = err, time.Now().Add(CredentialsRetryInterval)
+	c.mu.Unlock()
+	return creds, err
+}
+
+// validateRole checks the role a bucket is accessed with, if any.
+func validateRole(a awsConfig) error {
+	switch {
+	case a.RoleARN == "" && (a.ExternalID != "" || a.SessionName != ""):
+		return fmt.Errorf("external_id and session_name require role_arn")
+	case a.RoleARN == "":
+		return nil
+	case a.Swift != nil || a.SFTP != nil || a.B2 != nil:
+		return fmt.Errorf("role_arn is only for buckets on S3")
+	case !roleARN.MatchString(a.RoleARN):
+		return fmt.Errorf("role_arn %q isn't the ARN of an IAM role", a.RoleARN)
+	case a.SessionName != "" && !sessionName.MatchString(a.SessionName):
+		return fmt.Errorf("session_name %q must be 2 to 64 letters, digits or any of +=,.@_-", a.SessionName)
+	}
+	return nil
+}
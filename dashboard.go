@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/codegangsta/cli"
+	"os"
+	"strings"
+)
+
+// DashboardDatasource is the datasource of the panels of dashboards unless
+// another is given: an input that Grafana asks for on import.
+const DashboardDatasource = "${DS_PROMETHEUS}"
+
+// dashboardPanel is a time series panel of a dashboard, graphing the
+// results of PromQL queries.
+type dashboardPanel struct {
+	title string
+	unit  string
+	// queries are PromQL queries by legend.
+	queries [][2]string
+}
+
+// dashboardPanels are the panels of the dashboard of the metrics of jag, see
+// metrics, 2 per row. Series are selected by the audit variable.
+var dashboardPanels = []dashboardPanel{
+	{"Mismatch rate", "percentunit", [][2]string{
+		{"{{audit}}", `sum by (audit) (rate(jag_keys_verified_total{outcome="mismatch",audit=~"$audit"}[$__rate_interval])) / sum by (audit) (rate(jag_keys_verified_total{audit=~"$audit"}[$__rate_interval]))`},
+	}},
+	{"Keys verified by outcome", "ops", [][2]string{
+		{"{{outcome}}", `sum by (outcome) (rate(jag_keys_verified_total{audit=~"$audit"}[$__rate_interval]))`},
+	}},
+	{"Replication lag", "s", [][2]string{
+		{"{{audit}}", `jag_replication_lag_seconds{audit=~"$audit"}`},
+	}},
+	{"Keys at risk", "short", [][2]string{
+		{"at risk {{audit}}", `jag_keys_at_risk{audit=~"$audit"}`},
+		{"writes per hour {{audit}}", `jag_writes_per_hour{audit=~"$audit"}`},
+	}},
+	{"Daily coverage of the source", "percentunit", [][2]string{
+		{"{{audit}}", `sum by (audit) (increase(jag_keys_verified_total{audit=~"$audit"}[1d])) / max by (audit) (jag_model_keys{audit=~"$audit"})`},
+	}},
+	{"Rounds", "short", [][2]string{
+		{"completed {{audit}}", `sum by (audit) (increase(jag_rounds_total{audit=~"$audit"}[1h]))`},
+		{"failed {{audit}}", `sum by (audit) (increase(jag_round_failures_total{audit=~"$audit"}[1h]))`},
+	}},
+	{"Round duration", "s", [][2]string{
+		{"{{audit}}", `jag_round_duration_seconds{audit=~"$audit"}`},
+	}},
+	{"Time since last round", "s", [][2]string{
+		{"{{audit}}", `time() - jag_last_round_timestamp_seconds{audit=~"$audit"}`},
+	}},
+	{"Namespaces alerting", "short", [][2]string{
+		{"{{namespace}}", `jag_namespace_alert{audit=~"$audit"}`},
+	}},
+	{"Risk score and maintenance", "short", [][2]string{
+		{"risk {{audit}}", `jag_risk_score{audit=~"$audit"}`},
+		{"maintenance {{audit}}", `jag_maintenance{audit=~"$audit"}`},
+	}},
+	{"Success rate of endpoints", "percentunit", [][2]string{
+		{"{{side}} {{endpoint}}", `jag_endpoint_success_rate{audit=~"$audit"}`},
+	}},
+	{"Latency of endpoints", "s", [][2]string{
+		{"{{side}} {{endpoint}}", `jag_endpoint_latency_seconds{audit=~"$audit"}`},
+	}},
+	{"Degradation level", "short", [][2]string{
+		{"{{audit}}", `jag_degradation_level{audit=~"$audit"}`},
+	}},
+}
+
+// prometheusDashboard returns the Grafana dashboard of the metrics of jag,
+// with panels querying a Prometheus datasource.
+func prometheusDashboard(datasource string) map[string]interface{} {
+	ds := map[string]interface{}{"type": "prometheus", "uid": datasource}
+	panels := make([]interface{}, len(dashboardPanels))
+	for i, p := range dashboardPanels {
+		targets := make([]interface{}, len(p.queries))
+		for j, q := range p.queries {
+			targets[j] = map[string]interface{}{
+				"datasource":   ds,
+				"expr":         q[1],
+				"legendFormat": q[0],
+				"refId":        string(rune('A' + j)),
+			}
+		}
+		panels[i] = map[string]interface{}{
+			"id":         i + 1,
+			"type":       "timeseries",
+			"title":      p.title,
+			"datasource": ds,
+			"gridPos":    map[string]int{"h": 8, "w": 12, "x": i % 2 * 12, "y": i / 2 * 8},
+			"fieldConfig": map[string]interface{}{
+				"defaults":  map[string]interface{}{"unit": p.unit},
+				"overrides": []interface{}{},
+			},
+			"targets": targets,
+		}
+	}
+	dashboard := map[string]interface{}{
+		"uid":           "jag",
+		"title":         "jag",
+		"tags":          []string{"jag"},
+		"timezone":      "utc",
+		"schemaVersion": 39,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []interface{}{map[string]interface{}{
+				"name":       "audit",
+				"label":      "Audit",
+				"type":       "query",
+				"datasource": ds,
+				"query":      "label_values(jag_rounds_total, audit)",
+				"refresh":    2,
+				"includeAll": true,
+				"multi":      true,
+				// audits without a name have no audit label
+				"allValue": ".*",
+				"current":  map[string]interface{}{"text": "All", "value": "$__all"},
+			}},
+		},
+		"panels": panels,
+	}
+	if datasource == DashboardDatasource {
+		dashboard["__inputs"] = []interface{}{map[string]string{
+			"name":     "DS_PROMETHEUS",
+			"label":    "Prometheus",
+			"type":     "datasource",
+			"pluginId": "prometheus",
+		}}
+	}
+	return dashboard
+}
+
+func dashboardsCommand() cli.Command {
+	prometheusFlag := cli.BoolFlag{
+		Name:  "prometheus",
+		Usage: "print the dashboard of the metrics scraped by Prometheus",
+	}
+	datasourceFlag := cli.StringFlag{
+		Name:  "datasource",
+		Usage: "UID of the Prometheus datasource of the panels, by default one chosen on import",
+		Value: DashboardDatasource,
+	}
+
+	doDashboards := func(ctx *cli.Context) {
+		if !ctx.Bool(prometheusFlag.Name) {
+			fail(ctx, "error: only dashboards of Prometheus metrics are supported, with --%s", prometheusFlag.Name)
+		}
+		data, err := json.MarshalIndent(prometheusDashboard(mustString(ctx, datasourceFlag)), "", "   ")
+		if err != nil {
+			fail(ctx, "bug: can't create dashboard JSON: %v", err)
+		}
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			fail(ctx, "error: can't write dashboard to stdout: %v", err)
+		}
+	}
+
+	return cli.Command{
+		Name:  "dashboards",
+		Usage: "Prints a Grafana dashboard of the metrics of audits.",
+		Description: strings.TrimSpace(`
+Prints a Grafana dashboard graphing the metrics that audits serve on
+http://127.0.0.1:6060/metrics, for Prometheus to scrape: mismatch rates,
+replication lag, keys at risk, coverage of the source, rounds and namespaces
+alerting. Import it in Grafana, choosing the Prometheus datasource, or give
+the UID of the datasource with --datasource.`),
+		Flags:  []cli.Flag{prometheusFlag, datasourceFlag},
+		Action: doDashboards,
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+// DefaultDegradationErrorRate is the share of verifications that can fail
+// because the destination is overwhelmed or down before the audit degrades,
+// if the config doesn't say otherwise.
+const DefaultDegradationErrorRate = 0.2
+
+// degradationConfig degrades the audit while the destination fails: after
+// Rounds rounds in a row whose verifications failed too often, the checks
+// reading the content of keys are left out, then all but the existence
+// check, and finally keys are only recorded as a backlog, a few probes
+// excepted. Once the destination recovers for RecoverRounds rounds in a row,
+// the audit climbs back one level at a time, up to all the checks of the
+// config.
+type degradationConfig struct {
+	// MaxErrorRate is the share of verifications that can fail because
+	// the destination is overwhelmed or unavailable.
+	MaxErrorRate float64 `json:"max_error_rate,omitempty"`
+	// Rounds is how many rounds in a row must fail too often before the
+	// audit degrades a level.
+	Rounds int `json:"rounds,omitempty"`
+	// RecoverRounds is how many rounds in a row must succeed before the
+	// audit recovers a level.
+	RecoverRounds int `json:"recover_rounds,omitempty"`
+	// Probes is how many keys sampled are still verified, with the
+	// existence check, by rounds recording the backlog only, to tell when
+	// the destination recovers.
+	Probes int `json:"probes,omitempty"`
+}
+
+func loadDegradation(d *degradationConfig) error {
+	if d.MaxErrorRate < 0 || d.MaxErrorRate >= 1 {
+		return fmt.Errorf("max_error_rate must be between 0 and 1")
+	}
+	if d.Rounds < 0 || d.RecoverRounds < 0 || d.Probes < 0 {
+		return fmt.Errorf("rounds, recover_rounds and probes can't be negative")
+	}
+	if d.MaxErrorRate == 0 {
+		d.MaxErrorRate = DefaultDegradationErrorRate
+	}
+	if d.Rounds == 0 {
+		d.Rounds = 2
+	}
+	if d.RecoverRounds == 0 {
+		d.RecoverRounds = 3
+	}
+	if d.Probes == 0 {
+		d.Probes = 10
+	}
+	return nil
+}
+
+// degradationLevel is how much of the checks of the config rounds perform.
+type degradationLevel int
+
+const (
+	// levelFull performs all the checks of the config.
+	levelFull degradationLevel = iota
+	// levelMetadata leaves out the checks reading the content of keys.
+	levelMetadata
+	// levelExistence only verifies that keys exist in the destination.
+	levelExistence
+	// levelBacklog records the keys sampled as follow-ups instead of
+	// verifying them, but for a few probes, and doesn't verify the queue.
+	levelBacklog
+)
+
+var degradationLevels = []string{"full", "metadata", "existence", "backlog"}
+
+func (l degradationLevel) String() string { return degradationLevels[l] }
+
+func parseDegradationLevel(s string) (degradationLevel, bool) {
+	for i, name := range degradationLevels {
+		if name == s {
+			return degradationLevel(i), true
+		}
+	}
+	return levelFull, false
+}
+
+// metadataChecks are the checks that don't read the content of keys, and
+// are still performed by rounds degraded to metadata.
+var metadataChecks = map[string]bool{
+	"existence":     true,
+	"etag":          true,
+	"size":          true,
+	"metadata":      true,
+	"versions":      true,
+	"tags":          true,
+	"retention":     true,
+	"last_modified": true,
+}
+
+// degradedChecks are the checks rounds perform at a level, at least the
+// existence of the keys.
+func degradedChecks(checks []Check, level degradationLevel) []Check {
+	if level == levelFull {
+		return checks
+	}
+	var degraded []Check
+	for _, check := range checks {
+		if level == levelMetadata && metadataChecks[check.Name()] {
+			degraded = append(degraded, check)
+		}
+	}
+	if len(degraded) == 0 {
+		degraded = []Check{ExistenceCheck{}}
+	}
+	return degraded
+}
+
+// degradationReport is the level a round was degraded to.
+type degradationReport struct {
+	Level string `json:"level"`
+	// Since is when the audit reached the level.
+	Since time.Time `json:"since"`
+	// ErrorRate is the share of the verifications of the round that failed
+	// because the destination is overwhelmed or unavailable.
+	ErrorRate float64 `json:"error_rate"`
+	// Backlogged is how many keys sampled were recorded as follow-ups
+	// instead of being verified.
+	Backlogged int `json:"backlogged,omitempty"`
+	// Next is the level of the next round, if it changes.
+	Next string `json:"next,omitempty"`
+}
+
+// degradationState is the level of the audit, in the checkpoint.
+type degradationState struct {
+	Level string    `json:"level"`
+	Since time.Time `json:"since"`
+}
+
+// degradationLadder moves the audit between levels given how its rounds
+// went.
+type degradationLadder struct {
+	cfg   degradationConfig
+	level degradationLevel
+	since time.Time
+	// failing and recovering count the rounds in a row that failed too
+	// often, and that didn't.
+	failing    int
+	recovering int
+}
+
+func newDegradationLadder(cfg degradationConfig, now time.Time) *degradationLadder {
+	return &degradationLadder{cfg: cfg, since: now}
+}
+
+// restore resumes the level the checkpoint recorded.
+func (d *degradationLadder) restore(st *degradationState) {
+	if st == nil {
+		return
+	}
+	level, ok := parseDegradationLevel(st.Level)
+	if !ok {
+		log.WithField("level", st.Level).Warn("ignoring unknown degradation level in checkpoint")
+		return
+	}
+	d.level, d.since = level, st.Since
+	if level != levelFull {
+		log.WithFields(log.Fields{
+			"level": level,
+			"since": st.Since,
+		}).Warn("audit resumes degraded")
+	}
+}
+
+func (d *degradationLadder) state() *degradationState {
+	return &degradationState{Level: d.level.String(), Since: d.since}
+}
+
+// observe moves the ladder given the share of the verifications of a round
+// that failed, returning whether the level changed.
+func (d *degradationLadder) observe(errorRate float64, now time.Time) bool {
+	if errorRate > d.cfg.MaxErrorRate {
+		d.failing++
+		d.recovering = 0
+	} else {
+		d.recovering++
+		d.failing = 0
+	}
+	switch {
+	case d.failing >= d.cfg.Rounds && d.level < levelBacklog:
+		d.level++
+	case d.recovering >= d.cfg.RecoverRounds && d.level > levelFull:
+		d.level--
+	default:
+		return false
+	}
+	d.failing, d.recovering, d.since = 0, 0, now
+	return true
+}
+
+// degradeTo has the verifier, and those auditing on its behalf, perform the
+// checks of a level.
+func (v *verifier) degradeTo(level degradationLevel) {
+	v.level = level
+	v.checks = degradedChecks(v.allChecks, level)
+	if v.reverse != nil {
+		v.reverse.degradeTo(level)
+	}
+	for _, na := range v.namespaces {
+		na.v.degradeTo(level)
+	}
+	if v.hot != nil {
+		v.hot.v.degradeTo(level)
+	}
+}
+
+// probeSamples passes the first probes of the keys sampled on to be
+// verified, and backlogs the others, as rounds recording the backlog only
+// do. The channel returned is closed once keys is, and done once the
+// backlog is complete.
+func (v *verifier) probeSamples(keys <-chan object, backlog *[]object) (probes <-chan object, done <-chan struct{}) {
+	out := make(chan object)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		defer close(out)
+		n := 0
+		for k := range keys {
+			if n >= v.cfg.Degradation.Probes {
+				*backlog = append(*backlog, k)
+				continue
+			}
+			n++
+			select {
+			case out <- k:
+			case <-v.abort:
+				*backlog = append(*backlog, k)
+			}
+		}
+	}()
+	return out, finished
+}
+
+// recordBacklog records the keys backlogged by a round as follow-ups, to be
+// verified once the destination recovers.
+func (v *verifier) recordBacklog(report *RoundReport, backlog []object) {
+	dropped := 0
+	for _, k := range backlog {
+		if len(v.followUps) >= MaxQueuedKeys {
+			dropped++
+			continue
+		}
+		v.followUps = append(v.followUps, followUp{Key: k})
+	}
+	report.Degradation.Backlogged += len(backlog) - dropped
+	if dropped > 0 {
+		log.WithField("dropped", dropped).Warn("keys sampled were dropped from the backlog, too many are backlogged")
+	}
+}
+
+// degrade moves the audit between levels given how a round went, reporting
+// the level of the round.
+func (v *verifier) degrade(report *RoundReport) {
+	pushbacks := 0
+	for _, res := range report.Results {
+		// the source pushing back doesn't tell how the destination is doing
+		if isPushback(res) && res.ErrorSide == "destination" {
+			pushbacks++
+		}
+	}
+	if report.Degradation == nil {
+		report.Degradation = &degradationReport{}
+	}
+	d := report.Degradation
+	d.Level, d.Since = v.ladder.level.String(), v.ladder.since
+	if len(report.Results) == 0 {
+		// nothing tells how the destination is doing
+		return
+	}
+	d.ErrorRate = float64(pushbacks) / float64(len(report.Results))
+	from := v.ladder.level
+	if !v.ladder.observe(d.ErrorRate, time.Now().UTC()) {
+		return
+	}
+	d.Next = v.ladder.level.String()
+	fields := log.Fields{
+		"from":       from,
+		"to":         v.ladder.level,
+		"error_rate": d.ErrorRate,
+	}
+	if v.ladder.level > from {
+		log.WithFields(fields).Warn("degrading audit, destination keeps failing")
+	} else {
+		log.WithFields(fields).Info("recovering audit, destination stopped failing")
+	}
+}
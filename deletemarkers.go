@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"math/rand"
+	"time"
+)
+
+// DefaultDeleteMarkerSLA is how long a deletion can take to be propagated to
+// the destination, if the config doesn't say otherwise.
+const DefaultDeleteMarkerSLA = time.Hour
+
+// deleteMarkerCheck is the name under which the audit of deletions is
+// reported.
+const deleteMarkerCheck = "delete_marker"
+
+// auditDeleteMarkers samples keys that were deleted from the source for
+// longer than the SLA, and verifies that they were deleted from the
+// destination as well.
+func (v *verifier) auditDeleteMarkers(r *rand.Rand, now time.Time, report *RoundReport) {
+	count := v.cfg.DeleteMarkers.Count
+	log.Infof("randomly sampling %d deleted keys from bucket %q", count, v.src.Name())
+	seen := make(map[string]bool, count)
+	for attempt := 0; len(seen) < count && attempt < count*RetryLimit; attempt++ {
+		select {
+		case <-v.abort:
+			log.Warn("verifier: aborting audit of delete markers")
+			return
+		default:
+		}
+		marker, err := v.sampleDeleteMarker(r, now)
+		if err != nil {
+			log.WithField("error", err).Error("couldn't sample delete markers from source bucket")
+			return
+		}
+		if marker == nil || seen[marker.Key] {
+			continue
+		}
+		if p := v.cfg.Partition; p != nil && !p.contains(marker.Key) {
+			continue
+		}
+		seen[marker.Key] = true
+		v.addResult(report, v.verifyDeletion(*marker))
+	}
+	if len(seen) < count {
+		log.WithFields(log.Fields{
+			"want": count,
+			"got":  len(seen),
+		}).Warn("couldn't find enough deleted keys in source bucket")
+	}
+}
+
+// sampleDeleteMarker walks down a random path of the source bucket and
+// picks a random delete marker older than the SLA along the way. It returns
+// nil if the path had none.
+func (v *verifier) sampleDeleteMarker(r *rand.Rand, now time.Time) (*deleteMarker, error) {
+	deadline := now.Add(-v.cfg.DeleteMarkers.SLA)
+	prefix := ""
+	for {
+		resp, err := v.src.ListVersions(context.Background(), prefix, "/", "", "", MaxList)
+		if err != nil {
+			return nil, err
+		}
+		var eligible []deleteMarker
+		for _, dm := range resp.DeleteMarkers {
+			deleted, err := time.Parse(time.RFC3339Nano, dm.LastModified)
+			if err == nil && dm.IsLatest && deleted.Before(deadline) {
+				eligible = append(eligible, dm)
+			}
+		}
+		// stop here with probability proportional to the markers found here
+		stop := len(resp.CommonPrefixes) == 0 ||
+			r.Intn(len(eligible)+len(resp.CommonPrefixes)) < len(eligible)
+		if stop {
+			if len(eligible) == 0 {
+				return nil, nil
+			}
+			return &eligible[r.Intn(len(eligible))], nil
+		}
+		prefix = resp.CommonPrefixes[r.Intn(len(resp.CommonPrefixes))]
+	}
+}
+
+// verifyDeletion verifies that a key deleted from the source doesn't exist in
+// the destination.
+func (v *verifier) verifyDeletion(marker deleteMarker) Result {
+	got, err := v.findDestinationKey(context.Background(), marker.Key)
+	if err != nil {
+		return inconclusiveResult(marker.Key, err)
+	}
+	res := Result{
+		Key:     marker.Key,
+		Version: marker.VersionId,
+		Outcome: outcomeMatch,
+		Check:   deleteMarkerCheck,
+		want:    object{Key: marker.Key, LastModified: marker.LastModified, VersionID: marker.VersionId},
+	}
+	if got == nil {
+		return res
+	}
+	res.Outcome = outcomeMismatch
+	res.Details = log.Fields{
+		"want":       "deleted",
+		"got.etag":   got.ETag,
+		"deleted_at": marker.LastModified,
+		"sla":        v.cfg.DeleteMarkers.SLA,
+	}
+	log.WithFields(res.Details).WithField("key", marker.Key).Error("mismatch at key, deletion wasn't propagated")
+	return res
+}
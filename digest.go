@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DefaultContentHash is the algorithm the content check digests keys with
+// when the config doesn't specify one.
+const DefaultContentHash = "md5"
+
+// contentHashes are the algorithms the content check can digest keys with.
+// Picking the algorithm of the checksums a backend records, see
+// checksummedBucket, spares downloading its keys: S3 records the SHA-1, the
+// SHA-256 or the CRC32C of the keys uploaded with one, B2 the SHA-1, and
+// Swift the MD5 of the keys not stored as segments.
+var contentHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"xxhash": func() hash.Hash { return xxhash.New() },
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+}
+
+func contentHashNames() string {
+	names := make([]string, 0, len(contentHashes))
+	for name := range contentHashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func loadContentHash(name string) error {
+	if _, ok := contentHashes[name]; !ok {
+		return fmt.Errorf("unknown hash %q, valid hashes are %s", name, contentHashNames())
+	}
+	return nil
+}
+
+// digestKey returns the hex encoded checksum of the content of a key, as
+// recorded by its bucket or by downloading it. The download is interrupted
+// once ctx is canceled.
+func digestKey(ctx context.Context, bkt bucket, o object, algorithm string) (string, error) {
+	if cb, ok := bkt.(checksummedBucket); ok {
+		sum, err := cb.checksumOf(ctx, o, algorithm)
+		if err != nil || sum != "" {
+			return sum, err
+		}
+	}
+	rc, err := bkt.GetReader(ctx, o.Key, o.VersionID)
+	if err != nil {
+		return "", err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = rc.Close() })
+	defer func() {
+		stop()
+		_ = rc.Close()
+	}()
+	h := contentHashes[algorithm]()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
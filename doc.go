@@ -22,9 +22,28 @@ previous snapshop of the bucket's keys.
        makeconfig   Create a sample config file at the specified path.
        audit    Continuously samples keys in two buckets, check that they match.
        model    Computes and prints a model for the given bucket listing.
+       listing  Validates and cleans listings of buckets.
+       sample   Samples random keys from the source bucket, as an audit would.
+       state    Exports or imports the state of an audit, or lists its operator actions.
+       suppress Acknowledges mismatches so they stop being alerted on.
+       mismatches   Lists the open mismatches, or the audit history of a key.
+       ack      Acknowledges or unacknowledges the mismatches of a key.
+       migration-status Reports how far a migration to the destination is, and when it should complete.
+       fixity   Continuously samples keys in the source bucket, check that they didn't change.
+       plan-repair  Plans batches of copies repairing the mismatches of a report: jag plan-repair report.json
+       schema   Prints the JSON schema of the reports of rounds.
+       dashboards   Prints a Grafana dashboard of the metrics of audits.
+       service  Installs, uninstalls or runs the audit as a service.
+       update   Replaces jag by the release of a release endpoint.
+       selftest Verifies that the sampler picks keys uniformly.
        help, h  Shows a list of commands or help for one command
 
     GLOBAL OPTIONS:
+       --debug
+       --debug-requests log the method, URL, status, request IDs and timing of every S3 request
+       --log-levels     levels of subsystems logging apart from the others, e.g. sampler=debug,verifier=warn
+       --max-procs "0"  how many CPUs to use, by default as many as the CPU quota of the container allows
+       --memory-limit   memory to stay under, e.g. 2GiB, by default the memory limit of the container if any
        --version, -v    print the version
        --help, -h       show help
 
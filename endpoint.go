@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// HealthWindow is how many of the last requests to an endpoint its
+	// success rate and latency are computed over.
+	HealthWindow = 100
+	// MinHealthySuccessRate is the success rate under which an endpoint is
+	// unhealthy.
+	MinHealthySuccessRate = 0.9
+)
+
+// wrapEndpoints has the requests to each endpoint of a bucket, a side of the
+// audit configured by a, tracked for the health of the endpoint and sent
+// through a circuit breaker if the config has some. The endpoints of buckets
+// failing over are wrapped each, so that their health is told apart.
+func wrapEndpoints(cfg *config, side string, a awsConfig, bkt bucket) bucket {
+	if fb, ok := bkt.(*failoverBucket); ok {
+		for i, endpoint := range fb.endpoints {
+			fb.endpoints[i] = newEndpointBucket(cfg, side, fb.names[i], endpoint)
+		}
+		return fb
+	}
+	return newEndpointBucket(cfg, side, a.endpointName(), bkt)
+}
+
+// endpointName names the endpoint of a bucket in the status of the audit.
+func (a awsConfig) endpointName() string {
+	switch {
+	case a.Swift != nil:
+		return a.Swift.AuthURL
+	case a.SFTP != nil:
+		return "sftp://" + a.SFTP.Host
+	case a.B2 != nil && a.B2.APIURL != "":
+		return a.B2.APIURL
+	case a.B2 != nil:
+		return "b2"
+	}
+	return a.Region
+}
+
+// endpointBucket sends requests to an endpoint of a bucket, tracking how
+// they go.
+type endpointBucket struct {
+	bkt      bucket
+	side     string
+	endpoint string
+	// labels are those of the metrics of the endpoint.
+	labels string
+	// breaker is nil unless the config has circuit breakers.
+	breaker *circuitBreaker
+
+	mu     sync.Mutex
+	health endpointHealth
+}
+
+func newEndpointBucket(cfg *config, side, endpoint string, bkt bucket) *endpointBucket {
+	b := &endpointBucket{
+		bkt:      bkt,
+		side:     side,
+		endpoint: endpoint,
+		labels:   metricLabels(cfg, "side", side, "endpoint", endpoint),
+	}
+	if cfg.CircuitBreaker != nil {
+		b.breaker = newCircuitBreaker(*cfg.CircuitBreaker, log.Fields{
+			"side":     side,
+			"bucket":   bkt.Name(),
+			"endpoint": endpoint,
+		})
+	}
+	endpoints.mu.Lock()
+	endpoints.all = append(endpoints.all, b)
+	endpoints.mu.Unlock()
+	return b
+}
+
+// endpointHealth is how the requests to an endpoint went, since the audit
+// started and over the last HealthWindow requests.
+type endpointHealth struct {
+	requests int64
+	errors   int64
+
+	window         [HealthWindow]requestSample
+	n, next        int
+	windowFailures int
+	windowLatency  time.Duration
+
+	lastError     error
+	lastErrorAt   time.Time
+	lastSuccessAt time.Time
+}
+
+type requestSample struct {
+	failed  bool
+	latency time.Duration
+}
+
+// record accounts for a request, returning whether it failed. Keys that
+// don't exist are answers of the endpoint like any other, not failures.
+func (h *endpointHealth) record(err error, latency time.Duration, now time.Time) bool {
+	failed := err != nil && !errors.Is(err, ErrKeyMissing)
+	if h.n == HealthWindow {
+		old := h.window[h.next]
+		if old.failed {
+			h.windowFailures--
+		}
+		h.windowLatency -= old.latency
+	} else {
+		h.n++
+	}
+	h.window[h.next] = requestSample{failed: failed, latency: latency}
+	h.next = (h.next + 1) % HealthWindow
+	h.windowLatency += latency
+	h.requests++
+	if failed {
+		h.errors++
+		h.windowFailures++
+		h.lastError, h.lastErrorAt = err, now
+	} else {
+		h.lastSuccessAt = now
+	}
+	return failed
+}
+
+func (h *endpointHealth) successRate() float64 {
+	if h.n == 0 {
+		return 1
+	}
+	return 1 - float64(h.windowFailures)/float64(h.n)
+}
+
+func (h *endpointHealth) meanLatency() time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	return h.windowLatency / time.Duration(h.n)
+}
+
+// try sends a request to the endpoint, unless its breaker is open.
+func (b *endpointBucket) try(req func(bkt bucket) error) error {
+	probe := false
+	if b.breaker != nil {
+		var err error
+		if probe, err = b.breaker.allow(); err != nil {
+			return &endpointError{side: b.side, err: err}
+		}
+	}
+	start := time.Now()
+	err := req(b.bkt)
+	b.observe(err, time.Since(start))
+	if b.breaker != nil {
+		open := 0.0
+		if !b.breaker.record(probe, err) {
+			open = 1
+		}
+		setMetric(metricBreakerOpen, b.labels, open, false)
+	}
+	if err != nil {
+		return &endpointError{side: b.side, err: err}
+	}
+	return nil
+}
+
+// endpointError is an error of a request to an endpoint, telling the side of
+// the audit it failed on.
+type endpointError struct {
+	side string
+	err  error
+}
+
+func (e *endpointError) Error() string { return e.err.Error() }
+func (e *endpointError) Unwrap() error { return e.err }
+
+// errorSide returns the side of the audit an error failed on, or "" if it
+// isn't the error of a request to an endpoint.
+func errorSide(err error) string {
+	var eerr *endpointError
+	if !errors.As(err, &eerr) {
+		return ""
+	}
+	return eerr.side
+}
+
+// observe records how a request went in the health and the metrics of the
+// endpoint.
+func (b *endpointBucket) observe(err error, latency time.Duration) {
+	b.mu.Lock()
+	failed := b.health.record(err, latency, time.Now())
+	rate, mean := b.health.successRate(), b.health.meanLatency()
+	b.mu.Unlock()
+	setMetric(metricEndpointRequests, b.labels, 1, true)
+	if failed {
+		setMetric(metricEndpointErrors, b.labels, 1, true)
+	}
+	setMetric(metricEndpointSuccess, b.labels, rate, false)
+	setMetric(metricEndpointLatency, b.labels, mean.Seconds(), false)
+}
+
+// endpointStatus is the health of an endpoint, served on the status
+// endpoint.
+type endpointStatus struct {
+	Side     string `json:"side"`
+	Bucket   string `json:"bucket"`
+	Endpoint string `json:"endpoint"`
+	// Healthy is set unless the success rate is under
+	// MinHealthySuccessRate, or the breaker isn't closed.
+	Healthy  bool  `json:"healthy"`
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`
+	// SuccessRate and LatencySeconds are over the last HealthWindow
+	// requests.
+	SuccessRate    float64    `json:"success_rate"`
+	LatencySeconds float64    `json:"latency_seconds"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorKind  string     `json:"last_error_kind,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+	LastSuccessAt  *time.Time `json:"last_success_at,omitempty"`
+	// Breaker is nil unless the config has circuit breakers.
+	Breaker *breakerStatus `json:"breaker,omitempty"`
+}
+
+func (b *endpointBucket) status() endpointStatus {
+	b.mu.Lock()
+	h := b.health
+	b.mu.Unlock()
+	st := endpointStatus{
+		Side:           b.side,
+		Bucket:         b.Name(),
+		Endpoint:       b.endpoint,
+		Requests:       h.requests,
+		Errors:         h.errors,
+		SuccessRate:    h.successRate(),
+		LatencySeconds: h.meanLatency().Seconds(),
+	}
+	if h.lastError != nil {
+		at := h.lastErrorAt.UTC()
+		st.LastError, st.LastErrorKind, st.LastErrorAt = h.lastError.Error(), errorKind(h.lastError), &at
+	}
+	if !h.lastSuccessAt.IsZero() {
+		at := h.lastSuccessAt.UTC()
+		st.LastSuccessAt = &at
+	}
+	st.Healthy = st.SuccessRate >= MinHealthySuccessRate
+	if b.breaker != nil {
+		st.Breaker = b.breaker.status()
+		st.Healthy = st.Healthy && st.Breaker.State == breakerClosed
+	}
+	return st
+}
+
+// endpoints are the endpoints of the audit, in the order they were wrapped.
+var endpoints struct {
+	mu  sync.Mutex
+	all []*endpointBucket
+}
+
+// endpointStatuses returns the health of the endpoints of the audit.
+func endpointStatuses() []endpointStatus {
+	endpoints.mu.Lock()
+	all := append([]*endpointBucket(nil), endpoints.all...)
+	endpoints.mu.Unlock()
+	statuses := make([]endpointStatus, len(all))
+	for i, b := range all {
+		statuses[i] = b.status()
+	}
+	return statuses
+}
+
+func (b *endpointBucket) Name() string { return b.bkt.Name() }
+
+func (b *endpointBucket) List(ctx context.Context, prefix, delim, marker string, max int) (resp *listResp, err error) {
+	err = b.try(func(bkt bucket) error {
+		resp, err = bkt.List(ctx, prefix, delim, marker, max)
+		return err
+	})
+	return resp, err
+}
+
+func (b *endpointBucket) ListVersions(ctx context.Context, prefix, delim, keyMarker, versionMarker string, max int) (resp *listVersionsResp, err error) {
+	err = b.try(func(bkt bucket) error {
+		resp, err = bkt.ListVersions(ctx, prefix, delim, keyMarker, versionMarker, max)
+		return err
+	})
+	return resp, err
+}
+
+func (b *endpointBucket) GetReader(ctx context.Context, key, version string) (rc io.ReadCloser, err error) {
+	err = b.try(func(bkt bucket) error {
+		rc, err = bkt.GetReader(ctx, key, version)
+		return err
+	})
+	return rc, err
+}
+
+func (b *endpointBucket) Head(ctx context.Context, key, version string) (header http.Header, err error) {
+	err = b.try(func(bkt bucket) error {
+		header, err = bkt.Head(ctx, key, version)
+		return err
+	})
+	return header, err
+}
+
+func (b *endpointBucket) Tags(ctx context.Context, key, version string) (tags map[string]string, err error) {
+	err = b.try(func(bkt bucket) error {
+		tags, err = bkt.Tags(ctx, key, version)
+		return err
+	})
+	return tags, err
+}
+
+func (b *endpointBucket) Retention(ctx context.Context, key, version string) (ret *retention, err error) {
+	err = b.try(func(bkt bucket) error {
+		ret, err = bkt.Retention(ctx, key, version)
+		return err
+	})
+	return ret, err
+}
+
+func (b *endpointBucket) Lifecycle(ctx context.Context) (rules []lifecycleRule, err error) {
+	err = b.try(func(bkt bucket) error {
+		rules, err = bkt.Lifecycle(ctx)
+		return err
+	})
+	return rules, err
+}
+
+func (b *endpointBucket) SignedURL(key, version string, expires time.Time) string {
+	return b.bkt.SignedURL(key, version, expires)
+}
+
+func (b *endpointBucket) traceKey(ctx context.Context, key, version string) (ids requestIDs, err error) {
+	tracer, ok := b.bkt.(requestTracer)
+	if !ok {
+		return requestIDs{}, nil
+	}
+	err = b.try(func(bucket) error {
+		ids, err = tracer.traceKey(ctx, key, version)
+		return err
+	})
+	return ids, err
+}
+
+func (b *endpointBucket) stats() (stats *bucketStats, err error) {
+	sb, ok := b.bkt.(statsBucket)
+	if !ok {
+		return nil, fmt.Errorf("bucket %q keeps no statistics", b.Name())
+	}
+	err = b.try(func(bucket) error {
+		stats, err = sb.stats()
+		return err
+	})
+	return stats, err
+}
+
+// resolveSegments resolves the segments of keys of buckets storing them as
+// segments, and leaves the keys of other buckets as is.
+func (b *endpointBucket) resolveSegments(ctx context.Context, o object) (resolved object, segmented bool, err error) {
+	sb, ok := b.bkt.(segmentedBucket)
+	if !ok {
+		return o, false, nil
+	}
+	err = b.try(func(bucket) error {
+		resolved, segmented, err = sb.resolveSegments(ctx, o)
+		return err
+	})
+	return resolved, segmented, err
+}
+
+// checksumOf returns the checksum a bucket recorded, or an empty checksum if
+// the bucket doesn't record them, see checksummedBucket.
+func (b *endpointBucket) checksumOf(ctx context.Context, o object, algorithm string) (sum string, err error) {
+	cb, ok := b.bkt.(checksummedBucket)
+	if !ok {
+		return "", nil
+	}
+	err = b.try(func(bucket) error {
+		sum, err = cb.checksumOf(ctx, o, algorithm)
+		return err
+	})
+	return sum, err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/smithy-go"
+	"net"
+	"net/http"
+)
+
+// Errors returned by jag are wrapping one of these, so that callers can
+// branch on the kind of failure with errors.Is.
+var (
+	// ErrConfigInvalid means the config can't be used.
+	ErrConfigInvalid = errors.New("invalid config")
+	// ErrModelMismatch means the model was built for another bucket.
+	ErrModelMismatch = errors.New("model doesn't describe this bucket")
+	// ErrModelStale means the model doesn't predict the shape of the bucket
+	// anymore, so no key could be sampled with it.
+	ErrModelStale = errors.New("model is stale")
+	// ErrThrottled means S3 asked us to slow down.
+	ErrThrottled = errors.New("throttled by S3")
+	// ErrKeyMissing means a key or a bucket doesn't exist.
+	ErrKeyMissing = errors.New("no such key")
+	// ErrAccessDenied means the credentials can't access a bucket.
+	ErrAccessDenied = errors.New("access denied")
+	// ErrUnavailable means S3 failed to serve a request.
+	ErrUnavailable = errors.New("S3 unavailable")
+	// ErrTimeout means an operation didn't complete within its deadline.
+	ErrTimeout = errors.New("timed out")
+)
+
+// errorKinds name the kinds of errors, in the order they're matched.
+var errorKinds = []struct {
+	err  error
+	name string
+}{
+	{ErrConfigInvalid, "config_invalid"},
+	{ErrModelMismatch, "model_mismatch"},
+	{ErrModelStale, "model_stale"},
+	{ErrThrottled, "throttled"},
+	{ErrKeyMissing, "key_missing"},
+	{ErrAccessDenied, "access_denied"},
+	{ErrUnavailable, "unavailable"},
+	{ErrTimeout, "timeout"},
+}
+
+// errorKind returns a short name for the kind of error, suitable to classify
+// failures in logs and reports.
+func errorKind(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.err) {
+			return kind.name
+		}
+	}
+	return "unknown"
+}
+
+// configErrorf returns an error wrapping ErrConfigInvalid.
+func configErrorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrConfigInvalid, fmt.Sprintf(format, args...))
+}
+
+// s3Error wraps an error returned by the client of S3, or of another AWS
+// service, into the kind of error it represents, if it's a known one: the
+// error of a response, or of a request that got none. The original error
+// stays in the chain.
+func s3Error(err error) error {
+	status := httpStatus(err)
+	if status == 0 {
+		return transportError(err)
+	}
+	switch code := errorCode(err); {
+	case throttlingCodes[code] || status == http.StatusServiceUnavailable || status == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %w", ErrThrottled, err)
+	case status == http.StatusNotFound:
+		return fmt.Errorf("%w: %w", ErrKeyMissing, err)
+	case status == http.StatusForbidden:
+		return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+	case status >= 500:
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
+
+// throttlingCodes are the codes of the errors AWS services slow clients down
+// with.
+var throttlingCodes = map[string]bool{
+	"SlowDown":                               true,
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"RequestThrottled":                       true,
+	"ProvisionedThroughputExceededException": true,
+}
+
+// transportError wraps the error of a request that got no response into
+// ErrTimeout if it timed out, or ErrUnavailable if it couldn't be sent or
+// its response couldn't be read.
+func transportError(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	case !errors.As(err, &netErr):
+		return err
+	case netErr.Timeout():
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return fmt.Errorf("%w: %w", ErrUnavailable, err)
+}
+
+// httpStatus returns the status of the response an AWS service failed a
+// request with, or 0 if the error isn't one of a response.
+func httpStatus(err error) int {
+	var respErr interface{ HTTPStatusCode() int }
+	if !errors.As(err, &respErr) {
+		return 0
+	}
+	return respErr.HTTPStatusCode()
+}
+
+// errorCode returns the code of the error an AWS service failed a request
+// with, such as NoSuchKey, or "" if it has none.
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return ""
+	}
+	return apiErr.ErrorCode()
+}
+
+// isRetryable tells if a request that failed with this error is worth
+// retrying.
+func isRetryable(err error) bool {
+	return errors.Is(err, ErrThrottled) || errors.Is(err, ErrUnavailable)
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultEventsDelay is how long after a key is written according to an
+// event it's verified, leaving syncers time to copy it.
+const DefaultEventsDelay = 15 * time.Minute
+
+// EventsRetryDelay is how long consuming events waits once it failed before
+// trying again.
+const EventsRetryDelay = 10 * time.Second
+
+// kinesisPollInterval is how often the shards of a stream are read, under
+// the 5 reads a second a shard allows.
+const kinesisPollInterval = time.Second
+
+// eventsClient is the client of the services events are consumed from,
+// whose requests wait for messages up to 20s.
+var eventsClient = &http.Client{Timeout: time.Minute}
+
+// eventsConfig verifies a fraction of the keys written to the source,
+// according to its S3 event notifications, a delay after they were written.
+// Notifications are consumed from one of:
+//
+//   - an SQS queue, to which the bucket, or an SNS topic it notifies,
+//     sends them;
+//   - a Kinesis stream;
+//   - a Kafka topic, through a Kafka REST proxy.
+//
+// Messages are S3 event notifications, possibly wrapped by SNS, or
+// EventBridge events of created objects. SQS and Kinesis are reached in the
+// region of the source, with its credentials.
+type eventsConfig struct {
+	// SQS is the URL of the queue.
+	SQS string
+	// Kinesis is the name of the stream.
+	Kinesis string
+	Kafka   *kafkaConfig
+	// Fraction is the fraction of the keys written that are verified,
+	// those under none of the prefixes.
+	Fraction float64
+	// MaxPerMinute caps how many keys written under none of the prefixes
+	// are queued a minute, 0 if unlimited, so that a backfill writing
+	// millions of keys doesn't verify millions of keys.
+	MaxPerMinute int
+	// Prefixes sample the keys written under them apart from the others,
+	// the longest prefix of a key applying.
+	Prefixes []eventsPrefix
+	// Delay is how long after a key is written it's verified.
+	Delay time.Duration
+	// MaxPerRound is how many written keys are verified in a round, at
+	// most. Keys beyond are verified in the next rounds.
+	MaxPerRound int
+}
+
+// kafkaConfig is a topic of Kafka consumed through a Kafka REST proxy, such
+// as Confluent's, with its v2 API.
+type kafkaConfig struct {
+	// Proxy is the URL of the REST proxy.
+	Proxy string `json:"proxy"`
+	Topic string `json:"topic"`
+	// Group is the consumer group, jag by default.
+	Group string `json:"group,omitempty"`
+}
+
+// eventsPrefix samples the keys written under a prefix, with their own
+// fraction and cap, such as to verify few of the keys of a backfill.
+type eventsPrefix struct {
+	Prefix string `json:"prefix"`
+	// Fraction is the fraction of the keys written that are verified,
+	// none if 0.
+	Fraction float64 `json:"fraction"`
+	// MaxPerMinute caps how many keys written are queued a minute, 0 if
+	// unlimited.
+	MaxPerMinute int `json:"max_per_minute,omitempty"`
+}
+
+type eventsFile struct {
+	SQS          string         `json:"sqs,omitempty"`
+	Kinesis      string         `json:"kinesis,omitempty"`
+	Kafka        *kafkaConfig   `json:"kafka,omitempty"`
+	Fraction     float64        `json:"fraction,omitempty"`
+	MaxPerMinute uint           `json:"max_per_minute,omitempty"`
+	Prefixes     []eventsPrefix `json:"prefixes,omitempty"`
+	Delay        string         `json:"delay,omitempty"`
+	MaxPerRound  uint           `json:"max_per_round,omitempty"`
+}
+
+func loadEvents(f *eventsFile, c *config) (*eventsConfig, error) {
+	e := &eventsConfig{
+		SQS:          f.SQS,
+		Kinesis:      f.Kinesis,
+		Kafka:        f.Kafka,
+		Fraction:     f.Fraction,
+		MaxPerMinute: int(f.MaxPerMinute),
+		Prefixes:     f.Prefixes,
+		Delay:        DefaultEventsDelay,
+		MaxPerRound:  int(f.MaxPerRound),
+	}
+	sources := 0
+	for _, set := range []bool{e.SQS != "", e.Kinesis != "", e.Kafka != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("exactly one of sqs, kinesis and kafka is required")
+	}
+	if e.SQS != "" || e.Kinesis != "" {
+		a := c.Source
+		if a.Swift != nil || a.SFTP != nil || a.B2 != nil {
+			return nil, fmt.Errorf("sqs and kinesis require the source to be an S3 bucket")
+		}
+		if _, ok := awsRegion(a.Region); !ok {
+			return nil, fmt.Errorf("sqs and kinesis require the region of the source")
+		}
+	}
+	if e.SQS != "" {
+		if u, err := url.Parse(e.SQS); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("sqs: want the https URL of a queue, got %q", e.SQS)
+		}
+	}
+	if e.Kafka != nil {
+		if u, err := url.Parse(e.Kafka.Proxy); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("kafka.proxy: want the URL of a Kafka REST proxy, got %q", e.Kafka.Proxy)
+		}
+		if e.Kafka.Topic == "" {
+			return nil, fmt.Errorf("kafka.topic is required")
+		}
+		if e.Kafka.Group == "" {
+			e.Kafka.Group = "jag"
+		}
+	}
+	if e.Fraction == 0 {
+		e.Fraction = 1
+	}
+	if e.Fraction < 0 || e.Fraction > 1 {
+		return nil, fmt.Errorf("fraction must be between 0 and 1")
+	}
+	seen := make(map[string]bool)
+	for _, p := range e.Prefixes {
+		if seen[p.Prefix] {
+			return nil, fmt.Errorf("prefix %q: listed twice", p.Prefix)
+		}
+		seen[p.Prefix] = true
+		if p.Fraction < 0 || p.Fraction > 1 {
+			return nil, fmt.Errorf("prefix %q: fraction must be between 0 and 1", p.Prefix)
+		}
+		if p.MaxPerMinute < 0 {
+			return nil, fmt.Errorf("prefix %q: max_per_minute can't be negative", p.Prefix)
+		}
+	}
+	if f.Delay != "" {
+		var err error
+		if e.Delay, err = time.ParseDuration(f.Delay); err != nil {
+			return nil, fmt.Errorf("delay: %v", err)
+		}
+		if e.Delay < 0 {
+			return nil, fmt.Errorf("delay can't be negative")
+		}
+	}
+	if e.MaxPerRound == 0 {
+		e.MaxPerRound = c.CheckCount
+	}
+	return e, nil
+}
+
+func (e *eventsConfig) file() *eventsFile {
+	return &eventsFile{
+		SQS:          e.SQS,
+		Kinesis:      e.Kinesis,
+		Kafka:        e.Kafka,
+		Fraction:     e.Fraction,
+		MaxPerMinute: uint(e.MaxPerMinute),
+		Prefixes:     e.Prefixes,
+		Delay:        e.Delay.String(),
+		MaxPerRound:  uint(e.MaxPerRound),
+	}
+}
+
+// sampling returns the rule sampling the keys written under a key's longest
+// prefix, as its index in Prefixes, -1 if none, and its fraction and cap.
+func (e *eventsConfig) sampling(key string) (rule int, fraction float64, maxPerMinute int) {
+	rule, fraction, maxPerMinute = -1, e.Fraction, e.MaxPerMinute
+	longest := -1
+	for i, p := range e.Prefixes {
+		if len(p.Prefix) > longest && strings.HasPrefix(key, p.Prefix) {
+			rule, fraction, maxPerMinute, longest = i, p.Fraction, p.MaxPerMinute, len(p.Prefix)
+		}
+	}
+	return rule, fraction, maxPerMinute
+}
+
+// s3Event is a message notifying of changes to a bucket, in the format of S3
+// event notifications, of SNS notifications wrapping them, or of EventBridge
+// events.
+type s3Event struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				// Key is URL encoded, as in forms.
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+
+	// Type and Message are those of SNS notifications.
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+
+	// DetailType and Detail are those of EventBridge events.
+	DetailType string `json:"detail-type"`
+	Detail     struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key string `json:"key"`
+		} `json:"object"`
+	} `json:"detail"`
+}
+
+// writtenKeys returns the keys of a bucket an event notifies were written.
+// Other events, such as deletions or the test events S3 sends when
+// notifications are configured, are ignored.
+func writtenKeys(msg []byte, bucket string) ([]string, error) {
+	var ev s3Event
+	if err := json.Unmarshal(msg, &ev); err != nil {
+		return nil, fmt.Errorf("invalid event: %v", err)
+	}
+	if ev.Type == "Notification" {
+		return writtenKeys([]byte(ev.Message), bucket)
+	}
+	if ev.DetailType == "Object Created" {
+		if ev.Detail.Bucket.Name != bucket {
+			return nil, nil
+		}
+		return []string{ev.Detail.Object.Key}, nil
+	}
+	var keys []string
+	for _, rec := range ev.Records {
+		if !strings.HasPrefix(rec.EventName, "ObjectCreated:") || rec.S3.Bucket.Name != bucket {
+			continue
+		}
+		key, err := url.QueryUnescape(rec.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", rec.S3.Object.Key, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// eventSource is where events are consumed from.
+type eventSource interface {
+	// receive returns the next messages, waiting a while for some. The
+	// messages returned are acknowledged.
+	receive() ([][]byte, error)
+	close()
+}
+
+// eventConsumer consumes the events of the source, queueing a fraction of
+// the keys written until they're due to be verified.
+type eventConsumer struct {
+	*keyQueue
+	cfg    eventsConfig
+	bucket string
+	src    eventSource
+	r      *rand.Rand
+
+	// window is when the minute the caps apply to started, and inWindow
+	// and capped how many keys were queued in it and how many weren't,
+	// by sampling rule.
+	window   time.Time
+	inWindow map[int]int
+	capped   map[int]int
+}
+
+func newEventConsumer(cfg eventsConfig, source awsConfig) (*eventConsumer, error) {
+	c := &eventConsumer{
+		keyQueue: newKeyQueue(cfg.Delay),
+		cfg:      cfg,
+		bucket:   source.Bucket,
+		r:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		inWindow: make(map[int]int),
+		capped:   make(map[int]int),
+	}
+	if cfg.Kafka != nil {
+		c.src = &kafkaSource{cfg: *cfg.Kafka}
+		return c, nil
+	}
+	// the requests to SQS and Kinesis are signed like those to the source,
+	// and go to the FIPS endpoints of the services if the source's do
+	client := *s3HTTPClient(source)
+	client.Timeout = eventsClient.Timeout
+	source.DualStack = false
+	awsCfg, err := awsSDKConfig(source, &client)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SQS != "" {
+		c.src = &sqsSource{client: sqs.NewFromConfig(awsCfg), queue: cfg.SQS}
+	} else {
+		c.src = &kinesisSource{client: kinesis.NewFromConfig(awsCfg), stream: cfg.Kinesis}
+	}
+	return c, nil
+}
+
+// consume consumes events until abort is closed.
+func (c *eventConsumer) consume(abort <-chan struct{}) {
+	defer c.src.close()
+	for {
+		select {
+		case <-abort:
+			return
+		default:
+		}
+		msgs, err := c.src.receive()
+		if err != nil {
+			log.WithField("error", err).Warn("can't consume events")
+			select {
+			case <-abort:
+				return
+			case <-time.After(EventsRetryDelay):
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			c.handle(msg, time.Now())
+		}
+	}
+}
+
+// handle queues a fraction of the keys an event notifies were written, as
+// many as the caps allow.
+func (c *eventConsumer) handle(msg []byte, now time.Time) {
+	keys, err := writtenKeys(msg, c.bucket)
+	if err != nil {
+		log.WithField("error", err).Debug("ignoring event")
+		return
+	}
+	for _, key := range keys {
+		rule, fraction, maxPerMinute := c.cfg.sampling(key)
+		if c.r.Float64() >= fraction {
+			continue
+		}
+		if now.Sub(c.window) >= time.Minute {
+			c.reportCapped()
+			c.window = now
+		}
+		if maxPerMinute > 0 && c.inWindow[rule] >= maxPerMinute {
+			c.capped[rule]++
+			continue
+		}
+		c.inWindow[rule]++
+		c.add(key, now)
+	}
+}
+
+// reportCapped logs how many keys the caps left out in the last minute, and
+// starts counting anew.
+func (c *eventConsumer) reportCapped() {
+	for rule, capped := range c.capped {
+		prefix, maxPerMinute := "", c.cfg.MaxPerMinute
+		if rule >= 0 {
+			prefix, maxPerMinute = c.cfg.Prefixes[rule].Prefix, c.cfg.Prefixes[rule].MaxPerMinute
+		}
+		log.WithFields(log.Fields{
+			"prefix":         prefix,
+			"capped":         capped,
+			"max_per_minute": maxPerMinute,
+		}).Info("keys written according to events weren't verified, over their cap")
+	}
+	c.inWindow, c.capped = make(map[int]int), make(map[int]int)
+}
+
+// verifyEvents verifies n of the keys written according to events that are
+// due.
+func (v *verifier) verifyEvents(report *RoundReport, n int) {
+	v.verifyQueued(report, v.events.keyQueue, n, "written according to events", func(res *Result) { res.Event = true })
+}
+
+// sqsSource receives the messages of an SQS queue, deleting them once
+// received.
+type sqsSource struct {
+	client *sqs.Client
+	queue  string
+}
+
+func (s *sqsSource) receive() ([][]byte, error) {
+	out, err := s.client.ReceiveMessage(context.Background(), &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(s.queue),
+		MaxNumberOfMessages: 10,
+		WaitTimeSeconds:     20,
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	if len(out.Messages) == 0 {
+		return nil, nil
+	}
+	msgs := make([][]byte, len(out.Messages))
+	entries := make([]sqstypes.DeleteMessageBatchRequestEntry, len(out.Messages))
+	for i, m := range out.Messages {
+		msgs[i] = []byte(aws.ToString(m.Body))
+		entries[i] = sqstypes.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: m.ReceiptHandle,
+		}
+	}
+	_, err = s.client.DeleteMessageBatch(context.Background(), &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(s.queue),
+		Entries:  entries,
+	})
+	if err != nil {
+		// the messages are received again once they're visible again,
+		// their keys being queued twice at worst
+		log.WithField("error", err).Warn("can't delete messages of SQS queue")
+	}
+	return msgs, nil
+}
+
+func (s *sqsSource) close() {}
+
+// kinesisSource reads the records of the shards of a Kinesis stream, from
+// their latest record when the audit starts. Records aggregated by the
+// Kinesis Producer Library aren't supported.
+type kinesisSource struct {
+	client *kinesis.Client
+	stream string
+
+	// iterators are those of the open shards, by shard, and known the
+	// shards read or being read. Once the stream is resharded, the shards
+	// appearing are read from their first record. Once reading fails, the
+	// shards are read again from their latest record.
+	iterators map[string]string
+	known     map[string]bool
+	last      time.Time
+}
+
+// listShards starts reading the open shards not read yet.
+func (k *kinesisSource) listShards() error {
+	iteratorType := kinesistypes.ShardIteratorTypeTrimHorizon
+	if k.known == nil {
+		k.known, k.iterators = make(map[string]bool), make(map[string]string)
+		iteratorType = kinesistypes.ShardIteratorTypeLatest
+	}
+	in := &kinesis.ListShardsInput{StreamName: aws.String(k.stream)}
+	for {
+		out, err := k.client.ListShards(context.Background(), in)
+		if err != nil {
+			return s3Error(err)
+		}
+		for _, shard := range out.Shards {
+			id := aws.ToString(shard.ShardId)
+			if k.known[id] || shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+				continue
+			}
+			it, err := k.client.GetShardIterator(context.Background(), &kinesis.GetShardIteratorInput{
+				StreamName:        aws.String(k.stream),
+				ShardId:           shard.ShardId,
+				ShardIteratorType: iteratorType,
+			})
+			if err != nil {
+				return s3Error(err)
+			}
+			k.known[id] = true
+			k.iterators[id] = aws.ToString(it.ShardIterator)
+		}
+		if out.NextToken == nil {
+			return nil
+		}
+		in = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+}
+
+func (k *kinesisSource) receive() ([][]byte, error) {
+	if wait := kinesisPollInterval - time.Since(k.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	k.last = time.Now()
+	if len(k.iterators) == 0 {
+		if err := k.listShards(); err != nil {
+			return nil, err
+		}
+	}
+	var msgs [][]byte
+	resharded := false
+	for shard, it := range k.iterators {
+		out, err := k.client.GetRecords(context.Background(), &kinesis.GetRecordsInput{
+			ShardIterator: aws.String(it),
+			Limit:         aws.Int32(1000),
+		})
+		if err != nil {
+			// the iterators may have expired, the shards are read again
+			// from their latest record
+			k.iterators, k.known = nil, nil
+			return msgs, s3Error(err)
+		}
+		for _, rec := range out.Records {
+			msgs = append(msgs, rec.Data)
+		}
+		if out.NextShardIterator == nil {
+			// the shard was closed, its children are read next
+			delete(k.iterators, shard)
+			resharded = true
+			continue
+		}
+		k.iterators[shard] = *out.NextShardIterator
+	}
+	if resharded {
+		if err := k.listShards(); err != nil {
+			return msgs, err
+		}
+	}
+	return msgs, nil
+}
+
+func (k *kinesisSource) close() {}
+
+// kafkaSource consumes the records of a topic through a consumer instance of
+// a Kafka REST proxy, its offsets committed automatically.
+type kafkaSource struct {
+	cfg kafkaConfig
+	// instance is the URL of the consumer instance, once created.
+	instance string
+}
+
+const (
+	kafkaContentType = "application/vnd.kafka.v2+json"
+	kafkaRecordsType = "application/vnd.kafka.binary.v2+json"
+)
+
+func (k *kafkaSource) do(method, u, accept string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, u, &body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", kafkaContentType)
+	}
+	req.Header.Set("Accept", accept)
+	resp, err := eventsClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Code    int    `json:"error_code"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+			e.Message = resp.Status
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			// the instance expired, it's created again
+			k.instance = ""
+		}
+		return fmt.Errorf("error %d %d of Kafka REST proxy: %s", resp.StatusCode, e.Code, e.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// subscribe creates a consumer instance subscribed to the topic.
+func (k *kafkaSource) subscribe() error {
+	host, _ := os.Hostname()
+	var instance struct {
+		BaseURI string `json:"base_uri"`
+	}
+	err := k.do("POST", strings.TrimSuffix(k.cfg.Proxy, "/")+"/consumers/"+url.PathEscape(k.cfg.Group), kafkaContentType,
+		map[string]string{
+			"name":               fmt.Sprintf("jag-%s-%d", host, os.Getpid()),
+			"format":             "binary",
+			"auto.offset.reset":  "latest",
+			"auto.commit.enable": "true",
+		}, &instance)
+	if err != nil {
+		return err
+	}
+	k.instance = instance.BaseURI
+	return k.do("POST", k.instance+"/subscription", kafkaContentType, map[string][]string{"topics": {k.cfg.Topic}}, nil)
+}
+
+func (k *kafkaSource) receive() ([][]byte, error) {
+	if k.instance == "" {
+		if err := k.subscribe(); err != nil {
+			return nil, err
+		}
+	}
+	var records []struct {
+		Value []byte `json:"value"`
+	}
+	if err := k.do("GET", k.instance+"/records?timeout=20000", kafkaRecordsType, nil, &records); err != nil {
+		return nil, err
+	}
+	msgs := make([][]byte, 0, len(records))
+	for _, rec := range records {
+		msgs = append(msgs, rec.Value)
+	}
+	return msgs, nil
+}
+
+func (k *kafkaSource) close() {
+	if k.instance != "" {
+		_ = k.do("DELETE", k.instance, kafkaContentType, nil, nil)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// exportConfig exports the results of rounds to a bucket for the long term,
+// in a layout SQL engines such as Athena or BigQuery query as external
+// tables partitioned the Hive way. Each round writes a file of rounds and a
+// file of results, as newline-delimited JSON objects, under the prefix:
+//
+//	rounds/dt=2006-01-02/<round>.json
+//	results/dt=2006-01-02/<round>.json
+//
+// dt being the day the round started, in UTC. Parquet isn't written.
+type exportConfig struct {
+	// URL is the prefix written to, like s3://bucket/audits/, with the
+	// credentials of the destination.
+	URL string `json:"url"`
+	// Gzip compresses the files, named with a .json.gz extension.
+	Gzip bool `json:"gzip,omitempty"`
+}
+
+// exportDateLayout is the layout of the dt partition of exported files.
+const exportDateLayout = "2006-01-02"
+
+func loadExport(e *exportConfig) error {
+	if _, _, err := parseS3URL(e.URL); err != nil {
+		return fmt.Errorf("url: %v", err)
+	}
+	return nil
+}
+
+// exportedRound is a row of the rounds table.
+type exportedRound struct {
+	Round       roundID           `json:"round"`
+	Audit       string            `json:"audit,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Version     string            `json:"version"`
+	Commit      string            `json:"commit,omitempty"`
+	Started     time.Time         `json:"started"`
+	Finished    time.Time         `json:"finished"`
+	Counts      map[outcome]int   `json:"counts"`
+	Maintenance bool              `json:"maintenance,omitempty"`
+	// Risk is null unless the config scores mismatches.
+	Risk *float64 `json:"risk,omitempty"`
+}
+
+// exportedResult is a row of the results table, a result of a round
+// flattened for SQL engines.
+type exportedResult struct {
+	Round     roundID   `json:"round"`
+	Audit     string    `json:"audit,omitempty"`
+	Started   time.Time `json:"started"`
+	Key       string    `json:"key"`
+	Version   string    `json:"version,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Outcome   outcome   `json:"outcome"`
+	Check     string    `json:"check,omitempty"`
+	IgnoredBy string    `json:"ignored_by,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ErrorKind string    `json:"error_kind,omitempty"`
+	FollowUp  bool      `json:"follow_up,omitempty"`
+	Reverse   bool      `json:"reverse,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Risk      float64   `json:"risk,omitempty"`
+	Claimed   bool      `json:"claimed,omitempty"`
+	Event     bool      `json:"event,omitempty"`
+	Requested bool      `json:"requested,omitempty"`
+	// Details are a JSON object in a string, since their fields depend on
+	// the check, which tables can't describe.
+	Details string `json:"details,omitempty"`
+}
+
+// exporter writes the rounds of an audit where its config exports them.
+type exporter struct {
+	bkt    writableBucket
+	prefix string
+	gzip   bool
+}
+
+func newExporter(a awsConfig, e exportConfig) (*exporter, error) {
+	name, prefix, err := parseS3URL(e.URL)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	a.Bucket, a.Fallbacks = name, nil
+	if err := prepareEndpoints(a); err != nil {
+		return nil, err
+	}
+	bkt, err := awsBucket(a)
+	if err != nil {
+		return nil, err
+	}
+	return &exporter{
+		bkt:    bkt.(writableBucket),
+		prefix: prefix,
+		gzip:   e.Gzip,
+	}, nil
+}
+
+// export writes the round and its results. The results are written first,
+// so that a round in the rounds table has all its results.
+func (e *exporter) export(r *RoundReport) error {
+	results := make([]interface{}, len(r.Results))
+	for i, res := range r.Results {
+		row := exportedResult{
+			Round:     r.ID,
+			Audit:     r.Audit,
+			Started:   r.Started.UTC(),
+			Key:       res.Key,
+			Version:   res.Version,
+			Size:      res.Size,
+			Outcome:   res.Outcome,
+			Check:     res.Check,
+			IgnoredBy: res.IgnoredBy,
+			Error:     res.Error,
+			ErrorKind: res.ErrorKind,
+			FollowUp:  res.FollowUp,
+			Reverse:   res.Reverse,
+			Namespace: res.Namespace,
+			Risk:      res.Risk,
+			Claimed:   res.Claimed,
+			Event:     res.Event,
+			Requested: res.Requested,
+		}
+		if len(res.Details) != 0 {
+			details, err := json.Marshal(res.Details)
+			if err != nil {
+				return fmt.Errorf("key %q: can't encode details: %v", res.Key, err)
+			}
+			row.Details = string(details)
+		}
+		results[i] = row
+	}
+	if err := e.write("results", r, results); err != nil {
+		return err
+	}
+	round := exportedRound{
+		Round:       r.ID,
+		Audit:       r.Audit,
+		Labels:      r.Labels,
+		Version:     r.Build.Version,
+		Commit:      r.Build.Commit,
+		Started:     r.Started.UTC(),
+		Finished:    r.Finished.UTC(),
+		Counts:      r.Counts,
+		Maintenance: r.Maintenance != nil,
+	}
+	if r.Risk != nil {
+		round.Risk = &r.Risk.Score
+	}
+	return e.write("rounds", r, []interface{}{round})
+}
+
+// write writes rows to the file of the round in the partition of a table.
+func (e *exporter) write(table string, r *RoundReport, rows []interface{}) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	key := fmt.Sprintf("%s%s/dt=%s/%s.json", e.prefix, table, r.Started.UTC().Format(exportDateLayout), r.ID)
+	data := buf.Bytes()
+	if e.gzip {
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		key, data = key+".gz", gz.Bytes()
+	}
+	if err := e.bkt.put(key, data); err != nil {
+		return fmt.Errorf("can't write %q: %w", key, err)
+	}
+	return nil
+}
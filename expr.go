@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// An expression is a small boolean expression evaluated against a set of
+// variables, used to express bucket specific rules in the config without
+// recompiling jag. For instance:
+//
+//	size > 0 && !hasPrefix(key, "tmp/") && storage_class != "GLACIER"
+//
+// Values are numbers, strings or booleans. The supported operators are, by
+// increasing precedence:
+//
+//	||
+//	&&
+//	== != < <= > >=
+//	+ -
+//	* / %
+//	! - (unary)
+//
+// The supported functions are hasPrefix, hasSuffix, contains, matches (a
+// regular expression match) and len.
+type expression struct {
+	src  string
+	root exprNode
+}
+
+type exprNode interface {
+	eval(vars map[string]interface{}) (interface{}, error)
+}
+
+// compileExpr parses an expression.
+func compileExpr(src string) (*expression, error) {
+	p := &exprParser{src: src}
+	if err := p.lex(); err != nil {
+		return nil, fmt.Errorf("expression %q: %v", src, err)
+	}
+	root, err := p.parseBinary(0)
+	if err == nil && p.peek().kind != tokEOF {
+		err = fmt.Errorf("unexpected %q at offset %d", p.peek().text, p.peek().pos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %v", src, err)
+	}
+	return &expression{src: src, root: root}, nil
+}
+
+func (e *expression) String() string { return e.src }
+
+// evalBool evaluates the expression, which must yield a boolean.
+func (e *expression) evalBool(vars map[string]interface{}) (bool, error) {
+	v, err := e.root.eval(vars)
+	if err != nil {
+		return false, fmt.Errorf("expression %q: %v", e.src, err)
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q: yields %v, not a boolean", e.src, v)
+	}
+	return b, nil
+}
+
+// lexing
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+var exprOps = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", ","}
+
+type exprParser struct {
+	src  string
+	toks []token
+	i    int
+}
+
+func (p *exprParser) lex() error {
+	s := p.src
+	i := 0
+lexing:
+	for i < len(s) {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			p.toks = append(p.toks, token{tokIdent, s[i:j], i})
+			i = j
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(s) && (s[j] == '.' || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			p.toks = append(p.toks, token{tokNumber, s[i:j], i})
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return fmt.Errorf("unterminated string at offset %d", i)
+			}
+			str, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return fmt.Errorf("invalid string at offset %d: %v", i, err)
+			}
+			p.toks = append(p.toks, token{tokString, str, i})
+			i = j + 1
+		default:
+			for _, op := range exprOps {
+				if strings.HasPrefix(s[i:], op) {
+					p.toks = append(p.toks, token{tokOp, op, i})
+					i += len(op)
+					continue lexing
+				}
+			}
+			return fmt.Errorf("unexpected character %q at offset %d", c, i)
+		}
+	}
+	p.toks = append(p.toks, token{tokEOF, "end of expression", len(s)})
+	return nil
+}
+
+// parsing
+
+func (p *exprParser) peek() token { return p.toks[p.i] }
+
+func (p *exprParser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) expect(op string) error {
+	if t := p.next(); t.kind != tokOp || t.text != op {
+		return fmt.Errorf("expected %q at offset %d, got %q", op, t.pos, t.text)
+	}
+	return nil
+}
+
+var exprPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+func (p *exprParser) parseBinary(minPrec int) (exprNode, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		prec, ok := exprPrecedence[t.text]
+		if t.kind != tokOp || !ok || prec <= minPrec {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.parseBinary(prec)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryNode{op: t.text, lhs: lhs, rhs: rhs}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	t := p.peek()
+	if t.kind == tokOp && (t.text == "!" || t.text == "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: t.text, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", t.text, t.pos)
+		}
+		return literalNode{f}, nil
+	case tokString:
+		return literalNode{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		}
+		if p.peek().text != "(" {
+			return varNode(t.text), nil
+		}
+		fn, ok := exprFuncs[t.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %q at offset %d", t.text, t.pos)
+		}
+		p.next()
+		call := &callNode{name: t.text, fn: fn}
+		for p.peek().text != ")" {
+			arg, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if p.peek().text != "," {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if err := call.compileRegexp(); err != nil {
+			return nil, fmt.Errorf("%v at offset %d", err, t.pos)
+		}
+		return call, nil
+	case tokOp:
+		if t.text == "(" {
+			inner, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+// evaluation
+
+type literalNode struct{ v interface{} }
+
+func (n literalNode) eval(map[string]interface{}) (interface{}, error) { return n.v, nil }
+
+type varNode string
+
+func (n varNode) eval(vars map[string]interface{}) (interface{}, error) {
+	v, ok := vars[string(n)]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %q", string(n))
+	}
+	return v, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(vars map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch x := v.(type) {
+	case bool:
+		if n.op == "!" {
+			return !x, nil
+		}
+	case float64:
+		if n.op == "-" {
+			return -x, nil
+		}
+	}
+	return nil, fmt.Errorf("can't apply %q to %v", n.op, v)
+}
+
+type binaryNode struct {
+	op       string
+	lhs, rhs exprNode
+}
+
+func (n *binaryNode) eval(vars map[string]interface{}) (interface{}, error) {
+	l, err := n.lhs.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	// short circuit boolean operators
+	if lb, ok := l.(bool); ok && (n.op == "&&" && !lb || n.op == "||" && lb) {
+		return lb, nil
+	}
+	r, err := n.rhs.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return l == r, nil
+	case "!=":
+		return l != r, nil
+	}
+	switch lv := l.(type) {
+	case bool:
+		if rv, ok := r.(bool); ok && (n.op == "&&" || n.op == "||") {
+			return rv, nil
+		}
+	case string:
+		if rv, ok := r.(string); ok {
+			switch n.op {
+			case "+":
+				return lv + rv, nil
+			case "<":
+				return lv < rv, nil
+			case "<=":
+				return lv <= rv, nil
+			case ">":
+				return lv > rv, nil
+			case ">=":
+				return lv >= rv, nil
+			}
+		}
+	case float64:
+		if rv, ok := r.(float64); ok {
+			switch n.op {
+			case "+":
+				return lv + rv, nil
+			case "-":
+				return lv - rv, nil
+			case "*":
+				return lv * rv, nil
+			case "/":
+				return lv / rv, nil
+			case "%":
+				if rv == 0 {
+					return nil, fmt.Errorf("%v %% %v: modulo by zero", lv, rv)
+				}
+				return math.Mod(lv, rv), nil
+			case "<":
+				return lv < rv, nil
+			case "<=":
+				return lv <= rv, nil
+			case ">":
+				return lv > rv, nil
+			case ">=":
+				return lv >= rv, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("can't apply %q to %v and %v", n.op, l, r)
+}
+
+type callNode struct {
+	name string
+	fn   func(args []interface{}) (interface{}, error)
+	args []exprNode
+}
+
+func (n *callNode) eval(vars map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := n.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", n.name, err)
+	}
+	return v, nil
+}
+
+// compileRegexp compiles the regular expression of a call to matches once
+// if it's a literal, rather than on each evaluation.
+func (n *callNode) compileRegexp() error {
+	if n.name != "matches" || len(n.args) != 2 {
+		return nil
+	}
+	lit, ok := n.args[1].(literalNode)
+	if !ok {
+		return nil
+	}
+	pattern, ok := lit.v.(string)
+	if !ok {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid regular expression %q: %v", pattern, err)
+	}
+	n.fn = func(args []interface{}) (interface{}, error) {
+		strs, err := stringArgs(args, 2)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(strs[0]), nil
+	}
+	return nil
+}
+
+func stringArgs(args []interface{}, n int) ([]string, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("want %d arguments, got %d", n, len(args))
+	}
+	strs := make([]string, n)
+	for i, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("argument %d is %v, not a string", i, arg)
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+func stringFunc(f func(s, arg string) bool) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		strs, err := stringArgs(args, 2)
+		if err != nil {
+			return nil, err
+		}
+		return f(strs[0], strs[1]), nil
+	}
+}
+
+var exprFuncs = map[string]func([]interface{}) (interface{}, error){
+	"hasPrefix": stringFunc(strings.HasPrefix),
+	"hasSuffix": stringFunc(strings.HasSuffix),
+	"contains":  stringFunc(strings.Contains),
+	"matches": func(args []interface{}) (interface{}, error) {
+		strs, err := stringArgs(args, 2)
+		if err != nil {
+			return nil, err
+		}
+		return regexp.MatchString(strs[1], strs[0])
+	},
+	"len": func(args []interface{}) (interface{}, error) {
+		strs, err := stringArgs(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return float64(len(strs[0])), nil
+	},
+}
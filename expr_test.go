@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var exprVars = map[string]interface{}{
+	"key":  "photos/2016/a.jpg",
+	"size": 10.0,
+	"age":  3600.0,
+}
+
+func TestExprEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		// precedence
+		{`1 + 2 * 3`, 7.0},
+		{`(1 + 2) * 3`, 9.0},
+		{`10 - 4 - 3`, 3.0},
+		{`-2 * 3`, -6.0},
+		{`7 % 4 + 1`, 4.0},
+		{`1 + 2 == 3`, true},
+		{`size > 5 && size < 20`, true},
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!false && true`, true},
+		{`!(size > 5) || age > 0`, true},
+		// short circuit
+		{`false && unknown > 0`, false},
+		{`true || unknown > 0`, true},
+		// strings and functions
+		{`"a" + "b" == "ab"`, true},
+		{`hasPrefix(key, "photos/") && !hasSuffix(key, ".png")`, true},
+		{`len(key) > size`, true},
+		{`matches(key, "^photos/[0-9]{4}/")`, true},
+		{`matches(key, "\\.png$")`, false},
+		{`matches(key, "^" + "photos/")`, true},
+	}
+	for _, tt := range tests {
+		e, err := compileExpr(tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		got, err := e.root.eval(exprVars)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`size % 0 == 0`, "modulo by zero"},
+		{`size % (age - age) > 1`, "modulo by zero"},
+		{`size + "b" > 0`, `can't apply "+"`},
+		{`"a" - "b" == ""`, `can't apply "-"`},
+		{`!size`, `can't apply "!"`},
+		{`-key == ""`, `can't apply "-"`},
+		{`size && true`, `can't apply "&&"`},
+		{`hasPrefix(size, "a")`, "not a string"},
+		{`len(key, key) > 0`, "want 1 arguments"},
+		{`unknown > 0`, `unknown variable "unknown"`},
+		{`size + 1`, "not a boolean"},
+	}
+	for _, tt := range tests {
+		e, err := compileExpr(tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		_, err = e.evalBool(exprVars)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`matches(key, "photos/(")`, "invalid regular expression"},
+		{`size >`, "unexpected"},
+		{`(size > 1`, `expected ")"`},
+		{`size > 1 1`, "unexpected"},
+		{`nope(key)`, `unknown function "nope"`},
+		{`key == "a`, "unterminated string"},
+		{`size # 1`, "unexpected character"},
+	}
+	for _, tt := range tests {
+		_, err := compileExpr(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// FailoverThreshold is how many requests in a row must fail on an
+	// endpoint before failing over to the next one.
+	FailoverThreshold = 5
+	// FailbackAfter is how long the primary endpoint is left alone after
+	// failing over, before trying it again.
+	FailbackAfter = 10 * time.Minute
+)
+
+// failoverBucket sends requests to the primary endpoint of a bucket, and
+// fails over to fallback endpoints while the primary one fails persistently.
+// Failing over is only sensible because audits never write to buckets.
+type failoverBucket struct {
+	endpoints []bucket
+	// names are the region names or URLs of the endpoints.
+	names []string
+
+	mu         sync.Mutex
+	active     int
+	failures   int
+	failedOver time.Time
+}
+
+func newFailoverBucket(endpoints []bucket, names []string) *failoverBucket {
+	return &failoverBucket{endpoints: endpoints, names: names}
+}
+
+// isEndpointFailure tells if an error is a failure of the endpoint, rather
+// than of the request. Requests canceled by their caller aren't failures of
+// the endpoint.
+func isEndpointFailure(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, ErrUnavailable) || errors.As(err, &netErr)
+}
+
+func (b *failoverBucket) current() (bucket, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.active != 0 && time.Since(b.failedOver) > FailbackAfter {
+		log.WithFields(log.Fields{
+			"bucket":   b.Name(),
+			"endpoint": b.names[0],
+		}).Info("trying primary endpoint again")
+		b.active = 0
+		b.failures = 0
+	}
+	return b.endpoints[b.active], b.active
+}
+
+// record accounts for the outcome of a request sent to an endpoint.
+func (b *failoverBucket) record(endpoint int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if endpoint != b.active {
+		// already failed over
+		return
+	}
+	if !isEndpointFailure(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures < FailoverThreshold {
+		return
+	}
+	next := (b.active + 1) % len(b.endpoints)
+	log.WithFields(log.Fields{
+		"bucket": b.Name(),
+		"from":   b.names[b.active],
+		"to":     b.names[next],
+		"error":  err,
+	}).Warn("endpoint is failing persistently, failing over")
+	b.active = next
+	b.failures = 0
+	b.failedOver = time.Now()
+}
+
+// try sends a request to the active endpoint.
+func (b *failoverBucket) try(req func(bkt bucket) error) error {
+	bkt, endpoint := b.current()
+	err := req(bkt)
+	b.record(endpoint, err)
+	return err
+}
+
+// degraded returns the endpoint in use if it isn't the primary one.
+func (b *failoverBucket) degraded() (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.names[b.active], b.active != 0
+}
+
+func (b *failoverBucket) Name() string { return b.endpoints[0].Name() }
+
+func (b *failoverBucket) List(ctx context.Context, prefix, delim, marker string, max int) (resp *listResp, err error) {
+	err = b.try(func(bkt bucket) error {
+		resp, err = bkt.List(ctx, prefix, delim, marker, max)
+		return err
+	})
+	return resp, err
+}
+
+func (b *failoverBucket) ListVersions(ctx context.Context, prefix, delim, keyMarker, versionMarker string, max int) (resp *listVersionsResp, err error) {
+	err = b.try(func(bkt bucket) error {
+		resp, err = bkt.ListVersions(ctx, prefix, delim, keyMarker, versionMarker, max)
+		return err
+	})
+	return resp, err
+}
+
+func (b *failoverBucket) GetReader(ctx context.Context, key, version string) (rc io.ReadCloser, err error) {
+	err = b.try(func(bkt bucket) error {
+		rc, err = bkt.GetReader(ctx, key, version)
+		return err
+	})
+	return rc, err
+}
+
+func (b *failoverBucket) Head(ctx context.Context, key, version string) (header http.Header, err error) {
+	err = b.try(func(bkt bucket) error {
+		header, err = bkt.Head(ctx, key, version)
+		return err
+	})
+	return header, err
+}
+
+func (b *failoverBucket) Tags(ctx context.Context, key, version string) (tags map[string]string, err error) {
+	err = b.try(func(bkt bucket) error {
+		tags, err = bkt.Tags(ctx, key, version)
+		return err
+	})
+	return tags, err
+}
+
+func (b *failoverBucket) Retention(ctx context.Context, key, version string) (ret *retention, err error) {
+	err = b.try(func(bkt bucket) error {
+		ret, err = bkt.Retention(ctx, key, version)
+		return err
+	})
+	return ret, err
+}
+
+func (b *failoverBucket) Lifecycle(ctx context.Context) (rules []lifecycleRule, err error) {
+	err = b.try(func(bkt bucket) error {
+		rules, err = bkt.Lifecycle(ctx)
+		return err
+	})
+	return rules, err
+}
+
+func (b *failoverBucket) SignedURL(key, version string, expires time.Time) string {
+	bkt, _ := b.current()
+	return bkt.SignedURL(key, version, expires)
+}
+
+func (b *failoverBucket) traceKey(ctx context.Context, key, version string) (ids requestIDs, err error) {
+	err = b.try(func(bkt bucket) error {
+		tracer, ok := bkt.(requestTracer)
+		if !ok {
+			return nil
+		}
+		ids, err = tracer.traceKey(ctx, key, version)
+		return err
+	})
+	return ids, err
+}
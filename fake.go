@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memBucket is a bucket held in memory, used to exercise the auditor without
+// talking to S3.
+type memBucket struct {
+	name string
+
+	mu      sync.RWMutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	key    listedKey
+	data   []byte
+	header http.Header
+	tags   map[string]string
+	// retention is nil if the key has no Object Lock retention.
+	retention *retention
+}
+
+func newMemBucket(name string) *memBucket {
+	return &memBucket{name: name, objects: make(map[string]memObject)}
+}
+
+func (b *memBucket) put(key string, data []byte, modtime time.Time) {
+	sum := md5.Sum(data)
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = memObject{
+		key: listedKey{
+			Key:          key,
+			LastModified: modtime.UTC().Format(time.RFC3339Nano),
+			Size:         int64(len(data)),
+			ETag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+			StorageClass: "STANDARD",
+		},
+		data:   data,
+		header: header,
+	}
+}
+
+// copyTo puts all the objects of this bucket in another one.
+func (b *memBucket) copyTo(dst *memBucket) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	for k, obj := range b.objects {
+		dst.objects[k] = obj
+	}
+}
+
+// keys returns all the keys in the bucket, sorted by name.
+func (b *memBucket) keys() []listedKey {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	keys := make([]listedKey, 0, len(b.objects))
+	for _, obj := range b.objects {
+		keys = append(keys, obj.key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	return keys
+}
+
+func (b *memBucket) Name() string { return b.name }
+
+func (b *memBucket) List(ctx context.Context, prefix, delim, marker string, max int) (*listResp, error) {
+	resp := &listResp{
+		Name:      b.name,
+		Prefix:    prefix,
+		Delimiter: delim,
+		Marker:    marker,
+		MaxKeys:   max,
+	}
+	seenPrefix := make(map[string]bool)
+	for _, k := range b.keys() {
+		if k.Key <= marker || !strings.HasPrefix(k.Key, prefix) {
+			continue
+		}
+		if len(resp.Contents)+len(resp.CommonPrefixes) == max {
+			resp.IsTruncated = true
+			break
+		}
+		rest := k.Key[len(prefix):]
+		if i := strings.Index(rest, delim); delim != "" && i >= 0 {
+			pfx := prefix + rest[:i+len(delim)]
+			if !seenPrefix[pfx] {
+				seenPrefix[pfx] = true
+				resp.CommonPrefixes = append(resp.CommonPrefixes, pfx)
+				resp.NextMarker = pfx
+			}
+			continue
+		}
+		resp.Contents = append(resp.Contents, k)
+		resp.NextMarker = k.Key
+	}
+	return resp, nil
+}
+
+// unversioned is the version of keys in buckets without versioning.
+const unversioned = "null"
+
+// ListVersions lists the keys as if the bucket wasn't versioned.
+func (b *memBucket) ListVersions(ctx context.Context, prefix, delim, keyMarker, versionMarker string, max int) (*listVersionsResp, error) {
+	list, err := b.List(ctx, prefix, delim, keyMarker, max)
+	if err != nil {
+		return nil, err
+	}
+	resp := &listVersionsResp{
+		Name:            b.name,
+		Prefix:          prefix,
+		Delimiter:       delim,
+		KeyMarker:       keyMarker,
+		VersionIdMarker: versionMarker,
+		MaxKeys:         max,
+		IsTruncated:     list.IsTruncated,
+		NextKeyMarker:   list.NextMarker,
+		CommonPrefixes:  list.CommonPrefixes,
+	}
+	if list.IsTruncated {
+		resp.NextVersionIdMarker = unversioned
+	}
+	for _, k := range list.Contents {
+		resp.Versions = append(resp.Versions, keyVersion{
+			Key:          k.Key,
+			VersionId:    unversioned,
+			IsLatest:     true,
+			LastModified: k.LastModified,
+			ETag:         k.ETag,
+			Size:         k.Size,
+			StorageClass: k.StorageClass,
+			Owner:        k.Owner,
+		})
+	}
+	return resp, nil
+}
+
+func (b *memBucket) lookup(key, version string) (memObject, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	obj, ok := b.objects[key]
+	if !ok || (version != "" && version != unversioned) {
+		return obj, fmt.Errorf("%w: key %q in bucket %q", ErrKeyMissing, key, b.name)
+	}
+	return obj, nil
+}
+
+func (b *memBucket) GetReader(ctx context.Context, key, version string) (io.ReadCloser, error) {
+	obj, err := b.lookup(key, version)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (b *memBucket) Head(ctx context.Context, key, version string) (http.Header, error) {
+	obj, err := b.lookup(key, version)
+	if err != nil {
+		return nil, err
+	}
+	return obj.header, nil
+}
+
+func (b *memBucket) Tags(ctx context.Context, key, version string) (map[string]string, error) {
+	obj, err := b.lookup(key, version)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(obj.tags))
+	for k, v := range obj.tags {
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+func (b *memBucket) Retention(ctx context.Context, key, version string) (*retention, error) {
+	obj, err := b.lookup(key, version)
+	if err != nil {
+		return nil, err
+	}
+	return obj.retention, nil
+}
+
+func (b *memBucket) Lifecycle(ctx context.Context) ([]lifecycleRule, error) { return nil, nil }
+
+func (b *memBucket) SignedURL(key, version string, expires time.Time) string {
+	return "mem://" + b.name + "/" + key
+}
+
+// fault is a kind of failure injected in a bucket.
+type fault string
+
+const (
+	noFault fault = ""
+	// faultDrop makes a key missing.
+	faultDrop fault = "drop"
+	// faultETag corrupts the ETag of a key.
+	faultETag fault = "etag"
+	// faultDelay hides a key until some time has passed.
+	faultDelay fault = "delay"
+)
+
+// faultRates are the probabilities that each key of a bucket is affected by
+// a fault. A key is affected by at most one fault.
+type faultRates struct {
+	Drop        float64
+	CorruptETag float64
+	DelayRate   float64
+	// Delay is how long keys with a delayed visibility stay hidden.
+	Delay time.Duration
+}
+
+// faultyBucket injects faults in the keys of a bucket, behaving like a buggy
+// copy of it would.
+type faultyBucket struct {
+	bucket
+	rates   faultRates
+	created time.Time
+
+	mu     sync.Mutex
+	r      *rand.Rand
+	faults map[string]fault
+}
+
+func newFaultyBucket(b bucket, rates faultRates, seed int64) *faultyBucket {
+	return &faultyBucket{
+		bucket:  b,
+		rates:   rates,
+		created: time.Now(),
+		r:       rand.New(rand.NewSource(seed)),
+		faults:  make(map[string]fault),
+	}
+}
+
+// faultOf decides once, and then remembers, which fault affects a key.
+func (b *faultyBucket) faultOf(key string) fault {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if f, ok := b.faults[key]; ok {
+		return f
+	}
+	dice := b.r.Float64()
+	f := noFault
+	switch {
+	case dice < b.rates.Drop:
+		f = faultDrop
+	case dice < b.rates.Drop+b.rates.CorruptETag:
+		f = faultETag
+	case dice < b.rates.Drop+b.rates.CorruptETag+b.rates.DelayRate:
+		f = faultDelay
+	}
+	b.faults[key] = f
+	return f
+}
+
+// hides tells if a key is invisible because of its fault.
+func (b *faultyBucket) hides(key string) bool {
+	switch b.faultOf(key) {
+	case faultDrop:
+		return true
+	case faultDelay:
+		return time.Since(b.created) < b.rates.Delay
+	}
+	return false
+}
+
+func (b *faultyBucket) List(ctx context.Context, prefix, delim, marker string, max int) (*listResp, error) {
+	resp, err := b.bucket.List(ctx, prefix, delim, marker, max)
+	if err != nil {
+		return nil, err
+	}
+	contents := resp.Contents[:0:0]
+	for _, k := range resp.Contents {
+		if b.hides(k.Key) {
+			continue
+		}
+		if b.faultOf(k.Key) == faultETag {
+			k.ETag = `"` + strings.Repeat("0", 32) + `"`
+		}
+		contents = append(contents, k)
+	}
+	resp.Contents = contents
+	return resp, nil
+}
+
+func (b *faultyBucket) ListVersions(ctx context.Context, prefix, delim, keyMarker, versionMarker string, max int) (*listVersionsResp, error) {
+	resp, err := b.bucket.ListVersions(ctx, prefix, delim, keyMarker, versionMarker, max)
+	if err != nil {
+		return nil, err
+	}
+	versions := resp.Versions[:0:0]
+	for _, kv := range resp.Versions {
+		if b.hides(kv.Key) {
+			continue
+		}
+		if b.faultOf(kv.Key) == faultETag {
+			kv.ETag = `"` + strings.Repeat("0", 32) + `"`
+		}
+		versions = append(versions, kv)
+	}
+	resp.Versions = versions
+	return resp, nil
+}
+
+func (b *faultyBucket) GetReader(ctx context.Context, key, version string) (io.ReadCloser, error) {
+	if b.hides(key) {
+		return nil, fmt.Errorf("%w: key %q in bucket %q", ErrKeyMissing, key, b.Name())
+	}
+	return b.bucket.GetReader(ctx, key, version)
+}
+
+func (b *faultyBucket) Head(ctx context.Context, key, version string) (http.Header, error) {
+	if b.hides(key) {
+		return nil, fmt.Errorf("%w: key %q in bucket %q", ErrKeyMissing, key, b.Name())
+	}
+	return b.bucket.Head(ctx, key, version)
+}
+
+func (b *faultyBucket) Tags(ctx context.Context, key, version string) (map[string]string, error) {
+	if b.hides(key) {
+		return nil, fmt.Errorf("%w: key %q in bucket %q", ErrKeyMissing, key, b.Name())
+	}
+	return b.bucket.Tags(ctx, key, version)
+}
+
+func (b *faultyBucket) Retention(ctx context.Context, key, version string) (*retention, error) {
+	if b.hides(key) {
+		return nil, fmt.Errorf("%w: key %q in bucket %q", ErrKeyMissing, key, b.Name())
+	}
+	return b.bucket.Retention(ctx, key, version)
+}
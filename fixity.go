@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errManifest is returned when reading from a checksum manifest what it
+// doesn't describe.
+var errManifest = errors.New("not described by a checksum manifest")
+
+// checksumManifest is a sidecar manifest of the checksums of keys, such as
+// produced by an uploader, in the format of md5sum, sha256sum and the like,
+// or of the manifests of BagIt bags: a line per key, its hex encoded
+// checksum followed by its name.
+type checksumManifest struct {
+	// inventory describes the keys, modified when the manifest was.
+	*inventory
+	hash string
+	sums map[string]string
+}
+
+// readChecksumManifest reads a manifest of checksums computed with one of
+// contentHashes. Names escaped by the tools of coreutils, whose lines start
+// with a backslash, are unescaped.
+func readChecksumManifest(filename, bucket, algorithm string) (*checksumManifest, error) {
+	if err := loadContentHash(algorithm); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := &checksumManifest{
+		inventory: &inventory{bucket: bucket, at: info.ModTime().UTC()},
+		hash:      algorithm,
+		sums:      make(map[string]string),
+	}
+	modified := m.at.Format(time.RFC3339Nano)
+	size := contentHashes[algorithm]().Size()
+
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		escaped := strings.HasPrefix(text, `\`)
+		sum, name, ok := strings.Cut(strings.TrimPrefix(text, `\`), " ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: no name after the checksum", line)
+		}
+		// binary mode is marked with a star, text mode with a space
+		name = strings.TrimPrefix(strings.TrimPrefix(strings.TrimLeft(name, " \t"), "*"), " ")
+		if escaped {
+			name = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(name)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("line %d: no name after the checksum", line)
+		}
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != size {
+			return nil, fmt.Errorf("line %d: key %q: %q isn't a checksum of %s", line, name, sum, algorithm)
+		}
+		if _, ok := m.sums[name]; ok {
+			return nil, fmt.Errorf("line %d: key %q is listed twice", line, name)
+		}
+		m.sums[name] = strings.ToLower(sum)
+		m.keys = append(m.keys, listedKey{Key: name, LastModified: modified})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(m.keys, func(i, j int) bool { return m.keys[i].Key < m.keys[j].Key })
+	return m, nil
+}
+
+// manifestBucket is a bucket as it was described by a checksum manifest.
+// Only its listings and the checksums of its keys can be read.
+type manifestBucket struct {
+	snapshotBucket
+	manifest *checksumManifest
+}
+
+func newManifestBucket(m *checksumManifest) manifestBucket {
+	return manifestBucket{snapshotBucket: snapshotBucket{m.inventory}, manifest: m}
+}
+
+func (b manifestBucket) checksumOf(ctx context.Context, o object, algorithm string) (string, error) {
+	sum, ok := b.manifest.sums[o.Key]
+	if !ok || algorithm != b.manifest.hash || o.VersionID != "" {
+		return "", fmt.Errorf("checksum of key %q with %s: %w", o.Key, algorithm, errManifest)
+	}
+	return sum, nil
+}
+
+// withManifest is the config of an audit verifying the content of the keys
+// of the destination against the checksums of a manifest, computed with the
+// content_hash of the config. Keys of any age are sampled. As for
+// snapshots, see withSnapshot, versions, deletions, bidirectional sampling,
+// the state directory and exports are left out, and only the content check
+// is performed, which also tells the keys missing from the destination.
+func (c *config) withManifest(at time.Time) *config {
+	m := *c
+	m.Checks = []string{"content"}
+	m.CheckYoungest = 0
+	m.CheckOldest = at.Sub(time.Unix(0, 0))
+	m.SampleVersions = false
+	m.Bidirectional = false
+	m.HotPrefixes = nil
+	m.DeleteMarkers = deleteMarkersConfig{}
+	m.Reconcile = false
+	m.InventoryDiff = nil
+	m.Flapping = nil
+	m.StateDir = ""
+	m.Export = nil
+	m.Claims = nil
+	m.Events = nil
+	// the content check is the point of the audit
+	m.Degradation = nil
+	return &m
+}
+
+// fixityRecord is the fixity of a key, or of a version of it, as it was when
+// first verified by a fixity audit.
+type fixityRecord struct {
+	Key          string    `json:"key"`
+	Version      string    `json:"version,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	Size         int64     `json:"size"`
+	LastModified string    `json:"last_modified"`
+	Hash         string    `json:"hash"`
+	Checksum     string    `json:"checksum"`
+	Recorded     time.Time `json:"recorded"`
+}
+
+// fixityStore is the record of the fixity of the keys in the state
+// directory, read on first use.
+type fixityStore struct {
+	state   stateDir
+	once    sync.Once
+	err     error
+	mu      sync.Mutex
+	records map[object]fixityRecord
+}
+
+func fixityID(key, version string) object { return object{Key: key, VersionID: version} }
+
+func (s *fixityStore) load() error {
+	s.once.Do(func() {
+		records, err := s.state.readFixity()
+		if err != nil {
+			s.err = fmt.Errorf("can't read fixity records: %w", err)
+			return
+		}
+		s.records = make(map[object]fixityRecord, len(records))
+		for _, rec := range records {
+			s.records[fixityID(rec.Key, rec.Version)] = rec
+		}
+	})
+	return s.err
+}
+
+func (s *fixityStore) lookup(key, version string) (fixityRecord, bool, error) {
+	if err := s.load(); err != nil {
+		return fixityRecord{}, false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[fixityID(key, version)]
+	return rec, ok, nil
+}
+
+func (s *fixityStore) record(rec fixityRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.state.appendFixity(rec); err != nil {
+		return fmt.Errorf("can't record fixity of key %q: %w", rec.Key, err)
+	}
+	s.records[fixityID(rec.Key, rec.Version)] = rec
+	return nil
+}
+
+// FixityCheck verifies that a key of a single bucket is as it was when it
+// was first verified, as recorded in the state directory: that its ETag,
+// size and the checksum of its content didn't change since. Keys never
+// verified before are recorded, and match. A key whose content changed but
+// not its modification time has rotten, while a key modified since was
+// overwritten, and is recorded again. Versions of keys are recorded apart,
+// so that a new version is recorded when first verified.
+type FixityCheck struct {
+	hash  string
+	store *fixityStore
+}
+
+func newFixityCheck(cfg *config) (Check, error) {
+	if cfg.StateDir == "" {
+		return nil, configErrorf("check %q records the fixity of keys in the state_dir, which is required", "fixity")
+	}
+	hash := cfg.ContentHash
+	if hash == "" {
+		hash = DefaultContentHash
+	}
+	return FixityCheck{hash: hash, store: &fixityStore{state: stateDir(cfg.StateDir)}}, nil
+}
+
+func (FixityCheck) Name() string { return "fixity" }
+
+func (c FixityCheck) Check(p *keyPair) (log.Fields, error) {
+	if p.got == nil {
+		return missingFields(p), nil
+	}
+	rec, ok, err := c.store.lookup(p.got.Key, p.got.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := digestKey(p.ctx, p.dst, *p.got, c.hash)
+	if err != nil {
+		return nil, err
+	}
+	if ok && rec.LastModified != p.got.LastModified {
+		log.WithFields(log.Fields{
+			"key":                p.got.Key,
+			"want.last_modified": rec.LastModified,
+			"got.last_modified":  p.got.LastModified,
+		}).Info("key was overwritten since its fixity was recorded, recording it again")
+	}
+	if !ok || rec.LastModified != p.got.LastModified {
+		return nil, c.store.record(fixityRecord{
+			Key:          p.got.Key,
+			Version:      p.got.VersionID,
+			ETag:         p.got.ETag,
+			Size:         p.got.Size,
+			LastModified: p.got.LastModified,
+			Hash:         c.hash,
+			Checksum:     sum,
+			Recorded:     time.Now().UTC(),
+		})
+	}
+
+	fields := log.Fields{}
+	if rec.ETag != "" && p.got.ETag != "" && rec.ETag != p.got.ETag {
+		fields["want.etag"], fields["got.etag"] = rec.ETag, p.got.ETag
+	}
+	if rec.Size != p.got.Size {
+		fields["want.size"], fields["got.size"] = rec.Size, p.got.Size
+	}
+	// checksums of another hash than the configured one can't be compared
+	if rec.Hash == c.hash && rec.Checksum != sum {
+		fields["want."+c.hash], fields["got."+c.hash] = rec.Checksum, sum
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	fields["recorded"] = rec.Recorded
+	fields["cause"] = "corrupted"
+	return fields, nil
+}
+
+// withFixity is the config of a fixity audit of the source bucket alone,
+// verifying its keys with the fixity check against their records in the
+// fixity directory of the state directory, so that its rounds, follow-ups
+// and records don't mix with those of the audit. The destination,
+// namespaces, deletions and bidirectional sampling are left out.
+func (c *config) withFixity() (*config, error) {
+	if c.StateDir == "" {
+		return nil, configErrorf("a fixity audit records the fixity of keys in the state_dir, which is required")
+	}
+	f := *c
+	f.StateDir = filepath.Join(c.StateDir, fixityDir)
+	f.Destination = c.Source
+	f.Checks = []string{"fixity"}
+	f.KeyNormalization = nil
+	f.Namespaces = nil
+	f.Bidirectional = false
+	f.DeleteMarkers = deleteMarkersConfig{}
+	f.Reconcile = false
+	f.InventoryDiff = nil
+	return &f, nil
+}
+
+func fixityCommand(abort <-chan struct{}) cli.Command {
+	cfgFlag := cli.StringFlag{
+		Name:  "cfg",
+		Usage: "path to the JSON config file",
+	}
+	modelFlag := cli.StringFlag{
+		Name:  "model",
+		Usage: "path to a JSON file representing model of the keys in the source bucket, the model of the fixity audit or else of the state directory by default",
+	}
+	buildModelFlag := cli.StringFlag{
+		Name:  "build-model",
+		Usage: "path to a gzip'd JSON file representing all the keys in the source bucket, to build a model from",
+	}
+	onceFlag := cli.BoolFlag{
+		Name:  "once",
+		Usage: "audit a single round, then exit",
+	}
+
+	doFixity := func(ctx *cli.Context) {
+		cfg, err := mustConfig(ctx, cfgFlag).withFixity()
+		if err != nil {
+			fail(ctx, "error: %v", err)
+		}
+		state, err := openStateDir(cfg.StateDir)
+		if err != nil {
+			fail(ctx, "error: can't open state directory %q: %v", cfg.StateDir, err)
+		}
+		var model *bucketModel
+		switch {
+		case ctx.String(buildModelFlag.Name) != "":
+			model = mustBuildModel(ctx, cfg.Source.Bucket, buildModelFlag, abort)
+			if err := state.saveModel(modelFile, model); err != nil {
+				fail(ctx, "error: can't save model in state directory: %v", err)
+			}
+		case ctx.String(modelFlag.Name) != "":
+			model = mustRetrieveModel(ctx, modelFlag)
+		default:
+			// the model of the audit describes the same bucket
+			filename := state.path(modelFile)
+			if _, err := os.Stat(filename); os.IsNotExist(err) {
+				filename = filepath.Join(filepath.Dir(cfg.StateDir), modelFile)
+			}
+			model = mustRetrieveModelFile(ctx, filename)
+		}
+
+		mustPrepareEndpoints(ctx, cfg.Source)
+		bkt := wrapEndpoints(cfg, "source", cfg.Source, mustAWSBucket(ctx, cfg.Source))
+		v, err := newVerifier(cfg, *model, bkt, bkt, abort)
+		if err != nil {
+			fail(ctx, "error: can't create verifier, %v", err)
+		}
+		if ctx.Bool(onceFlag.Name) {
+			if _, err := v.once(); err != nil {
+				log.WithField("kind", errorKind(err)).Fatal(err)
+			}
+			return
+		}
+		if err := v.execute(); err != nil {
+			log.WithField("kind", errorKind(err)).Fatal(err)
+		}
+	}
+
+	return cli.Command{
+		Name:  "fixity",
+		Usage: "Continuously samples keys in the source bucket, check that they didn't change.",
+		Description: strings.TrimSpace(`
+Audits the fixity of the keys of the source bucket alone, to detect bit rot or
+unexpected overwrites. The first time a key is sampled, its ETag, size and the
+checksum of its content, computed with the content_hash of the config, are
+recorded in the fixity directory of the state directory. When it is sampled
+again, they are verified against the record, and a mismatch tells the key was
+corrupted since. A key modified since it was recorded was overwritten, and is
+recorded again. Versions of keys are recorded apart when sample_versions is
+set. The destination of the config is left out, and a state_dir is required.
+The model is the one of the fixity audit, or else the one of the audit.`),
+		Flags: []cli.Flag{
+			cfgFlag, modelFlag, buildModelFlag, onceFlag,
+		},
+		Action: doFixity,
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults of the debouncing of alerts on keys, see flappingConfig.
+const (
+	DefaultAlertAfter   = 3
+	DefaultResolveAfter = 3
+)
+
+// flappingConfig debounces the alerts on keys whose verification flaps
+// between match and mismatch, as keys being synced do. Keys that mismatched
+// are verified again at the start of the following rounds, until they're
+// alerted on, or until their alert resolves.
+type flappingConfig struct {
+	// AlertAfter is how many verifications of a key in a row must mismatch
+	// before it's alerted on. The mismatches before are pending.
+	AlertAfter int `json:"alert_after,omitempty"`
+	// ResolveAfter is how many verifications of a key alerted on in a row
+	// must match before its alert resolves. It's still reported as a
+	// mismatch until then.
+	ResolveAfter int `json:"resolve_after,omitempty"`
+}
+
+func loadFlapping(f *flappingConfig) error {
+	if f.AlertAfter == 0 {
+		f.AlertAfter = DefaultAlertAfter
+	}
+	if f.ResolveAfter == 0 {
+		f.ResolveAfter = DefaultResolveAfter
+	}
+	if f.AlertAfter < 0 || f.ResolveAfter < 0 {
+		return fmt.Errorf("alert_after and resolve_after must be positive")
+	}
+	return nil
+}
+
+// flapState is how the verifications of a key mismatching went lately.
+type flapState struct {
+	Key object `json:"key"`
+	// Reverse, Namespace and Hot tell the verifier that tracks the key,
+	// see verifier.flapStates.
+	Reverse    bool   `json:"reverse,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Hot        bool   `json:"hot,omitempty"`
+	Check      string `json:"check"`
+	Mismatches int    `json:"mismatches"`
+	Matches    int    `json:"matches"`
+	// AlertingSince is when the key was first alerted on, zero if it isn't
+	// yet.
+	AlertingSince time.Time `json:"alerting_since,omitempty"`
+}
+
+// flapTracker tracks the keys a verifier found mismatching, until their
+// mismatch is either alerted on and resolved, or flaps back to a match.
+type flapTracker struct {
+	cfg  flappingConfig
+	mu   sync.Mutex
+	keys map[object]*flapState
+}
+
+func newFlapTracker(cfg flappingConfig) *flapTracker {
+	return &flapTracker{cfg: cfg, keys: make(map[object]*flapState)}
+}
+
+func flapID(k object) object { return object{Key: k.Key, VersionID: k.VersionID} }
+
+// judge debounces the result of the verification of a key: a mismatch is
+// pending until the key mismatched AlertAfter times in a row, and a key
+// alerted on still mismatches until it matched ResolveAfter times in a row.
+// Other outcomes say nothing about whether the key flaps.
+func (t *flapTracker) judge(res *Result, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := flapID(res.want)
+	st := t.keys[id]
+	switch res.Outcome {
+	case outcomeMismatch:
+		if res.Details == nil {
+			res.Details = log.Fields{}
+		}
+		if st == nil {
+			st = &flapState{Key: res.want}
+			t.keys[id] = st
+		}
+		st.Check = res.Check
+		st.Matches = 0
+		st.Mismatches++
+		if st.AlertingSince.IsZero() {
+			if st.Mismatches < t.cfg.AlertAfter {
+				res.Outcome = outcomePending
+				res.Details["mismatches"] = st.Mismatches
+				res.Details["alert_after"] = t.cfg.AlertAfter
+				return
+			}
+			st.AlertingSince = now
+		}
+		res.Details["alerting_since"] = st.AlertingSince
+
+	case outcomeMatch:
+		switch {
+		case st == nil:
+		case st.AlertingSince.IsZero():
+			log.WithField("key", res.Key).Info("pending mismatch at key flapped back to a match")
+			delete(t.keys, id)
+		case st.Matches+1 >= t.cfg.ResolveAfter:
+			log.WithFields(log.Fields{
+				"key":            res.Key,
+				"alerting_since": st.AlertingSince,
+			}).Info("alert on key resolved")
+			delete(t.keys, id)
+		default:
+			st.Mismatches = 0
+			st.Matches++
+			*res = Result{
+				Key:     res.Key,
+				Version: res.Version,
+				Outcome: outcomeMismatch,
+				Check:   st.Check,
+				Details: log.Fields{
+					"got":            "match",
+					"matches":        st.Matches,
+					"resolve_after":  t.cfg.ResolveAfter,
+					"alerting_since": st.AlertingSince,
+				},
+				want: res.want,
+				got:  res.got,
+			}
+		}
+	}
+}
+
+// forget stops tracking a key.
+func (t *flapTracker) forget(k object) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.keys, flapID(k))
+}
+
+// states returns the state of the keys tracked, by key.
+func (t *flapTracker) states() []flapState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	states := make([]flapState, 0, len(t.keys))
+	for _, st := range t.keys {
+		states = append(states, *st)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Key.Key != states[j].Key.Key {
+			return states[i].Key.Key < states[j].Key.Key
+		}
+		return states[i].Key.VersionID < states[j].Key.VersionID
+	})
+	return states
+}
+
+// restore tracks the keys of a checkpoint that tracks tells the tracker
+// tracked.
+func (t *flapTracker) restore(states []flapState, tracks func(flapState) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, st := range states {
+		if !tracks(st) {
+			continue
+		}
+		st := st
+		st.Reverse, st.Namespace = false, ""
+		t.keys[flapID(st.Key)] = &st
+	}
+}
+
+// verifyFlapping verifies again n of the keys that mismatched in previous
+// rounds and are either pending or alerted on, for their mismatch to be
+// confirmed or resolved.
+func (v *verifier) verifyFlapping(report *RoundReport, n int) {
+	if v.flaps == nil || n == 0 {
+		return
+	}
+	states := v.flaps.states()
+	if n < len(states) {
+		// the keys left out this round are the first verified next round
+		start := v.flapOffset % len(states)
+		states = append(states[start:], states[:start]...)[:n]
+		v.flapOffset = start + n
+	}
+	log.Infof("verifying %d keys that mismatched in previous rounds", len(states))
+	v.flapped = make(map[uint64]struct{}, len(states))
+	for _, st := range states {
+		select {
+		case <-v.abort:
+			log.Warn("verifier: aborting verification of mismatching keys")
+			return
+		default:
+		}
+		v.flapped[identify(st.Key).hash()] = struct{}{}
+
+		// the key may have changed or disappeared since, unlike versions of
+		// keys
+		want, err := &st.Key, error(nil)
+		if st.Key.VersionID == "" {
+			want, err = findKey(context.Background(), v.src, st.Key.Key)
+		}
+		var res Result
+		switch {
+		case err != nil:
+			res = inconclusiveResult(st.Key.Key, err)
+			res.want = st.Key
+		case want == nil:
+			log.WithField("key", st.Key.Key).Info("forgetting mismatch, key was removed from source")
+			v.flaps.forget(st.Key)
+			continue
+		default:
+			res = v.verifyKeyWithDeadline(*want)
+		}
+		res.FollowUp = true
+		v.addResult(report, res)
+	}
+}
+
+// flapStates returns the state of the keys tracked by the verifier and by
+// those verifying keys on its behalf, telling which one tracks each key.
+func (v *verifier) flapStates() []flapState {
+	if v.flaps == nil {
+		return nil
+	}
+	states := v.flaps.states()
+	if v.reverse != nil {
+		for _, st := range v.reverse.flaps.states() {
+			st.Reverse = true
+			states = append(states, st)
+		}
+	}
+	for _, na := range v.namespaces {
+		for _, st := range na.v.flaps.states() {
+			st.Namespace = na.Name
+			states = append(states, st)
+		}
+	}
+	if v.hot != nil {
+		for _, st := range v.hot.v.flaps.states() {
+			st.Hot = true
+			states = append(states, st)
+		}
+	}
+	return states
+}
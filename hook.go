@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultHookTimeout is how long the hook program can run on a key before
+// it's killed, if the config doesn't say otherwise.
+const DefaultHookTimeout = time.Minute
+
+// HookCheck verifies a key by invoking a user provided program. The program
+// receives a JSON description of the key in both buckets on its stdin, and
+// the key is considered to match if the program exits with status 0.
+type HookCheck struct {
+	audit   string
+	labels  map[string]string
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+func newHookCheck(cfg *config) (Check, error) {
+	if cfg.Hook.Command == "" {
+		return nil, errors.New("no hook command configured")
+	}
+	timeout := cfg.Hook.Timeout
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+	return HookCheck{
+		audit:   cfg.AuditName,
+		labels:  cfg.Labels,
+		command: cfg.Hook.Command,
+		args:    cfg.Hook.Args,
+		timeout: timeout,
+	}, nil
+}
+
+func (HookCheck) Name() string { return "hook" }
+
+// hookObject describes a key to the hook program. The URL is presigned and
+// valid for as long as the hook is allowed to run, so that the program can
+// download the key without credentials.
+type hookObject struct {
+	Bucket       string `json:"bucket"`
+	Key          string `json:"key"`
+	Version      string `json:"version,omitempty"`
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+func newHookObject(bkt bucket, k object, expires time.Time) *hookObject {
+	return &hookObject{
+		Bucket:       bkt.Name(),
+		Key:          k.Key,
+		Version:      k.VersionID,
+		URL:          bkt.SignedURL(k.Key, k.VersionID, expires),
+		Size:         k.Size,
+		ETag:         k.ETag,
+		LastModified: k.LastModified,
+	}
+}
+
+func (h HookCheck) Check(p *keyPair) (log.Fields, error) {
+	if p.got == nil {
+		return missingFields(p), nil
+	}
+	expires := time.Now().Add(h.timeout)
+	input, err := json.Marshal(struct {
+		Audit       string            `json:"audit,omitempty"`
+		Labels      map[string]string `json:"labels,omitempty"`
+		Source      *hookObject       `json:"source"`
+		Destination *hookObject       `json:"destination"`
+	}{
+		Audit:       h.audit,
+		Labels:      h.labels,
+		Source:      newHookObject(p.src, p.want, expires),
+		Destination: newHookObject(p.dst, *p.got, expires),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, h.timeout)
+	defer cancel()
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.command, h.args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("hook %q didn't complete within %v", h.command, h.timeout)
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		return log.Fields{
+			"hook":        h.command,
+			"hook.status": cmd.ProcessState.ExitCode(),
+			"hook.output": strings.TrimSpace(output.String()),
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("running hook %q: %v", h.command, err)
+	}
+	return nil, nil
+}
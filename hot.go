@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Defaults of the audit of hot prefixes, see hotConfig.
+const (
+	DefaultHotShare    = 0.5
+	DefaultHotPrefixes = 5
+	DefaultHotRounds   = 24
+)
+
+// hotConfig prioritizes the prefixes written to the most, where replication
+// bugs are the most likely to show, over cold prefixes such as archives. The
+// rate of change of the first level of prefixes is estimated each round, see
+// changeRate, and recorded in the history. Share of the keys of each round
+// are sampled under the Prefixes prefixes written to the most over the last
+// Rounds rounds, the others in the whole bucket as usual, which keeps the
+// rates of all the prefixes estimated.
+type hotConfig struct {
+	Share    float64 `json:"share,omitempty"`
+	Prefixes int     `json:"prefixes,omitempty"`
+	Rounds   int     `json:"rounds,omitempty"`
+	// MinWritesPerHour is the rate of change under which prefixes are
+	// cold, however few prefixes are hot.
+	MinWritesPerHour float64 `json:"min_writes_per_hour,omitempty"`
+}
+
+func loadHot(h *hotConfig) error {
+	if h.Share < 0 || h.Share >= 1 {
+		return fmt.Errorf("share must be between 0 and 1")
+	}
+	if h.Prefixes < 0 || h.Rounds < 0 || h.MinWritesPerHour < 0 {
+		return fmt.Errorf("prefixes, rounds and min_writes_per_hour can't be negative")
+	}
+	if h.Share == 0 {
+		h.Share = DefaultHotShare
+	}
+	if h.Prefixes == 0 {
+		h.Prefixes = DefaultHotPrefixes
+	}
+	if h.Rounds == 0 {
+		h.Rounds = DefaultHotRounds
+	}
+	return nil
+}
+
+// hotAudit samples keys under the hot prefixes, by its own verifier.
+type hotAudit struct {
+	cfg hotConfig
+	v   *verifier
+	// rates are the writes per hour of the prefixes in the last rounds,
+	// oldest first.
+	rates []map[string]float64
+}
+
+// hotCheckCount is how many of the keys of each round are sampled under the
+// hot prefixes.
+func hotCheckCount(cfg *config) int {
+	n := int(math.Round(cfg.HotPrefixes.Share * float64(cfg.CheckCount)))
+	switch {
+	case n < 1:
+		return 1
+	case n >= cfg.CheckCount:
+		// keys are still sampled in the whole bucket, to estimate the
+		// rates of change
+		return cfg.CheckCount - 1
+	}
+	return n
+}
+
+// newHotAudit creates a verifier for the hot prefixes, sharing the buckets
+// and model of the verifier auditing the whole bucket, and takes its share
+// of the keys sampled in each round.
+func (v *verifier) newHotAudit() error {
+	cfg := v.subConfig()
+	cfg.CheckCount = hotCheckCount(v.cfg)
+	cfg.SampleWorkers, cfg.VerifyWorkers = defaultWorkers(cfg.CheckCount)
+	sub, err := newVerifier(&cfg, v.model, v.src, v.dst, v.abort)
+	if err != nil {
+		return fmt.Errorf("hot prefixes: %w", err)
+	}
+	sub.lifecycle = v.lifecycle
+	if v.cfg.Flapping != nil {
+		sub.flaps = newFlapTracker(*v.cfg.Flapping)
+	}
+	rest := *v.cfg
+	rest.CheckCount -= cfg.CheckCount
+	v.cfg = &rest
+	v.hot = &hotAudit{cfg: *v.cfg.HotPrefixes, v: sub}
+	return nil
+}
+
+// observe tracks the rates of change of the prefixes estimated in a round.
+func (h *hotAudit) observe(rates map[string]float64) {
+	h.rates = append(h.rates, rates)
+	if len(h.rates) > h.cfg.Rounds {
+		h.rates = h.rates[len(h.rates)-h.cfg.Rounds:]
+	}
+}
+
+// restore tracks the rates of change recorded in the history.
+func (h *hotAudit) restore(history []roundSummary) {
+	for _, summary := range history {
+		if summary.WritesPerHour != nil {
+			h.observe(summary.WritesPerHour)
+		}
+	}
+}
+
+// hottest returns the prefixes written to the most over the rounds tracked,
+// those written to the most first. The keys at the root of the bucket aren't
+// under a prefix, and are never hot.
+func (h *hotAudit) hottest() []string {
+	mean := make(map[string]float64)
+	for _, rates := range h.rates {
+		for prefix, rate := range rates {
+			mean[prefix] += rate / float64(len(h.rates))
+		}
+	}
+	var prefixes []string
+	for prefix, rate := range mean {
+		if prefix != "" && rate > 0 && rate >= h.cfg.MinWritesPerHour {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		ri, rj := mean[prefixes[i]], mean[prefixes[j]]
+		if ri != rj {
+			return ri > rj
+		}
+		return prefixes[i] < prefixes[j]
+	})
+	if len(prefixes) > h.cfg.Prefixes {
+		prefixes = prefixes[:h.cfg.Prefixes]
+	}
+	return prefixes
+}
+
+// prefixWritesPerHour are the writes per hour of the prefixes of a rate of
+// change, as the history records them.
+func prefixWritesPerHour(rate *changeRate) map[string]float64 {
+	if rate == nil {
+		return nil
+	}
+	rates := make(map[string]float64, len(rate.Prefixes))
+	for prefix, pr := range rate.Prefixes {
+		rates[prefix] = pr.WritesPerHour
+	}
+	return rates
+}
+
+// auditHot verifies keys sampled under the hot prefixes, adding their
+// results to the report. Until a rate of change is estimated, they're
+// sampled in the whole bucket.
+func (v *verifier) auditHot(r *rand.Rand, now time.Time, report *RoundReport) error {
+	if report.ChangeRate != nil {
+		v.hot.observe(prefixWritesPerHour(report.ChangeRate))
+	}
+	prefixes := v.hot.hottest()
+	if len(prefixes) == 0 {
+		log.Info("no prefix is hot yet, sampling hot keys in the whole bucket")
+	}
+	v.hot.v.prefixes = prefixes
+	report.HotPrefixes = prefixes
+	return v.verifyWith(v.hot.v, r, now, report, func(res *Result) {
+		res.Hot = true
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"regexp"
+)
+
+// labelName is what the names of labels look like, so that they can be used
+// as is by log and metric pipelines.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func validateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !labelName.MatchString(name) {
+			return fmt.Errorf("invalid label name %q, want letters, digits and underscores", name)
+		}
+	}
+	return nil
+}
+
+// identity are the fields telling the audit apart from the others: its
+// name as "audit", and each label prefixed by "label.".
+func (c *config) identity() log.Fields {
+	fields := make(log.Fields, len(c.Labels)+1)
+	if c.AuditName != "" {
+		fields["audit"] = c.AuditName
+	}
+	for name, value := range c.Labels {
+		fields["label."+name] = value
+	}
+	return fields
+}
+
+// identityHook adds the identity of the audit to every log line.
+type identityHook struct {
+	fields log.Fields
+}
+
+func (identityHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+		log.InfoLevel,
+		log.DebugLevel,
+	}
+}
+
+func (h identityHook) Fire(e *log.Entry) error {
+	for k, v := range h.fields {
+		if _, ok := e.Data[k]; !ok {
+			e.Data[k] = v
+		}
+	}
+	return nil
+}
+
+// labelLogs adds the identity of the audit to every log line from now on.
+func labelLogs(cfg *config) {
+	fields := cfg.identity()
+	if len(fields) == 0 {
+		return
+	}
+	log.AddHook(identityHook{fields: fields})
+}
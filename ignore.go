@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ignoreRule describes a known and accepted divergence between the buckets,
+// whose mismatches are ignored.
+type ignoreRule struct {
+	// Name identifies the rule in reports.
+	Name   string
+	Prefix string
+	// Key is a regular expression that the keys must match, if set.
+	Key string
+	key *regexp.Regexp
+	// Checks are the checks whose mismatches are ignored, or all of them if
+	// empty.
+	Checks []string
+	// Expires is when the divergence stops being accepted, if set.
+	Expires time.Time
+}
+
+// ignoreRuleFile is the representation of an ignore rule in JSON.
+type ignoreRuleFile struct {
+	Name    string   `json:"name,omitempty"`
+	Prefix  string   `json:"prefix,omitempty"`
+	Key     string   `json:"key,omitempty"`
+	Checks  []string `json:"checks,omitempty"`
+	Expires string   `json:"expires,omitempty"`
+}
+
+func loadIgnoreRules(files []ignoreRuleFile) ([]ignoreRule, error) {
+	rules := make([]ignoreRule, 0, len(files))
+	for i, f := range files {
+		rule := ignoreRule{
+			Name:   f.Name,
+			Prefix: f.Prefix,
+			Key:    f.Key,
+			Checks: f.Checks,
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("ignore[%d]", i)
+		}
+		if f.Key != "" {
+			re, err := regexp.Compile(f.Key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: key: %v", rule.Name, err)
+			}
+			rule.key = re
+		}
+		for _, check := range f.Checks {
+			if _, ok := checksByName[check]; !ok {
+				return nil, fmt.Errorf("%s: unknown check %q, valid checks are %s", rule.Name, check, checkNames())
+			}
+		}
+		if f.Expires != "" {
+			expires, err := time.Parse(time.RFC3339, f.Expires)
+			if err != nil {
+				return nil, fmt.Errorf("%s: expires: %v", rule.Name, err)
+			}
+			rule.Expires = expires
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r ignoreRule) file() ignoreRuleFile {
+	f := ignoreRuleFile{
+		Name:   r.Name,
+		Prefix: r.Prefix,
+		Key:    r.Key,
+		Checks: r.Checks,
+	}
+	if !r.Expires.IsZero() {
+		f.Expires = r.Expires.Format(time.RFC3339)
+	}
+	return f
+}
+
+// matches tells if the rule ignores the mismatch of a check on a key.
+func (r ignoreRule) matches(key, check string, now time.Time) bool {
+	if !r.Expires.IsZero() && now.After(r.Expires) {
+		return false
+	}
+	if !strings.HasPrefix(key, r.Prefix) {
+		return false
+	}
+	if r.key != nil && !r.key.MatchString(key) {
+		return false
+	}
+	if len(r.Checks) == 0 {
+		return true
+	}
+	for _, c := range r.Checks {
+		if c == check {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"math"
+	"path"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultInventoryDiffFrequency is how often the inventories of the buckets
+// are diffed, if the config doesn't say otherwise. S3 publishes inventories
+// daily or weekly.
+const DefaultInventoryDiffFrequency = 7 * 24 * time.Hour
+
+// MaxInventoryDiffResults is how many of the differences found by diffing
+// inventories are reported as results. The others are only counted.
+const MaxInventoryDiffResults = 1000
+
+// inventoryDateLayout is how S3 names the directories of the inventories it
+// publishes, after when they were taken.
+const inventoryDateLayout = "2006-01-02T15-04Z"
+
+var errInventoryDiffAborted = errors.New("diff of inventories aborted")
+
+// inventoryDiffConfig configures the diff of the inventories of both
+// buckets, an exhaustive comparison of their keys on a schedule, alongside
+// the keys sampled each round.
+type inventoryDiffConfig struct {
+	// Source and Destination are where S3 publishes the inventories of the
+	// buckets, URLs like s3://bucket/prefix/source-bucket/config-id/. The
+	// buckets of the inventories are reached with the credentials and in
+	// the region of the buckets they describe.
+	Source      string
+	Destination string
+	// Frequency is how often the inventories are diffed.
+	Frequency time.Duration
+}
+
+type inventoryDiffFile struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Frequency   string `json:"frequency,omitempty"`
+}
+
+func loadInventoryDiff(c *config, d *inventoryDiffFile) (*inventoryDiffConfig, error) {
+	diff := &inventoryDiffConfig{
+		Source:      d.Source,
+		Destination: d.Destination,
+		Frequency:   DefaultInventoryDiffFrequency,
+	}
+	if d.Frequency != "" {
+		var err error
+		if diff.Frequency, err = time.ParseDuration(d.Frequency); err != nil {
+			return nil, configErrorf("inventory_diff.frequency: %v", err)
+		}
+	}
+	for _, side := range []struct {
+		name   string
+		s3url  string
+		bucket awsConfig
+	}{{"source", d.Source, c.Source}, {"destination", d.Destination, c.Destination}} {
+		if _, _, err := parseS3URL(side.s3url); err != nil {
+			return nil, configErrorf("inventory_diff.%s: %v", side.name, err)
+		}
+		if side.bucket.Swift != nil || side.bucket.SFTP != nil || side.bucket.B2 != nil {
+			return nil, configErrorf("inventory_diff.%s: only buckets of S3 publish inventories", side.name)
+		}
+	}
+	// keys of the destination can't be mapped back to the source
+	if len(c.KeyNormalization) != 0 {
+		return nil, configErrorf("inventory_diff: can't diff inventories with a key_normalization")
+	}
+	return diff, nil
+}
+
+// inventoryDiff is the summary of the diff of the latest inventories of both
+// buckets. Keys modified too recently to have been replicated when both
+// inventories were taken are skipped.
+type inventoryDiff struct {
+	Source      *inventorySide `json:"source,omitempty"`
+	Destination *inventorySide `json:"destination,omitempty"`
+	// Missing are keys of the source that the destination doesn't have,
+	// Extra keys of the destination that the source doesn't have.
+	Missing        int `json:"missing"`
+	Extra          int `json:"extra"`
+	ETagMismatches int `json:"etag_mismatches,omitempty"`
+	SizeMismatches int `json:"size_mismatches,omitempty"`
+	Skipped        int `json:"skipped"`
+	// Truncated is set if more differences were found than reported as
+	// results, see MaxInventoryDiffResults.
+	Truncated bool `json:"truncated,omitempty"`
+	// Error is why the inventories couldn't be diffed.
+	Error string `json:"error,omitempty"`
+}
+
+// inventorySide is the inventory of a bucket that was diffed.
+type inventorySide struct {
+	Manifest string    `json:"manifest"`
+	At       time.Time `json:"at"`
+	Keys     int       `json:"keys"`
+}
+
+// inventoryLocation is where S3 publishes the inventories of a bucket.
+type inventoryLocation struct {
+	bkt    bucket
+	prefix string
+}
+
+// newInventoryLocation locates the inventories of the bucket of a, whose
+// bucket is reached with the credentials and in the region of a.
+func newInventoryLocation(a awsConfig, s3url string) (inventoryLocation, error) {
+	name, prefix, err := parseS3URL(s3url)
+	if err != nil {
+		return inventoryLocation{}, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	a.Bucket, a.Fallbacks = name, nil
+	if err := prepareEndpoints(a); err != nil {
+		return inventoryLocation{}, err
+	}
+	bkt, err := awsBucket(a)
+	if err != nil {
+		return inventoryLocation{}, err
+	}
+	return inventoryLocation{bkt: bkt, prefix: prefix}, nil
+}
+
+// latestInventory returns the key of the manifest of the latest inventory
+// published under prefix, in the directory named after when it was taken.
+func latestInventory(bkt bucket, prefix string) (string, error) {
+	latest, marker := "", ""
+	for {
+		resp, err := bkt.List(context.Background(), prefix, "/", marker, MaxList)
+		if err != nil {
+			return "", err
+		}
+		for _, dir := range resp.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(dir, prefix), "/")
+			if _, err := time.Parse(inventoryDateLayout, name); err == nil && dir > latest {
+				latest = dir
+			}
+		}
+		next := resp.NextMarker
+		if next == "" && len(resp.CommonPrefixes) > 0 {
+			next = resp.CommonPrefixes[len(resp.CommonPrefixes)-1]
+		}
+		if !resp.IsTruncated || next == "" || next == marker {
+			break
+		}
+		marker = next
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no inventory in bucket %q under %q", bkt.Name(), prefix)
+	}
+	return latest + "manifest.json", nil
+}
+
+// fetchInventory reads the inventory of a bucket whose manifest is at key,
+// passing the latest versions of the keys it lists to emit, and returns when
+// it was taken.
+func fetchInventory(bkt bucket, key, bucketName string, emit func(listedKey) error) (time.Time, error) {
+	rc, err := bkt.GetReader(context.Background(), key, "")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("can't get manifest %q: %w", key, err)
+	}
+	data, err := io.ReadAll(rc)
+	_ = rc.Close()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("can't read manifest %q: %w", key, err)
+	}
+	m, at, columns, err := parseInventoryManifest(data)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("manifest %q: %w", key, err)
+	}
+	if m.SourceBucket != bucketName {
+		return time.Time{}, fmt.Errorf("manifest %q is of an inventory of bucket %q, not %q", key, m.SourceBucket, bucketName)
+	}
+	for _, file := range m.Files {
+		if err := fetchInventoryFile(bkt, file.Key, columns, emit); err != nil {
+			return time.Time{}, fmt.Errorf("%s: %w", file.Key, err)
+		}
+	}
+	return at, nil
+}
+
+func fetchInventoryFile(bkt bucket, key string, columns map[string]int, emit func(listedKey) error) error {
+	rc, err := bkt.GetReader(context.Background(), key, "")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rc.Close() }()
+	var rd io.Reader = rc
+	if path.Ext(key) == ".gz" {
+		gz, err := gzip.NewReader(rc)
+		if err != nil {
+			return err
+		}
+		rd = gz
+	}
+	return readInventoryCSV(rd, columns, emit)
+}
+
+// inventoryDiffDue tells if the inventories are due to be diffed.
+func (v *verifier) inventoryDiffDue(now time.Time) bool {
+	return v.cfg.InventoryDiff != nil && now.Sub(v.checkpoint.LastInventoryDiff) >= v.cfg.InventoryDiff.Frequency
+}
+
+// diffInventories diffs the latest inventories of both buckets, adding the
+// differences to the report until MaxInventoryDiffResults of them are. The
+// inventories are sorted apart, spilling to disk rather than taking more
+// than a quarter of the memory jag is limited to each, then merged.
+func (v *verifier) diffInventories(now time.Time, report *RoundReport) *inventoryDiff {
+	diff := &inventoryDiff{}
+	log.Infof("diffing the latest inventories of bucket %q and bucket %q", v.src.Name(), v.dst.Name())
+	if err := v.diffLatestInventories(diff, report); err != nil {
+		log.WithField("error", err).Error("couldn't diff inventories")
+		diff.Error = err.Error()
+		return diff
+	}
+	v.checkpoint.LastInventoryDiff = now
+	log.WithFields(log.Fields{
+		"missing":         diff.Missing,
+		"extra":           diff.Extra,
+		"etag_mismatches": diff.ETagMismatches,
+		"size_mismatches": diff.SizeMismatches,
+		"skipped":         diff.Skipped,
+	}).Info("diffed inventories")
+	return diff
+}
+
+func (v *verifier) diffLatestInventories(diff *inventoryDiff, report *RoundReport) error {
+	budget := debug.SetMemoryLimit(-1)
+	if budget == math.MaxInt64 {
+		budget = 0
+	}
+	sorters := [2]*listingSorter{newListingSorter(budget / 4), newListingSorter(budget / 4)}
+	defer sorters[0].close()
+	defer sorters[1].close()
+
+	names := [2]string{v.cfg.Source.Bucket, v.cfg.Destination.Bucket}
+	sides := [2]**inventorySide{&diff.Source, &diff.Destination}
+	for i, loc := range v.inventories {
+		key, err := latestInventory(loc.bkt, loc.prefix)
+		if err != nil {
+			return err
+		}
+		sorter := sorters[i]
+		at, err := fetchInventory(loc.bkt, key, names[i], func(k listedKey) error {
+			// instances of a partitioned audit diff their own keys
+			if p := v.cfg.Partition; p != nil && !p.contains(k.Key) {
+				return nil
+			}
+			return sorter.add(k)
+		})
+		if err != nil {
+			return err
+		}
+		*sides[i] = &inventorySide{Manifest: "s3://" + loc.bkt.Name() + "/" + key, At: at}
+	}
+
+	// keys modified since the oldest inventory was taken, or too young to be
+	// replicated when it was, can't be compared
+	cutoff := diff.Source.At
+	if diff.Destination.At.Before(cutoff) {
+		cutoff = diff.Destination.At
+	}
+	cutoff = cutoff.Add(-v.cfg.CheckYoungest)
+	young := func(k listedKey) bool {
+		modified, err := time.Parse(time.RFC3339Nano, k.LastModified)
+		return err != nil || modified.After(cutoff)
+	}
+
+	compare := make(map[string]bool)
+	for _, name := range v.cfg.Checks {
+		compare[name] = true
+	}
+	reported := 0
+	add := func(key, check string, reverse bool, details log.Fields) {
+		if reported == MaxInventoryDiffResults {
+			diff.Truncated = true
+			return
+		}
+		reported++
+		details["found_by"] = "inventory_diff"
+		res := Result{
+			Key:     key,
+			Outcome: outcomeMismatch,
+			Check:   check,
+			Details: details,
+			Reverse: reverse,
+			want:    object{Key: key},
+		}
+		log.WithFields(details).WithField("key", key).Error("mismatch at key, found by diffing inventories")
+		v.addResult(report, res)
+	}
+	missing := func(s listedKey) {
+		if young(s) {
+			diff.Skipped++
+			return
+		}
+		diff.Missing++
+		add(s.Key, "existence", false, log.Fields{"got": "no match in destination"})
+	}
+	extra := func(d listedKey) {
+		if young(d) {
+			diff.Skipped++
+			return
+		}
+		diff.Extra++
+		// keys only in the destination are mismatches of bidirectional
+		// audits alone
+		if v.cfg.Bidirectional {
+			add(d.Key, "existence", true, log.Fields{"got": "no match in source"})
+		}
+	}
+	match := func(s, d listedKey) {
+		if young(s) || young(d) {
+			diff.Skipped++
+			return
+		}
+		if compare["etag"] && s.ETag != "" && d.ETag != "" && s.ETag != d.ETag {
+			diff.ETagMismatches++
+			add(s.Key, "etag", false, log.Fields{"want.etag": s.ETag, "got.etag": d.ETag})
+		}
+		if compare["size"] && s.Size != d.Size {
+			diff.SizeMismatches++
+			add(s.Key, "size", false, log.Fields{"want.size": s.Size, "got.size": d.Size})
+		}
+	}
+
+	// both inventories are merged as they're read back in order
+	dstc := make(chan listedKey, MaxList)
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+	var reading sync.WaitGroup
+	// the destination sorter is closed once it's not read anymore, whichever
+	// way the diff returns
+	defer func() {
+		close(done)
+		reading.Wait()
+	}()
+	dstKeys := 0
+	reading.Add(1)
+	go func() {
+		defer reading.Done()
+		var err error
+		dstKeys, err = sorters[1].each(func(k listedKey) error {
+			select {
+			case dstc <- k:
+				return nil
+			case <-done:
+				return errInventoryDiffAborted
+			}
+		})
+		close(dstc)
+		errc <- err
+	}()
+	d, more := <-dstc
+	n, err := sorters[0].each(func(s listedKey) error {
+		select {
+		case <-v.abort:
+			return errInventoryDiffAborted
+		default:
+		}
+		for more && d.Key < s.Key {
+			extra(d)
+			d, more = <-dstc
+		}
+		if more && d.Key == s.Key {
+			match(s, d)
+			d, more = <-dstc
+		} else {
+			missing(s)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	diff.Source.Keys = n
+	for ; more; d, more = <-dstc {
+		extra(d)
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	diff.Destination.Keys = dstKeys
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotChecks are the checks that can verify keys against an inventory
+// snapshot, which only describes the keys of the source.
+var snapshotChecks = map[string]bool{
+	"existence":     true,
+	"etag":          true,
+	"size":          true,
+	"last_modified": true,
+}
+
+// errSnapshot is returned when reading from a snapshot what it doesn't
+// describe.
+var errSnapshot = errors.New("not described by an inventory snapshot")
+
+// inventoryManifest is the manifest.json of an S3 inventory, listing the
+// files of the inventory.
+type inventoryManifest struct {
+	SourceBucket string `json:"sourceBucket"`
+	FileFormat   string `json:"fileFormat"`
+	FileSchema   string `json:"fileSchema"`
+	// CreationTimestamp is in milliseconds since the epoch.
+	CreationTimestamp string `json:"creationTimestamp"`
+	Files             []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// inventory is a snapshot of the keys of a bucket at a point in time, read
+// from an S3 inventory.
+type inventory struct {
+	bucket string
+	at     time.Time
+	// keys are sorted by name.
+	keys []listedKey
+}
+
+// parseInventoryManifest parses the manifest of a CSV S3 inventory, and
+// returns when the inventory was taken and the columns of its files.
+func parseInventoryManifest(data []byte) (*inventoryManifest, time.Time, map[string]int, error) {
+	var m inventoryManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, time.Time{}, nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if m.FileFormat != "CSV" {
+		return nil, time.Time{}, nil, fmt.Errorf("inventory is in format %q, only CSV is supported", m.FileFormat)
+	}
+	ms, err := strconv.ParseInt(m.CreationTimestamp, 10, 64)
+	if err != nil {
+		return nil, time.Time{}, nil, fmt.Errorf("invalid creation timestamp %q: %v", m.CreationTimestamp, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range strings.Split(m.FileSchema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"Key", "LastModifiedDate"} {
+		if _, ok := columns[required]; !ok {
+			return nil, time.Time{}, nil, fmt.Errorf("inventory doesn't have the %s field", required)
+		}
+	}
+	return &m, time.UnixMilli(ms).UTC(), columns, nil
+}
+
+// readInventory reads the CSV files of an S3 inventory, given its manifest.
+// The files are looked for next to the manifest, or in the data directory
+// of the inventory, as laid out by S3. Only the latest versions of keys are
+// kept.
+func readInventory(manifestFile string) (*inventory, error) {
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	m, at, columns, err := parseInventoryManifest(data)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &inventory{bucket: m.SourceBucket, at: at}
+	dir := filepath.Dir(manifestFile)
+	for _, file := range m.Files {
+		name := path.Base(file.Key)
+		filename := filepath.Join(dir, name)
+		if _, err := os.Stat(filename); err != nil {
+			filename = filepath.Join(dir, "..", "data", name)
+		}
+		if err := inv.readFile(filename, columns); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	sort.Slice(inv.keys, func(i, j int) bool { return inv.keys[i].Key < inv.keys[j].Key })
+	return inv, nil
+}
+
+func (inv *inventory) readFile(filename string, columns map[string]int) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	var rd io.Reader = f
+	if filepath.Ext(filename) == ".gz" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		rd = gz
+	}
+	return readInventoryCSV(rd, columns, func(k listedKey) error {
+		inv.keys = append(inv.keys, k)
+		return nil
+	})
+}
+
+// readInventoryCSV reads a CSV file of an inventory, passing the latest
+// versions of the keys it lists to emit.
+func readInventoryCSV(rd io.Reader, columns map[string]int, emit func(listedKey) error) error {
+	r := csv.NewReader(rd)
+	r.FieldsPerRecord = -1
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if field(record, "IsLatest") == "false" || field(record, "IsDeleteMarker") == "true" {
+			continue
+		}
+		// names of keys are URL encoded in inventories
+		name, err := url.QueryUnescape(field(record, "Key"))
+		if err != nil {
+			return fmt.Errorf("line %d: invalid key: %v", line, err)
+		}
+		k := listedKey{
+			Key:          name,
+			LastModified: field(record, "LastModifiedDate"),
+			ETag:         field(record, "ETag"),
+			StorageClass: field(record, "StorageClass"),
+			Owner:        keyOwner{ID: field(record, "ObjectOwner")},
+		}
+		if _, err := time.Parse(time.RFC3339Nano, k.LastModified); err != nil {
+			return fmt.Errorf("line %d: key %q: invalid last modification time: %v", line, name, err)
+		}
+		// listings quote ETags, inventories don't
+		if k.ETag != "" && !strings.HasPrefix(k.ETag, `"`) {
+			k.ETag = `"` + k.ETag + `"`
+		}
+		if size := field(record, "Size"); size != "" {
+			if k.Size, err = strconv.ParseInt(size, 10, 64); err != nil {
+				return fmt.Errorf("line %d: key %q: invalid size: %v", line, name, err)
+			}
+		}
+		if err := emit(k); err != nil {
+			return err
+		}
+	}
+}
+
+// model builds the model of the bucket from the snapshot.
+func (inv *inventory) model(abort <-chan struct{}) *bucketModel {
+	keys := make(chan interface{})
+	go func() {
+		defer close(keys)
+		for i := range inv.keys {
+			keys <- &inv.keys[i]
+		}
+	}()
+	return buildModel(inv.bucket, keys, abort)
+}
+
+// snapshotBucket is a bucket as it was described by an inventory. Only its
+// listings can be read.
+type snapshotBucket struct {
+	*inventory
+}
+
+func (b snapshotBucket) Name() string { return b.bucket }
+
+func (b snapshotBucket) List(ctx context.Context, prefix, delim, marker string, max int) (*listResp, error) {
+	resp := &listResp{
+		Name:      b.bucket,
+		Prefix:    prefix,
+		Delimiter: delim,
+		Marker:    marker,
+		MaxKeys:   max,
+	}
+	i := sort.Search(len(b.keys), func(i int) bool {
+		return b.keys[i].Key >= prefix && b.keys[i].Key > marker
+	})
+	for i < len(b.keys) && strings.HasPrefix(b.keys[i].Key, prefix) {
+		if len(resp.Contents)+len(resp.CommonPrefixes) == max {
+			resp.IsTruncated = true
+			break
+		}
+		k := b.keys[i]
+		rest := k.Key[len(prefix):]
+		if j := strings.Index(rest, delim); delim != "" && j >= 0 {
+			pfx := prefix + rest[:j+len(delim)]
+			resp.CommonPrefixes = append(resp.CommonPrefixes, pfx)
+			resp.NextMarker = pfx
+			// skip the keys under the common prefix
+			i += sort.Search(len(b.keys)-i, func(n int) bool { return !strings.HasPrefix(b.keys[i+n].Key, pfx) })
+			continue
+		}
+		resp.Contents = append(resp.Contents, k)
+		resp.NextMarker = k.Key
+		i++
+	}
+	return resp, nil
+}
+
+func (b snapshotBucket) ListVersions(ctx context.Context, prefix, delim, keyMarker, versionMarker string, max int) (*listVersionsResp, error) {
+	return nil, errSnapshot
+}
+
+func (b snapshotBucket) GetReader(ctx context.Context, key, version string) (io.ReadCloser, error) {
+	return nil, errSnapshot
+}
+
+func (b snapshotBucket) Head(ctx context.Context, key, version string) (http.Header, error) {
+	return nil, errSnapshot
+}
+
+func (b snapshotBucket) Tags(ctx context.Context, key, version string) (map[string]string, error) {
+	return nil, errSnapshot
+}
+
+func (b snapshotBucket) Retention(ctx context.Context, key, version string) (*retention, error) {
+	return nil, errSnapshot
+}
+
+func (b snapshotBucket) Lifecycle(ctx context.Context) ([]lifecycleRule, error) {
+	return nil, errSnapshot
+}
+
+func (b snapshotBucket) SignedURL(key, version string, expires time.Time) string { return "" }
+
+// withSnapshot is the config of an audit of the keys of the source as they
+// were in an inventory snapshot taken at a point in time. Keys of any age
+// are sampled, but for those younger than check_youngest when the snapshot
+// was taken, which might not have been replicated yet. What needs more than
+// the listing of the source is left out: versions, deletions, bidirectional
+// sampling, and the checks not in snapshotChecks. The state directory and
+// exports are left out too.
+func (c *config) withSnapshot(at time.Time) (*config, error) {
+	for _, name := range c.Checks {
+		if !snapshotChecks[name] {
+			return nil, configErrorf("check %q can't verify keys against a snapshot", name)
+		}
+	}
+	snap := *c
+	snap.CheckOldest = at.Sub(time.Unix(0, 0))
+	snap.SampleVersions = false
+	snap.Bidirectional = false
+	snap.DeleteMarkers = deleteMarkersConfig{}
+	snap.Reconcile = false
+	snap.InventoryDiff = nil
+	snap.Flapping = nil
+	snap.StateDir = ""
+	snap.Export = nil
+	snap.Claims = nil
+	snap.Events = nil
+	return &snap, nil
+}
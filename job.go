@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Run modes of the audit command.
+const (
+	// RunModeDaemon audits rounds continuously, until aborted.
+	RunModeDaemon = "daemon"
+	// RunModeJob audits a single round, writes its report to stdout and
+	// exits with a status telling the class of its results, for the audit to
+	// be run by a Kubernetes CronJob.
+	RunModeJob = "k8s-job"
+)
+
+// Exit statuses of a round run as a job, telling what the worst result of
+// the round was. Jobs failing with ExitFailed are worth retrying, the others
+// aren't.
+const (
+	// ExitOK means every key matched, or its mismatch was tolerated or
+	// scored under the maximum risk, or the audit was in maintenance.
+	ExitOK = 0
+	// ExitFailed means the round couldn't complete.
+	ExitFailed = 1
+	// ExitMismatch means keys mismatched, or their risk score exceeded the
+	// maximum of the config.
+	ExitMismatch = 2
+	// ExitInconclusive means keys couldn't be verified, and none mismatched.
+	ExitInconclusive = 3
+)
+
+// exitStatus is the exit status of a job that audited the round. Rounds
+// audited in maintenance are ExitOK. In audits scoring the risk of
+// mismatches, only rounds alerted on are ExitMismatch.
+func (r *RoundReport) exitStatus() int {
+	switch {
+	case r.Maintenance != nil:
+		return ExitOK
+	case r.Risk != nil && r.Risk.Alert:
+		return ExitMismatch
+	case r.Risk == nil && r.Counts[outcomeMismatch] > 0:
+		return ExitMismatch
+	case r.Counts[outcomeInconclusive] > 0:
+		return ExitInconclusive
+	}
+	return ExitOK
+}
+
+// exitStatusNames name the exit statuses in status files.
+var exitStatusNames = map[int]string{
+	ExitOK:           "ok",
+	ExitFailed:       "failed",
+	ExitMismatch:     "mismatch",
+	ExitInconclusive: "inconclusive",
+}
+
+// statusFile is the summary of the last round written to --status-file, for
+// wrappers that can't parse the output of jag, such as health checks and
+// cron wrappers. Its fields are stable, like those of reports.
+type statusFile struct {
+	Round    roundID   `json:"round"`
+	Finished time.Time `json:"finished"`
+	// Status names the ExitStatus of the round, which a job auditing it
+	// exits with.
+	Status     string          `json:"status"`
+	ExitStatus int             `json:"exit_status"`
+	Verified   int             `json:"verified"`
+	Counts     map[outcome]int `json:"counts,omitempty"`
+	// Error is why the round failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// writeStatusFile writes the summary of a round, its report or the error
+// that failed it, to a file, replacing the file atomically so that readers
+// never see part of it.
+func writeStatusFile(filename string, id roundID, r *RoundReport, roundErr error) error {
+	st := statusFile{Round: id, Finished: time.Now().UTC(), ExitStatus: ExitFailed}
+	if roundErr != nil {
+		st.Error = roundErr.Error()
+	} else {
+		st.Finished = r.Finished.UTC()
+		st.ExitStatus = r.exitStatus()
+		st.Verified = len(r.Results)
+		st.Counts = r.Counts
+	}
+	st.Status = exitStatusNames[st.ExitStatus]
+	data, err := json.MarshalIndent(st, "", "   ")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// parseS3URL splits a URL like s3://bucket/path/to/key into the name of the
+// bucket and the key.
+func parseS3URL(s3url string) (bucket, key string, err error) {
+	u, err := url.Parse(s3url)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %q, want s3://bucket/key", s3url)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// A writableBucket can write keys, which audits only do to upload reports.
+type writableBucket interface {
+	put(key string, data []byte) error
+}
+
+// uploadReport writes the report to a key of a bucket, with the credentials
+// and the region of a. If the key is empty or ends with a slash, the report
+// is written under it in a key named after the round.
+func uploadReport(a awsConfig, s3url string, r *RoundReport) (string, error) {
+	name, key, err := parseS3URL(s3url)
+	if err != nil {
+		return "", err
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += string(r.ID) + ".json"
+	}
+	data, err := json.MarshalIndent(r, "", "   ")
+	if err != nil {
+		return "", err
+	}
+	a.Bucket, a.Fallbacks = name, nil
+	if err := prepareEndpoints(a); err != nil {
+		return "", err
+	}
+	bkt, err := awsBucket(a)
+	if err != nil {
+		return "", err
+	}
+	return "s3://" + name + "/" + key, bkt.(writableBucket).put(key, data)
+}
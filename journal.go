@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalSyncDelay is how long after keys are queued the queue journal is
+// synced to disk, at most, bounding what a crash of the host loses.
+const JournalSyncDelay = time.Second
+
+// journalEntry is a line of the queue journal: a key queued by a source.
+type journalEntry struct {
+	Source string    `json:"source"`
+	Key    string    `json:"key"`
+	Queued time.Time `json:"queued"`
+}
+
+// queueJournal persists the keys queued by operators, claimed to be copied
+// and written according to events in the state directory, so that they're
+// still verified once the audit restarts. Each key queued is appended to the
+// journal, which is rewritten after each round with the keys still queued,
+// once the results of the keys dequeued are saved: keys dequeued by a round
+// that didn't complete are verified again. Follow-ups and mismatches
+// debounced are persisted in the checkpoint instead.
+type queueJournal struct {
+	s stateDir
+
+	mu      sync.Mutex
+	f       *os.File
+	syncing bool
+	// pending are the keys queued when the journal was opened, by source,
+	// until they're restored in the queue of their source.
+	pending map[string][]queuedKey
+}
+
+// openQueueJournal returns the queue journal of the state, with the keys it
+// had queued pending.
+func (s stateDir) openQueueJournal() (*queueJournal, error) {
+	j := &queueJournal{s: s, pending: make(map[string][]queuedKey)}
+	f, err := os.Open(s.path(queueFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		queued := make(map[journalEntry]bool)
+		var order []journalEntry
+		scan := bufio.NewScanner(f)
+		scan.Buffer(nil, 1<<20)
+		for scan.Scan() {
+			var e journalEntry
+			if err := json.Unmarshal(scan.Bytes(), &e); err != nil {
+				// the last line is partly written if the host crashed
+				log.WithField("error", err).Warn("ignoring corrupted entry of queue journal")
+				continue
+			}
+			id := journalEntry{Source: e.Source, Key: e.Key}
+			if !queued[id] {
+				queued[id] = true
+				order = append(order, e)
+			}
+		}
+		_ = f.Close()
+		if err := scan.Err(); err != nil {
+			return nil, fmt.Errorf("can't read queue journal: %v", err)
+		}
+		for _, e := range order {
+			j.pending[e.Source] = append(j.pending[e.Source], queuedKey{key: e.Key, seen: e.Queued})
+		}
+	}
+	var entries []journalEntry
+	for source, keys := range j.pending {
+		for _, k := range keys {
+			entries = append(entries, journalEntry{Source: source, Key: k.key, Queued: k.seen})
+		}
+	}
+	if err := j.rewrite(entries); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// rewrite replaces the journal by the entries, and reopens it to append to
+// it. The caller must hold mu, unless the journal isn't shared yet.
+func (j *queueJournal) rewrite(entries []journalEntry) error {
+	var data []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	// Windows can't replace an open file
+	if j.f != nil {
+		_ = j.f.Close()
+		j.f = nil
+	}
+	if err := j.s.writeFile(queueFile, data); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.s.path(queueFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	return f.Sync()
+}
+
+// restore queues the keys of a source the journal had queued, then journals
+// the keys the queue queues and dequeues.
+func (j *queueJournal) restore(source string, q *keyQueue) {
+	j.mu.Lock()
+	keys := j.pending[source]
+	delete(j.pending, source)
+	j.mu.Unlock()
+	for _, k := range keys {
+		q.add(k.key, k.seen)
+	}
+	if len(keys) != 0 {
+		log.WithFields(log.Fields{
+			"source": source,
+			"keys":   len(keys),
+		}).Info("queued keys again from queue journal")
+	}
+	q.mu.Lock()
+	q.journal, q.source = j, source
+	q.mu.Unlock()
+}
+
+// record appends entries to the journal, syncing it soon after.
+func (j *queueJournal) record(entries ...journalEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return
+	}
+	var data []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			log.WithField("error", err).Error("bug: can't encode entry of queue journal")
+			return
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if _, err := j.f.Write(data); err != nil {
+		log.WithField("error", err).Error("couldn't append to queue journal")
+		return
+	}
+	if !j.syncing {
+		j.syncing = true
+		time.AfterFunc(JournalSyncDelay, j.sync)
+	}
+}
+
+func (j *queueJournal) sync() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.syncing = false
+	if j.f == nil {
+		return
+	}
+	if err := j.f.Sync(); err != nil {
+		log.WithField("error", err).Error("couldn't sync queue journal")
+	}
+}
+
+// compact rewrites the journal with the keys still queued, so that it
+// doesn't grow.
+func (j *queueJournal) compact(queues map[string]*keyQueue) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var entries []journalEntry
+	for source, q := range queues {
+		for _, k := range q.snapshot() {
+			entries = append(entries, journalEntry{Source: source, Key: k.key, Queued: k.seen})
+		}
+	}
+	if err := j.rewrite(entries); err != nil {
+		log.WithField("error", err).Error("couldn't rewrite queue journal")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"sort"
+	"strings"
+)
+
+// keyNormalizations are the ways destination stores might rewrite the names
+// of the keys they're given: Unicode normalization forms, and case folding
+// for case-insensitive stores.
+var keyNormalizations = map[string]func(string) string{
+	"nfc":   norm.NFC.String,
+	"nfd":   norm.NFD.String,
+	"nfkc":  norm.NFKC.String,
+	"nfkd":  norm.NFKD.String,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+func keyNormalizationNames() string {
+	names := make([]string, 0, len(keyNormalizations))
+	for name := range keyNormalizations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func loadKeyNormalization(names []string) error {
+	for _, name := range names {
+		if _, ok := keyNormalizations[name]; !ok {
+			return fmt.Errorf("unknown normalization %q, valid normalizations are %s", name, keyNormalizationNames())
+		}
+	}
+	return nil
+}
+
+// destinationKey is the name a key of the source has in the destination,
+// once normalized by the destination store.
+func (c *config) destinationKey(key string) string {
+	for _, name := range c.KeyNormalization {
+		key = keyNormalizations[name](key)
+	}
+	return key
+}
+
+// findDestinationKey returns the copy of a key of the source in the
+// destination, or nil if there's none. The copy is looked up by its
+// normalized name, and found if its name is the same once normalized, for
+// stores that keep the names they're given but compare them normalized.
+func (v *verifier) findDestinationKey(ctx context.Context, key string) (*object, error) {
+	if len(v.cfg.KeyNormalization) == 0 {
+		return findKey(ctx, v.dst, key)
+	}
+	name := v.cfg.destinationKey(key)
+	res, err := listBkt(ctx, v.dst, name, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Contents) == 0 || v.cfg.destinationKey(res.Contents[0].Key) != name {
+		return nil, nil
+	}
+	o := objectOf(res.Contents[0])
+	return &o, nil
+}
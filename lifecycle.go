@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"strings"
+	"time"
+)
+
+// lifecycleRule is a lifecycle rule of the destination bucket, which
+// legitimately expires or transitions keys after they were copied.
+type lifecycleRule struct {
+	ID     string `json:"id,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	// ExpirationDays is how many days after their creation keys are
+	// deleted, or 0 if they aren't.
+	ExpirationDays int `json:"expiration_days,omitempty"`
+	// TransitionDays is how many days after their creation keys are moved
+	// to StorageClass, if set.
+	TransitionDays int    `json:"transition_days,omitempty"`
+	StorageClass   string `json:"storage_class,omitempty"`
+}
+
+// lifecycleConfig are the lifecycle rules to take into account when
+// verifying keys.
+type lifecycleConfig struct {
+	// Fetch also uses the lifecycle rules of the destination bucket.
+	Fetch bool            `json:"fetch,omitempty"`
+	Rules []lifecycleRule `json:"rules,omitempty"`
+}
+
+// lifecycleAction is what a lifecycle rule did to a key.
+type lifecycleAction string
+
+const (
+	lifecycleExpiration lifecycleAction = "expiration"
+	lifecycleTransition lifecycleAction = "transition"
+)
+
+// enabledRules returns the enabled rules of the lifecycle of a bucket.
+func enabledRules(lifecycle []types.LifecycleRule) []lifecycleRule {
+	var rules []lifecycleRule
+	for _, r := range lifecycle {
+		if r.Status != types.ExpirationStatusEnabled {
+			continue
+		}
+		prefix := aws.ToString(r.Prefix)
+		if prefix == "" && r.Filter != nil {
+			prefix = aws.ToString(r.Filter.Prefix)
+		}
+		if r.Expiration != nil && aws.ToInt32(r.Expiration.Days) != 0 {
+			rules = append(rules, lifecycleRule{
+				ID:             aws.ToString(r.ID),
+				Prefix:         prefix,
+				ExpirationDays: int(aws.ToInt32(r.Expiration.Days)),
+			})
+		}
+		for _, t := range r.Transitions {
+			rules = append(rules, lifecycleRule{
+				ID:             aws.ToString(r.ID),
+				Prefix:         prefix,
+				TransitionDays: int(aws.ToInt32(t.Days)),
+				StorageClass:   string(t.StorageClass),
+			})
+		}
+	}
+	return rules
+}
+
+// applies tells if the rule explains the state of a key in the destination,
+// given the key in the source.
+func (r lifecycleRule) applies(want object, got *object, now time.Time) (lifecycleAction, bool) {
+	if !strings.HasPrefix(want.Key, r.Prefix) {
+		return "", false
+	}
+	created, err := time.Parse(time.RFC3339Nano, want.LastModified)
+	if err != nil {
+		return "", false
+	}
+	age := now.Sub(created)
+	day := 24 * time.Hour
+	switch {
+	case got == nil && r.ExpirationDays != 0 && age >= time.Duration(r.ExpirationDays)*day:
+		return lifecycleExpiration, true
+	case got != nil && r.StorageClass != "" && got.StorageClass == r.StorageClass &&
+		age >= time.Duration(r.TransitionDays)*day:
+		return lifecycleTransition, true
+	}
+	return "", false
+}
+
+// loadLifecycle gathers the lifecycle rules of the config and, if asked to,
+// of the destination bucket.
+func loadLifecycle(cfg lifecycleConfig, dst bucket) ([]lifecycleRule, error) {
+	rules := cfg.Rules
+	if !cfg.Fetch {
+		return rules, nil
+	}
+	fetched, err := dst.Lifecycle(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch lifecycle of bucket %q: %w", dst.Name(), err)
+	}
+	log.WithFields(log.Fields{
+		"bucket": dst.Name(),
+		"rules":  len(fetched),
+	}).Info("fetched lifecycle rules of destination bucket")
+	return append(rules, fetched...), nil
+}
+
+// lifecycleResult classifies the failure of a check on a key as the doing of
+// a lifecycle rule, if one explains it. The mismatch is nil if the check
+// failed to run.
+func (v *verifier) lifecycleResult(want object, got *object, check Check, mismatch log.Fields) (Result, bool) {
+	now := time.Now()
+	for _, rule := range v.lifecycle {
+		action, ok := rule.applies(want, got, now)
+		if !ok {
+			continue
+		}
+		// a transition only changes the storage class of keys, which can
+		// keep them from being read, never their content
+		if action == lifecycleTransition && !storageClassOnly(mismatch) {
+			continue
+		}
+		res := Result{
+			Key:     want.Key,
+			Outcome: outcomeLifecycle,
+			Check:   check.Name(),
+			Details: log.Fields{
+				"lifecycle.rule":   rule.ID,
+				"lifecycle.action": action,
+			},
+		}
+		log.WithFields(res.Details).WithField("key", want.Key).Info("key was changed by a lifecycle rule of the destination")
+		return res, true
+	}
+	return Result{}, false
+}
+
+// storageClassOnly tells if a mismatch is only about the storage class of a
+// key.
+func storageClassOnly(mismatch log.Fields) bool {
+	for name := range mismatch {
+		field := strings.ToLower(name[strings.IndexByte(name, '.')+1:])
+		if field != "storage_class" && field != "x-amz-storage-class" {
+			return false
+		}
+	}
+	return true
+}
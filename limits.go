@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup filesystem is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupUnlimited is above any real limit, cgroups v1 report unlimited
+// memory as a page-aligned huge number.
+const cgroupUnlimited = 1 << 60
+
+// readCgroupFile returns the trimmed content of a file of the cgroup
+// filesystem, or "" if it doesn't exist.
+func readCgroupFile(name string) string {
+	data, err := os.ReadFile(cgroupRoot + "/" + name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// cgroupCPUQuota is how many CPUs the cgroup of the process can use, or 0
+// if it isn't limited.
+func cgroupCPUQuota() float64 {
+	// cgroups v2: "$MAX $PERIOD", $MAX being "max" if unlimited
+	if fields := strings.Fields(readCgroupFile("cpu.max")); len(fields) == 2 {
+		quota, qerr := strconv.ParseFloat(fields[0], 64)
+		period, perr := strconv.ParseFloat(fields[1], 64)
+		if qerr != nil || perr != nil || period <= 0 {
+			return 0
+		}
+		return quota / period
+	}
+	// cgroups v1: a quota of -1 is unlimited
+	quota, qerr := strconv.ParseFloat(readCgroupFile("cpu/cpu.cfs_quota_us"), 64)
+	period, perr := strconv.ParseFloat(readCgroupFile("cpu/cpu.cfs_period_us"), 64)
+	if qerr != nil || perr != nil || quota <= 0 || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
+
+// cgroupMemoryLimit is how many bytes of memory the cgroup of the process
+// can use, or 0 if it isn't limited.
+func cgroupMemoryLimit() int64 {
+	limit := readCgroupFile("memory.max")
+	if limit == "" {
+		limit = readCgroupFile("memory/memory.limit_in_bytes")
+	}
+	n, err := strconv.ParseInt(limit, 10, 64)
+	if err != nil || n <= 0 || n >= cgroupUnlimited {
+		return 0
+	}
+	return n
+}
+
+// defaultMaxProcs is how many threads run Go code at once: one per CPU the
+// process can use, rounding up a fractional quota.
+func defaultMaxProcs() int {
+	procs := runtime.NumCPU()
+	if quota := cgroupCPUQuota(); quota > 0 && int(math.Ceil(quota)) < procs {
+		procs = int(math.Ceil(quota))
+	}
+	if procs < 1 {
+		procs = 1
+	}
+	return procs
+}
+
+// byteUnits are the suffixes of sizes understood by parseBytes.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseBytes parses a size like 512MiB or 2GB, or a count of bytes.
+func parseBytes(size string) (int64, error) {
+	s := strings.TrimSpace(size)
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(n * float64(unit)), nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// MaxListingErrors is how many invalid lines of a listing are described
+// before only counting them.
+const MaxListingErrors = 10
+
+// openListing opens a listing of a bucket, gunzipping it if its name ends
+// in .gz.
+func openListing(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(filename) != ".gz" {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// listingStats counts what was found in a listing.
+type listingStats struct {
+	Lines       int
+	Keys        int
+	Malformed   int
+	MissingKey  int
+	InvalidTime int
+	Duplicates  int
+}
+
+// invalid is how many lines of the listing weren't valid keys.
+func (s listingStats) invalid() int { return s.Malformed + s.MissingKey + s.InvalidTime }
+
+// cleanListing reads a listing, one key per line, and passes its valid
+// keys to emit sorted by name. Keys listed more than once are kept as last
+// modified. Each invalid line is passed to invalid with its number. Keys are
+// spilled to disk when they'd take more than budget bytes of memory, unless
+// budget is 0.
+func cleanListing(rd io.Reader, budget int64, invalid func(line int, err error), emit func(listedKey) error) (listingStats, error) {
+	var stats listingStats
+	sorter := newListingSorter(budget)
+	defer sorter.close()
+	scan := bufio.NewScanner(rd)
+	scan.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scan.Scan() {
+		stats.Lines++
+		line := bytes.TrimSpace(scan.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var k listedKey
+		if err := json.Unmarshal(line, &k); err != nil {
+			stats.Malformed++
+			invalid(stats.Lines, err)
+			continue
+		}
+		if k.Key == "" {
+			stats.MissingKey++
+			invalid(stats.Lines, fmt.Errorf("no key name"))
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, k.LastModified); err != nil {
+			stats.InvalidTime++
+			invalid(stats.Lines, fmt.Errorf("key %q: invalid last modification time: %v", k.Key, err))
+			continue
+		}
+		stats.Keys++
+		if err := sorter.add(k); err != nil {
+			return stats, fmt.Errorf("can't spill keys to disk: %v", err)
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return stats, fmt.Errorf("line %d: %v", stats.Lines+1, err)
+	}
+	distinct, err := sorter.each(emit)
+	if err != nil {
+		return stats, err
+	}
+	stats.Duplicates = stats.Keys - distinct
+	return stats, nil
+}
+
+// listingWriter writes keys one per line, gzip'd if the name of its file
+// ends in .gz.
+type listingWriter struct {
+	f   *os.File
+	gz  *gzip.Writer
+	bw  *bufio.Writer
+	enc *json.Encoder
+}
+
+func createListing(filename string) (*listingWriter, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	w := &listingWriter{f: f}
+	var out io.Writer = f
+	if filepath.Ext(filename) == ".gz" {
+		w.gz = gzip.NewWriter(f)
+		out = w.gz
+	}
+	w.bw = bufio.NewWriter(out)
+	w.enc = json.NewEncoder(w.bw)
+	return w, nil
+}
+
+func (w *listingWriter) write(k listedKey) error { return w.enc.Encode(k) }
+
+func (w *listingWriter) Close() error {
+	err := w.bw.Flush()
+	if w.gz != nil {
+		if cerr := w.gz.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func listingCommand() cli.Command {
+	return cli.Command{
+		Name:  "listing",
+		Usage: "Validates and cleans listings of buckets.",
+		Subcommands: []cli.Command{
+			listingCleanCommand(),
+			listingIndexCommand(),
+		},
+	}
+}
+
+func listingCleanCommand() cli.Command {
+	fileFlag := cli.StringFlag{
+		Name:  "file",
+		Usage: "path to a JSON file, gzip'd if it ends in .gz, listing the keys of a bucket",
+	}
+	outputFlag := cli.StringFlag{
+		Name:  "output",
+		Usage: "path where the clean listing is written, gzip'd if it ends in .gz",
+	}
+
+	doClean := func(ctx *cli.Context) {
+		filename := mustString(ctx, fileFlag)
+		output := ctx.String(outputFlag.Name)
+		emit := func(listedKey) error { return nil }
+		var out *listingWriter
+		if output != "" {
+			var err error
+			if out, err = createListing(output); err != nil {
+				fail(ctx, "error: can't create clean listing %q: %v", output, err)
+			}
+			emit = out.write
+		}
+		stats := mustCleanListing(ctx, filename, emit)
+		if out != nil {
+			if err := out.Close(); err != nil {
+				fail(ctx, "error: can't write clean listing %q: %v", output, err)
+			}
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "lines:\t%d\n", stats.Lines)
+		fmt.Fprintf(tw, "valid keys:\t%d\n", stats.Keys)
+		fmt.Fprintf(tw, "malformed lines:\t%d\n", stats.Malformed)
+		fmt.Fprintf(tw, "keys without name:\t%d\n", stats.MissingKey)
+		fmt.Fprintf(tw, "invalid times:\t%d\n", stats.InvalidTime)
+		fmt.Fprintf(tw, "duplicate keys:\t%d\n", stats.Duplicates)
+		fmt.Fprintf(tw, "distinct keys:\t%d\n", stats.Keys-stats.Duplicates)
+		_ = tw.Flush()
+
+		if output == "" && stats.invalid()+stats.Duplicates > 0 {
+			fail(ctx, "error: listing %q needs cleaning, give an --output", filename)
+		}
+	}
+
+	return cli.Command{
+		Name:  "clean",
+		Usage: "Validates a listing, and writes it without invalid lines and duplicates.",
+		Description: strings.TrimSpace(`
+Reads a listing of a bucket, one JSON key per line, and reports its malformed
+lines, keys without names or with invalid last modification times, and keys
+listed more than once. With --output, the valid keys are written sorted by name,
+keeping the last modified listing of duplicate keys. Without it, the command
+fails if the listing needs cleaning. Keys are spilled to temporary files when
+they'd take more than half of the --memory-limit.`),
+		Flags:  []cli.Flag{fileFlag, outputFlag},
+		Action: doClean,
+	}
+}
+
+// mustCleanListing passes the valid keys of a listing to emit, describing
+// its invalid lines on stderr. Keys are spilled to disk rather than taking
+// more than half the memory jag is limited to.
+func mustCleanListing(ctx *cli.Context, filename string, emit func(listedKey) error) listingStats {
+	limit, err := memoryLimit(ctx)
+	if err != nil {
+		fail(ctx, "error: %v", err)
+	}
+	rd, err := openListing(filename)
+	if err != nil {
+		fail(ctx, "error: can't open listing %q: %v", filename, err)
+	}
+	defer func() { _ = rd.Close() }()
+
+	described := 0
+	stats, err := cleanListing(rd, limit/2, func(line int, err error) {
+		if described++; described <= MaxListingErrors {
+			fmt.Fprintf(os.Stderr, "%s:%d: %v\n", filename, line, err)
+		}
+	}, emit)
+	if err != nil {
+		fail(ctx, "error: can't read listing %q: %v", filename, err)
+	}
+	if described > MaxListingErrors {
+		fmt.Fprintf(os.Stderr, "%s: %d more invalid lines\n", filename, described-MaxListingErrors)
+	}
+	return stats
+}
+
+func listingIndexCommand() cli.Command {
+	fileFlag := cli.StringFlag{
+		Name:  "file",
+		Usage: "path to a JSON file, gzip'd if it ends in .gz, listing the keys of a bucket",
+	}
+	outputFlag := cli.StringFlag{
+		Name:  "output",
+		Usage: "path where the index is written",
+	}
+	blockKeysFlag := cli.IntFlag{
+		Name:  "block-keys",
+		Usage: "how many keys are compressed together in a block of the index",
+		Value: DefaultIndexBlockKeys,
+	}
+
+	doIndex := func(ctx *cli.Context) {
+		filename := mustString(ctx, fileFlag)
+		output := mustString(ctx, outputFlag)
+		blockKeys := ctx.Int(blockKeysFlag.Name)
+		if blockKeys <= 0 {
+			fail(ctx, "error: --%s must be positive", blockKeysFlag.Name)
+		}
+		idx, err := createListingIndex(output, blockKeys)
+		if err != nil {
+			fail(ctx, "error: can't create index %q: %v", output, err)
+		}
+		stats := mustCleanListing(ctx, filename, func(k listedKey) error { return idx.add(k.Key) })
+		if err := idx.Close(); err != nil {
+			fail(ctx, "error: can't write index %q: %v", output, err)
+		}
+		if stats.Keys == 0 {
+			_ = os.Remove(output)
+			fail(ctx, "error: listing %q has no valid keys", filename)
+		}
+		log.WithFields(log.Fields{
+			"keys":          stats.Keys - stats.Duplicates,
+			"invalid_lines": stats.invalid(),
+			"duplicates":    stats.Duplicates,
+			"index":         output,
+		}).Info("indexed listing")
+	}
+
+	return cli.Command{
+		Name:  "index",
+		Usage: "Builds an index of a listing for the listing_index sampler.",
+		Description: strings.TrimSpace(`
+Writes the names of the valid keys of a listing, sorted and compressed in blocks,
+with a table of the offsets of the blocks. The listing_index sampler given the
+index in its "index" option picks a key reading a single block, instead of
+holding every key in memory. Invalid lines and duplicate keys are dropped, as
+with listing clean.`),
+		Flags:  []cli.Flag{fileFlag, outputFlag, blockKeysFlag},
+		Action: doIndex,
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os"
+)
+
+// DefaultIndexBlockKeys is how many keys are compressed together in a block
+// of a listing index. Picking a key reads and decompresses its whole block.
+const DefaultIndexBlockKeys = 1024
+
+// listingIndexMagic starts and ends listing index files.
+var listingIndexMagic = []byte("JAGIDX1\n")
+
+// A listing index holds the sorted names of the keys of a listing, in
+// blocks of gzip'd names each prefixed by their length. After the blocks
+// come the offsets of every block and of the end of the last one, then a
+// trailer: the offset of the table of offsets, the count of keys and the
+// count of keys per block, followed by the magic. All integers are uint64
+// in little endian.
+const listingIndexTrailerSize = 3*8 + 8
+
+// listingIndexWriter writes a listing index, given the names of its keys
+// in sorted order.
+type listingIndexWriter struct {
+	f         *os.File
+	bw        *bufio.Writer
+	blockKeys int
+	block     []string
+	offset    uint64
+	offsets   []uint64
+	keys      int
+}
+
+func createListingIndex(filename string, blockKeys int) (*listingIndexWriter, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	w := &listingIndexWriter{f: f, bw: bufio.NewWriter(f), blockKeys: blockKeys}
+	if _, err := w.bw.Write(listingIndexMagic); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	w.offset = uint64(len(listingIndexMagic))
+	return w, nil
+}
+
+func (w *listingIndexWriter) add(name string) error {
+	w.block = append(w.block, name)
+	w.keys++
+	if len(w.block) < w.blockKeys {
+		return nil
+	}
+	return w.flushBlock()
+}
+
+func (w *listingIndexWriter) flushBlock() error {
+	var block bytes.Buffer
+	var length [binary.MaxVarintLen64]byte
+	gz := gzip.NewWriter(&block)
+	for _, name := range w.block {
+		n := binary.PutUvarint(length[:], uint64(len(name)))
+		if _, err := gz.Write(length[:n]); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(gz, name); err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if _, err := w.bw.Write(block.Bytes()); err != nil {
+		return err
+	}
+	w.offsets = append(w.offsets, w.offset)
+	w.offset += uint64(block.Len())
+	w.block = w.block[:0]
+	return nil
+}
+
+// Close writes the last block, the table of offsets and the trailer.
+func (w *listingIndexWriter) Close() error {
+	err := w.finish()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *listingIndexWriter) finish() error {
+	if len(w.block) > 0 {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+	table := append(w.offsets, w.offset)
+	if err := binary.Write(w.bw, binary.LittleEndian, table); err != nil {
+		return err
+	}
+	trailer := []uint64{w.offset, uint64(w.keys), uint64(w.blockKeys)}
+	if err := binary.Write(w.bw, binary.LittleEndian, trailer); err != nil {
+		return err
+	}
+	if _, err := w.bw.Write(listingIndexMagic); err != nil {
+		return err
+	}
+	return w.bw.Flush()
+}
+
+// listingIndex picks keys in a listing index by their rank, reading only
+// the block holding each key. The index is mapped in memory when possible,
+// so that the pages of its blocks are cached by the OS rather than held in
+// the heap, and dropped under memory pressure.
+type listingIndex struct {
+	f *os.File
+	// data is the whole index if it's mapped in memory, otherwise it's nil
+	// and offsets are read from the file.
+	data        []byte
+	tableOffset uint64
+	offsets     []uint64
+	keys        int
+	blockKeys   int
+}
+
+// openListingIndex opens a listing index, mapping it in memory or reading
+// its table of offsets.
+func openListingIndex(filename string) (*listingIndex, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := readListingIndex(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("index %q: %v", filename, err)
+	}
+	return idx, nil
+}
+
+func readListingIndex(f *os.File) (*listingIndex, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < int64(len(listingIndexMagic)+listingIndexTrailerSize) {
+		return nil, errors.New("not a listing index, too short")
+	}
+	head := make([]byte, len(listingIndexMagic))
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return nil, err
+	}
+	trailer := make([]byte, listingIndexTrailerSize)
+	if _, err := f.ReadAt(trailer, size-listingIndexTrailerSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head, listingIndexMagic) || !bytes.Equal(trailer[24:], listingIndexMagic) {
+		return nil, errors.New("not a listing index, bad magic")
+	}
+	x := &listingIndex{f: f, tableOffset: binary.LittleEndian.Uint64(trailer[0:])}
+	keys := binary.LittleEndian.Uint64(trailer[8:])
+	blockKeys := binary.LittleEndian.Uint64(trailer[16:])
+	if blockKeys == 0 {
+		return nil, errors.New("corrupted trailer, no keys per block")
+	}
+	x.keys, x.blockKeys = int(keys), int(blockKeys)
+	blocks := (keys + blockKeys - 1) / blockKeys
+	if x.tableOffset+(blocks+1)*8 != uint64(size-listingIndexTrailerSize) {
+		return nil, errors.New("corrupted trailer, table of offsets doesn't fit")
+	}
+
+	if x.data, err = mmapFile(f, size); err == nil {
+		return x, nil
+	}
+	log.WithField("error", err).Debug("can't map listing index in memory, reading it instead")
+	table := make([]byte, (blocks+1)*8)
+	if _, err := f.ReadAt(table, int64(x.tableOffset)); err != nil {
+		return nil, err
+	}
+	x.offsets = make([]uint64, blocks+1)
+	for i := range x.offsets {
+		x.offsets[i] = binary.LittleEndian.Uint64(table[i*8:])
+	}
+	return x, nil
+}
+
+// block returns the compressed names of a block.
+func (x *listingIndex) block(i int) ([]byte, error) {
+	if x.data == nil {
+		start, end := x.offsets[i], x.offsets[i+1]
+		data := make([]byte, end-start)
+		_, err := x.f.ReadAt(data, int64(start))
+		return data, err
+	}
+	entry := x.tableOffset + uint64(i)*8
+	start := binary.LittleEndian.Uint64(x.data[entry:])
+	end := binary.LittleEndian.Uint64(x.data[entry+8:])
+	if start > end || end > x.tableOffset {
+		return nil, errors.New("corrupted table of offsets")
+	}
+	return x.data[start:end], nil
+}
+
+// Len is the count of keys in the index.
+func (x *listingIndex) Len() int { return x.keys }
+
+// Key returns the name of the i-th key of the index, in sorted order. It's
+// safe to pick keys concurrently.
+func (x *listingIndex) Key(i int) (string, error) {
+	if i < 0 || i >= x.keys {
+		return "", fmt.Errorf("no key %d in an index of %d keys", i, x.keys)
+	}
+	block := i / x.blockKeys
+	data, err := x.block(block)
+	if err != nil {
+		return "", fmt.Errorf("block %d: %v", block, err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("block %d: %v", block, err)
+	}
+	rd := bufio.NewReader(gz)
+	for skip := i % x.blockKeys; ; skip-- {
+		n, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return "", fmt.Errorf("block %d: %v", block, err)
+		}
+		if skip == 0 {
+			name := make([]byte, n)
+			if _, err := io.ReadFull(rd, name); err != nil {
+				return "", fmt.Errorf("block %d: %v", block, err)
+			}
+			return string(name), nil
+		}
+		if _, err := rd.Discard(int(n)); err != nil {
+			return "", fmt.Errorf("block %d: %v", block, err)
+		}
+	}
+}
+
+func (x *listingIndex) Close() error {
+	if x.data != nil {
+		if err := munmap(x.data); err != nil {
+			return err
+		}
+		x.data = nil
+	}
+	return x.f.Close()
+}
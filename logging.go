@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevelsPath is where the levels of subsystems are read and changed on
+// the HTTP endpoint of the audit command.
+const LogLevelsPath = "/debug/log-levels"
+
+// subsystem logs what a part of jag does, at a level that can be set apart
+// from the level of jag and changed while it runs, e.g. to trace the
+// decisions of samplers without every other part logging at debug level.
+type subsystem struct {
+	name string
+	// logger is nil while the subsystem logs at the level of jag. It's
+	// replaced rather than changed, as it's used concurrently.
+	logger atomic.Pointer[log.Logger]
+}
+
+// subsystems are the subsystems, by name.
+var subsystems = map[string]*subsystem{}
+
+var (
+	// samplerLog logs the decisions taken while sampling keys, at debug
+	// level. They're logged for every key seen, so they're only worth
+	// logging to investigate a sampler.
+	samplerLog = newSubsystem("sampler")
+	// verifierLog logs the verification of every key, at debug level.
+	verifierLog = newSubsystem("verifier")
+)
+
+func newSubsystem(name string) *subsystem {
+	s := &subsystem{name: name}
+	subsystems[name] = s
+	return s
+}
+
+// entry returns an entry logging for the subsystem.
+func (s *subsystem) entry() *log.Entry {
+	if l := s.logger.Load(); l != nil {
+		return l.WithField("subsystem", s.name)
+	}
+	return log.WithField("subsystem", s.name)
+}
+
+func (s *subsystem) WithField(key string, value interface{}) *log.Entry {
+	return s.entry().WithField(key, value)
+}
+
+func (s *subsystem) WithFields(fields log.Fields) *log.Entry {
+	return s.entry().WithFields(fields)
+}
+
+func (s *subsystem) Debug(args ...interface{}) { s.entry().Debug(args...) }
+
+// level is the level the subsystem logs at.
+func (s *subsystem) level() log.Level {
+	if l := s.logger.Load(); l != nil {
+		return l.Level
+	}
+	return log.GetLevel()
+}
+
+// enabled tells if the subsystem logs at a level, to avoid preparing
+// entries that won't be logged.
+func (s *subsystem) enabled(level log.Level) bool { return level <= s.level() }
+
+// setLevel makes the subsystem log at a level of its own, to the output of
+// jag.
+func (s *subsystem) setLevel(level log.Level) {
+	std := log.StandardLogger()
+	s.logger.Store(&log.Logger{
+		Out:       std.Out,
+		Formatter: std.Formatter,
+		Hooks:     std.Hooks,
+		Level:     level,
+	})
+}
+
+// resetLevel makes the subsystem log at the level of jag again.
+func (s *subsystem) resetLevel() { s.logger.Store(nil) }
+
+// parseLogLevels parses levels of subsystems like "sampler=debug,verifier=warn".
+// The level "default" is the level of jag.
+func parseLogLevels(spec string) (map[string]string, error) {
+	levels := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, level, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid log level %q, want subsystem=level", pair)
+		}
+		levels[strings.TrimSpace(name)] = strings.TrimSpace(level)
+	}
+	return levels, nil
+}
+
+// setLogLevels sets the levels of subsystems, by name. Nothing is changed
+// if a subsystem or level is unknown.
+func setLogLevels(levels map[string]string) error {
+	parsed := make(map[*subsystem]*log.Level, len(levels))
+	for name, level := range levels {
+		s, ok := subsystems[name]
+		if !ok {
+			return fmt.Errorf("unknown subsystem %q, want one of %s", name, strings.Join(subsystemNames(), ", "))
+		}
+		if level == "default" {
+			parsed[s] = nil
+			continue
+		}
+		l, err := log.ParseLevel(level)
+		if err != nil {
+			return fmt.Errorf("subsystem %q: %w", name, err)
+		}
+		parsed[s] = &l
+	}
+	for s, level := range parsed {
+		if level == nil {
+			s.resetLevel()
+		} else {
+			s.setLevel(*level)
+		}
+	}
+	return nil
+}
+
+func subsystemNames() []string {
+	names := make([]string, 0, len(subsystems))
+	for name := range subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// logLevels are the levels subsystems log at, by name.
+func logLevels() map[string]string {
+	levels := make(map[string]string, len(subsystems))
+	for name, s := range subsystems {
+		levels[name] = s.level().String()
+	}
+	return levels
+}
+
+func init() {
+	http.HandleFunc(LogLevelsPath, serveLogLevels)
+}
+
+// serveLogLevels returns the levels of subsystems as a JSON object, and
+// sets them on PUT given an object like {"sampler": "debug"}.
+func serveLogLevels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var levels map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&levels); err != nil {
+			http.Error(w, fmt.Sprintf("invalid levels: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := setLogLevels(levels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		recordRequestAction(r, "log_levels", log.Fields{"levels": levels})
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(logLevels())
+}
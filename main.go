@@ -4,24 +4,45 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"os"
 	"os/signal"
-	"runtime"
+	"sync"
 	"syscall"
 )
 
 func main() {
 
-	n := runtime.NumCPU()
-	runtime.GOMAXPROCS(n)
-
 	abort := make(chan struct{}, 0)
+	var once sync.Once
+	shutdown := func(reason string) {
+		once.Do(func() {
+			log.Warnf("%s, aborting", reason)
+			close(abort)
+		})
+	}
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGTERM)
+	signal.Notify(sig, shutdownSignals...)
 	go func() {
-		<-sig
-		log.Warn("received SIGTERM, aborting")
-		close(abort)
+		shutdown("received " + signalName(<-sig))
 	}()
+	watchTriggerSignals()
+
+	run := func() { newApp(abort).Run(os.Args) }
+	ok, err := runService(run, shutdown)
+	if err != nil {
+		log.WithField("error", err).Fatal("couldn't run as a service")
+	}
+	if !ok {
+		run()
+	}
+}
 
-	newApp(abort).Run(os.Args)
+// signalName names a signal aborting the audit as operators send it.
+func signalName(s os.Signal) string {
+	switch s {
+	case os.Interrupt:
+		return "SIGINT"
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	}
+	return s.String()
 }
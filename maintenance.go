@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MaintenancePath is where maintenance mode is read and changed on the HTTP
+// endpoint of the audit command.
+const MaintenancePath = "/debug/maintenance"
+
+// maintenance is a planned window in which the buckets are expected to
+// diverge, such as a migration. Audits keep verifying keys and recording
+// their results, but don't alert on them: namespaces don't alert, and jobs
+// exit with ExitOK whatever their results. Mismatches are still logged.
+type maintenance struct {
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+	// By is what put the audit in maintenance: its config, or an operator
+	// through the endpoint.
+	By string `json:"by"`
+}
+
+// maintenanceOverride is maintenance mode as set through the endpoint,
+// which overrides the config until it's reset.
+var maintenanceOverride struct {
+	mu  sync.Mutex
+	set bool
+	// m is nil if maintenance mode was turned off.
+	m *maintenance
+}
+
+// currentMaintenance returns the maintenance in progress, nil if there's
+// none. The config puts the audit in maintenance from when it started,
+// unless maintenance mode was set through the endpoint.
+func (v *verifier) currentMaintenance() *maintenance {
+	maintenanceOverride.mu.Lock()
+	defer maintenanceOverride.mu.Unlock()
+	if maintenanceOverride.set {
+		return maintenanceOverride.m
+	}
+	if v.cfg.Maintenance {
+		return &maintenance{Since: v.started, By: "config"}
+	}
+	return nil
+}
+
+func init() {
+	http.HandleFunc(MaintenancePath, serveMaintenance)
+}
+
+// maintenanceRequest turns maintenance mode on or off.
+type maintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// maintenanceStatus is maintenance mode as set through the endpoint.
+type maintenanceStatus struct {
+	// Override is false if maintenance mode is as configured.
+	Override    bool         `json:"override"`
+	Maintenance *maintenance `json:"maintenance"`
+}
+
+// serveMaintenance returns maintenance mode as set through the endpoint, as
+// a JSON object. It's turned on or off on PUT given an object like
+// {"enabled": true, "reason": "migration"}, and reset to what the config
+// says on DELETE.
+func serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	maintenanceOverride.mu.Lock()
+	defer maintenanceOverride.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid maintenance: %v", err), http.StatusBadRequest)
+			return
+		}
+		maintenanceOverride.set, maintenanceOverride.m = true, nil
+		if req.Enabled {
+			maintenanceOverride.m = &maintenance{Reason: req.Reason, Since: time.Now().UTC(), By: requestPrincipal(r)}
+		}
+		recordRequestAction(r, "maintenance", log.Fields{
+			"enabled": req.Enabled,
+			"reason":  req.Reason,
+		})
+	case http.MethodDelete:
+		maintenanceOverride.set, maintenanceOverride.m = false, nil
+		recordRequestAction(r, "maintenance_reset", nil)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(maintenanceStatus{
+		Override:    maintenanceOverride.set,
+		Maintenance: maintenanceOverride.m,
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MetricsPath is where the metrics of the audit are served to Prometheus,
+// on the HTTP endpoint of the audit command.
+const MetricsPath = "/metrics"
+
+// A metric is exported to Prometheus. Every series of a metric is labeled
+// with the identity of the audit: its name as "audit", and each of its
+// labels prefixed by "label_".
+type metric struct {
+	name string
+	kind string
+	help string
+}
+
+var (
+	metricRounds           = metric{"jag_rounds_total", "counter", "Rounds audited."}
+	metricRoundFailures    = metric{"jag_round_failures_total", "counter", "Rounds that couldn't complete."}
+	metricVerified         = metric{"jag_keys_verified_total", "counter", "Keys verified, by outcome."}
+	metricRoundDuration    = metric{"jag_round_duration_seconds", "gauge", "How long the last round took."}
+	metricLastRound        = metric{"jag_last_round_timestamp_seconds", "gauge", "When the last round finished, as a Unix time."}
+	metricModelKeys        = metric{"jag_model_keys", "gauge", "Keys in the model of the source bucket."}
+	metricLag              = metric{"jag_replication_lag_seconds", "gauge", "Mean replication lag of the keys that matched in the last round."}
+	metricWritesPerHour    = metric{"jag_writes_per_hour", "gauge", "Estimated rate of writes to the source bucket."}
+	metricAtRisk           = metric{"jag_keys_at_risk", "gauge", "Estimated keys written but not replicated yet."}
+	metricRisk             = metric{"jag_risk_score", "gauge", "Risk score of the mismatches of the last round."}
+	metricNamespace        = metric{"jag_namespace_alert", "gauge", "1 if the namespace was alerted on in the last round it was audited."}
+	metricMaintenance      = metric{"jag_maintenance", "gauge", "1 if the last round was audited in maintenance."}
+	metricEndpointRequests = metric{"jag_endpoint_requests_total", "counter", "Requests sent to the endpoint of a bucket, by side."}
+	metricEndpointErrors   = metric{"jag_endpoint_errors_total", "counter", "Requests to the endpoint of a bucket that failed, by side."}
+	metricEndpointSuccess  = metric{"jag_endpoint_success_rate", "gauge", "Share of the last requests to the endpoint of a bucket that succeeded."}
+	metricEndpointLatency  = metric{"jag_endpoint_latency_seconds", "gauge", "Mean latency of the last requests to the endpoint of a bucket."}
+	metricBreakerOpen      = metric{"jag_circuit_breaker_open", "gauge", "1 if the circuit breaker of the endpoint is open or half-open."}
+	metricDegradation      = metric{"jag_degradation_level", "gauge", "Level the checks of the next round are degraded to: 0 full, 1 metadata, 2 existence, 3 backlog."}
+	metricBuildInfo        = metric{"jag_build_info", "gauge", "Always 1, labeled with the version jag was built from."}
+)
+
+// metrics are all the metrics, in the order they're served.
+var metrics = []metric{
+	metricRounds, metricRoundFailures, metricVerified, metricRoundDuration,
+	metricLastRound, metricModelKeys, metricLag, metricWritesPerHour,
+	metricAtRisk, metricRisk, metricNamespace, metricMaintenance,
+	metricEndpointRequests, metricEndpointErrors, metricEndpointSuccess,
+	metricEndpointLatency, metricBreakerOpen, metricDegradation,
+	metricBuildInfo,
+}
+
+// metricValues are the values of the series of the metrics, by name of
+// metric and by labels.
+var metricValues struct {
+	mu     sync.Mutex
+	series map[string]map[string]float64
+}
+
+func init() {
+	http.HandleFunc(MetricsPath, serveMetrics)
+}
+
+// metricLabels returns the labels of a series of the audit, in the format of
+// Prometheus, extra being pairs of names and values.
+func metricLabels(cfg *config, extra ...string) string {
+	var pairs []string
+	add := func(name, value string) {
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, value))
+	}
+	if cfg.AuditName != "" {
+		add("audit", cfg.AuditName)
+	}
+	for name, value := range cfg.Labels {
+		add("label_"+name, value)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		add(extra[i], extra[i+1])
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// setMetric sets the value of a series, or adds to it if add is set.
+func setMetric(m metric, labels string, value float64, add bool) {
+	metricValues.mu.Lock()
+	defer metricValues.mu.Unlock()
+	if metricValues.series == nil {
+		metricValues.series = make(map[string]map[string]float64)
+	}
+	series := metricValues.series[m.name]
+	if series == nil {
+		series = make(map[string]float64)
+		metricValues.series[m.name] = series
+	}
+	if add {
+		value += series[labels]
+	}
+	series[labels] = value
+}
+
+// observeRound updates the metrics with the report of a round, of an audit
+// whose model has modelKeys keys.
+func observeRound(cfg *config, r *RoundReport, modelKeys int) {
+	labels := metricLabels(cfg)
+	setMetric(metricRounds, labels, 1, true)
+	for outcome, n := range r.Counts {
+		setMetric(metricVerified, metricLabels(cfg, "outcome", string(outcome)), float64(n), true)
+	}
+	setMetric(metricRoundDuration, labels, r.Finished.Sub(r.Started).Seconds(), false)
+	setMetric(metricLastRound, labels, float64(r.Finished.UnixNano())/1e9, false)
+	setMetric(metricModelKeys, labels, float64(modelKeys), false)
+	if r.ChangeRate != nil {
+		setMetric(metricLag, labels, r.ChangeRate.LagSeconds, false)
+		setMetric(metricWritesPerHour, labels, r.ChangeRate.WritesPerHour, false)
+		setMetric(metricAtRisk, labels, r.ChangeRate.AtRisk, false)
+	}
+	if r.Risk != nil {
+		setMetric(metricRisk, labels, r.Risk.Score, false)
+	}
+	for name, counts := range r.Namespaces {
+		alert := 0.0
+		if counts.Alert {
+			alert = 1
+		}
+		setMetric(metricNamespace, metricLabels(cfg, "namespace", name), alert, false)
+	}
+	maintenance := 0.0
+	if r.Maintenance != nil {
+		maintenance = 1
+	}
+	setMetric(metricMaintenance, labels, maintenance, false)
+	if d := r.Degradation; d != nil {
+		level := d.Level
+		if d.Next != "" {
+			level = d.Next
+		}
+		if l, ok := parseDegradationLevel(level); ok {
+			setMetric(metricDegradation, labels, float64(l), false)
+		}
+	}
+	observeLastRound(r)
+}
+
+// observeBuild sets the build info of the audit.
+func observeBuild(cfg *config) {
+	labels := metricLabels(cfg,
+		"version", build.Version,
+		"commit", build.Commit,
+		"build_date", build.BuildDate,
+		"go_version", build.GoVersion,
+	)
+	setMetric(metricBuildInfo, labels, 1, false)
+}
+
+// observeRoundFailure counts a round that couldn't complete.
+func observeRoundFailure(cfg *config) {
+	setMetric(metricRoundFailures, metricLabels(cfg), 1, true)
+}
+
+// writeMetrics writes the metrics in the text format of Prometheus.
+func writeMetrics(w io.Writer) error {
+	metricValues.mu.Lock()
+	defer metricValues.mu.Unlock()
+	for _, m := range metrics {
+		series := metricValues.series[m.name]
+		if len(series) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+		labels := make([]string, 0, len(series))
+		for l := range series {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			name := m.name
+			if l != "" {
+				name += "{" + l + "}"
+			}
+			if _, err := fmt.Fprintf(w, "%s %g\n", name, series[l]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// serveMetrics serves the metrics to Prometheus.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = writeMetrics(w)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultMigrationWindow is how far back the rounds of an audit are looked at
+// to estimate the progress of a migration.
+const DefaultMigrationWindow = 24 * time.Hour
+
+// Ways the keys of the source found in the destination are counted.
+const (
+	migrationByListing  = "listing"
+	migrationBySampling = "sampling"
+)
+
+// migrationStatus tells how far a migration from the source bucket to the
+// destination is, and when it should complete at the pace of the recent
+// rounds of its audit.
+type migrationStatus struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	SourceKeys  int    `json:"source_keys"`
+	// SyncedKeys are the keys of the source found in the destination,
+	// counted with a listing of the destination or extrapolated from the
+	// keys sampled by the rounds, as told by Method.
+	SyncedKeys    int     `json:"synced_keys"`
+	Method        string  `json:"method"`
+	PercentSynced float64 `json:"percent_synced"`
+	// Rounds and Sampled are the rounds within the window, and the keys they
+	// verified conclusively.
+	Rounds  int `json:"rounds"`
+	Sampled int `json:"sampled"`
+	// PercentPerHour is the pace of the migration over the window, and
+	// Completion when it completes at that pace. Completion is unknown if
+	// the migration isn't progressing.
+	PercentPerHour float64    `json:"percent_per_hour"`
+	Completion     *time.Time `json:"completion,omitempty"`
+	// OpenMismatches are the keys whose latest verification was a mismatch,
+	// by check.
+	OpenMismatches map[string]int `json:"open_mismatches,omitempty"`
+}
+
+// syncedShare is the share of the keys verified conclusively in a round that
+// were found replicated, and how many keys that is out of.
+func syncedShare(counts map[outcome]int) (float64, int) {
+	synced := counts[outcomeMatch] + counts[outcomeIgnored] + counts[outcomeLifecycle]
+	total := synced + counts[outcomeMismatch] + counts[outcomeSuppressed]
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(synced) / float64(total), total
+}
+
+// newMigrationStatus estimates the status of a migration. The pace is the
+// slope of the share of keys found replicated by the rounds finished within
+// the window. Without a model of the destination, the share of keys synced
+// is that slope's value at the last round.
+func newMigrationStatus(src *bucketModel, dst *bucketModel, history []roundSummary, records []keyRecord, now time.Time, window time.Duration) (*migrationStatus, error) {
+	if window <= 0 {
+		window = DefaultMigrationWindow
+	}
+	status := &migrationStatus{
+		Source:     src.name,
+		SourceKeys: src.keyCount,
+	}
+
+	// least squares fit of the synced share over hours
+	var xs, ys []float64
+	var last time.Time
+	for _, round := range history {
+		if round.Finished.Before(now.Add(-window)) || round.Finished.After(now) {
+			continue
+		}
+		share, n := syncedShare(round.Counts)
+		if n == 0 {
+			continue
+		}
+		status.Rounds++
+		status.Sampled += n
+		xs = append(xs, round.Finished.Sub(now).Hours())
+		ys = append(ys, share)
+		if round.Finished.After(last) {
+			last = round.Finished
+		}
+	}
+	var slope, intercept float64
+	switch len(xs) {
+	case 0:
+	case 1:
+		intercept = ys[0]
+	default:
+		var sx, sy, sxx, sxy float64
+		for i := range xs {
+			sx += xs[i]
+			sy += ys[i]
+			sxx += xs[i] * xs[i]
+			sxy += xs[i] * ys[i]
+		}
+		n := float64(len(xs))
+		if d := n*sxx - sx*sx; d != 0 {
+			slope = (n*sxy - sx*sy) / d
+		}
+		intercept = (sy - slope*sx) / n
+	}
+
+	var share float64
+	switch {
+	case dst != nil:
+		status.Destination = dst.name
+		status.Method = migrationByListing
+		status.SyncedKeys = dst.keyCount
+		if status.SyncedKeys > src.keyCount {
+			status.SyncedKeys = src.keyCount
+		}
+		if src.keyCount > 0 {
+			share = float64(status.SyncedKeys) / float64(src.keyCount)
+		} else {
+			share = 1
+		}
+	case len(xs) != 0:
+		status.Method = migrationBySampling
+		share = math.Max(0, math.Min(1, intercept+slope*last.Sub(now).Hours()))
+		status.SyncedKeys = int(math.Round(share * float64(src.keyCount)))
+	default:
+		return nil, errors.New("no model of the destination, and no round verified keys within the window")
+	}
+	status.PercentSynced = share * 100
+	status.PercentPerHour = slope * 100
+	if slope > 0 && share < 1 {
+		completion := now.Add(time.Duration((1 - share) / slope * float64(time.Hour)))
+		status.Completion = &completion
+	}
+
+	for _, om := range openMismatches(records) {
+		if om.last.Outcome != outcomeMismatch {
+			continue
+		}
+		if status.OpenMismatches == nil {
+			status.OpenMismatches = make(map[string]int)
+		}
+		status.OpenMismatches[om.last.Check]++
+	}
+	return status, nil
+}
+
+// writeSummary writes the status meant for humans.
+func (s *migrationStatus) writeSummary(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "source:\t%s\t%d keys\n", s.Source, s.SourceKeys)
+	if s.Method == migrationByListing {
+		fmt.Fprintf(tw, "destination:\t%s\t%d keys\n", s.Destination, s.SyncedKeys)
+	} else {
+		fmt.Fprintf(tw, "destination:\t%s\t~%d keys, extrapolated from %d keys sampled in %d rounds\n", s.Destination, s.SyncedKeys, s.Sampled, s.Rounds)
+	}
+	fmt.Fprintf(tw, "synced:\t%.2f%%\t\n", s.PercentSynced)
+	fmt.Fprintf(tw, "pace:\t%+.2f%% per hour\t\n", s.PercentPerHour)
+	switch {
+	case s.PercentSynced >= 100:
+		fmt.Fprintf(tw, "completion:\tcomplete\t\n")
+	case s.Completion != nil:
+		fmt.Fprintf(tw, "completion:\t%s\tin %s\n", s.Completion.Format(time.RFC3339), time.Until(*s.Completion).Round(time.Minute))
+	default:
+		fmt.Fprintf(tw, "completion:\tunknown, not progressing\t\n")
+	}
+	if len(s.OpenMismatches) != 0 {
+		checks := make([]string, 0, len(s.OpenMismatches))
+		for check := range s.OpenMismatches {
+			checks = append(checks, check)
+		}
+		sort.Strings(checks)
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "CHECK\tOPEN MISMATCHES\t")
+		for _, check := range checks {
+			fmt.Fprintf(tw, "%s\t%d\t\n", check, s.OpenMismatches[check])
+		}
+	}
+	return tw.Flush()
+}
+
+func migrationStatusCommand(abort <-chan struct{}) cli.Command {
+	cfgFlag := cli.StringFlag{
+		Name:  "cfg",
+		Usage: "path to the JSON config file",
+	}
+	srcModelFlag := cli.StringFlag{
+		Name:  "source-model",
+		Usage: "path to a JSON file representing model of the keys in the source bucket, the model of the state directory by default",
+	}
+	srcListingFlag := cli.StringFlag{
+		Name:  "source-listing",
+		Usage: "path to a gzip'd JSON file representing all the keys in the source bucket, instead of a model",
+	}
+	dstModelFlag := cli.StringFlag{
+		Name:  "destination-model",
+		Usage: "path to a JSON file representing model of the keys in the destination bucket",
+	}
+	dstListingFlag := cli.StringFlag{
+		Name:  "destination-listing",
+		Usage: "path to a gzip'd JSON file representing all the keys in the destination bucket, instead of a model",
+	}
+	windowFlag := cli.DurationFlag{
+		Name:  "window",
+		Usage: "how far back rounds are looked at to estimate the pace of the migration",
+		Value: DefaultMigrationWindow,
+	}
+	formatFlag := cli.StringFlag{
+		Name:  "format",
+		Usage: "table, to read the status, or json",
+		Value: "table",
+	}
+
+	doMigrationStatus := func(ctx *cli.Context) {
+		cfg := mustConfig(ctx, cfgFlag)
+		format := ctx.String(formatFlag.Name)
+		if format != "json" && format != "table" {
+			fail(ctx, "error: unknown format %q, valid formats are json, table", format)
+		}
+		var state stateDir
+		if cfg.StateDir != "" {
+			var err error
+			if state, err = openStateDir(cfg.StateDir); err != nil {
+				fail(ctx, "error: can't open state directory %q: %v", cfg.StateDir, err)
+			}
+		}
+
+		var src *bucketModel
+		switch {
+		case ctx.String(srcListingFlag.Name) != "":
+			src = mustBuildModel(ctx, cfg.Source.Bucket, srcListingFlag, abort)
+		case ctx.String(srcModelFlag.Name) != "":
+			src = mustRetrieveModel(ctx, srcModelFlag)
+		case state != "":
+			src = mustRetrieveModelFile(ctx, state.path(modelFile))
+		default:
+			fail(ctx, "required: flag %q or %q must have a value, the config doesn't have a state_dir", srcModelFlag.Name, srcListingFlag.Name)
+		}
+		var dst *bucketModel
+		switch {
+		case ctx.String(dstListingFlag.Name) != "":
+			dst = mustBuildModel(ctx, cfg.Destination.Bucket, dstListingFlag, abort)
+		case ctx.String(dstModelFlag.Name) != "":
+			dst = mustRetrieveModel(ctx, dstModelFlag)
+		}
+
+		var history []roundSummary
+		var records []keyRecord
+		if state != "" {
+			var err error
+			if history, err = state.readHistory(); err != nil {
+				fail(ctx, "error: can't read history: %v", err)
+			}
+			if records, err = state.readResults(); err != nil {
+				fail(ctx, "error: can't read results history: %v", err)
+			}
+		}
+		status, err := newMigrationStatus(src, dst, history, records, time.Now(), ctx.Duration(windowFlag.Name))
+		if err != nil {
+			fail(ctx, "error: can't estimate the status of the migration: %v", err)
+		}
+		if status.Destination == "" {
+			status.Destination = cfg.Destination.Bucket
+		}
+
+		if format == "table" {
+			if err := status.writeSummary(os.Stdout); err != nil {
+				fail(ctx, "bug: can't write migration status to stdout: %v", err)
+			}
+			return
+		}
+		data, err := json.MarshalIndent(status, "", "   ")
+		if err != nil {
+			fail(ctx, "bug: can't create migration status JSON: %v", err)
+		}
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			fail(ctx, "bug: can't write migration status to stdout: %v", err)
+		}
+	}
+
+	return cli.Command{
+		Name:  "migration-status",
+		Usage: "Reports how far a migration to the destination is, and when it should complete.",
+		Description: strings.TrimSpace(`
+Combines a model or listing of the source, a model or listing of the
+destination if any, and the history of the rounds and mismatches of the audit
+into the percentage of the keys of the source synced to the destination. The
+pace of the migration is the trend of the share of keys found replicated by
+the rounds within the window, and the estimated completion time is when that
+pace reaches all the keys. Without a model or listing of the destination, the
+keys synced are extrapolated from that trend.`),
+		Flags: []cli.Flag{
+			cfgFlag, srcModelFlag, srcListingFlag, dstModelFlag, dstListingFlag,
+			windowFlag, formatFlag,
+		},
+		Action: doMigrationStatus,
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile can't map files on this platform, files are read instead.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("memory mapped files aren't supported on this platform")
+}
+
+func munmap(data []byte) error { return nil }
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"container/heap"
 	"encoding/json"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"launchpad.net/goamz/s3"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"runtime"
 	"strings"
+	"sync"
+	"text/tabwriter"
 )
 
 type bucketModel struct {
@@ -12,12 +20,26 @@ type bucketModel struct {
 	name     string
 	depths   []int
 	keyCount int
+	// prefixes estimates how many distinct prefixes there are at each
+	// depth. It's empty for models built before it was estimated.
+	prefixes []int
+	// placeholders is how many of the keys are placeholders, see
+	// isPlaceholder. It's 0 for models built before they were counted.
+	placeholders int
+}
+
+// isPlaceholder tells if a key is a placeholder rather than data: an empty
+// key, or a "directory" marker whose name ends with a slash, as consoles
+// create to show folders.
+func isPlaceholder(key string, size int64) bool {
+	return size == 0 || strings.HasSuffix(key, "/")
 }
 
 func (b bucketModel) MarshalJSON() ([]byte, error) {
 	type depthLevel struct {
-		Level int `json:"level"`
-		Count int `json:"count"`
+		Level    int `json:"level"`
+		Count    int `json:"count"`
+		Prefixes int `json:"prefixes,omitempty"`
 	}
 	depths := make([]depthLevel, len(b.depths))
 	for i, count := range b.depths {
@@ -25,64 +47,419 @@ func (b bucketModel) MarshalJSON() ([]byte, error) {
 			Level: i,
 			Count: count,
 		}
+		if i < len(b.prefixes) {
+			depths[i].Prefixes = b.prefixes[i]
+		}
 	}
 	return json.MarshalIndent(struct {
-		Name     string       `json:"bucket_name"`
-		Depth    []depthLevel `json:"depths"`
-		KeyCount int          `json:"key_count"`
-	}{Name: b.name, Depth: depths, KeyCount: b.keyCount}, "", "   ")
+		Name         string       `json:"bucket_name"`
+		Depth        []depthLevel `json:"depths"`
+		KeyCount     int          `json:"key_count"`
+		Placeholders int          `json:"placeholders,omitempty"`
+	}{Name: b.name, Depth: depths, KeyCount: b.keyCount, Placeholders: b.placeholders}, "", "   ")
 }
 
 func (b *bucketModel) UnmarshalJSON(p []byte) error {
 	type depthLevel struct {
-		Level int `json:"level"`
-		Count int `json:"count"`
+		Level    int `json:"level"`
+		Count    int `json:"count"`
+		Prefixes int `json:"prefixes,omitempty"`
 	}
 	var d struct {
-		Name     string       `json:"bucket_name"`
-		Depth    []depthLevel `json:"depths"`
-		KeyCount int          `json:"key_count"`
+		Name         string       `json:"bucket_name"`
+		Depth        []depthLevel `json:"depths"`
+		KeyCount     int          `json:"key_count"`
+		Placeholders int          `json:"placeholders,omitempty"`
 	}
 	err := json.Unmarshal(p, &d)
 	b.name = d.Name
 	b.depths = make([]int, len(d.Depth))
+	b.prefixes = nil
 	for _, depthL := range d.Depth {
 		b.depths[depthL.Level] = depthL.Count
+		if depthL.Prefixes != 0 && b.prefixes == nil {
+			b.prefixes = make([]int, len(d.Depth))
+		}
+	}
+	if b.prefixes != nil {
+		for _, depthL := range d.Depth {
+			b.prefixes[depthL.Level] = depthL.Prefixes
+		}
 	}
 	b.keyCount = d.KeyCount
+	b.placeholders = d.Placeholders
 	return err
 }
 
+// buildModel builds the model of a bucket from its keys, read by as many
+// workers as there are CPUs. Each worker counts the keys it reads on its
+// own, and their counts are merged once all keys are read: the model is the
+// same whatever the order the keys are read in.
 func buildModel(name string, keys <-chan interface{}, abort <-chan struct{}) *bucketModel {
 	log.Info("computing model...")
 	defer log.Info("done!")
-	depthMap := make(map[int]int)
-	count := 0
-	maxDepth := 0
-loop:
-	for key := range keys {
-		select {
-		case <-abort:
-			log.Warn("aborting build of model")
-			break loop
-		default:
-		}
-		count++
-		depth := strings.Count(key.(*s3.Key).Key, "/")
-		depthMap[depth]++
-		if depth > maxDepth {
-			maxDepth = depth
-		}
-	}
-
-	depths := make([]int, maxDepth+1)
-	for d, count := range depthMap {
+	workers := runtime.NumCPU()
+	partials := make([]*modelCounts, workers)
+	var wg sync.WaitGroup
+	for i := range partials {
+		partials[i] = newModelCounts()
+		wg.Add(1)
+		go func(counts *modelCounts) {
+			defer wg.Done()
+			for key := range keys {
+				select {
+				case <-abort:
+					return
+				default:
+				}
+				counts.add(key.(*listedKey))
+			}
+		}(partials[i])
+	}
+	wg.Wait()
+	select {
+	case <-abort:
+		log.Warn("aborting build of model")
+	default:
+	}
+
+	counts := partials[0]
+	for _, partial := range partials[1:] {
+		counts.merge(partial)
+	}
+	return counts.model(name)
+}
+
+// modelCounts counts the keys a model is built from.
+type modelCounts struct {
+	depthMap     map[int]int
+	sketches     map[int]*prefixSketch
+	count        int
+	placeholders int
+	maxDepth     int
+}
+
+func newModelCounts() *modelCounts {
+	return &modelCounts{
+		depthMap: make(map[int]int),
+		sketches: make(map[int]*prefixSketch),
+	}
+}
+
+func (c *modelCounts) add(k *listedKey) {
+	c.count++
+	if isPlaceholder(k.Key, k.Size) {
+		c.placeholders++
+	}
+	path := k.Key
+	depth := strings.Count(path, "/")
+	c.depthMap[depth]++
+	// the key is under a prefix at each depth down to its own
+	level := 0
+	for i := 0; i < len(path); i++ {
+		if path[i] != '/' {
+			continue
+		}
+		level++
+		c.sketch(level).add(path[:i+1])
+	}
+	if depth > c.maxDepth {
+		c.maxDepth = depth
+	}
+}
+
+func (c *modelCounts) sketch(level int) *prefixSketch {
+	sketch, ok := c.sketches[level]
+	if !ok {
+		sketch = newPrefixSketch(PrefixSketchSize)
+		c.sketches[level] = sketch
+	}
+	return sketch
+}
+
+// merge adds the keys counted by o.
+func (c *modelCounts) merge(o *modelCounts) {
+	c.count += o.count
+	c.placeholders += o.placeholders
+	for d, count := range o.depthMap {
+		c.depthMap[d] += count
+	}
+	for level, sketch := range o.sketches {
+		c.sketch(level).merge(sketch)
+	}
+	if o.maxDepth > c.maxDepth {
+		c.maxDepth = o.maxDepth
+	}
+}
+
+func (c *modelCounts) model(name string) *bucketModel {
+	depths := make([]int, c.maxDepth+1)
+	for d, count := range c.depthMap {
 		depths[d] = count
 	}
+	prefixes := make([]int, c.maxDepth+1)
+	prefixes[0] = 1
+	for d, sketch := range c.sketches {
+		prefixes[d] = sketch.estimate()
+	}
 
 	return &bucketModel{
-		name:     name,
-		depths:   depths,
-		keyCount: count,
+		name:         name,
+		depths:       depths,
+		keyCount:     c.count,
+		prefixes:     prefixes,
+		placeholders: c.placeholders,
+	}
+}
+
+// writeFile writes the model as JSON to a file, replacing the file if it
+// already exists.
+func (b bucketModel) writeFile(filename string) error {
+	data, err := b.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// modelPathOf is where the model built from a listing is saved by default,
+// next to it: the model of listing.json.gz is saved to listing.model.json.
+func modelPathOf(listing string) string {
+	base := strings.TrimSuffix(listing, ".gz")
+	base = strings.TrimSuffix(base, ".json")
+	return base + ".model.json"
+}
+
+// averageDepth is the mean depth of the keys of the bucket.
+func (b bucketModel) averageDepth() float64 {
+	if b.keyCount == 0 {
+		return 0
+	}
+	sum := 0
+	for depth, count := range b.depths {
+		sum += depth * count
+	}
+	return float64(sum) / float64(b.keyCount)
+}
+
+// depthGrowth is how the keys at a depth of a bucket changed between two
+// models. Counts of prefixes are -1 when a model doesn't estimate them.
+type depthGrowth struct {
+	depth       int
+	oldKeys     int
+	newKeys     int
+	oldPrefixes int
+	newPrefixes int
+}
+
+// growth compares the model with a newer model of the same bucket, depth by
+// depth.
+func (b bucketModel) growth(newer bucketModel) []depthGrowth {
+	levels := len(b.depths)
+	if len(newer.depths) > levels {
+		levels = len(newer.depths)
+	}
+	at := func(counts []int, level int) int {
+		if level < len(counts) {
+			return counts[level]
+		}
+		return 0
+	}
+	prefixesAt := func(m bucketModel, level int) int {
+		if len(m.prefixes) == 0 {
+			return -1
+		}
+		return at(m.prefixes, level)
+	}
+	growth := make([]depthGrowth, levels)
+	for level := range growth {
+		growth[level] = depthGrowth{
+			depth:       level,
+			oldKeys:     at(b.depths, level),
+			newKeys:     at(newer.depths, level),
+			oldPrefixes: prefixesAt(b, level),
+			newPrefixes: prefixesAt(newer, level),
+		}
+	}
+	return growth
+}
+
+// writeGrowth writes how the bucket grew since this model was built, as
+// told by a newer model.
+func (b bucketModel) writeGrowth(w io.Writer, newer bucketModel) error {
+	change := func(before, after int) string {
+		switch {
+		case before == after:
+			return "0%"
+		case before == 0:
+			return "new"
+		}
+		return fmt.Sprintf("%+.1f%%", float64(after-before)/float64(before)*100)
+	}
+	prefixes := func(n int) string {
+		if n < 0 {
+			return "-"
+		}
+		return fmt.Sprintf("~%d", n)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEPTH\tOLD KEYS\tNEW KEYS\tCHANGE\tOLD PREFIXES\tNEW PREFIXES")
+	for _, g := range b.growth(newer) {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%s\t%s\n", g.depth, g.oldKeys, g.newKeys,
+			change(g.oldKeys, g.newKeys), prefixes(g.oldPrefixes), prefixes(g.newPrefixes))
+	}
+	fmt.Fprintf(tw, "total\t%d\t%d\t%s\t\t\n", b.keyCount, newer.keyCount, change(b.keyCount, newer.keyCount))
+	return tw.Flush()
+}
+
+// SummaryBarWidth is the width of the bar of the most populated depth, in
+// the summary of a model.
+const SummaryBarWidth = 40
+
+// writeSummary writes a summary of the model meant for humans, with a
+// histogram of the depths of the keys.
+func (b bucketModel) writeSummary(w io.Writer) error {
+	most := 0
+	for _, count := range b.depths {
+		if count > most {
+			most = count
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "bucket:\t%s\n", b.name)
+	fmt.Fprintf(tw, "keys:\t%d\n", b.keyCount)
+	fmt.Fprintf(tw, "placeholders:\t%d\n", b.placeholders)
+	fmt.Fprintf(tw, "average depth:\t%.2f\n", b.averageDepth())
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "DEPTH\tKEYS\tPREFIXES\t")
+	for depth, count := range b.depths {
+		prefixes := "-"
+		if depth < len(b.prefixes) {
+			prefixes = fmt.Sprintf("~%d", b.prefixes[depth])
+		}
+		width := 0
+		if most > 0 {
+			width = int(math.Ceil(float64(count) / float64(most) * SummaryBarWidth))
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\n", depth, count, prefixes, strings.Repeat("#", width))
+	}
+	return tw.Flush()
+}
+
+// PrefixSketchSize is how many hashes of prefixes are kept to estimate the
+// number of prefixes at each depth. The estimates are exact below this
+// number, and off by about 3% above it.
+const PrefixSketchSize = 1024
+
+// prefixSketch estimates the number of distinct prefixes at a depth in
+// bounded memory, keeping only the smallest hashes of the prefixes seen. The
+// more prefixes there are, the smaller the largest of those hashes is.
+type prefixSketch struct {
+	size   int
+	hashes uint64Heap
+	kept   map[uint64]struct{}
+}
+
+func newPrefixSketch(size int) *prefixSketch {
+	return &prefixSketch{size: size, kept: make(map[uint64]struct{}, size)}
+}
+
+func (s *prefixSketch) add(prefix string) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(prefix))
+	// FNV spreads similar prefixes poorly, mix its bits before comparing
+	sum := h.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	s.addHash(sum)
+}
+
+// merge adds the prefixes seen by o, which keeps as many hashes. The
+// smallest hashes of both are those of all their prefixes.
+func (s *prefixSketch) merge(o *prefixSketch) {
+	for _, sum := range o.hashes {
+		s.addHash(sum)
+	}
+}
+
+func (s *prefixSketch) addHash(sum uint64) {
+	if _, ok := s.kept[sum]; ok {
+		return
+	}
+	if len(s.hashes) < s.size {
+		heap.Push(&s.hashes, sum)
+		s.kept[sum] = struct{}{}
+		return
+	}
+	if sum >= s.hashes[0] {
+		return
+	}
+	delete(s.kept, s.hashes[0])
+	s.hashes[0] = sum
+	heap.Fix(&s.hashes, 0)
+	s.kept[sum] = struct{}{}
+}
+
+func (s *prefixSketch) estimate() int {
+	if len(s.hashes) < s.size {
+		return len(s.hashes)
+	}
+	largest := float64(s.hashes[0]) / math.MaxUint64
+	return int(float64(s.size-1) / largest)
+}
+
+// uint64Heap is a max-heap of hashes.
+type uint64Heap []uint64
+
+func (h uint64Heap) Len() int            { return len(h) }
+func (h uint64Heap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h uint64Heap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *uint64Heap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+func (h *uint64Heap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// relDiff is the difference between two counts, relative to the larger one.
+func relDiff(a, b int) float64 {
+	if a == b {
+		return 0
+	}
+	return math.Abs(float64(a-b)) / math.Max(float64(a), float64(b))
+}
+
+// drift describes how a model built from a listing differs from this model,
+// beyond a tolerance relative to the counts of keys. It returns nothing if
+// the models are consistent.
+func (b bucketModel) drift(listing bucketModel, tolerance float64) []string {
+	var diffs []string
+	if d := relDiff(b.keyCount, listing.keyCount); d > tolerance {
+		diffs = append(diffs, fmt.Sprintf("key count: model has %d, listing has %d (%.1f%% off)",
+			b.keyCount, listing.keyCount, d*100))
+	}
+	levels := len(b.depths)
+	if len(listing.depths) > levels {
+		levels = len(listing.depths)
+	}
+	for level := 0; level < levels; level++ {
+		var want, got int
+		if level < len(b.depths) {
+			want = b.depths[level]
+		}
+		if level < len(listing.depths) {
+			got = listing.depths[level]
+		}
+		if d := relDiff(want, got); d > tolerance {
+			diffs = append(diffs, fmt.Sprintf("depth %d: model has %d keys, listing has %d (%.1f%% off)",
+				level, want, got, d*100))
+		}
 	}
+	return diffs
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// namespace is a group of prefixes audited apart from the rest of the
+// bucket, with its own quota of keys and alert threshold. Keys are sampled
+// in the whole bucket and rejected if they're outside the namespace, so a
+// namespace must hold a fair share of the keys to be sampled.
+type namespace struct {
+	Name     string   `json:"name"`
+	Prefixes []string `json:"prefixes"`
+	// CheckCount is how many keys of the namespace are verified in each
+	// round it's audited, on top of the keys sampled in the whole bucket.
+	CheckCount int `json:"check_count"`
+	// FrequencyMultiplier is how many rounds apart the namespace is
+	// audited, 1 meaning every round.
+	FrequencyMultiplier int `json:"frequency_multiplier,omitempty"`
+	// MaxMismatchRate is the rate of mismatches in a round above which the
+	// namespace is alerted on, any mismatch by default.
+	MaxMismatchRate float64 `json:"max_mismatch_rate,omitempty"`
+	// SLO, if set, alerts on the burn rate of the error budget of the
+	// namespace instead of on the mismatches of each round.
+	SLO *slo `json:"slo,omitempty"`
+}
+
+// contains tells if a key belongs to the namespace.
+func (ns namespace) contains(key string) bool {
+	for _, prefix := range ns.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// due tells if the namespace is audited in a round.
+func (ns namespace) due(round int) bool {
+	return round%ns.FrequencyMultiplier == 0
+}
+
+func loadNamespaces(namespaces []namespace) ([]namespace, error) {
+	names := make(map[string]bool, len(namespaces))
+	for i := range namespaces {
+		ns := &namespaces[i]
+		if ns.Name == "" {
+			return nil, fmt.Errorf("namespaces[%d]: name is required", i)
+		}
+		if names[ns.Name] {
+			return nil, fmt.Errorf("%s: name is used by another namespace", ns.Name)
+		}
+		names[ns.Name] = true
+		if len(ns.Prefixes) == 0 {
+			return nil, fmt.Errorf("%s: prefixes are required", ns.Name)
+		}
+		if ns.CheckCount <= 0 {
+			return nil, fmt.Errorf("%s: check_count must be positive", ns.Name)
+		}
+		if ns.FrequencyMultiplier < 0 {
+			return nil, fmt.Errorf("%s: frequency_multiplier can't be negative", ns.Name)
+		}
+		if ns.FrequencyMultiplier == 0 {
+			ns.FrequencyMultiplier = 1
+		}
+		if ns.MaxMismatchRate < 0 || ns.MaxMismatchRate > 1 {
+			return nil, fmt.Errorf("%s: max_mismatch_rate must be between 0 and 1", ns.Name)
+		}
+		if ns.SLO != nil {
+			if err := loadSLO(ns.SLO); err != nil {
+				return nil, fmt.Errorf("%s: %v", ns.Name, err)
+			}
+		}
+	}
+	return namespaces, nil
+}
+
+// namespaceCounts are the outcomes of the keys of a namespace in a round.
+type namespaceCounts struct {
+	Counts map[outcome]int `json:"counts"`
+	// BurnRates are the burn rates of the error budget over each window of
+	// the SLO of the namespace, if it has one.
+	BurnRates map[string]float64 `json:"burn_rates,omitempty"`
+	// Alert is set if the rate of mismatches, or the burn rate of the error
+	// budget, exceeded the threshold of the namespace.
+	Alert bool `json:"alert,omitempty"`
+	// Risk is the score of the mismatches of the namespace, in audits
+	// scoring them.
+	Risk float64 `json:"risk,omitempty"`
+}
+
+// namespaceAudit is the audit of a namespace, by its own verifier.
+type namespaceAudit struct {
+	namespace
+	v *verifier
+	// budget is the error budget of the namespace, if it has an SLO.
+	budget errorBudget
+}
+
+// newNamespaceAudits creates a verifier for each namespace of the config,
+// sharing the buckets and model of the verifier auditing the whole bucket.
+func (v *verifier) newNamespaceAudits() error {
+	for _, ns := range v.cfg.Namespaces {
+		cfg := v.subConfig()
+		cfg.CheckCount = ns.CheckCount
+		cfg.SampleWorkers, cfg.VerifyWorkers = defaultWorkers(ns.CheckCount)
+		sub, err := newVerifier(&cfg, v.model, v.src, v.dst, v.abort)
+		if err != nil {
+			return fmt.Errorf("namespace %q: %w", ns.Name, err)
+		}
+		sub.lifecycle = v.lifecycle
+		sub.prefixes = ns.Prefixes
+		v.namespaces = append(v.namespaces, namespaceAudit{namespace: ns, v: sub})
+	}
+	return nil
+}
+
+// auditNamespaces verifies keys sampled in each namespace due this round,
+// adding their results to the report and alerting on the namespaces with
+// too many mismatches.
+func (v *verifier) auditNamespaces(r *rand.Rand, now time.Time, report *RoundReport) error {
+	for i := range v.namespaces {
+		na := &v.namespaces[i]
+		if !na.due(v.checkpoint.Rounds) {
+			continue
+		}
+		counts := namespaceCounts{Counts: make(map[outcome]int)}
+		err := v.verifyWith(na.v, r, now, report, func(res *Result) {
+			res.Namespace = na.Name
+			counts.Counts[res.Outcome]++
+		})
+		if err != nil {
+			return fmt.Errorf("namespace %q: %w", na.Name, err)
+		}
+
+		if na.SLO != nil {
+			na.alertOnBurnRate(now, &counts)
+		} else {
+			na.alertOnMismatchRate(&counts)
+		}
+		if report.Maintenance != nil {
+			counts.Alert = false
+		}
+		if report.Namespaces == nil {
+			report.Namespaces = make(map[string]namespaceCounts)
+		}
+		report.Namespaces[na.Name] = counts
+	}
+	return nil
+}
+
+// alertOnMismatchRate alerts if the rate of mismatches of the round exceeds
+// the threshold of the namespace.
+func (na *namespaceAudit) alertOnMismatchRate(counts *namespaceCounts) {
+	total := 0
+	for _, n := range counts.Counts {
+		total += n
+	}
+	if total == 0 {
+		return
+	}
+	rate := float64(counts.Counts[outcomeMismatch]) / float64(total)
+	if rate <= na.MaxMismatchRate {
+		return
+	}
+	counts.Alert = true
+	log.WithFields(log.Fields{
+		"namespace":         na.Name,
+		"mismatches":        counts.Counts[outcomeMismatch],
+		"keys":              total,
+		"max_mismatch_rate": na.MaxMismatchRate,
+	}).Error("namespace has too many mismatches")
+}
+
+// alertOnBurnRate tallies the round in the error budget of the namespace,
+// and alerts if the budget is burnt too fast over any window of its SLO.
+func (na *namespaceAudit) alertOnBurnRate(now time.Time, counts *namespaceCounts) {
+	na.budget.add(*na.SLO, now, counts.Counts)
+	counts.BurnRates = make(map[string]float64, len(na.SLO.Alerts))
+	for _, a := range na.SLO.Alerts {
+		burnRate := na.budget.burnRate(*na.SLO, now, a.window)
+		counts.BurnRates[a.Window] = burnRate
+		if burnRate <= a.BurnRate {
+			continue
+		}
+		counts.Alert = true
+		log.WithFields(log.Fields{
+			"namespace":     na.Name,
+			"objective":     na.SLO.Objective,
+			"window":        a.Window,
+			"burn_rate":     burnRate,
+			"max_burn_rate": a.BurnRate,
+		}).Error("namespace is burning its error budget too fast")
+	}
+}
+
+// restoreBudgets tallies the rounds of the history in the error budgets of
+// the namespaces, so that windows span restarts of the audit.
+func (v *verifier) restoreBudgets(history []roundSummary) {
+	for i := range v.namespaces {
+		na := &v.namespaces[i]
+		if na.SLO == nil {
+			continue
+		}
+		for _, summary := range history {
+			if counts, ok := summary.Namespaces[na.Name]; ok {
+				na.budget.add(*na.SLO, summary.Started, counts.Counts)
+			}
+		}
+	}
+}
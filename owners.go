@@ -0,0 +1,52 @@
+package main
+
+import "fmt"
+
+// ownersConfig restricts the keys sampled to those written by some owners,
+// as in buckets shared by teams writing with accounts of their own. Owners
+// are canonical IDs of AWS accounts.
+type ownersConfig struct {
+	// Include are the only owners whose keys are sampled, if any.
+	Include []string `json:"include,omitempty"`
+	// Exclude are owners whose keys are never sampled.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+func loadOwners(o *ownersConfig) error {
+	excluded := make(map[string]bool, len(o.Exclude))
+	for _, id := range o.Exclude {
+		if id == "" {
+			return fmt.Errorf("empty owner ID")
+		}
+		excluded[id] = true
+	}
+	for _, id := range o.Include {
+		if id == "" {
+			return fmt.Errorf("empty owner ID")
+		}
+		if excluded[id] {
+			return fmt.Errorf("owner %q is both included and excluded", id)
+		}
+	}
+	return nil
+}
+
+// allows tells if keys of an owner can be sampled. Keys whose owner isn't
+// known, such as from inventories that leave it out, are sampled only if no
+// owners are included.
+func (o *ownersConfig) allows(id string) bool {
+	for _, ex := range o.Exclude {
+		if id == ex {
+			return false
+		}
+	}
+	if len(o.Include) == 0 {
+		return true
+	}
+	for _, in := range o.Include {
+		if id == in {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+// partitionConfig partitions an audit between instances of jag auditing the
+// same buckets for throughput. Each instance verifies its own share of the
+// keys, those whose names hash to its index, with seeds of its own, so that
+// no two instances sample the same keys.
+type partitionConfig struct {
+	// Index is the instance, from 0 to Count-1.
+	Index int `json:"index"`
+	Count int `json:"count"`
+}
+
+// withPartitionIndex is the config of the instance of a partitioned audit
+// with an index, given on its command line rather than in the config shared
+// by the instances.
+func (c *config) withPartitionIndex(index string) (*config, error) {
+	if c.Partition == nil {
+		return nil, configErrorf("the audit isn't partitioned, its config has no partition")
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return nil, configErrorf("invalid partition index %q: %v", index, err)
+	}
+	p := *c
+	p.Partition = &partitionConfig{Index: i, Count: c.Partition.Count}
+	if err := loadPartition(p.Partition); err != nil {
+		return nil, configErrorf("partition: %v", err)
+	}
+	return &p, nil
+}
+
+func loadPartition(p *partitionConfig) error {
+	if p.Count < 1 {
+		return fmt.Errorf("count must be at least 1")
+	}
+	if p.Index < 0 || p.Index >= p.Count {
+		return fmt.Errorf("index must be from 0 to %d", p.Count-1)
+	}
+	return nil
+}
+
+// contains tells if a key is in the share of the instance.
+func (p *partitionConfig) contains(key string) bool {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()%uint64(p.Count) == uint64(p.Index)
+}
+
+// seed returns a seed of the instance close to a seed: seeds of an instance
+// are congruent to its index modulo the number of instances.
+func (p *partitionConfig) seed(seed int64) int64 {
+	n, i := int64(p.Count), int64(p.Index)
+	base := seed / n * n
+	if base > math.MaxInt64-i {
+		base -= n
+	}
+	return base + i
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+)
+
+// auditPlan describes what an audit does given its config, without running
+// it, so that changes to configs can be reviewed. Its JSON form is stable:
+// the same config always gives the same plan.
+type auditPlan struct {
+	Audit       string            `json:"audit,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Preset      string            `json:"preset,omitempty"`
+	Maintenance bool              `json:"maintenance,omitempty"`
+	Partition   *partitionConfig  `json:"partition,omitempty"`
+	Source      planBucket        `json:"source"`
+	Destination planBucket        `json:"destination"`
+	// CircuitBreaker is set if the endpoints of the buckets are
+	// requested through circuit breakers.
+	CircuitBreaker *breakerFile `json:"circuit_breaker,omitempty"`
+	Schedule       planSchedule `json:"schedule"`
+	Sample         planSample   `json:"sample"`
+	Filters        planFilters  `json:"filters"`
+	Checks         planChecks   `json:"checks"`
+	StateDir       string       `json:"state_dir,omitempty"`
+	// Export is where the rounds are exported, if they are.
+	Export *exportConfig `json:"export,omitempty"`
+	Admin  planAdmin     `json:"admin"`
+}
+
+// planAdmin is the HTTP endpoint of the audit. Tokens and passwords are
+// left out.
+type planAdmin struct {
+	Listen string `json:"listen"`
+	// Auth are the ways requests are authenticated, if they are: bearer,
+	// bearer-read for the read token, and basic.
+	Auth []string `json:"auth,omitempty"`
+	// TLS is how the endpoint is served over TLS, if it is: with the
+	// certificate of a file, or self-signed.
+	TLS string `json:"tls,omitempty"`
+}
+
+// planBucket is a bucket and the endpoints it's reached at, in the order
+// they're failed over to. Credentials are left out.
+type planBucket struct {
+	Bucket    string   `json:"bucket"`
+	Region    string   `json:"region"`
+	Endpoints []string `json:"endpoints"`
+	DualStack bool     `json:"dual_stack,omitempty"`
+	FIPS      bool     `json:"fips,omitempty"`
+}
+
+type planSchedule struct {
+	RunMode string `json:"run_mode"`
+	// Once is set if a single round is audited, Frequency otherwise.
+	Once      bool   `json:"once,omitempty"`
+	Frequency string `json:"frequency,omitempty"`
+	// Report and ReportS3 are where the report of each round is written.
+	Report   string `json:"report,omitempty"`
+	ReportS3 string `json:"report_s3,omitempty"`
+	// StatusFile is where the summary of each round is written.
+	StatusFile string `json:"status_file,omitempty"`
+	// WarmUpKeys are verified before the first round.
+	WarmUpKeys int `json:"warm_up_keys,omitempty"`
+}
+
+// planSample is how many keys each round samples, and how.
+type planSample struct {
+	Sampler        string          `json:"sampler"`
+	SamplerOptions json.RawMessage `json:"sampler_options,omitempty"`
+	// Keys are sampled from the source, Reverse keys are sampled from the
+	// destination in bidirectional audits, and Hot keys are sampled under
+	// the prefixes of the source written to the most.
+	Keys          int                `json:"keys"`
+	Reverse       int                `json:"reverse,omitempty"`
+	Hot           int                `json:"hot,omitempty"`
+	HotPrefixes   *hotConfig         `json:"hot_prefixes,omitempty"`
+	Versions      bool               `json:"versions,omitempty"`
+	Namespaces    []namespace        `json:"namespaces,omitempty"`
+	DeleteMarkers *deleteMarkersFile `json:"delete_markers,omitempty"`
+	SampleWorkers int                `json:"sample_workers"`
+	VerifyWorkers int                `json:"verify_workers"`
+	Autotune      *autotuneFile      `json:"autotune,omitempty"`
+}
+
+// planFilters select the sampled keys, and the mismatches that are
+// tolerated.
+type planFilters struct {
+	Youngest       string           `json:"youngest"`
+	Oldest         string           `json:"oldest"`
+	Keys           []string         `json:"keys,omitempty"`
+	Constraint     string           `json:"constraint,omitempty"`
+	IgnoreMismatch string           `json:"ignore_mismatch,omitempty"`
+	Ignore         []ignoreRuleFile `json:"ignore,omitempty"`
+	// MinSize and MaxSize bound the size of the keys sampled, in bytes.
+	MinSize int64         `json:"min_size,omitempty"`
+	MaxSize int64         `json:"max_size,omitempty"`
+	Owners  *ownersConfig `json:"owners,omitempty"`
+	// SkipPlaceholders is set if placeholder keys aren't sampled.
+	SkipPlaceholders bool `json:"skip_placeholders,omitempty"`
+}
+
+// planChecks are the checks verifying keys sampled from the source, and from
+// the destination in bidirectional audits.
+type planChecks struct {
+	Checks     []string `json:"checks"`
+	Reverse    []string `json:"reverse,omitempty"`
+	KeyTimeout string   `json:"key_timeout"`
+	// KeyNormalization is how the names of keys are normalized to look
+	// them up in the destination.
+	KeyNormalization []string `json:"key_normalization,omitempty"`
+	// ContentHash is the algorithm of the checksums compared by the content
+	// check, if it is performed.
+	ContentHash string `json:"content_hash,omitempty"`
+	// Reconcile is set if the statistics of the buckets are compared.
+	Reconcile bool `json:"reconcile,omitempty"`
+	// InFlightUploads is set if the mismatches of keys being uploaded to
+	// the source are pending.
+	InFlightUploads bool `json:"in_flight_uploads,omitempty"`
+	// MaxUploadAge is how long uploads are in flight, if they are listed.
+	MaxUploadAge string `json:"max_upload_age,omitempty"`
+	// InventoryDiff is set if the inventories of the buckets are diffed.
+	InventoryDiff *inventoryDiffFile `json:"inventory_diff,omitempty"`
+	// Flapping is set if alerts on keys are debounced.
+	Flapping *flappingConfig `json:"flapping,omitempty"`
+	// Risk is set if rounds are alerted on by the score of their
+	// mismatches.
+	Risk *riskConfig `json:"risk,omitempty"`
+	// Claims is set if the keys syncers claim to have copied are
+	// verified.
+	Claims *claimsFile `json:"claims,omitempty"`
+	// Events is set if the keys written according to the event
+	// notifications of the source are verified.
+	Events *eventsFile `json:"events,omitempty"`
+	// Queue is set if the keys verified besides those sampled are
+	// bounded.
+	Queue *queueConfig `json:"queue,omitempty"`
+	// Degradation is set if the checks are degraded while the
+	// destination fails.
+	Degradation *degradationConfig `json:"degradation,omitempty"`
+}
+
+// newAuditPlan describes the audit of a config, on a schedule whose
+// frequency is the config's unless a single round is audited.
+func newAuditPlan(cfg *config, schedule planSchedule) *auditPlan {
+	p := &auditPlan{
+		Audit:       cfg.AuditName,
+		Labels:      cfg.Labels,
+		Maintenance: cfg.Maintenance,
+		Partition:   cfg.Partition,
+		Source:      newPlanBucket(cfg.Source),
+		Destination: newPlanBucket(cfg.Destination),
+		Schedule:    schedule,
+		Sample: planSample{
+			Sampler:        cfg.Sampler,
+			SamplerOptions: cfg.SamplerOptions,
+			Keys:           cfg.CheckCount,
+			Versions:       cfg.SampleVersions,
+			Namespaces:     cfg.Namespaces,
+			SampleWorkers:  cfg.SampleWorkers,
+			VerifyWorkers:  cfg.VerifyWorkers,
+		},
+		Filters: planFilters{
+			Youngest:         cfg.CheckYoungest.String(),
+			Oldest:           cfg.CheckOldest.String(),
+			Constraint:       cfg.Constraint,
+			MinSize:          cfg.MinSize,
+			MaxSize:          cfg.MaxSize,
+			Owners:           cfg.Owners,
+			IgnoreMismatch:   cfg.IgnoreMismatch,
+			SkipPlaceholders: cfg.SkipPlaceholders,
+		},
+		Checks: planChecks{
+			Checks:           cfg.Checks,
+			KeyTimeout:       cfg.KeyTimeout.String(),
+			KeyNormalization: cfg.KeyNormalization,
+			Reconcile:        cfg.Reconcile,
+			InFlightUploads:  cfg.InFlightUploads,
+			Flapping:         cfg.Flapping,
+			Risk:             cfg.Risk,
+			Queue:            cfg.Queue,
+			Degradation:      cfg.Degradation,
+		},
+		StateDir: cfg.StateDir,
+		Export:   cfg.Export,
+		Admin:    planAdmin{Listen: cfg.Admin.addr()},
+	}
+	if cfg.Admin.Token != "" {
+		p.Admin.Auth = append(p.Admin.Auth, "bearer")
+	}
+	if cfg.Admin.ReadToken != "" {
+		p.Admin.Auth = append(p.Admin.Auth, "bearer-read")
+	}
+	if cfg.Admin.BasicAuth != nil {
+		p.Admin.Auth = append(p.Admin.Auth, "basic")
+	}
+	switch {
+	case cfg.Admin.TLS == nil:
+	case cfg.Admin.TLS.SelfSigned:
+		p.Admin.TLS = "self-signed"
+	default:
+		p.Admin.TLS = cfg.Admin.TLS.CertFile
+	}
+	if !schedule.Once {
+		p.Schedule.Frequency = cfg.CheckFrequency.String()
+	}
+	p.Schedule.WarmUpKeys = cfg.WarmUpKeys
+	if cfg.InFlightUploads {
+		p.Checks.MaxUploadAge = cfg.MaxUploadAge.String()
+	}
+	if cfg.Claims != nil {
+		p.Checks.Claims = cfg.Claims.file()
+	}
+	if cfg.Events != nil {
+		p.Checks.Events = cfg.Events.file()
+	}
+	if cfg.CircuitBreaker != nil {
+		p.CircuitBreaker = cfg.CircuitBreaker.file()
+	}
+	if cfg.Preset != nil {
+		p.Preset = cfg.Preset.Name
+		p.Filters.Keys = cfg.Preset.Keys
+	}
+	if p.Sample.Sampler == "" {
+		p.Sample.Sampler = DefaultSampler
+	}
+	if cfg.HotPrefixes != nil {
+		p.Sample.Hot = hotCheckCount(cfg)
+		p.Sample.Keys -= p.Sample.Hot
+		p.Sample.HotPrefixes = cfg.HotPrefixes
+	}
+	if cfg.Bidirectional {
+		p.Sample.Reverse = p.Sample.Keys / 2
+		p.Sample.Keys -= p.Sample.Reverse
+		p.Checks.Reverse = reverseChecks(cfg.Checks)
+	}
+	for _, name := range cfg.Checks {
+		if name == "content" {
+			p.Checks.ContentHash = cfg.ContentHash
+		}
+	}
+	if cfg.DeleteMarkers.Count != 0 {
+		p.Sample.DeleteMarkers = &deleteMarkersFile{
+			Count: uint(cfg.DeleteMarkers.Count),
+			SLA:   cfg.DeleteMarkers.SLA.String(),
+		}
+	}
+	if cfg.Autotune != nil {
+		p.Sample.Autotune = &autotuneFile{
+			TargetRound:  cfg.Autotune.TargetRound.String(),
+			MaxErrorRate: cfg.Autotune.MaxErrorRate,
+			MaxWorkers:   uint(cfg.Autotune.MaxWorkers),
+		}
+	}
+	if cfg.InventoryDiff != nil {
+		p.Checks.InventoryDiff = &inventoryDiffFile{
+			Source:      cfg.InventoryDiff.Source,
+			Destination: cfg.InventoryDiff.Destination,
+			Frequency:   cfg.InventoryDiff.Frequency.String(),
+		}
+	}
+	for _, rule := range cfg.Ignore {
+		p.Filters.Ignore = append(p.Filters.Ignore, rule.file())
+	}
+	return p
+}
+
+func newPlanBucket(a awsConfig) planBucket {
+	b := planBucket{
+		Bucket:    a.Bucket,
+		Region:    a.Region,
+		Endpoints: []string{a.endpoint(a.region()).S3Endpoint},
+		DualStack: a.DualStack,
+		FIPS:      a.FIPS,
+	}
+	switch {
+	case a.Swift != nil:
+		b.Endpoints = []string{a.Swift.AuthURL}
+	case a.SFTP != nil:
+		b.Endpoints = []string{"sftp://" + a.SFTP.Host + path.Join("/", a.SFTP.Root)}
+	case a.B2 != nil:
+		b.Endpoints = []string{a.B2.APIURL}
+	}
+	for _, fallback := range a.Fallbacks {
+		region, _ := regionOf(fallback)
+		b.Endpoints = append(b.Endpoints, a.endpoint(region).S3Endpoint)
+	}
+	return b
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A preset is a spot audit of part of the key space, run on demand with
+// audit --preset rather than every round. It samples its own count of keys
+// among those matching its patterns, and verifies them with its own checks.
+type preset struct {
+	Name string `json:"name"`
+	// Keys are glob patterns selecting the keys of the preset: * matches
+	// any characters but a slash, ** any characters, and ? a single
+	// character but a slash.
+	Keys       []string `json:"keys"`
+	CheckCount int      `json:"check_count"`
+	// Checks are the checks of the audit if empty.
+	Checks []string `json:"checks,omitempty"`
+
+	patterns []*regexp.Regexp
+}
+
+// compileGlob turns a glob pattern into a regular expression matching whole
+// keys.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			re.WriteString("[^/]*")
+		case glob[i] == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// matches tells if a key is selected by the patterns of the preset.
+func (p *preset) matches(key string) bool {
+	for _, re := range p.patterns {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadPresets(cfg *config, presets []preset) ([]preset, error) {
+	names := make(map[string]bool, len(presets))
+	for i := range presets {
+		p := &presets[i]
+		if p.Name == "" {
+			return nil, fmt.Errorf("presets[%d]: name is required", i)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("%s: name is used by another preset", p.Name)
+		}
+		names[p.Name] = true
+		if len(p.Keys) == 0 {
+			return nil, fmt.Errorf("%s: keys are required", p.Name)
+		}
+		p.patterns = make([]*regexp.Regexp, len(p.Keys))
+		for j, glob := range p.Keys {
+			re, err := compileGlob(glob)
+			if err != nil {
+				return nil, fmt.Errorf("%s: keys %q: %v", p.Name, glob, err)
+			}
+			p.patterns[j] = re
+		}
+		if p.CheckCount <= 0 {
+			return nil, fmt.Errorf("%s: check_count must be positive", p.Name)
+		}
+		for _, name := range p.Checks {
+			mkCheck, ok := checksByName[name]
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown check %q, valid checks are %s", p.Name, name, checkNames())
+			}
+			if _, err := mkCheck(cfg); err != nil {
+				return nil, fmt.Errorf("%s: check %q: %v", p.Name, name, err)
+			}
+		}
+	}
+	return presets, nil
+}
+
+// withPreset is the config of a spot audit with a preset. The spot audit
+// only samples the keys of the preset, and leaves out what's audited by the
+// rounds of the config: bidirectional sampling, namespaces, deletions, the
+// state directory and exports.
+func (c *config) withPreset(name string) (*config, error) {
+	var p *preset
+	for i := range c.Presets {
+		if c.Presets[i].Name == name {
+			p = &c.Presets[i]
+		}
+	}
+	if p == nil {
+		names := make([]string, len(c.Presets))
+		for i := range c.Presets {
+			names[i] = c.Presets[i].Name
+		}
+		return nil, configErrorf("unknown preset %q, valid presets are %s", name, strings.Join(names, ", "))
+	}
+	spot := *c
+	spot.Preset = p
+	spot.CheckCount = p.CheckCount
+	spot.SampleWorkers, spot.VerifyWorkers = defaultWorkers(p.CheckCount)
+	if len(p.Checks) != 0 {
+		spot.Checks = p.Checks
+	}
+	spot.Bidirectional = false
+	spot.Namespaces = nil
+	spot.HotPrefixes = nil
+	spot.DeleteMarkers = deleteMarkersConfig{}
+	spot.Reconcile = false
+	spot.InventoryDiff = nil
+	spot.Flapping = nil
+	spot.Autotune = nil
+	spot.Degradation = nil
+	spot.StateDir = ""
+	spot.Export = nil
+	spot.Claims = nil
+	spot.Events = nil
+	return &spot, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"time"
+)
+
+// DefaultProfileDir is where the profiles of slow rounds are written, in
+// the state directory if there's one, else in the working directory.
+const DefaultProfileDir = "profiles"
+
+// ProfileUploadTimeout is how long uploading a profile can take.
+const ProfileUploadTimeout = time.Minute
+
+// profilingConfig keeps profiles of the rounds that take too long.
+type profilingConfig struct {
+	// SlowRound is how long a round must take for its profiles to be kept.
+	SlowRound time.Duration
+	// Dir is where profiles are written, unless they're uploaded.
+	Dir string
+	// UploadURL, if set, is where profiles are POSTed instead.
+	UploadURL string
+}
+
+type profilingFile struct {
+	SlowRound string `json:"slow_round"`
+	Dir       string `json:"dir,omitempty"`
+	UploadURL string `json:"upload_url,omitempty"`
+}
+
+// profiler profiles the CPU during each round, and keeps the CPU profile
+// and a heap profile of the slow rounds.
+type profiler struct {
+	cfg profilingConfig
+	// identity of the audit, named in the query of uploads.
+	identity log.Fields
+	cpu      bytes.Buffer
+	// profiling is false if the CPU profile couldn't be started, e.g.
+	// because it's requested on the pprof endpoint.
+	profiling bool
+}
+
+func newProfiler(cfg profilingConfig, identity log.Fields, state stateDir) *profiler {
+	if cfg.Dir == "" {
+		cfg.Dir = DefaultProfileDir
+		if state != "" {
+			cfg.Dir = state.path(DefaultProfileDir)
+		}
+	}
+	return &profiler{cfg: cfg, identity: identity}
+}
+
+// start starts profiling the CPU for a round.
+func (p *profiler) start() {
+	p.cpu.Reset()
+	if err := pprof.StartCPUProfile(&p.cpu); err != nil {
+		log.WithField("error", err).Warn("can't profile the CPU during the round")
+		return
+	}
+	p.profiling = true
+}
+
+// stop stops profiling the CPU, and keeps the profiles if the round was
+// slow. The report is nil if the round failed.
+func (p *profiler) stop(report *RoundReport) {
+	if p.profiling {
+		pprof.StopCPUProfile()
+		p.profiling = false
+	}
+	if report == nil {
+		return
+	}
+	took := report.Finished.Sub(report.Started)
+	if took <= p.cfg.SlowRound {
+		return
+	}
+	profiles := map[string][]byte{}
+	if p.cpu.Len() > 0 {
+		profiles["cpu"] = p.cpu.Bytes()
+	}
+	var heap bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+		log.WithField("error", err).Error("couldn't profile the heap")
+	} else {
+		profiles["heap"] = heap.Bytes()
+	}
+	for kind, data := range profiles {
+		llog := log.WithFields(log.Fields{
+			"round":   report.ID,
+			"took":    took,
+			"profile": kind,
+		})
+		where, err := p.keep(report.ID, kind, data)
+		if err != nil {
+			llog.WithField("error", err).Error("couldn't keep profile of slow round")
+			continue
+		}
+		llog.WithField("where", where).Warn("round was slow, kept its profile")
+	}
+}
+
+// keep writes or uploads a profile of a round, and tells where it is.
+func (p *profiler) keep(id roundID, kind string, data []byte) (string, error) {
+	if p.cfg.UploadURL != "" {
+		return p.cfg.UploadURL, p.upload(id, kind, data)
+	}
+	if err := os.MkdirAll(p.cfg.Dir, 0755); err != nil {
+		return "", err
+	}
+	filename := filepath.Join(p.cfg.Dir, fmt.Sprintf("%s.%s.pprof", id, kind))
+	return filename, os.WriteFile(filename, data, 0644)
+}
+
+// upload POSTs a profile, naming its round, its kind and the identity of the
+// audit in the query.
+func (p *profiler) upload(id roundID, kind string, data []byte) error {
+	u, err := url.Parse(p.cfg.UploadURL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	for k, v := range p.identity {
+		q.Set(k, fmt.Sprint(v))
+	}
+	q.Set("round", string(id))
+	q.Set("profile", kind)
+	u.RawQuery = q.Encode()
+
+	client := &http.Client{Timeout: ProfileUploadTimeout}
+	resp, err := client.Post(u.String(), "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("upload failed: %s", resp.Status)
+	}
+	return nil
+}
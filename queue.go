@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MaxQueuedKeys bounds the keys of a queue waiting to be verified. Keys
+// beyond are dropped, so that a syncer copying, or a bucket written to,
+// faster than the audit verifies doesn't grow the audit unbounded.
+const MaxQueuedKeys = 100000
+
+// QueuePath is where the queue of the keys verified besides those sampled
+// is inspected, and keys are queued by operators, on the HTTP endpoint of the
+// audit command.
+const QueuePath = "/debug/queue"
+
+// MaxRequestedKeys is how many keys an operator can queue in a request.
+const MaxRequestedKeys = 1000
+
+// The sources of the queue.
+const (
+	sourceManual   = "manual"
+	sourceFollowUp = "follow_up"
+	sourceFlapping = "flapping"
+	sourceClaims   = "claims"
+	sourceEvents   = "events"
+)
+
+// queueSources are the sources of the queue, highest priority first: their
+// keys are verified in this order, and they're first to get what's left of
+// the round once it's shared.
+var queueSources = []string{sourceManual, sourceFollowUp, sourceFlapping, sourceClaims, sourceEvents}
+
+// queueConfig bounds the keys verified in a round besides those sampled:
+// the keys requested by operators, the follow-ups of inconclusive keys, the
+// keys whose mismatches are debounced, and the keys claimed to be copied or
+// written according to events. Keys sampled aren't queued, they're verified
+// once the queue is.
+//
+// Sources share MaxPerRound fairly: each gets an equal share, and the share
+// a source doesn't need goes to the others, so that no source starves the
+// others. Keys a round doesn't verify are verified in the next rounds.
+type queueConfig struct {
+	// MaxPerRound is how many queued keys are verified in a round, at
+	// most, unlimited if 0.
+	MaxPerRound int `json:"max_per_round,omitempty"`
+	// Quotas are how many keys of a source are verified in a round, at
+	// most, by source. Sources without a quota are only bounded by
+	// MaxPerRound.
+	Quotas map[string]int `json:"quotas,omitempty"`
+}
+
+func loadQueue(q *queueConfig) error {
+	if q.MaxPerRound < 0 {
+		return fmt.Errorf("max_per_round can't be negative")
+	}
+	for source, quota := range q.Quotas {
+		known := false
+		for _, s := range queueSources {
+			known = known || s == source
+		}
+		if !known {
+			return fmt.Errorf("quotas: unknown source %q, want one of %v", source, queueSources)
+		}
+		if quota < 0 {
+			return fmt.Errorf("quotas: quota of %q can't be negative", source)
+		}
+	}
+	return nil
+}
+
+// allocate returns how many keys of each source are verified in a round,
+// given how many each has due. Each source gets an equal share of what's
+// left of MaxPerRound until it has none due or reaches its quota, so that
+// the share a source doesn't need goes to the others, and what can't be
+// shared equally goes to the sources of higher priority.
+func (q *queueConfig) allocate(due map[string]int) map[string]int {
+	want := make(map[string]int, len(due))
+	for source, n := range due {
+		if quota, ok := q.quota(source); ok && quota < n {
+			n = quota
+		}
+		want[source] = n
+	}
+	if q == nil || q.MaxPerRound == 0 {
+		return want
+	}
+	alloc := make(map[string]int, len(want))
+	left := q.MaxPerRound
+	for left > 0 {
+		var active []string
+		for _, source := range queueSources {
+			if alloc[source] < want[source] {
+				active = append(active, source)
+			}
+		}
+		if len(active) == 0 {
+			break
+		}
+		share := left / len(active)
+		if share == 0 {
+			for _, source := range active[:left] {
+				alloc[source]++
+			}
+			break
+		}
+		for _, source := range active {
+			n := want[source] - alloc[source]
+			if n > share {
+				n = share
+			}
+			alloc[source] += n
+			left -= n
+		}
+	}
+	return alloc
+}
+
+func (q *queueConfig) quota(source string) (int, bool) {
+	if q == nil {
+		return 0, false
+	}
+	quota, ok := q.Quotas[source]
+	return quota, ok
+}
+
+// keyQueue holds keys to verify once a delay passed since they were queued,
+// such as keys claimed to be copied, or written according to events. Keys
+// are kept in memory, and journaled in the state directory if the queue was
+// restored from a journal, see queueJournal.
+type keyQueue struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	pending []queuedKey
+	// queued are the keys pending, queued again while they're pending.
+	queued  map[string]bool
+	dropped int
+	// journal is nil unless the keys are journaled, as queued by source.
+	journal *queueJournal
+	source  string
+	// inflight are the keys dequeued whose results aren't persisted yet,
+	// which stay in the journal until they are, see settle.
+	inflight []queuedKey
+}
+
+type queuedKey struct {
+	key  string
+	seen time.Time
+}
+
+func newKeyQueue(delay time.Duration) *keyQueue {
+	return &keyQueue{
+		delay:  delay,
+		queued: make(map[string]bool),
+	}
+}
+
+// add queues a key, unless it's already queued. It returns false if the
+// queue is full.
+func (q *keyQueue) add(key string, now time.Time) bool {
+	q.mu.Lock()
+	if q.queued[key] {
+		q.mu.Unlock()
+		return true
+	}
+	if len(q.pending) >= MaxQueuedKeys {
+		q.dropped++
+		q.mu.Unlock()
+		return false
+	}
+	q.queued[key] = true
+	q.pending = append(q.pending, queuedKey{key: key, seen: now})
+	journal, source := q.journal, q.source
+	q.mu.Unlock()
+	// the journal is compacted with the keys queued, which it must not
+	// wait for
+	if journal != nil {
+		journal.record(journalEntry{Source: source, Key: key, Queued: now})
+	}
+	return true
+}
+
+// snapshot returns the keys queued, and those dequeued whose results aren't
+// persisted yet.
+func (q *keyQueue) snapshot() []queuedKey {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append(append([]queuedKey(nil), q.inflight...), q.pending...)
+}
+
+// len returns how many keys are queued, due or not.
+func (q *keyQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// dueCount returns how many keys were queued at least the delay before now.
+func (q *keyQueue) dueCount(now time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for n < len(q.pending) && !q.pending[n].seen.Add(q.delay).After(now) {
+		n++
+	}
+	return n
+}
+
+// due dequeues the keys queued at least the delay before now, at most max
+// of them, oldest first. It also returns how many keys were dropped since it
+// was last called. Journaled keys stay in the journal until their results
+// are persisted, see settle.
+func (q *keyQueue) due(now time.Time, max int) (keys []queuedKey, dropped int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for n < len(q.pending) && n < max && !q.pending[n].seen.Add(q.delay).After(now) {
+		keys = append(keys, q.pending[n])
+		delete(q.queued, q.pending[n].key)
+		n++
+	}
+	q.pending = append(q.pending[:0], q.pending[n:]...)
+	if q.journal != nil {
+		q.inflight = append(q.inflight, keys...)
+	}
+	dropped, q.dropped = q.dropped, 0
+	return keys, dropped
+}
+
+// requeue queues again keys dequeued but not verified, first, unless
+// they were queued again since.
+func (q *keyQueue) requeue(keys []queuedKey) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var back []queuedKey
+	for _, k := range keys {
+		if !q.queued[k.key] {
+			q.queued[k.key] = true
+			back = append(back, k)
+		}
+	}
+	q.pending = append(back, q.pending...)
+	requeued := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		requeued[k.key] = true
+	}
+	inflight := q.inflight[:0]
+	for _, k := range q.inflight {
+		if !requeued[k.key] {
+			inflight = append(inflight, k)
+		}
+	}
+	q.inflight = inflight
+}
+
+// settle forgets the keys dequeued, once their results are persisted, so
+// that the journal drops them when it's compacted.
+func (q *keyQueue) settle() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inflight = nil
+}
+
+// manualKeys are the keys operators queued on the endpoint, verified by the
+// verifier of the audit command in its next round.
+var manualKeys = newKeyQueue(0)
+
+// acceptManual has the verifier verify the keys queued by operators.
+func (v *verifier) acceptManual(q *keyQueue) {
+	v.manual = q
+	if v.journal != nil {
+		v.journal.restore(sourceManual, q)
+	}
+}
+
+// journaledQueues are the queues of the verifier whose keys are journaled,
+// by source.
+func (v *verifier) journaledQueues() map[string]*keyQueue {
+	queues := make(map[string]*keyQueue)
+	if v.manual != nil {
+		queues[sourceManual] = v.manual
+	}
+	if v.claims != nil {
+		queues[sourceClaims] = v.claims.keyQueue
+	}
+	if v.events != nil {
+		queues[sourceEvents] = v.events.keyQueue
+	}
+	return queues
+}
+
+// queueDue returns how many keys of each source are due.
+func (v *verifier) queueDue(now time.Time) map[string]int {
+	due := map[string]int{sourceFollowUp: len(v.followUps)}
+	if v.manual != nil {
+		due[sourceManual] = v.manual.dueCount(now)
+	}
+	if v.flaps != nil {
+		due[sourceFlapping] = len(v.flaps.states())
+	}
+	// claims and events have their own bound
+	if v.claims != nil {
+		due[sourceClaims] = v.claims.dueCount(now)
+		if due[sourceClaims] > v.cfg.Claims.MaxPerRound {
+			due[sourceClaims] = v.cfg.Claims.MaxPerRound
+		}
+	}
+	if v.events != nil {
+		due[sourceEvents] = v.events.dueCount(now)
+		if due[sourceEvents] > v.cfg.Events.MaxPerRound {
+			due[sourceEvents] = v.cfg.Events.MaxPerRound
+		}
+	}
+	return due
+}
+
+// verifyQueue verifies the keys of the queue the round has room for, the
+// sources of higher priority first.
+func (v *verifier) verifyQueue(report *RoundReport) {
+	if v.level == levelBacklog {
+		log.Warn("not verifying queued keys, audit is degraded to recording the backlog")
+		if v.manual != nil {
+			observeQueue(v.cfg.Queue, v.queueDepths(), nil)
+		}
+		return
+	}
+	now := time.Now()
+	alloc := v.cfg.Queue.allocate(v.queueDue(now))
+	for _, source := range queueSources {
+		n := alloc[source]
+		if n == 0 {
+			continue
+		}
+		switch source {
+		case sourceManual:
+			v.verifyQueued(report, v.manual, n, "requested by operators", func(res *Result) { res.Requested = true })
+		case sourceFollowUp:
+			v.verifyFollowUps(report, n)
+		case sourceFlapping:
+			v.verifyFlapping(report, n)
+		case sourceClaims:
+			v.verifyClaims(report, n)
+		case sourceEvents:
+			v.verifyEvents(report, n)
+		}
+	}
+	if v.manual != nil {
+		observeQueue(v.cfg.Queue, v.queueDepths(), alloc)
+	}
+}
+
+// queueDepths returns how many keys of each source are queued, due or not.
+func (v *verifier) queueDepths() map[string]int {
+	depths := map[string]int{sourceFollowUp: len(v.followUps)}
+	if v.manual != nil {
+		depths[sourceManual] = v.manual.len()
+	}
+	if v.flaps != nil {
+		depths[sourceFlapping] = len(v.flaps.states())
+	}
+	if v.claims != nil {
+		depths[sourceClaims] = v.claims.len()
+	}
+	if v.events != nil {
+		depths[sourceEvents] = v.events.len()
+	}
+	return depths
+}
+
+// verifyQueued verifies n of the keys of a queue that are due, marking their
+// results. Keys removed from the source since they were queued aren't
+// verified, and keys whose verification is inconclusive are followed up.
+func (v *verifier) verifyQueued(report *RoundReport, q *keyQueue, n int, what string, mark func(*Result)) {
+	keys, dropped := q.due(time.Now(), n)
+	if dropped > 0 {
+		log.WithField("dropped", dropped).Warnf("keys %s were dropped, too many were queued", what)
+	}
+	if len(keys) == 0 {
+		return
+	}
+	log.Infof("verifying %d keys %s", len(keys), what)
+
+	keyc := make(chan object, v.verifyWorkers())
+	var failed []Result
+	// handled are the keys verified or left out, the others being queued
+	// again if the verification is aborted
+	handled := make(map[string]bool, len(keys))
+	verified := make(map[string]bool, len(keys))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(keyc)
+		for _, k := range keys {
+			key := k.key
+			want, err := findKey(context.Background(), v.src, key)
+			switch {
+			case err != nil:
+				res := inconclusiveResult(key, err)
+				res.want = object{Key: key}
+				failed = append(failed, res)
+				handled[key] = true
+				continue
+			case want == nil:
+				log.WithField("key", key).Infof("not verifying key %s, it isn't in source", what)
+				handled[key] = true
+				continue
+			}
+			select {
+			case keyc <- *want:
+			case <-v.abort:
+				return
+			}
+		}
+	}()
+	v.verifyKeysMatch(keyc, func(res Result) {
+		verified[res.want.Key] = true
+		mark(&res)
+		v.addResult(report, res)
+		if res.Outcome == outcomeInconclusive {
+			v.followUps = append(v.followUps, followUp{Key: res.want, Attempts: 1})
+		}
+	})
+	<-done
+	for _, res := range failed {
+		mark(&res)
+		v.addResult(report, res)
+		v.followUps = append(v.followUps, followUp{Key: res.want, Attempts: 1})
+	}
+	select {
+	case <-v.abort:
+		var left []queuedKey
+		for _, k := range keys {
+			if !handled[k.key] && !verified[k.key] {
+				left = append(left, k)
+			}
+		}
+		if len(left) != 0 {
+			log.WithField("keys", len(left)).Warnf("verification aborted, keys %s are queued again", what)
+			q.requeue(left)
+		}
+	default:
+	}
+}
+
+// queueStatus is the queue as of the last round, served on the endpoint.
+type queueStatus struct {
+	MaxPerRound int           `json:"max_per_round,omitempty"`
+	Sources     []queueSource `json:"sources"`
+	// Updated is when the last round verified the queue, zero until then.
+	Updated time.Time `json:"updated"`
+}
+
+type queueSource struct {
+	Source string `json:"source"`
+	// Queued is how many keys are queued, due or not.
+	Queued int `json:"queued"`
+	// Verified is how many keys the last round verified.
+	Verified int  `json:"verified"`
+	Quota    *int `json:"quota,omitempty"`
+}
+
+// queueState is the queue as of the last round of the audit command.
+var queueState struct {
+	mu     sync.Mutex
+	status queueStatus
+}
+
+func init() {
+	http.HandleFunc(QueuePath, serveQueue)
+}
+
+// observeQueue sets the queue served on the endpoint, as of a round.
+func observeQueue(cfg *queueConfig, depths, verified map[string]int) {
+	status := queueStatus{Updated: time.Now().UTC()}
+	if cfg != nil {
+		status.MaxPerRound = cfg.MaxPerRound
+	}
+	for _, source := range queueSources {
+		s := queueSource{Source: source, Queued: depths[source], Verified: verified[source]}
+		if quota, ok := cfg.quota(source); ok {
+			s.Quota = &quota
+		}
+		status.Sources = append(status.Sources, s)
+	}
+	queueState.mu.Lock()
+	queueState.status = status
+	queueState.mu.Unlock()
+}
+
+// serveQueue returns the queue as JSON. Keys are queued for the next round
+// on POST given an object like {"keys": ["photos/a.jpg"]}.
+func serveQueue(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Keys []string `json:"keys"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid keys: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(req.Keys) == 0 || len(req.Keys) > MaxRequestedKeys {
+			http.Error(w, fmt.Sprintf("invalid keys: want 1 to %d keys", MaxRequestedKeys), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		for _, key := range req.Keys {
+			if key == "" {
+				http.Error(w, "invalid keys: keys can't be empty", http.StatusBadRequest)
+				return
+			}
+		}
+		for _, key := range req.Keys {
+			if !manualKeys.add(key, now) {
+				http.Error(w, "queue is full", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		recordRequestAction(r, "queue_keys", log.Fields{"keys": len(req.Keys)})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	queueState.mu.Lock()
+	status := queueState.status
+	queueState.mu.Unlock()
+	sources := make([]queueSource, len(status.Sources))
+	copy(sources, status.Sources)
+	if len(sources) == 0 {
+		// no round verified the queue yet
+		for _, source := range queueSources {
+			sources = append(sources, queueSource{Source: source})
+		}
+	}
+	for i := range sources {
+		if sources[i].Source == sourceManual {
+			sources[i].Queued = manualKeys.len()
+		}
+	}
+	status.Sources = sources
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
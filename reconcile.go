@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"strconv"
+	"time"
+)
+
+// bucketStats are the aggregate statistics a bucket keeps of its keys, as
+// of a point in time.
+type bucketStats struct {
+	Keys  int64     `json:"keys"`
+	Bytes int64     `json:"bytes"`
+	At    time.Time `json:"at"`
+}
+
+// A statsBucket keeps statistics of its keys, which are cheap to get
+// compared to listing them.
+type statsBucket interface {
+	stats() (*bucketStats, error)
+}
+
+// reconciliation compares the statistics of both buckets, a coarse signal of
+// the health of the replication alongside the sampled keys. The statistics
+// of buckets might not be as of the same time: CloudWatch only has daily
+// metrics of S3 buckets.
+type reconciliation struct {
+	Source      *bucketStats `json:"source,omitempty"`
+	Destination *bucketStats `json:"destination,omitempty"`
+	// KeysDelta and BytesDelta are how many more keys and bytes the
+	// destination has than the source, negative if it has less.
+	KeysDelta  int64 `json:"keys_delta"`
+	BytesDelta int64 `json:"bytes_delta"`
+	// Error is why the statistics of a bucket couldn't be had.
+	Error string `json:"error,omitempty"`
+}
+
+// s3Bucket keeps the daily storage metrics of its bucket in CloudWatch, unless
+// it's on an S3 compatible store.
+func (b s3Bucket) stats() (*bucketStats, error) {
+	if b.region.custom() {
+		return nil, fmt.Errorf("bucket %q keeps no statistics", b.name)
+	}
+	client := cloudwatch.NewFromConfig(b.cfg, func(o *cloudwatch.Options) {
+		o.Region = b.region.Name
+	})
+	return s3MetricsStats(client, b.name, time.Now())
+}
+
+func (b *failoverBucket) stats() (stats *bucketStats, err error) {
+	err = b.try(func(bkt bucket) error {
+		sb, ok := bkt.(statsBucket)
+		if !ok {
+			return fmt.Errorf("bucket %q keeps no statistics", bkt.Name())
+		}
+		stats, err = sb.stats()
+		return err
+	})
+	return stats, err
+}
+
+// stats are the number of objects and bytes used by the container, which
+// Swift keeps up to date.
+func (b swiftBucket) stats() (*bucketStats, error) {
+	resp, err := b.do(context.Background(), "HEAD", "", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("HEAD on container %q: %w", b.container, err)
+	}
+	_ = resp.Body.Close()
+	stats := &bucketStats{At: time.Now().UTC()}
+	if stats.Keys, err = strconv.ParseInt(resp.Header.Get("X-Container-Object-Count"), 10, 64); err != nil {
+		return nil, fmt.Errorf("container %q: invalid object count: %v", b.container, err)
+	}
+	if stats.Bytes, err = strconv.ParseInt(resp.Header.Get("X-Container-Bytes-Used"), 10, 64); err != nil {
+		return nil, fmt.Errorf("container %q: invalid bytes used: %v", b.container, err)
+	}
+	return stats, nil
+}
+
+// reconcile compares the statistics of both buckets.
+func reconcile(src, dst bucket) *reconciliation {
+	rec := &reconciliation{}
+	for _, side := range []struct {
+		bkt   bucket
+		stats **bucketStats
+	}{{src, &rec.Source}, {dst, &rec.Destination}} {
+		sb, ok := side.bkt.(statsBucket)
+		if !ok {
+			rec.Error = fmt.Sprintf("bucket %q keeps no statistics", side.bkt.Name())
+			return rec
+		}
+		stats, err := sb.stats()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"bucket": side.bkt.Name(),
+				"error":  err,
+				"kind":   errorKind(err),
+			}).Warn("couldn't get the statistics of the bucket, not reconciling")
+			rec.Error = err.Error()
+			return rec
+		}
+		*side.stats = stats
+	}
+	rec.KeysDelta = rec.Destination.Keys - rec.Source.Keys
+	rec.BytesDelta = rec.Destination.Bytes - rec.Source.Bytes
+	return rec
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/codegangsta/cli"
+	"os"
+	"sort"
+	"strings"
+)
+
+// repairEstimates are the assumptions repair plans estimate the time and
+// cost of copying keys with. The defaults are the list prices of S3 PUT
+// requests and of transfers between regions.
+type repairEstimates struct {
+	// BytesPerSecond is the throughput of copies.
+	BytesPerSecond int64 `json:"bytes_per_second"`
+	// SecondsPerKey is the overhead of copying a key, whatever its size.
+	SecondsPerKey float64 `json:"seconds_per_key"`
+	// CostPer1000Requests is the cost of 1000 copies, a request each.
+	CostPer1000Requests float64 `json:"cost_per_1000_requests"`
+	// CostPerGB is the cost of transferring a GB.
+	CostPerGB float64 `json:"cost_per_gb"`
+}
+
+func (e repairEstimates) seconds(keys int, bytes int64) float64 {
+	return float64(bytes)/float64(e.BytesPerSecond) + float64(keys)*e.SecondsPerKey
+}
+
+func (e repairEstimates) cost(keys int, bytes int64) float64 {
+	return float64(keys)*e.CostPer1000Requests/1000 + float64(bytes)/1e9*e.CostPerGB
+}
+
+// repairBatch is a batch of keys under a prefix to copy again from the
+// source to the destination.
+type repairBatch struct {
+	Prefix string   `json:"prefix"`
+	Keys   []string `json:"keys"`
+	Bytes  int64    `json:"bytes"`
+	// Risk is the sum of the risk scores of the keys, in audits scoring
+	// mismatches.
+	Risk             float64 `json:"risk,omitempty"`
+	EstimatedSeconds float64 `json:"estimated_seconds"`
+	EstimatedCost    float64 `json:"estimated_cost"`
+}
+
+// repairPlan is the plan of the repair of the mismatches of a round, its
+// batches in the order they should be repaired.
+type repairPlan struct {
+	Round            roundID         `json:"round"`
+	Audit            string          `json:"audit,omitempty"`
+	Keys             int             `json:"keys"`
+	Bytes            int64           `json:"bytes"`
+	EstimatedSeconds float64         `json:"estimated_seconds"`
+	EstimatedCost    float64         `json:"estimated_cost"`
+	Estimates        repairEstimates `json:"estimates"`
+	Batches          []repairBatch   `json:"batches"`
+	// Skipped counts the mismatches that copies don't repair, by reason.
+	Skipped map[string]int `json:"skipped,omitempty"`
+}
+
+// repairLimits bound the batches of a repair plan.
+type repairLimits struct {
+	// Depth is how many levels of prefix keys are grouped by.
+	Depth    int
+	MaxKeys  int
+	MaxBytes int64
+}
+
+// repairPrefix is the prefix of a key at a depth, up to and including its
+// depth-th slash.
+func repairPrefix(key string, depth int) string {
+	end := 0
+	for i := 0; i < depth; i++ {
+		j := strings.IndexByte(key[end:], '/')
+		if j < 0 {
+			break
+		}
+		end += j + 1
+	}
+	return key[:end]
+}
+
+// planRepair plans the repair of the mismatches of a round: the keys are
+// grouped by prefix, and batched by size, smallest first, so that batches
+// stay under the limits. Batches are ordered by risk, then smallest first,
+// so that the riskiest and the quickest mismatches are repaired first.
+func planRepair(r *RoundReport, limits repairLimits, est repairEstimates) *repairPlan {
+	plan := &repairPlan{
+		Round:     r.ID,
+		Audit:     r.Audit,
+		Estimates: est,
+		Batches:   []repairBatch{},
+		Skipped:   make(map[string]int),
+	}
+	byPrefix := make(map[string][]Result)
+	seen := make(map[string]bool)
+	for _, res := range r.Results {
+		switch {
+		case res.Outcome != outcomeMismatch:
+			continue
+		case res.Check == deleteMarkerCheck:
+			// the key was deleted from the source, deleting it from the
+			// destination repairs it
+			plan.Skipped[deleteMarkerCheck]++
+			continue
+		case res.Reverse:
+			// the key is missing from the source, same
+			plan.Skipped["reverse"]++
+			continue
+		case seen[res.Key]:
+			continue
+		}
+		seen[res.Key] = true
+		prefix := repairPrefix(res.Key, limits.Depth)
+		byPrefix[prefix] = append(byPrefix[prefix], res)
+	}
+
+	for prefix, results := range byPrefix {
+		sort.Slice(results, func(i, j int) bool {
+			if results[i].Size != results[j].Size {
+				return results[i].Size < results[j].Size
+			}
+			return results[i].Key < results[j].Key
+		})
+		batch := repairBatch{Prefix: prefix}
+		flush := func() {
+			if len(batch.Keys) == 0 {
+				return
+			}
+			batch.EstimatedSeconds = est.seconds(len(batch.Keys), batch.Bytes)
+			batch.EstimatedCost = est.cost(len(batch.Keys), batch.Bytes)
+			plan.Batches = append(plan.Batches, batch)
+			batch = repairBatch{Prefix: prefix}
+		}
+		for _, res := range results {
+			full := limits.MaxKeys > 0 && len(batch.Keys) >= limits.MaxKeys
+			if limits.MaxBytes > 0 && batch.Bytes+res.Size > limits.MaxBytes {
+				full = true
+			}
+			if full {
+				flush()
+			}
+			batch.Keys = append(batch.Keys, res.Key)
+			batch.Bytes += res.Size
+			batch.Risk += res.Risk
+		}
+		flush()
+	}
+
+	sort.Slice(plan.Batches, func(i, j int) bool {
+		a, b := plan.Batches[i], plan.Batches[j]
+		switch {
+		case a.Risk != b.Risk:
+			return a.Risk > b.Risk
+		case a.Bytes != b.Bytes:
+			return a.Bytes < b.Bytes
+		case a.Prefix != b.Prefix:
+			return a.Prefix < b.Prefix
+		}
+		return a.Keys[0] < b.Keys[0]
+	})
+	for _, b := range plan.Batches {
+		plan.Keys += len(b.Keys)
+		plan.Bytes += b.Bytes
+	}
+	plan.EstimatedSeconds = est.seconds(plan.Keys, plan.Bytes)
+	plan.EstimatedCost = est.cost(plan.Keys, plan.Bytes)
+	return plan
+}
+
+func planRepairCommand() cli.Command {
+	depthFlag := cli.IntFlag{
+		Name:  "depth",
+		Usage: "how many levels of prefix keys are grouped by",
+		Value: 1,
+	}
+	batchKeysFlag := cli.IntFlag{
+		Name:  "batch-keys",
+		Usage: "most keys in a batch, unlimited if 0",
+		Value: 1000,
+	}
+	batchBytesFlag := cli.StringFlag{
+		Name:  "batch-bytes",
+		Usage: "most bytes in a batch, e.g. 10GiB, unlimited if 0",
+		Value: "10GiB",
+	}
+	throughputFlag := cli.StringFlag{
+		Name:  "throughput",
+		Usage: "bytes copied per second, e.g. 100MiB",
+		Value: "100MiB",
+	}
+	keyOverheadFlag := cli.Float64Flag{
+		Name:  "key-overhead",
+		Usage: "seconds copying a key takes whatever its size",
+		Value: 0.05,
+	}
+	requestCostFlag := cli.Float64Flag{
+		Name:  "request-cost",
+		Usage: "cost of 1000 copy requests",
+		Value: 0.005,
+	}
+	transferCostFlag := cli.Float64Flag{
+		Name:  "transfer-cost",
+		Usage: "cost of transferring a GB",
+		Value: 0.02,
+	}
+
+	doPlanRepair := func(ctx *cli.Context) {
+		if len(ctx.Args()) != 1 {
+			fail(ctx, "error: need the path of the report of a round")
+		}
+		report := mustReadReport(ctx, ctx.Args().Get(0))
+
+		limits := repairLimits{
+			Depth:   ctx.Int(depthFlag.Name),
+			MaxKeys: ctx.Int(batchKeysFlag.Name),
+		}
+		var err error
+		if limits.Depth < 0 || limits.MaxKeys < 0 {
+			fail(ctx, "error: flags %q and %q can't be negative", depthFlag.Name, batchKeysFlag.Name)
+		}
+		if limits.MaxBytes, err = parseBytes(ctx.String(batchBytesFlag.Name)); err != nil {
+			fail(ctx, "error: flag %q: %v", batchBytesFlag.Name, err)
+		}
+		est := repairEstimates{
+			SecondsPerKey:       ctx.Float64(keyOverheadFlag.Name),
+			CostPer1000Requests: ctx.Float64(requestCostFlag.Name),
+			CostPerGB:           ctx.Float64(transferCostFlag.Name),
+		}
+		if est.BytesPerSecond, err = parseBytes(ctx.String(throughputFlag.Name)); err != nil || est.BytesPerSecond == 0 {
+			fail(ctx, "error: flag %q must be a positive size", throughputFlag.Name)
+		}
+
+		data, err := json.MarshalIndent(planRepair(report, limits, est), "", "   ")
+		if err != nil {
+			fail(ctx, "bug: can't create repair plan JSON: %v", err)
+		}
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			fail(ctx, "error: can't write repair plan to stdout: %v", err)
+		}
+	}
+
+	return cli.Command{
+		Name:  "plan-repair",
+		Usage: "Plans batches of copies repairing the mismatches of a report: jag plan-repair report.json",
+		Description: strings.TrimSpace(`
+Reads the report of a round, as written by --report or a k8s-job, and prints a
+JSON plan of the copies from the source to the destination repairing its
+mismatches. Keys are grouped by prefix, --depth levels deep, and batched by
+size, smallest first, under --batch-keys and --batch-bytes. Batches are
+ordered by risk, in audits scoring mismatches, then smallest first, each with
+the time and cost its copies should take given --throughput, --key-overhead,
+--request-cost and --transfer-cost, by default the list prices of S3 in
+dollars. Mismatches copies don't repair, such as keys missing from the source
+in bidirectional audits or deleted from it, are counted as skipped. Sizes are
+those of the keys in the source when the round sampled them.`),
+		Flags: []cli.Flag{
+			depthFlag, batchKeysFlag, batchBytesFlag, throughputFlag,
+			keyOverheadFlag, requestCostFlag, transferCostFlag,
+		},
+		Action: doPlanRepair,
+	}
+}
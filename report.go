@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outcome is the conclusion of the verification of a key.
+type outcome string
+
+const (
+	outcomeMatch    outcome = "match"
+	outcomeMismatch outcome = "mismatch"
+	// outcomeIgnored is a mismatch tolerated by the mismatch policy.
+	outcomeIgnored outcome = "ignored"
+	// outcomeInconclusive means the key couldn't be verified, because of
+	// an error or because it took too long.
+	outcomeInconclusive outcome = "inconclusive"
+	// outcomeSuppressed is a mismatch acknowledged by an operator.
+	outcomeSuppressed outcome = "suppressed"
+	// outcomeLifecycle is a mismatch explained by a lifecycle rule of the
+	// destination bucket.
+	outcomeLifecycle outcome = "lifecycle"
+	// outcomePending is a mismatch not alerted on yet, since the key
+	// didn't mismatch enough times in a row, see flappingConfig, since its
+	// prefix is being synced, see syncWindow, or since it's being uploaded
+	// in parts to the source, see inFlightUpload.
+	outcomePending outcome = "pending"
+)
+
+// Result is the result of verifying a key. Its JSON form is part of reports,
+// whose schema is printed by the schema command.
+type Result struct {
+	Key     string `json:"key"`
+	Version string `json:"version,omitempty"`
+	// Size is the size of the key in the source.
+	Size    int64      `json:"size,omitempty"`
+	Outcome outcome    `json:"outcome"`
+	Check   string     `json:"check,omitempty"`
+	Details log.Fields `json:"details,omitempty"`
+	// IgnoredBy is the ignore rule or policy tolerating the mismatch.
+	IgnoredBy string `json:"ignored_by,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// ErrorKind classifies the error, see errorKind.
+	ErrorKind string `json:"error_kind,omitempty"`
+	// ErrorSide is the side of the audit the error came from, "source" or
+	// "destination", if it came from a request to a bucket.
+	ErrorSide string `json:"error_side,omitempty"`
+	// requestIDs identify the request that failed, or the request that
+	// observed the mismatching key in the destination.
+	requestIDs
+	// FollowUp is set if the key was verified again because a previous
+	// verification was inconclusive, or mismatched in an audit debouncing
+	// alerts.
+	FollowUp bool `json:"follow_up,omitempty"`
+	// Reverse is set if the key was sampled from the destination and
+	// verified against the source, in a bidirectional audit.
+	Reverse bool `json:"reverse,omitempty"`
+	// Namespace is set if the key was sampled in a namespace.
+	Namespace string `json:"namespace,omitempty"`
+	// Hot is set if the key was sampled under the hot prefixes, see
+	// hotConfig.
+	Hot bool `json:"hot,omitempty"`
+	// Risk is the score of the mismatch, in audits scoring them, see
+	// riskConfig.
+	Risk float64 `json:"risk,omitempty"`
+	// Claimed is set if the key was verified because a syncer claimed to
+	// have copied it, see claimsConfig.
+	Claimed bool `json:"claimed,omitempty"`
+	// Event is set if the key was verified because an event notified it
+	// was written, see eventsConfig.
+	Event bool `json:"event,omitempty"`
+	// Requested is set if the key was verified because an operator
+	// queued it, see QueuePath.
+	Requested bool `json:"requested,omitempty"`
+
+	// want is the key as it was sampled in the source.
+	want object
+	// got is the key as it was found in the destination, if it matched.
+	got *object
+}
+
+func inconclusiveResult(key string, err error) Result {
+	ids, _ := requestIDsOf(err)
+	return Result{
+		Key:        key,
+		Outcome:    outcomeInconclusive,
+		Error:      err.Error(),
+		ErrorKind:  errorKind(err),
+		ErrorSide:  errorSide(err),
+		requestIDs: ids,
+	}
+}
+
+// roundID identifies an audit round by when it started and the seed of its
+// sampling, which is enough to sample the same keys again.
+type roundID string
+
+const roundIDTime = "20060102T150405Z"
+
+func newRoundID(started time.Time, seed int64) roundID {
+	return roundID(fmt.Sprintf("%s-%d", started.UTC().Format(roundIDTime), seed))
+}
+
+// parse returns when the round started and the seed of its sampling.
+func (id roundID) parse() (time.Time, int64, error) {
+	i := strings.IndexByte(string(id), '-')
+	if i < 0 {
+		return time.Time{}, 0, fmt.Errorf("invalid round ID %q", id)
+	}
+	started, err := time.Parse(roundIDTime, string(id[:i]))
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid round ID %q: %v", id, err)
+	}
+	seed, err := strconv.ParseInt(string(id[i+1:]), 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid round ID %q: %v", id, err)
+	}
+	return started, seed, nil
+}
+
+// RoundReport is the result of an audit round. The names of its JSON fields
+// are stable, since reports are parsed by other programs.
+type RoundReport struct {
+	// Audit and Labels tell apart the reports of different audits.
+	Audit  string            `json:"audit,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Build is the version of jag that audited the round.
+	Build    buildInfo       `json:"build"`
+	ID       roundID         `json:"id"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Counts   map[outcome]int `json:"counts"`
+	Sampling samplingStats   `json:"sampling"`
+	// ChangeRate estimates the rate of change of the source bucket, and
+	// how many keys are likely not replicated yet.
+	ChangeRate *changeRate `json:"change_rate,omitempty"`
+	// Reconciliation compares the statistics of the buckets, if the config
+	// reconciles them.
+	Reconciliation *reconciliation `json:"reconciliation,omitempty"`
+	// InventoryDiff summarizes the diff of the inventories of the buckets,
+	// if they were diffed in the round.
+	InventoryDiff *inventoryDiff `json:"inventory_diff,omitempty"`
+	// Partition is the share of the keys the round verified, if the audit
+	// is partitioned between instances.
+	Partition *partitionConfig `json:"partition,omitempty"`
+	// Risk is the score of the mismatches of the round, if the config
+	// scores them.
+	Risk *riskScore `json:"risk,omitempty"`
+	// Maintenance is set if the audit was in maintenance during the round,
+	// whose results aren't alerted on.
+	Maintenance *maintenance `json:"maintenance,omitempty"`
+	// Degraded are the endpoints in use for buckets that failed over.
+	Degraded map[string]string `json:"degraded,omitempty"`
+	// Degradation is the level of the checks of the round, in audits
+	// degrading while the destination fails.
+	Degradation *degradationReport `json:"degradation,omitempty"`
+	// Namespaces are the outcomes of the namespaces audited in the round.
+	Namespaces map[string]namespaceCounts `json:"namespaces,omitempty"`
+	// HotPrefixes are the prefixes written to the most, under which keys
+	// were sampled on top of the whole bucket, see hotConfig.
+	HotPrefixes []string `json:"hot_prefixes,omitempty"`
+	// Ignored counts the mismatches tolerated by each ignore rule.
+	Ignored map[string]int `json:"ignored,omitempty"`
+	Results []Result       `json:"results"`
+}
+
+func newRoundReport(started time.Time) *RoundReport {
+	return &RoundReport{
+		Build:   build,
+		Started: started,
+		Counts:  make(map[outcome]int),
+		Ignored: make(map[string]int),
+		Results: []Result{},
+	}
+}
+
+func (r *RoundReport) add(res Result) {
+	r.Counts[res.Outcome]++
+	if res.IgnoredBy != "" {
+		r.Ignored[res.IgnoredBy]++
+	}
+	r.Results = append(r.Results, res)
+}
+
+func (r *RoundReport) logSummary() {
+	fields := log.Fields{
+		"round":        r.ID,
+		"duration":     r.Finished.Sub(r.Started),
+		"verified":     len(r.Results),
+		"matches":      r.Counts[outcomeMatch],
+		"mismatches":   r.Counts[outcomeMismatch],
+		"ignored":      r.Counts[outcomeIgnored],
+		"inconclusive": r.Counts[outcomeInconclusive],
+		"lifecycle":    r.Counts[outcomeLifecycle],
+		"suppressed":   r.Counts[outcomeSuppressed],
+		"pending":      r.Counts[outcomePending],
+		"follow_ups":   r.followUps(),
+		"walks":        r.Sampling.Walks,
+		"duplicates":   r.Sampling.Duplicates,
+	}
+	if r.ChangeRate != nil {
+		fields["writes_per_hour"] = r.ChangeRate.WritesPerHour
+		fields["at_risk"] = r.ChangeRate.AtRisk
+	}
+	if r.Reconciliation != nil && r.Reconciliation.Error == "" {
+		fields["keys_delta"] = r.Reconciliation.KeysDelta
+		fields["bytes_delta"] = r.Reconciliation.BytesDelta
+	}
+	if r.Risk != nil {
+		fields["risk"] = r.Risk.Score
+	}
+	if r.Maintenance != nil {
+		fields["maintenance"] = true
+	}
+	if r.InventoryDiff != nil && r.InventoryDiff.Error == "" {
+		fields["inventory_missing"] = r.InventoryDiff.Missing
+		fields["inventory_extra"] = r.InventoryDiff.Extra
+	}
+	log.WithFields(fields).Info("audit round completed")
+}
+
+func (r *RoundReport) followUps() int {
+	n := 0
+	for _, res := range r.Results {
+		if res.FollowUp {
+			n++
+		}
+	}
+	return n
+}
+
+// writeFile writes the report as JSON to a file, replacing the file if it
+// already exists.
+func (r *RoundReport) writeFile(filename string) error {
+	data, err := json.MarshalIndent(r, "", "   ")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
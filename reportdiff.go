@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DiffSignificance is how many standard deviations apart the rates of an
+// outcome, or of a kind of error, must be in two rounds for their difference
+// not to be put down to the keys each sampled.
+const DiffSignificance = 3
+
+// MaxDiffKeys is how many of the keys verified with different outcomes a
+// diff of reports lists.
+const MaxDiffKeys = 100
+
+// reportDiff compares the findings of two rounds auditing the same pair of
+// buckets, such as the rounds of audits running in two regions. Since they
+// audit the same replication, their findings differing points at a problem
+// on the side of one of the observers, such as its credentials, its network
+// or its config.
+type reportDiff struct {
+	A reportDiffSide `json:"a"`
+	B reportDiffSide `json:"b"`
+	// Common is how many keys both rounds verified.
+	Common int `json:"common"`
+	// Disagreements are the keys both rounds verified with different
+	// outcomes, at most MaxDiffKeys of them.
+	Disagreements []keyDisagreement `json:"disagreements,omitempty"`
+	// Outcomes and ErrorKinds are the shares of the keys verified by each
+	// round with each outcome, and that couldn't be verified because of
+	// each kind of error.
+	Outcomes   map[outcome]rateDiff `json:"outcomes"`
+	ErrorKinds map[string]rateDiff  `json:"error_kinds,omitempty"`
+	// Discrepancies tell how the findings of the rounds differ, empty if
+	// they agree.
+	Discrepancies []string `json:"discrepancies,omitempty"`
+}
+
+type reportDiffSide struct {
+	File     string    `json:"file"`
+	Audit    string    `json:"audit,omitempty"`
+	Round    roundID   `json:"round"`
+	Build    buildInfo `json:"build"`
+	Verified int       `json:"verified"`
+}
+
+type keyDisagreement struct {
+	Key     string     `json:"key"`
+	Version string     `json:"version,omitempty"`
+	Reverse bool       `json:"reverse,omitempty"`
+	A       keyFinding `json:"a"`
+	B       keyFinding `json:"b"`
+}
+
+type keyFinding struct {
+	Outcome   outcome `json:"outcome"`
+	Check     string  `json:"check,omitempty"`
+	ErrorKind string  `json:"error_kind,omitempty"`
+}
+
+func (f keyFinding) String() string {
+	switch {
+	case f.ErrorKind != "":
+		return fmt.Sprintf("%s (%s)", f.Outcome, f.ErrorKind)
+	case f.Check != "" && f.Outcome != outcomeMatch:
+		return fmt.Sprintf("%s (%s)", f.Outcome, f.Check)
+	}
+	return string(f.Outcome)
+}
+
+// rateDiff is the share of the keys verified by each round with a finding.
+// It's significant if the shares are further apart than sampling explains,
+// see DiffSignificance.
+type rateDiff struct {
+	A           float64 `json:"a"`
+	B           float64 `json:"b"`
+	Significant bool    `json:"significant,omitempty"`
+}
+
+func newRateDiff(x1, n1, x2, n2 int) rateDiff {
+	var d rateDiff
+	if n1 == 0 || n2 == 0 {
+		return d
+	}
+	d.A, d.B = float64(x1)/float64(n1), float64(x2)/float64(n2)
+	// two-proportion z-test
+	p := float64(x1+x2) / float64(n1+n2)
+	se := math.Sqrt(p * (1 - p) * (1/float64(n1) + 1/float64(n2)))
+	d.Significant = se > 0 && math.Abs(d.A-d.B)/se > DiffSignificance
+	return d
+}
+
+// resultID identifies the verification of a key in a round.
+type resultID struct {
+	key, version string
+	reverse      bool
+}
+
+// diffReports compares the reports of two rounds, named after their files.
+func diffReports(a, b *RoundReport, fileA, fileB string) *reportDiff {
+	d := &reportDiff{
+		A:          reportDiffSide{File: fileA, Audit: a.Audit, Round: a.ID, Build: a.Build, Verified: len(a.Results)},
+		B:          reportDiffSide{File: fileB, Audit: b.Audit, Round: b.ID, Build: b.Build, Verified: len(b.Results)},
+		Outcomes:   make(map[outcome]rateDiff),
+		ErrorKinds: make(map[string]rateDiff),
+	}
+	discrepancy := func(format string, args ...interface{}) {
+		d.Discrepancies = append(d.Discrepancies, fmt.Sprintf(format, args...))
+	}
+
+	if a.Audit != b.Audit {
+		discrepancy("%s is a round of audit %q, %s of audit %q", fileA, a.Audit, fileB, b.Audit)
+	}
+	if a.Build.Version != b.Build.Version {
+		discrepancy("%s was audited by jag %s, %s by jag %s", fileA, a.Build.Version, fileB, b.Build.Version)
+	}
+	for _, side := range []struct {
+		file string
+		r    *RoundReport
+	}{{fileA, a}, {fileB, b}} {
+		if side.r.Maintenance != nil {
+			discrepancy("%s was audited in maintenance", side.file)
+		}
+		if dg := side.r.Degradation; dg != nil && dg.Level != levelFull.String() {
+			discrepancy("%s was degraded to the %s checks", side.file, dg.Level)
+		}
+		buckets := make([]string, 0, len(side.r.Degraded))
+		for bkt := range side.r.Degraded {
+			buckets = append(buckets, bkt)
+		}
+		sort.Strings(buckets)
+		for _, bkt := range buckets {
+			discrepancy("%s failed bucket %q over to endpoint %q", side.file, bkt, side.r.Degraded[bkt])
+		}
+	}
+
+	findings := func(r *RoundReport) map[resultID]keyFinding {
+		m := make(map[resultID]keyFinding, len(r.Results))
+		for _, res := range r.Results {
+			m[resultID{res.Key, res.Version, res.Reverse}] = keyFinding{Outcome: res.Outcome, Check: res.Check, ErrorKind: res.ErrorKind}
+		}
+		return m
+	}
+	inA, inB := findings(a), findings(b)
+	var disagreements []keyDisagreement
+	for id, fa := range inA {
+		fb, ok := inB[id]
+		if !ok {
+			continue
+		}
+		d.Common++
+		if fa.Outcome != fb.Outcome {
+			disagreements = append(disagreements, keyDisagreement{Key: id.key, Version: id.version, Reverse: id.reverse, A: fa, B: fb})
+		}
+	}
+	sort.Slice(disagreements, func(i, j int) bool {
+		if disagreements[i].Key != disagreements[j].Key {
+			return disagreements[i].Key < disagreements[j].Key
+		}
+		return disagreements[i].Version < disagreements[j].Version
+	})
+	if len(disagreements) != 0 {
+		discrepancy("%d of the %d keys verified by both rounds have different outcomes, such as %q: %s in %s, %s in %s",
+			len(disagreements), d.Common, disagreements[0].Key, disagreements[0].A, fileA, disagreements[0].B, fileB)
+	}
+	if len(disagreements) > MaxDiffKeys {
+		disagreements = disagreements[:MaxDiffKeys]
+	}
+	d.Disagreements = disagreements
+
+	counts := func(r *RoundReport) (map[outcome]int, map[string]int) {
+		outcomes, kinds := make(map[outcome]int), make(map[string]int)
+		for _, res := range r.Results {
+			outcomes[res.Outcome]++
+			if res.ErrorKind != "" {
+				kinds[res.ErrorKind]++
+			}
+		}
+		return outcomes, kinds
+	}
+	outcomesA, kindsA := counts(a)
+	outcomesB, kindsB := counts(b)
+	var outcomes []string
+	for _, counts := range []map[outcome]int{outcomesA, outcomesB} {
+		for o := range counts {
+			if _, ok := d.Outcomes[o]; !ok {
+				d.Outcomes[o] = newRateDiff(outcomesA[o], len(a.Results), outcomesB[o], len(b.Results))
+				outcomes = append(outcomes, string(o))
+			}
+		}
+	}
+	var kinds []string
+	for _, counts := range []map[string]int{kindsA, kindsB} {
+		for kind := range counts {
+			if _, ok := d.ErrorKinds[kind]; !ok {
+				d.ErrorKinds[kind] = newRateDiff(kindsA[kind], len(a.Results), kindsB[kind], len(b.Results))
+				kinds = append(kinds, kind)
+			}
+		}
+	}
+	sort.Strings(outcomes)
+	sort.Strings(kinds)
+	for _, o := range outcomes {
+		if r := d.Outcomes[outcome(o)]; r.Significant {
+			discrepancy("%.1f%% of the keys are %s in %s, %.1f%% in %s", 100*r.A, o, fileA, 100*r.B, fileB)
+		}
+	}
+	for _, kind := range kinds {
+		if r := d.ErrorKinds[kind]; r.Significant {
+			discrepancy("%.1f%% of the keys couldn't be verified because of %s errors in %s, %.1f%% in %s", 100*r.A, kind, fileA, 100*r.B, fileB)
+		}
+	}
+	return d
+}
+
+// mustReadReport reads the report of a round, as written by --report or a
+// k8s-job.
+func mustReadReport(ctx *cli.Context, filename string) *RoundReport {
+	f := mustOpen(ctx, filename)
+	defer func() { _ = f.Close() }()
+	var report RoundReport
+	if err := json.NewDecoder(f).Decode(&report); err != nil {
+		fail(ctx, "error: invalid report %q: %v", filename, err)
+	}
+	return &report
+}
+
+func reportCommand() cli.Command {
+	return cli.Command{
+		Name:  "report",
+		Usage: "Compares the reports of rounds.",
+		Subcommands: []cli.Command{
+			diffReportsCommand(),
+		},
+	}
+}
+
+func diffReportsCommand() cli.Command {
+	doDiffReports := func(ctx *cli.Context) {
+		if len(ctx.Args()) != 2 {
+			fail(ctx, "error: need the paths of the reports of two rounds")
+		}
+		fileA, fileB := ctx.Args().Get(0), ctx.Args().Get(1)
+		diff := diffReports(mustReadReport(ctx, fileA), mustReadReport(ctx, fileB), fileA, fileB)
+		data, err := json.MarshalIndent(diff, "", "   ")
+		if err != nil {
+			fail(ctx, "bug: can't create report diff JSON: %v", err)
+		}
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			fail(ctx, "error: can't write report diff to stdout: %v", err)
+		}
+		if len(diff.Discrepancies) != 0 {
+			fail(ctx, "error: the findings of the rounds differ:\n%s", strings.Join(diff.Discrepancies, "\n"))
+		}
+	}
+
+	return cli.Command{
+		Name:  "diff",
+		Usage: "Compares the findings of two rounds: jag report diff a.json b.json",
+		Description: strings.TrimSpace(`
+Reads the reports of two rounds auditing the same pair of buckets, as written
+by --report or a k8s-job, such as the rounds of jag instances running in two
+regions, and prints a JSON diff of their findings, failing if they differ.
+Since both audit the same replication, findings differing point at a problem
+on the side of one of the observers, such as its credentials, its network or
+its config, rather than at the replication.
+
+The keys verified by both rounds with different outcomes are listed, and the
+shares of the keys of each outcome, and of each kind of error among the keys
+that couldn't be verified, are compared: they differ if they're further apart
+than sampling different keys explains. Rounds audited by other versions of
+jag, in maintenance, degraded or failed over are told too.`),
+		Action: doDiffReports,
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sync"
+)
+
+// ResultsPath is where the result of each key is streamed as soon as it's
+// verified, on the HTTP endpoint of the audit command.
+const ResultsPath = "/debug/results"
+
+// ResultsBacklog is how many results a client of the stream can fall behind
+// by. Results beyond are dropped for that client rather than slowing down
+// the audit.
+const ResultsBacklog = 1000
+
+// resultClient is a client streaming results.
+type resultClient struct {
+	results chan Result
+	// outcome only streams results of this outcome, if set.
+	outcome outcome
+	dropped int
+}
+
+// resultClients are the clients streaming results.
+var resultClients = struct {
+	mu      sync.Mutex
+	clients map[*resultClient]struct{}
+}{clients: make(map[*resultClient]struct{})}
+
+func init() {
+	http.HandleFunc(ResultsPath, serveResults)
+}
+
+// publishResult hands the result of a key to the clients streaming results.
+// It never blocks: clients too far behind miss the result.
+func publishResult(res Result) {
+	resultClients.mu.Lock()
+	defer resultClients.mu.Unlock()
+	for c := range resultClients.clients {
+		if c.outcome != "" && c.outcome != res.Outcome {
+			continue
+		}
+		select {
+		case c.results <- res:
+		default:
+			c.dropped++
+		}
+	}
+}
+
+func subscribeResults(only outcome) *resultClient {
+	c := &resultClient{results: make(chan Result, ResultsBacklog), outcome: only}
+	resultClients.mu.Lock()
+	resultClients.clients[c] = struct{}{}
+	resultClients.mu.Unlock()
+	return c
+}
+
+// unsubscribe stops streaming results to the client, and returns how many it
+// missed for being too slow.
+func (c *resultClient) unsubscribe() int {
+	resultClients.mu.Lock()
+	defer resultClients.mu.Unlock()
+	delete(resultClients.clients, c)
+	return c.dropped
+}
+
+// serveResults streams the result of each key verified, one JSON object per
+// line, until the client goes away. With ?outcome=, only results of that
+// outcome are streamed.
+func serveResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	c := subscribeResults(outcome(r.URL.Query().Get("outcome")))
+	defer func() {
+		if dropped := c.unsubscribe(); dropped > 0 {
+			log.WithFields(log.Fields{
+				"client":  r.RemoteAddr,
+				"dropped": dropped,
+			}).Warn("client streaming results was too slow, some results were dropped")
+		}
+	}()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case res := <-c.results:
+			if err := enc.Encode(res); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+// retention is the Object Lock retention of a key.
+type retention struct {
+	Mode            string
+	RetainUntilDate time.Time
+}
+
+// retentionModes ranks the Object Lock modes by strictness.
+var retentionModes = map[string]int{
+	"":           0,
+	"GOVERNANCE": 1,
+	"COMPLIANCE": 2,
+}
+
+// RetentionCheck verifies that the Object Lock retention of the key in the
+// destination is at least as strict and as long as in the source, and as the
+// configured policy. It costs a GET of the retention on each bucket.
+type RetentionCheck struct {
+	policy retentionPolicy
+}
+
+func newRetentionCheck(cfg *config) (Check, error) {
+	return RetentionCheck{policy: cfg.Retention}, nil
+}
+
+func (RetentionCheck) Name() string { return "retention" }
+
+func (c RetentionCheck) Check(p *keyPair) (log.Fields, error) {
+	if p.got == nil {
+		return missingFields(p), nil
+	}
+	want, err := p.src.Retention(p.ctx, p.want.Key, p.want.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	got, err := p.dst.Retention(p.ctx, p.got.Key, p.got.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	if want == nil {
+		want = &retention{}
+	}
+	if got == nil {
+		got = &retention{}
+	}
+
+	// the policy raises what's expected from the source
+	if retentionModes[c.policy.Mode] > retentionModes[want.Mode] {
+		want.Mode = c.policy.Mode
+	}
+	if c.policy.Period != 0 {
+		modified, err := time.Parse(time.RFC3339Nano, p.want.LastModified)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last modification time of key %q: %v", p.want.Key, err)
+		}
+		if until := modified.Add(c.policy.Period); until.After(want.RetainUntilDate) {
+			want.RetainUntilDate = until
+		}
+	}
+
+	fields := log.Fields{}
+	if retentionModes[got.Mode] < retentionModes[want.Mode] {
+		fields["want.retention.mode"] = want.Mode
+		fields["got.retention.mode"] = got.Mode
+	}
+	if got.RetainUntilDate.Before(want.RetainUntilDate) {
+		fields["want.retention.until"] = want.RetainUntilDate
+		fields["got.retention.until"] = got.RetainUntilDate
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
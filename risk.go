@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"math"
+	"strings"
+	"time"
+)
+
+// riskConfig scores the mismatches of a round by what the keys mismatching
+// are, so that rounds are alerted on when the data at risk matters rather
+// than when any key mismatched. A mismatch scores
+//
+//	weight * (1 + size_weight*log2(1+size) + age_weight*days)
+//
+// where weight is the weight of the longest prefix of the key, 1 if none,
+// size is the size of the key in bytes and days its age in days. A 5GB key
+// scores about 32*size_weight more than an empty one.
+type riskConfig struct {
+	SizeWeight float64 `json:"size_weight,omitempty"`
+	AgeWeight  float64 `json:"age_weight,omitempty"`
+	// Prefixes weigh the mismatches of keys by prefix, such as to make
+	// backups critical and temporary files negligible.
+	Prefixes []riskPrefix `json:"prefixes,omitempty"`
+	// MaxScore is the score of a round above which it's alerted on, and its
+	// job exits with ExitMismatch.
+	MaxScore float64 `json:"max_score"`
+}
+
+type riskPrefix struct {
+	Prefix string  `json:"prefix"`
+	Weight float64 `json:"weight"`
+}
+
+func loadRisk(r *riskConfig) error {
+	if r.SizeWeight < 0 || r.AgeWeight < 0 || r.MaxScore < 0 {
+		return fmt.Errorf("size_weight, age_weight and max_score can't be negative")
+	}
+	for _, p := range r.Prefixes {
+		if p.Weight < 0 {
+			return fmt.Errorf("prefix %q: weight can't be negative", p.Prefix)
+		}
+	}
+	return nil
+}
+
+// score is the score of the mismatch of a key as of now.
+func (r *riskConfig) score(k object, now time.Time) float64 {
+	weight, longest := 1.0, -1
+	for _, p := range r.Prefixes {
+		if len(p.Prefix) > longest && strings.HasPrefix(k.Key, p.Prefix) {
+			weight, longest = p.Weight, len(p.Prefix)
+		}
+	}
+	days := 0.0
+	if modtime, err := time.Parse(time.RFC3339Nano, k.LastModified); err == nil && now.After(modtime) {
+		days = now.Sub(modtime).Hours() / 24
+	}
+	return weight * (1 + r.SizeWeight*math.Log2(1+float64(k.Size)) + r.AgeWeight*days)
+}
+
+// riskScore is the score of the mismatches of a round.
+type riskScore struct {
+	Score    float64 `json:"score"`
+	MaxScore float64 `json:"max_score"`
+	// Alert is set if the score exceeded MaxScore, and the audit wasn't in
+	// maintenance.
+	Alert bool `json:"alert,omitempty"`
+}
+
+// scoreRisk scores the mismatches of the round, setting the score of each
+// of them.
+func (v *verifier) scoreRisk(report *RoundReport) {
+	risk := &riskScore{MaxScore: v.cfg.Risk.MaxScore}
+	for i := range report.Results {
+		res := &report.Results[i]
+		if res.Outcome != outcomeMismatch {
+			continue
+		}
+		res.Risk = v.cfg.Risk.score(res.want, report.Started)
+		risk.Score += res.Risk
+		if counts, ok := report.Namespaces[res.Namespace]; ok {
+			counts.Risk += res.Risk
+			report.Namespaces[res.Namespace] = counts
+		}
+	}
+	report.Risk = risk
+	if risk.Score <= risk.MaxScore || report.Maintenance != nil {
+		return
+	}
+	risk.Alert = true
+	log.WithFields(log.Fields{
+		"score":     risk.Score,
+		"max_score": risk.MaxScore,
+	}).Error("round's mismatches score above max_score")
+}
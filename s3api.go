@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"net/http"
+	"time"
+)
+
+// Requests to S3 are made with the AWS SDK, which signs them with Signature
+// Version 4 as the regions of S3 opened since 2014 such as eu-central-1
+// require, and knows the APIs on subresources of buckets and keys
+// (versions, tagging, ...).
+
+// MaxPresignTTL is the longest S3 accepts presigned URLs for.
+const MaxPresignTTL = 7 * 24 * time.Hour
+
+// responseHeader returns the header of the HTTP response to an operation of
+// the SDK.
+func responseHeader(metadata middleware.Metadata) http.Header {
+	if resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok {
+		return resp.Header
+	}
+	return http.Header{}
+}
+
+// requestIDs identify a request to S3 for AWS support.
+type requestIDs struct {
+	RequestID string `json:"request_id,omitempty"`
+	AmzID2    string `json:"amz_id_2,omitempty"`
+}
+
+// requestIDsOf returns the IDs of the request that failed with an error, if
+// it was a request to S3.
+func requestIDsOf(err error) (requestIDs, bool) {
+	var reqErr interface{ ServiceRequestID() string }
+	if !errors.As(err, &reqErr) {
+		return requestIDs{}, false
+	}
+	ids := requestIDs{RequestID: reqErr.ServiceRequestID()}
+	var hostErr interface{ ServiceHostID() string }
+	if errors.As(err, &hostErr) {
+		ids.AmzID2 = hostErr.ServiceHostID()
+	}
+	return ids, true
+}
+
+func (ids requestIDs) fields(fields log.Fields) log.Fields {
+	if ids.RequestID != "" {
+		fields["request_id"] = ids.RequestID
+	}
+	if ids.AmzID2 != "" {
+		fields["amz_id_2"] = ids.AmzID2
+	}
+	return fields
+}
+
+// A requestTracer is a bucket that can tell the IDs of a request for a key,
+// to let AWS support investigate the state of the key.
+type requestTracer interface {
+	traceKey(ctx context.Context, key, version string) (requestIDs, error)
+}
+
+func (b s3Bucket) traceKey(ctx context.Context, key, version string) (requestIDs, error) {
+	out, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(b.name),
+		Key:       aws.String(key),
+		VersionId: optional(version),
+	})
+	if ids, ok := requestIDsOf(err); ok {
+		return ids, nil
+	}
+	if err != nil {
+		return requestIDs{}, err
+	}
+	header := responseHeader(out.ResultMetadata)
+	return requestIDs{
+		RequestID: header.Get("x-amz-request-id"),
+		AmzID2:    header.Get("x-amz-id-2"),
+	}, nil
+}
+
+// sensitiveParams are the query parameters of presigned URLs that give
+// access to a bucket.
+var sensitiveParams = []string{
+	"AWSAccessKeyId", "Signature", "X-Amz-Credential", "X-Amz-Signature", "X-Amz-Security-Token",
+	"temp_url_sig", "Authorization",
+}
+
+// debugTransport logs the metadata of every request sent to S3, without the
+// credentials, so that failed requests can be escalated to AWS support.
+type debugTransport struct {
+	next http.RoundTripper
+}
+
+func (t debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	query := u.Query()
+	for _, name := range sensitiveParams {
+		if query.Get(name) != "" {
+			query.Set(name, "REDACTED")
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	fields := log.Fields{
+		"method":   req.Method,
+		"url":      u.String(),
+		"duration": time.Since(start),
+	}
+	if err != nil {
+		fields["error"] = err
+		log.WithFields(fields).Info("S3 request failed")
+		return resp, err
+	}
+	fields["status"] = resp.StatusCode
+	fields["request_id"] = resp.Header.Get("x-amz-request-id")
+	fields["amz_id_2"] = resp.Header.Get("x-amz-id-2")
+	log.WithFields(fields).Info("S3 request")
+	return resp, nil
+}
+
+// debugRequests logs all the requests sent to S3 from now on.
+func debugRequests() {
+	next := http.DefaultClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	http.DefaultClient.Transport = debugTransport{next: next}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+func sampleCommand(abort <-chan struct{}) cli.Command {
+	cfgFlag := cli.StringFlag{
+		Name:  "cfg",
+		Usage: "path to the JSON config file",
+	}
+	modelFlag := cli.StringFlag{
+		Name:  "model",
+		Usage: "path to a JSON file representing model of the keys in the source bucket",
+	}
+	countFlag := cli.IntFlag{
+		Name:  "count",
+		Usage: "number of keys to sample",
+		Value: 1,
+	}
+	seedFlag := cli.IntFlag{
+		Name:  "seed",
+		Usage: "seed of the sampler, random if 0",
+	}
+	traceFlag := cli.BoolFlag{
+		Name:  "trace",
+		Usage: "print the decisions taken to sample each key",
+	}
+
+	doSample := func(ctx *cli.Context) {
+		cfg := mustConfig(ctx, cfgFlag)
+		model := mustRetrieveModel(ctx, modelFlag)
+		seed := int64(ctx.Int(seedFlag.Name))
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		var constraint *expression
+		if cfg.Constraint != "" {
+			var err error
+			if constraint, err = compileExpr(cfg.Constraint); err != nil {
+				fail(ctx, "error: %v", err)
+			}
+		}
+		mustPrepareEndpoints(ctx, cfg.Source)
+
+		src := samplerSource{bkt: mustAWSBucket(ctx, cfg.Source), model: *model, abort: abort}
+		if ctx.Bool(traceFlag.Name) {
+			src.trace = &walkTrace{w: os.Stdout}
+		}
+		sampler, err := lookupSampler(cfg, src)
+		if err != nil {
+			fail(ctx, "error: %v", err)
+		}
+		accept := keyConstraint(cfg, constraint, nil, time.Now())
+		r := rand.New(rand.NewSource(seed))
+		for i := 0; i < ctx.Int(countFlag.Name); i++ {
+			if src.trace != nil {
+				fmt.Printf("walk %d with the %s sampler:\n", i+1, sampler.Name())
+			}
+			k, err := sampler.Sample(r, accept)
+			if err != nil {
+				fail(ctx, "error: can't sample a key: %v", err)
+			}
+			fmt.Println(k.Key)
+		}
+	}
+
+	return cli.Command{
+		Name:  "sample",
+		Usage: "Samples random keys from the source bucket, as an audit would.",
+		Description: strings.TrimSpace(`
+Samples keys from the source bucket with the sampler and the constraints of the
+config, and prints their names. With --trace, the decisions of each walk are
+printed: the prefixes listed, the probabilities and dice rolls of the tree
+walk, and the keys rejected.`),
+		Flags:  []cli.Flag{cfgFlag, modelFlag, countFlag, seedFlag, traceFlag},
+		Action: doSample,
+	}
+}
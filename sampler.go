@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultSampler is the sampler used when the config doesn't name one.
+const DefaultSampler = "tree_walk"
+
+// samplersByName are all the samplers that can be selected in the config.
+// Each decodes its own options from the config.
+var samplersByName = map[string]func(s samplerSource, options json.RawMessage) (Sampler, error){
+	"tree_walk":     newTreeWalkSampler,
+	"listing_index": newListingIndexSampler,
+	"marker":        newMarkerSampler,
+	"stratified":    newStratifiedSampler,
+}
+
+// samplerSource is what samplers sample keys from.
+type samplerSource struct {
+	bkt   bucket
+	model bucketModel
+	abort <-chan struct{}
+	// trace is nil unless the decisions of walks are traced.
+	trace *walkTrace
+}
+
+// walkTrace prints the decisions a sampler takes to pick a key, indented
+// by how deep in the bucket they're taken.
+type walkTrace struct {
+	w io.Writer
+}
+
+// step prints a decision. If the walk isn't traced, the decision is logged
+// when the sampler subsystem logs at debug level.
+func (t *walkTrace) step(depth int, format string, args ...interface{}) {
+	if t == nil {
+		if samplerLog.enabled(log.DebugLevel) {
+			samplerLog.WithField("depth", depth).Debug(fmt.Sprintf(format, args...))
+		}
+		return
+	}
+	fmt.Fprintf(t.w, "%s"+format+"\n", append([]interface{}{strings.Repeat("  ", depth)}, args...)...)
+}
+
+// A Sampler picks random keys in a bucket. Samplers trade how uniformly
+// they pick keys for how many requests they make, and for what they need to
+// know about the bucket beforehand.
+type Sampler interface {
+	Name() string
+	// Sample returns a random key that is accepted.
+	Sample(r *rand.Rand, accept func(object) bool) (*object, error)
+}
+
+// lookupSampler returns the sampler named in the config.
+func lookupSampler(cfg *config, src samplerSource) (Sampler, error) {
+	name := cfg.Sampler
+	if name == "" {
+		name = DefaultSampler
+	}
+	mkSampler, ok := samplersByName[name]
+	if !ok {
+		return nil, configErrorf("unknown sampler %q, valid samplers are %s", name, samplerNames())
+	}
+	sampler, err := mkSampler(src, cfg.SamplerOptions)
+	if err != nil {
+		return nil, configErrorf("sampler %q: %v", name, err)
+	}
+	return sampler, nil
+}
+
+func samplerNames() string {
+	names := make([]string, 0, len(samplersByName))
+	for name := range samplersByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// decodeOptions decodes the options of a sampler, if there are any.
+func decodeOptions(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(string(options)))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func filterKeys(candidates []listedKey, accept func(object) bool) []listedKey {
+	var valids []listedKey
+	for _, k := range candidates {
+		if accept(objectOf(k)) {
+			valids = append(valids, k)
+		}
+	}
+	return valids
+}
+
+// TreeWalkOptions configure a TreeWalkSampler.
+type TreeWalkOptions struct {
+	// MaxList is the maximum number of keys listed at each level.
+	MaxList int `json:"max_list,omitempty"`
+	// Slack is how many times less likely than uniform a walk can be to
+	// reach a key, for the key to still be picked uniformly. About as many
+	// walks are rejected for each key picked.
+	Slack float64 `json:"slack,omitempty"`
+	// Attempts is how many walks can be rejected before giving up.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// TreeWalkSampler walks down the tree of prefixes of a bucket, stopping at
+// one of the keys it lists or descending into one of the prefixes it lists,
+// each prefix weighted by the number of keys the model predicts under it.
+// How likely a walk is to reach a key depends on how far the prefixes walked
+// through are from the model, which is corrected by rejecting the walk with
+// the ratio of how likely a key is picked uniformly to how likely the walk
+// was: keys are picked uniformly unless they're more than Slack times less
+// likely to be reached than uniform. It needs a model, which walks deep
+// buckets efficiently if it knows how many prefixes there are at each depth.
+type TreeWalkSampler struct {
+	src  samplerSource
+	opts TreeWalkOptions
+
+	// listed and accepted count the keys listed by walks, and those of them
+	// accepted, to weight prefixes by the keys accepted under them.
+	mu       sync.Mutex
+	listed   int
+	accepted int
+}
+
+func newTreeWalkSampler(src samplerSource, options json.RawMessage) (Sampler, error) {
+	opts := TreeWalkOptions{MaxList: MaxList, Slack: 2, Attempts: 10 * RetryLimit}
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Slack < 1 {
+		return nil, errors.New("slack can't be less than 1")
+	}
+	return &TreeWalkSampler{src: src, opts: opts}, nil
+}
+
+func (*TreeWalkSampler) Name() string { return "tree_walk" }
+
+// acceptedRatio is the ratio of the keys listed so far that were accepted,
+// 1 until keys are listed.
+func (s *TreeWalkSampler) acceptedRatio() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return float64(s.accepted+1) / float64(s.listed+1)
+}
+
+func (s *TreeWalkSampler) observe(listed, accepted int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listed += listed
+	s.accepted += accepted
+}
+
+// keysUnder estimates how many keys are under each of n prefixes at a level,
+// from the model if it knows how many prefixes are at that level, by sharing
+// the keys under their parent not listed in it among them otherwise.
+func (s *TreeWalkSampler) keysUnder(level int, parent float64, keys, n int, accepted float64) float64 {
+	model := s.src.model
+	if level < len(model.prefixes) && model.prefixes[level] > 0 {
+		below := 0
+		for depth := level; depth < len(model.depths); depth++ {
+			below += model.depths[depth]
+		}
+		return accepted * float64(below) / float64(model.prefixes[level])
+	}
+	if n == 0 {
+		return 0
+	}
+	return math.Max(parent-float64(keys), float64(n)) / float64(n)
+}
+
+func (s *TreeWalkSampler) Sample(r *rand.Rand, accept func(object) bool) (*object, error) {
+	for attempt := 0; attempt < s.opts.Attempts; attempt++ {
+		s.src.trace.step(0, "walk %d", attempt+1)
+		o, err := s.walk(r, accept)
+		if err != nil || o != nil {
+			return o, err
+		}
+	}
+	return nil, fmt.Errorf("%w: no key picked after %d walks", ErrModelStale, s.opts.Attempts)
+}
+
+// walk walks down from the root of the bucket to a key, returning nil if
+// the walk reaches a dead end or is rejected.
+func (s *TreeWalkSampler) walk(r *rand.Rand, accept func(object) bool) (*object, error) {
+	accepted := s.acceptedRatio()
+	keyCount := math.Max(accepted*float64(s.src.model.keyCount), 1)
+	prefix := ""
+	under := keyCount
+	// p is how likely the walk was to get where it is
+	p := 1.0
+	for depth := 0; ; depth++ {
+		select {
+		case <-s.src.abort:
+			return nil, errors.New("aborted")
+		default:
+		}
+		resp, err := listBkt(context.Background(), s.src.bkt, prefix, s.opts.MaxList)
+		if err != nil {
+			return nil, err
+		}
+		candidates := filterKeys(resp.Contents, accept)
+		s.observe(len(resp.Contents), len(candidates))
+		perPrefix := s.keysUnder(depth+1, under, len(candidates), len(resp.CommonPrefixes), accepted)
+		total := float64(len(candidates)) + perPrefix*float64(len(resp.CommonPrefixes))
+		s.src.trace.step(depth+1, "list %q: %d keys, %d accepted, %d prefixes of ~%.1f keys",
+			prefix, len(resp.Contents), len(candidates), len(resp.CommonPrefixes), perPrefix)
+		if total == 0 {
+			s.src.trace.step(depth+1, "dead end")
+			return nil, nil
+		}
+
+		n := r.Float64() * total
+		if n < float64(len(candidates)) {
+			k := candidates[int(n)]
+			p /= total
+			keep := 1 / (s.opts.Slack * keyCount * p)
+			dice := r.Float64()
+			s.src.trace.step(depth+1, "key %q: p=%.6f keep=%.4f dice=%.4f picked=%t", k.Key, p, keep, dice, dice < keep)
+			if dice >= keep {
+				return nil, nil
+			}
+			o := objectOf(k)
+			return &o, nil
+		}
+		i := int((n - float64(len(candidates))) / perPrefix)
+		if i >= len(resp.CommonPrefixes) {
+			i = len(resp.CommonPrefixes) - 1
+		}
+		prefix = resp.CommonPrefixes[i]
+		p *= perPrefix / total
+		under = perPrefix
+		s.src.trace.step(depth+1, "descend into %q", prefix)
+	}
+}
+
+// StratifiedOptions configure a StratifiedSampler.
+type StratifiedOptions struct {
+	// MaxList is the maximum number of keys listed at each level.
+	MaxList int `json:"max_list,omitempty"`
+	// Attempts is how many walks can end without an accepted key before
+	// giving up.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// StratifiedSampler first picks a depth with the probability that a key is
+// at that depth according to the model, then walks down random prefixes to
+// that depth and picks a random key there. Depths are sampled in proportion,
+// which the tree walk doesn't guarantee, but prefixes of a depth with few
+// keys are favored.
+type StratifiedSampler struct {
+	src  samplerSource
+	opts StratifiedOptions
+}
+
+func newStratifiedSampler(src samplerSource, options json.RawMessage) (Sampler, error) {
+	opts := StratifiedOptions{MaxList: MaxList, Attempts: 10 * RetryLimit}
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if src.model.keyCount == 0 {
+		return nil, errors.New("model has no keys")
+	}
+	return &StratifiedSampler{src: src, opts: opts}, nil
+}
+
+func (*StratifiedSampler) Name() string { return "stratified" }
+
+// pickDepth picks a depth with the probability that a key is at that depth.
+func (s *StratifiedSampler) pickDepth(r *rand.Rand) int {
+	n := r.Intn(s.src.model.keyCount)
+	for depth, count := range s.src.model.depths {
+		if n < count {
+			return depth
+		}
+		n -= count
+	}
+	return len(s.src.model.depths) - 1
+}
+
+func (s *StratifiedSampler) Sample(r *rand.Rand, accept func(object) bool) (*object, error) {
+	// walks ending early are attempted again at the same depth, for depths
+	// to stay in proportion
+	depth := s.pickDepth(r)
+	s.src.trace.step(0, "picked depth %d", depth)
+walks:
+	for attempt := 0; attempt < s.opts.Attempts; attempt++ {
+		s.src.trace.step(0, "walk %d", attempt+1)
+		prefix := ""
+		for level := 0; ; level++ {
+			select {
+			case <-s.src.abort:
+				return nil, errors.New("aborted")
+			default:
+			}
+			resp, err := listBkt(context.Background(), s.src.bkt, prefix, s.opts.MaxList)
+			if err != nil {
+				return nil, err
+			}
+			if level < depth {
+				if len(resp.CommonPrefixes) == 0 {
+					s.src.trace.step(level+1, "list %q: dead end, no prefix", prefix)
+					continue walks
+				}
+				prefix = resp.CommonPrefixes[r.Intn(len(resp.CommonPrefixes))]
+				s.src.trace.step(level+1, "descend into %q among %d prefixes", prefix, len(resp.CommonPrefixes))
+				continue
+			}
+			candidates := filterKeys(resp.Contents, accept)
+			if len(candidates) == 0 {
+				s.src.trace.step(level+1, "list %q: %d keys, none accepted", prefix, len(resp.Contents))
+				continue walks
+			}
+			o := objectOf(candidates[r.Intn(len(candidates))])
+			s.src.trace.step(level+1, "pick %q among %d accepted of %d keys", o.Key, len(candidates), len(resp.Contents))
+			return &o, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no key accepted after %d walks", ErrModelStale, s.opts.Attempts)
+}
+
+// MarkerOptions configure a MarkerSampler.
+type MarkerOptions struct {
+	// Alphabet are the characters of random markers.
+	Alphabet string `json:"alphabet,omitempty"`
+	// Length is the length of random markers.
+	Length int `json:"length,omitempty"`
+	// Batch is how many keys are listed after a marker.
+	Batch int `json:"batch,omitempty"`
+	// Attempts is how many markers can be tried without finding an
+	// accepted key before giving up.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// MarkerSampler lists a few keys after a random marker and picks one of
+// them. It needs no model and costs a single LIST per key, but keys after
+// large gaps in the key space are favored.
+type MarkerSampler struct {
+	src  samplerSource
+	opts MarkerOptions
+}
+
+func newMarkerSampler(src samplerSource, options json.RawMessage) (Sampler, error) {
+	opts := MarkerOptions{
+		Alphabet: "0123456789abcdefghijklmnopqrstuvwxyz",
+		Length:   4,
+		Batch:    100,
+		Attempts: RetryLimit,
+	}
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Alphabet == "" || opts.Length <= 0 || opts.Batch <= 0 {
+		return nil, errors.New("alphabet, length and batch can't be empty")
+	}
+	return &MarkerSampler{src: src, opts: opts}, nil
+}
+
+func (*MarkerSampler) Name() string { return "marker" }
+
+func (s *MarkerSampler) Sample(r *rand.Rand, accept func(object) bool) (*object, error) {
+	marker := make([]byte, s.opts.Length)
+	for attempt := 0; attempt < s.opts.Attempts; attempt++ {
+		for i := range marker {
+			marker[i] = s.opts.Alphabet[r.Intn(len(s.opts.Alphabet))]
+		}
+		resp, err := s.src.bkt.List(context.Background(), "", "", string(marker), s.opts.Batch)
+		if err == nil && len(resp.Contents) == 0 {
+			// past the last key, wrap around
+			resp, err = s.src.bkt.List(context.Background(), "", "", "", s.opts.Batch)
+		}
+		if err != nil {
+			return nil, err
+		}
+		candidates := filterKeys(resp.Contents, accept)
+		s.src.trace.step(0, "marker %q: %d keys, %d accepted", marker, len(resp.Contents), len(candidates))
+		if len(candidates) == 0 {
+			continue
+		}
+		o := objectOf(candidates[r.Intn(len(candidates))])
+		s.src.trace.step(1, "pick %q", o.Key)
+		return &o, nil
+	}
+	return nil, fmt.Errorf("no key accepted after %d random markers", s.opts.Attempts)
+}
+
+// ListingIndexOptions configure a ListingIndexSampler.
+type ListingIndexOptions struct {
+	// Listing is the path to a listing of the bucket, gzip'd if it ends
+	// with .gz.
+	Listing string `json:"listing,omitempty"`
+	// Index is the path to a listing index built by jag listing index,
+	// used instead of a listing.
+	Index string `json:"index,omitempty"`
+	// Attempts is how many keys can be picked without finding an accepted
+	// one before giving up.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// ListingIndexSampler picks keys uniformly from a listing of the bucket,
+// verifying that they still exist. It costs a LIST per key, and can't sample
+// keys created after the listing. It holds the name of every key in memory,
+// unless it picks them from a listing index, at the cost of a read of the
+// index per key.
+type ListingIndexSampler struct {
+	src  samplerSource
+	opts ListingIndexOptions
+	keys keyIndex
+}
+
+// keyIndex are keys picked by their rank.
+type keyIndex interface {
+	Len() int
+	Key(i int) (string, error)
+}
+
+// listingKeys are the names of the keys of a listing, held in memory.
+type listingKeys []string
+
+func (k listingKeys) Len() int                  { return len(k) }
+func (k listingKeys) Key(i int) (string, error) { return k[i], nil }
+
+func newListingIndexSampler(src samplerSource, options json.RawMessage) (Sampler, error) {
+	opts := ListingIndexOptions{Attempts: RetryLimit}
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	var keys keyIndex
+	switch {
+	case opts.Listing != "" && opts.Index != "":
+		return nil, errors.New("both a listing and an index")
+	case opts.Index != "":
+		idx, err := openListingIndex(opts.Index)
+		if err != nil {
+			return nil, err
+		}
+		keys = idx
+	case opts.Listing != "":
+		names, err := readListing(opts.Listing)
+		if err != nil {
+			return nil, err
+		}
+		keys = listingKeys(names)
+	default:
+		return nil, errors.New("no listing")
+	}
+	if keys.Len() == 0 {
+		return nil, errors.New("listing has no keys")
+	}
+	return &ListingIndexSampler{src: src, opts: opts, keys: keys}, nil
+}
+
+// readListing reads the names of the keys in a listing.
+func readListing(filename string) ([]string, error) {
+	rd, err := openListing(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rd.Close() }()
+	var keys []string
+	dec := json.NewDecoder(rd)
+	for {
+		var k listedKey
+		err := dec.Decode(&k)
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing %q: %v", filename, err)
+		}
+		keys = append(keys, k.Key)
+	}
+}
+
+func (*ListingIndexSampler) Name() string { return "listing_index" }
+
+func (s *ListingIndexSampler) Sample(r *rand.Rand, accept func(object) bool) (*object, error) {
+	for attempt := 0; attempt < s.opts.Attempts; attempt++ {
+		rank := r.Intn(s.keys.Len())
+		name, err := s.keys.Key(rank)
+		if err != nil {
+			return nil, err
+		}
+		o, err := findKey(context.Background(), s.src.bkt, name)
+		if err != nil {
+			return nil, err
+		}
+		// deleted since the listing
+		if o == nil {
+			s.src.trace.step(0, "key %d of %d, %q: deleted since the listing", rank, s.keys.Len(), name)
+			continue
+		}
+		if !accept(*o) {
+			s.src.trace.step(0, "key %d of %d, %q: rejected", rank, s.keys.Len(), name)
+			continue
+		}
+		s.src.trace.step(0, "key %d of %d, %q: picked", rank, s.keys.Len(), name)
+		return o, nil
+	}
+	return nil, fmt.Errorf("%w: no key of the listing accepted after %d attempts", ErrModelStale, s.opts.Attempts)
+}
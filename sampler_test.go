@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// samplerDraws is how many keys are sampled to test the distribution of a
+// sampler.
+const samplerDraws = 4000
+
+// samplerExpectations return how likely each key of a bucket is to be
+// sampled by a sampler with its options, for every registered sampler.
+var samplerExpectations = map[string]func(b *memBucket, model *bucketModel, options json.RawMessage) []float64{
+	"tree_walk":     uniformExpectation,
+	"listing_index": uniformExpectation,
+	"stratified":    stratifiedExpectation,
+	"marker":        markerExpectation,
+}
+
+// samplerOptions are the options each sampler is tested with. The markers
+// are few enough for their distribution to be computed.
+var samplerOptions = map[string]interface{}{
+	"marker": MarkerOptions{Alphabet: "0kp", Length: 4, Batch: 5, Attempts: RetryLimit},
+}
+
+// fixedBucket is the bucket samplers are tested against, with its model.
+func fixedBucket() (*memBucket, *bucketModel) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newMemBucket("fixed")
+	fillBucket(b, rand.New(rand.NewSource(42)), 200, 3, 3, now.Add(-time.Hour), now)
+	return b, modelOfBucket(b)
+}
+
+func uniformExpectation(b *memBucket, _ *bucketModel, _ json.RawMessage) []float64 {
+	probs := make([]float64, len(b.keys()))
+	for i := range probs {
+		probs[i] = 1 / float64(len(probs))
+	}
+	return probs
+}
+
+// stratifiedExpectation picks a depth in proportion to its keys, then walks
+// down uniformly random prefixes to a uniformly random key, walks ending
+// early being attempted again.
+func stratifiedExpectation(b *memBucket, model *bucketModel, _ json.RawMessage) []float64 {
+	index := keyIndexOf(b)
+	probs := make([]float64, len(index))
+	for depth, count := range model.depths {
+		if count == 0 {
+			continue
+		}
+		reached := make(map[string]float64)
+		var walk func(prefix string, level int, p float64)
+		walk = func(prefix string, level int, p float64) {
+			resp, _ := b.List(context.Background(), prefix, "/", "", MaxList)
+			if level < depth {
+				for _, pfx := range resp.CommonPrefixes {
+					walk(pfx, level+1, p/float64(len(resp.CommonPrefixes)))
+				}
+				return
+			}
+			for _, k := range resp.Contents {
+				reached[k.Key] += p / float64(len(resp.Contents))
+			}
+		}
+		walk("", 0, 1)
+		success := 0.0
+		for _, p := range reached {
+			success += p
+		}
+		for key, p := range reached {
+			probs[index[key]] += float64(count) / float64(model.keyCount) * p / success
+		}
+	}
+	return probs
+}
+
+// markerExpectation lists a batch of keys after each possible marker, and
+// picks one of them.
+func markerExpectation(b *memBucket, _ *bucketModel, options json.RawMessage) []float64 {
+	var opts MarkerOptions
+	_ = json.Unmarshal(options, &opts)
+	index := keyIndexOf(b)
+	probs := make([]float64, len(index))
+	markers := []string{""}
+	for i := 0; i < opts.Length; i++ {
+		var longer []string
+		for _, m := range markers {
+			for _, c := range opts.Alphabet {
+				longer = append(longer, m+string(c))
+			}
+		}
+		markers = longer
+	}
+	for _, m := range markers {
+		resp, _ := b.List(context.Background(), "", "", m, opts.Batch)
+		if len(resp.Contents) == 0 {
+			resp, _ = b.List(context.Background(), "", "", "", opts.Batch)
+		}
+		for _, k := range resp.Contents {
+			probs[index[k.Key]] += 1 / float64(len(markers)*len(resp.Contents))
+		}
+	}
+	return probs
+}
+
+func keyIndexOf(b *memBucket) map[string]int {
+	index := make(map[string]int)
+	for i, k := range b.keys() {
+		index[k.Key] = i
+	}
+	return index
+}
+
+// pooled pools the keys expected less than 5 times into one category, for
+// the chi-squared test to hold. It fails if a key that can't be sampled was.
+func pooled(t *testing.T, observed, expected []float64) ([]float64, []float64) {
+	var obs, exp []float64
+	var smallObs, smallExp float64
+	for i := range expected {
+		switch {
+		case expected[i] == 0 && observed[i] != 0:
+			t.Errorf("key %d can't be sampled, but was %.0f times", i, observed[i])
+		case expected[i] < 5:
+			smallObs += observed[i]
+			smallExp += expected[i]
+		default:
+			obs = append(obs, observed[i])
+			exp = append(exp, expected[i])
+		}
+	}
+	return append(obs, smallObs), append(exp, smallExp)
+}
+
+func TestSamplersDistribution(t *testing.T) {
+	for name := range samplersByName {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			expectation, ok := samplerExpectations[name]
+			if !ok {
+				t.Fatalf("no expected distribution for sampler %q", name)
+			}
+			b, model := fixedBucket()
+			cfg := &config{Sampler: name}
+			if opts, ok := samplerOptions[name]; ok {
+				cfg.SamplerOptions, _ = json.Marshal(opts)
+			}
+			if name == "listing_index" {
+				listing, err := writeListing(b)
+				defer func() { _ = os.Remove(listing) }()
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.SamplerOptions, _ = json.Marshal(ListingIndexOptions{Listing: listing})
+			}
+			sampler, err := lookupSampler(cfg, samplerSource{bkt: b, model: *model})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			index := keyIndexOf(b)
+			observed := make([]float64, len(index))
+			r := rand.New(rand.NewSource(7))
+			for i := 0; i < samplerDraws; i++ {
+				k, err := sampler.Sample(r, func(object) bool { return true })
+				if err != nil {
+					t.Fatal(err)
+				}
+				observed[index[k.Key]]++
+			}
+			expected := expectation(b, model, cfg.SamplerOptions)
+			for i := range expected {
+				expected[i] *= samplerDraws
+			}
+			obs, exp := pooled(t, observed, expected)
+			if res := newSelftestResult(name, obs, exp); !res.ok() {
+				t.Errorf("chi-squared %.1f above %.1f", res.stat, res.critical)
+			}
+		})
+	}
+}
+
+// TestTreeWalkAccepted checks that the tree walk only picks accepted keys,
+// uniformly among them.
+func TestTreeWalkAccepted(t *testing.T) {
+	b, model := fixedBucket()
+	sampler, err := lookupSampler(&config{Sampler: "tree_walk"}, samplerSource{bkt: b, model: *model})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accept := func(o object) bool { return !strings.HasPrefix(o.Key, "p0/") }
+	index := make(map[string]int)
+	for _, k := range b.keys() {
+		if accept(objectOf(k)) {
+			index[k.Key] = len(index)
+		}
+	}
+	observed := make([]float64, len(index))
+	expected := make([]float64, len(index))
+	r := rand.New(rand.NewSource(7))
+	for i := 0; i < samplerDraws; i++ {
+		k, err := sampler.Sample(r, accept)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i, ok := index[k.Key]
+		if !ok {
+			t.Fatalf("picked key %q that isn't accepted", k.Key)
+		}
+		observed[i]++
+	}
+	for i := range expected {
+		expected[i] = float64(samplerDraws) / float64(len(expected))
+	}
+	obs, exp := pooled(t, observed, expected)
+	if res := newSelftestResult("accepted", obs, exp); !res.ok() {
+		t.Errorf("chi-squared %.1f above %.1f", res.stat, res.critical)
+	}
+}
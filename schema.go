@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/codegangsta/cli"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// schemaEnums are the values of the string types with a fixed set of
+// values.
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeOf(outcome("")): {
+		string(outcomeMatch), string(outcomeMismatch), string(outcomeIgnored),
+		string(outcomeInconclusive), string(outcomeSuppressed), string(outcomeLifecycle),
+		string(outcomePending),
+	},
+}
+
+// jsonSchema returns the JSON schema of the JSON form of values of a type,
+// as encoding/json produces it.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if enum, ok := schemaEnums[t]; ok {
+		return map[string]interface{}{"type": "string", "enum": enum}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		var required []string
+		addStructFields(t, props, &required)
+		sort.Strings(required)
+		schema := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) != 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	// interface{} holds anything
+	return map[string]interface{}{}
+}
+
+// addStructFields adds the properties of the fields of a struct, flattening
+// embedded structs like encoding/json does.
+func addStructFields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			addStructFields(f.Type, props, required)
+			continue
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = jsonSchema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// reportSchema is the JSON schema of the reports of rounds.
+func reportSchema() map[string]interface{} {
+	schema := jsonSchema(reflect.TypeOf(RoundReport{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "jag round report"
+	return schema
+}
+
+func schemaCommand() cli.Command {
+	doSchema := func(ctx *cli.Context) {
+		data, err := json.MarshalIndent(reportSchema(), "", "   ")
+		if err != nil {
+			fail(ctx, "bug: can't create schema JSON: %v", err)
+		}
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			fail(ctx, "error: can't write schema to stdout: %v", err)
+		}
+	}
+
+	return cli.Command{
+		Name:  "schema",
+		Usage: "Prints the JSON schema of the reports of rounds.",
+		Description: strings.TrimSpace(`
+Prints the JSON schema of the reports written with 'audit --report', which
+parsers of reports can validate against. Fields are only ever added to
+reports, never renamed or removed.`),
+		Action: doSchema,
+	}
+}
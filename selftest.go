@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// selftestZ is the z-score of the significance level of the self tests,
+// p = 0.001. A fair sampler fails a test once in a thousand runs.
+const selftestZ = 3.09
+
+// treeShape describes a synthetic bucket.
+type treeShape struct {
+	name     string
+	keys     int
+	maxDepth int
+	fanout   int
+}
+
+var selftestShapes = []treeShape{
+	{name: "flat", keys: 200, maxDepth: 0, fanout: 1},
+	{name: "shallow", keys: 200, maxDepth: 1, fanout: 10},
+	{name: "balanced", keys: 200, maxDepth: 3, fanout: 3},
+	{name: "deep", keys: 200, maxDepth: 8, fanout: 2},
+	{name: "wide", keys: 200, maxDepth: 2, fanout: 50},
+}
+
+// chiSquared returns the chi-squared statistic of observed counts against
+// expected counts, and its degrees of freedom. Categories not expected to
+// be observed are ignored.
+func chiSquared(observed, expected []float64) (stat float64, df int) {
+	for i := range expected {
+		if expected[i] == 0 {
+			continue
+		}
+		d := observed[i] - expected[i]
+		stat += d * d / expected[i]
+		df++
+	}
+	return stat, df - 1
+}
+
+// chiSquaredCritical approximates the critical value of the chi-squared
+// distribution with df degrees of freedom at the z-score z, using the
+// Wilson-Hilferty transformation.
+func chiSquaredCritical(df int, z float64) float64 {
+	k := float64(df)
+	return k * math.Pow(1-2/(9*k)+z*math.Sqrt(2/(9*k)), 3)
+}
+
+// selftestResult is the outcome of a uniformity test.
+type selftestResult struct {
+	name     string
+	stat     float64
+	critical float64
+}
+
+func (r selftestResult) ok() bool { return r.stat <= r.critical }
+
+func newSelftestResult(name string, observed, expected []float64) selftestResult {
+	stat, df := chiSquared(observed, expected)
+	if df < 1 {
+		// a single category is always uniform
+		return selftestResult{name: name}
+	}
+	return selftestResult{
+		name:     name,
+		stat:     stat,
+		critical: chiSquaredCritical(df, selftestZ),
+	}
+}
+
+// selftestRNG verifies that the random number generator picks uniformly
+// among n choices.
+func selftestRNG(r *rand.Rand, n, draws int) selftestResult {
+	observed := make([]float64, n)
+	expected := make([]float64, n)
+	for i := 0; i < draws; i++ {
+		observed[r.Intn(n)]++
+	}
+	for i := range expected {
+		expected[i] = float64(draws) / float64(n)
+	}
+	return newSelftestResult("rng", observed, expected)
+}
+
+// writeListing writes the listing of a bucket to a temporary file, for the
+// samplers that need one.
+func writeListing(b *memBucket) (string, error) {
+	f, err := os.CreateTemp("", "jag-selftest-*.json")
+	if err != nil {
+		return "", err
+	}
+	enc := json.NewEncoder(f)
+	for _, k := range b.keys() {
+		if err = enc.Encode(k); err != nil {
+			break
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return f.Name(), err
+}
+
+// selftestSampler verifies that a sampler picks keys uniformly in a
+// synthetic bucket of the given shape, both across keys and across depths.
+func selftestSampler(shape treeShape, sampler string, draws int, seed int64) ([]selftestResult, error) {
+	now := time.Now()
+	r := rand.New(rand.NewSource(seed))
+	b := newMemBucket("selftest-" + shape.name)
+	fillBucket(b, r, shape.keys, shape.maxDepth, shape.fanout, now.Add(-time.Hour), now)
+	model := modelOfBucket(b)
+
+	cfg := &config{Source: awsConfig{Bucket: b.Name()}, Checks: DefaultChecks, Sampler: sampler}
+	if sampler == "listing_index" {
+		listing, err := writeListing(b)
+		defer func() { _ = os.Remove(listing) }()
+		if err != nil {
+			return nil, err
+		}
+		cfg.SamplerOptions, _ = json.Marshal(ListingIndexOptions{Listing: listing})
+	}
+	v, err := newVerifier(cfg, *model, b, b, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := b.keys()
+	index := make(map[string]int, len(keys))
+	for i, k := range keys {
+		index[k.Key] = i
+	}
+	byKey := make([]float64, len(keys))
+	byDepth := make([]float64, len(model.depths))
+	acceptAll := func(object) bool { return true }
+	for i := 0; i < draws; i++ {
+		k, err := v.sampler.Sample(r, acceptAll)
+		if err != nil {
+			return nil, err
+		}
+		byKey[index[k.Key]]++
+		byDepth[strings.Count(k.Key, "/")]++
+	}
+
+	wantByKey := make([]float64, len(keys))
+	for i := range wantByKey {
+		wantByKey[i] = float64(draws) / float64(len(keys))
+	}
+	wantByDepth := make([]float64, len(model.depths))
+	for depth, count := range model.depths {
+		wantByDepth[depth] = float64(draws) * float64(count) / float64(model.keyCount)
+	}
+	return []selftestResult{
+		newSelftestResult(shape.name+"/keys", byKey, wantByKey),
+		newSelftestResult(shape.name+"/depths", byDepth, wantByDepth),
+	}, nil
+}
+
+func selftestCommand() cli.Command {
+	drawsFlag := cli.IntFlag{
+		Name:  "draws",
+		Usage: "number of keys to sample in each synthetic bucket",
+		Value: 4000,
+	}
+	seedFlag := cli.IntFlag{
+		Name:  "seed",
+		Usage: "seed of the synthetic buckets and sampler",
+		Value: 42,
+	}
+	samplerFlag := cli.StringFlag{
+		Name:  "sampler",
+		Usage: "sampler to test, one of " + samplerNames(),
+		Value: DefaultSampler,
+	}
+
+	doSelftest := func(ctx *cli.Context) {
+		if !ctx.GlobalBool("debug") {
+			log.SetLevel(log.FatalLevel)
+		}
+		draws := ctx.Int(drawsFlag.Name)
+		seed := int64(ctx.Int(seedFlag.Name))
+		sampler := mustString(ctx, samplerFlag)
+		if _, ok := samplersByName[sampler]; !ok {
+			fail(ctx, "error: unknown sampler %q, valid samplers are %s", sampler, samplerNames())
+		}
+
+		results := []selftestResult{selftestRNG(rand.New(rand.NewSource(seed)), 100, draws)}
+		for _, shape := range selftestShapes {
+			res, err := selftestSampler(shape, sampler, draws, seed)
+			if err != nil {
+				fail(ctx, "error: sampling bucket %q: %v", shape.name, err)
+			}
+			results = append(results, res...)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TEST\tCHI-SQUARED\tCRITICAL\tRESULT")
+		failed := false
+		for _, res := range results {
+			result := "PASS"
+			if !res.ok() {
+				result = "FAIL"
+				failed = true
+			}
+			fmt.Fprintf(tw, "%s\t%.1f\t%.1f\t%s\n", res.name, res.stat, res.critical, result)
+		}
+		_ = tw.Flush()
+		if failed {
+			os.Exit(1)
+		}
+	}
+
+	return cli.Command{
+		Name:  "selftest",
+		Usage: "Verifies that the sampler picks keys uniformly.",
+		Description: strings.TrimSpace(`
+Samples keys many times in synthetic buckets of various shapes, and runs
+chi-squared tests (p = 0.001) of the distribution of the samples across keys
+and across depths against a uniform distribution. The random number generator
+is tested the same way. The command fails if any test fails.
+
+Any sampler can be tested, the tree walk by default.`),
+		Flags:  []cli.Flag{drawsFlag, seedFlag, samplerFlag},
+		Action: doSelftest,
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ServiceRestartDelay is how long installed services wait before restarting
+// once they failed.
+const ServiceRestartDelay = 30 * time.Second
+
+// serviceName is what the names of services look like, for both systemd and
+// the Windows service control manager to accept them.
+var serviceName = regexp.MustCompile(`^[a-zA-Z0-9_.@-]+$`)
+
+// serviceDefinition is an audit installed as a service of the platform: a
+// systemd unit, or a Windows service.
+type serviceDefinition struct {
+	name        string
+	description string
+	// exe and args are the command line of the service, with absolute
+	// paths so that it runs from anywhere.
+	exe  string
+	args []string
+	// dir is the working directory of the service, the directory of its
+	// config.
+	dir string
+}
+
+// defaultServiceName is the name of the service of an audit: jag, suffixed
+// with the name of the audit if it has one.
+func defaultServiceName(cfg *config) string {
+	if cfg.AuditName == "" {
+		return "jag"
+	}
+	return "jag-" + cfg.AuditName
+}
+
+func serviceCommand(abort <-chan struct{}) cli.Command {
+	run := auditCommand(abort)
+	run.Name = "run"
+	run.Usage = "Audits like the audit command, as installed services do."
+
+	return cli.Command{
+		Name:  "service",
+		Usage: "Installs, uninstalls or runs the audit as a service.",
+		Subcommands: []cli.Command{
+			serviceInstallCommand(),
+			serviceUninstallCommand(),
+			run,
+		},
+	}
+}
+
+var (
+	serviceCfgFlag = cli.StringFlag{
+		Name:  "cfg",
+		Usage: "path to the JSON config file",
+	}
+	serviceNameFlag = cli.StringFlag{
+		Name:  "name",
+		Usage: "name of the service, by default jag, suffixed with the audit_name of the config if any",
+	}
+)
+
+func serviceInstallCommand() cli.Command {
+	// the flags of the audit command given to the service, as absolute paths
+	pathFlags := []cli.StringFlag{
+		{Name: "model", Usage: "path to a JSON file representing model of the keys in the source bucket"},
+		{Name: "build-model", Usage: "path to a gzip'd JSON file representing all the keys in the source bucket"},
+		{Name: "reverse-model", Usage: "path to a JSON file representing model of the keys in the destination bucket, for bidirectional audits"},
+		{Name: "build-reverse-model", Usage: "path to a gzip'd JSON file representing all the keys in the destination bucket, for bidirectional audits"},
+		{Name: "save-model", Usage: "path where the model built with --build-model is saved, by default next to the listing"},
+		{Name: "save-reverse-model", Usage: "path where the model built with --build-reverse-model is saved, by default next to the listing"},
+	}
+	printFlag := cli.BoolFlag{
+		Name:  "print",
+		Usage: "print the definition of the service instead of installing it",
+	}
+
+	doInstall := func(ctx *cli.Context) {
+		cfg := mustConfig(ctx, serviceCfgFlag)
+		name := ctx.String(serviceNameFlag.Name)
+		if name == "" {
+			name = defaultServiceName(cfg)
+		}
+		if !serviceName.MatchString(name) {
+			fail(ctx, "error: invalid service name %q, want letters, digits and _.@-", name)
+		}
+		if runtime.GOOS == "windows" && cfg.StateDir != "" && !filepath.IsAbs(cfg.StateDir) {
+			fail(ctx, "error: state_dir %q must be absolute, Windows services run in the system directory", cfg.StateDir)
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			fail(ctx, "error: can't find the jag executable: %v", err)
+		}
+		cfgFilename, err := filepath.Abs(mustString(ctx, serviceCfgFlag))
+		if err != nil {
+			fail(ctx, "error: %v", err)
+		}
+		def := serviceDefinition{
+			name:        name,
+			description: fmt.Sprintf("jag, auditing the replication of %s to %s", cfg.Source.Bucket, cfg.Destination.Bucket),
+			exe:         exe,
+			args:        []string{"service", "run", "--" + serviceCfgFlag.Name, cfgFilename},
+			dir:         filepath.Dir(cfgFilename),
+		}
+		for _, f := range pathFlags {
+			if filename := ctx.String(f.Name); filename != "" {
+				if filename, err = filepath.Abs(filename); err != nil {
+					fail(ctx, "error: %v", err)
+				}
+				def.args = append(def.args, "--"+f.Name, filename)
+			}
+		}
+		if ctx.String("model") == "" && ctx.String("build-model") == "" {
+			fail(ctx, "required: flag %q or %q must have a value", "model", "build-model")
+		}
+		if cfg.Bidirectional && ctx.String("reverse-model") == "" && ctx.String("build-reverse-model") == "" {
+			fail(ctx, "required: flag %q or %q must have a value for bidirectional audits", "reverse-model", "build-reverse-model")
+		}
+
+		if ctx.Bool(printFlag.Name) {
+			fmt.Print(def.definition())
+			return
+		}
+		if err := installService(def); err != nil {
+			fail(ctx, "error: can't install service %q: %v", def.name, err)
+		}
+		log.WithField("service", def.name).Info("service installed and started")
+	}
+
+	flags := []cli.Flag{serviceCfgFlag, serviceNameFlag}
+	for _, f := range pathFlags {
+		flags = append(flags, f)
+	}
+	return cli.Command{
+		Name:  "install",
+		Usage: "Installs and starts a service auditing with the config.",
+		Description: strings.TrimSpace(`
+Installs a service running 'jag service run' with the config and models given,
+their paths made absolute, starts it and has it start with the system. It
+restarts once it fails. On Linux, the service is a systemd unit written in
+/etc/systemd/system, which must be run as root. On Windows, it's a service of
+the service control manager logging to the Event Log, which must be run as an
+administrator. With --print, the definition of the service is printed instead,
+to be installed by hand or by configuration management.`),
+		Flags:  flags,
+		Action: doInstall,
+	}
+}
+
+func serviceUninstallCommand() cli.Command {
+	doUninstall := func(ctx *cli.Context) {
+		name := ctx.String(serviceNameFlag.Name)
+		if name == "" {
+			cfg := &config{}
+			if ctx.String(serviceCfgFlag.Name) != "" {
+				cfg = mustConfig(ctx, serviceCfgFlag)
+			}
+			name = defaultServiceName(cfg)
+		}
+		if err := uninstallService(name); err != nil {
+			fail(ctx, "error: can't uninstall service %q: %v", name, err)
+		}
+		log.WithField("service", name).Info("service stopped and uninstalled")
+	}
+
+	return cli.Command{
+		Name:   "uninstall",
+		Usage:  "Stops and uninstalls the service of an audit.",
+		Flags:  []cli.Flag{serviceCfgFlag, serviceNameFlag},
+		Action: doUninstall,
+	}
+}
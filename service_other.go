@@ -0,0 +1,103 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// shutdownSignals abort the audit.
+var shutdownSignals = []os.Signal{syscall.SIGTERM}
+
+// triggerSignals have the audit run a round right away, see roundTrigger.
+var triggerSignals = []os.Signal{syscall.SIGUSR1}
+
+// runService runs jag as a service of the platform, if it has services and
+// started jag as one. Otherwise it returns false without running it.
+func runService(run func(), shutdown func(reason string)) (bool, error) {
+	return false, nil
+}
+
+// SystemdUnitDir is where the units of services are installed.
+const SystemdUnitDir = "/etc/systemd/system"
+
+// definition is the systemd unit of the service.
+func (d serviceDefinition) definition() string {
+	cmd := []string{systemdQuote(d.exe)}
+	for _, arg := range d.args {
+		cmd = append(cmd, systemdQuote(arg))
+	}
+	return fmt.Sprintf(`[Unit]
+Description=%s
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=simple
+ExecStart=%s
+WorkingDirectory=%s
+Restart=on-failure
+RestartSec=%d
+KillSignal=SIGTERM
+
+[Install]
+WantedBy=multi-user.target
+`, d.description, strings.Join(cmd, " "), d.dir, int(ServiceRestartDelay.Seconds()))
+}
+
+// systemdQuote quotes an argument of a command line of a unit.
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(arg) + `"`
+}
+
+func (d serviceDefinition) unitFile() string {
+	return filepath.Join(SystemdUnitDir, d.name+".service")
+}
+
+// installService writes the unit of the service, then enables and starts
+// it.
+func installService(d serviceDefinition) error {
+	if _, err := os.Stat(d.unitFile()); err == nil {
+		return fmt.Errorf("%s already exists, uninstall it first", d.unitFile())
+	}
+	if err := os.WriteFile(d.unitFile(), []byte(d.definition()), 0644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", "--now", d.name+".service")
+}
+
+// uninstallService stops and disables the service, then removes its unit.
+func uninstallService(name string) error {
+	d := serviceDefinition{name: name}
+	if _, err := os.Stat(d.unitFile()); err != nil {
+		return err
+	}
+	if err := systemctl("disable", "--now", name+".service"); err != nil {
+		return err
+	}
+	if err := os.Remove(d.unitFile()); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
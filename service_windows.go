@@ -0,0 +1,177 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ServiceName is the source of the events jag logs as a Windows service,
+// whatever the name of the service, registered in the Application log by
+// 'jag service install'.
+const ServiceName = "jag"
+
+// shutdownSignals abort the audit. Go delivers CTRL_C and CTRL_BREAK as
+// os.Interrupt, and the console closing, the user logging off and the
+// system shutting down as SIGTERM.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// triggerSignals have the audit run a round right away, see roundTrigger.
+// Windows has no signal for it, rounds are triggered on the HTTP endpoint.
+var triggerSignals []os.Signal
+
+// runService runs jag as a Windows service if the service control manager
+// started it, until it stops or is asked to. Logs are then written to the
+// Event Log, since services have no console.
+func runService(run func(), shutdown func(reason string)) (bool, error) {
+	ok, err := svc.IsWindowsService()
+	if err != nil || !ok {
+		return false, err
+	}
+	elog, err := eventlog.Open(ServiceName)
+	if err != nil {
+		return true, fmt.Errorf("can't open event log: %v", err)
+	}
+	defer func() { _ = elog.Close() }()
+	log.SetOutput(io.Discard)
+	log.AddHook(eventLogHook{elog: elog})
+	return true, svc.Run(ServiceName, windowsService{run: run, shutdown: shutdown})
+}
+
+// windowsService runs jag for the service control manager.
+type windowsService struct {
+	run      func()
+	shutdown func(reason string)
+}
+
+func (s windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run()
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				if req.Cmd == svc.Stop {
+					s.shutdown("service stopped")
+				} else {
+					s.shutdown("system shutting down")
+				}
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventLogHook writes logs to the Event Log.
+type eventLogHook struct {
+	elog *eventlog.Log
+}
+
+func (eventLogHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+		log.InfoLevel,
+		log.DebugLevel,
+	}
+}
+
+func (h eventLogHook) Fire(e *log.Entry) error {
+	msg, err := e.String()
+	if err != nil {
+		return err
+	}
+	switch e.Level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		return h.elog.Error(1, msg)
+	case log.WarnLevel:
+		return h.elog.Warning(1, msg)
+	default:
+		return h.elog.Info(1, msg)
+	}
+}
+
+// definition is the commands creating the service.
+func (d serviceDefinition) definition() string {
+	cmd := []string{syscall.EscapeArg(d.exe)}
+	for _, arg := range d.args {
+		cmd = append(cmd, syscall.EscapeArg(arg))
+	}
+	binPath := strings.ReplaceAll(strings.Join(cmd, " "), `"`, `\"`)
+	return fmt.Sprintf("sc.exe create %s binPath= \"%s\" start= auto\r\n"+
+		"sc.exe description %s \"%s\"\r\n"+
+		"sc.exe failure %s reset= 86400 actions= restart/%d\r\n",
+		d.name, binPath, d.name, d.description, d.name, ServiceRestartDelay.Milliseconds())
+}
+
+// installService creates the service, starting with the system and
+// restarting once it fails, and starts it.
+func installService(d serviceDefinition) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = m.Disconnect() }()
+	if s, err := m.OpenService(d.name); err == nil {
+		_ = s.Close()
+		return fmt.Errorf("service already exists, uninstall it first")
+	}
+	s, err := m.CreateService(d.name, d.exe, mgr.Config{
+		DisplayName: d.name,
+		Description: d.description,
+		StartType:   mgr.StartAutomatic,
+	}, d.args...)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = s.Close() }()
+	restart := []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: ServiceRestartDelay}}
+	if err := s.SetRecoveryActions(restart, 24*60*60); err != nil {
+		return fmt.Errorf("can't restart service on failure: %v", err)
+	}
+	if err := eventlog.InstallAsEventCreate(ServiceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		// the source is registered by the first service installed
+		log.WithField("error", err).Debug("couldn't register event source")
+	}
+	return s.Start()
+}
+
+// uninstallService stops and deletes the service.
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = m.Disconnect() }()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = s.Close() }()
+	if _, err := s.Control(svc.Stop); err != nil {
+		log.WithField("error", err).Debug("couldn't stop service, it may not be running")
+	}
+	return s.Delete()
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SFTPDialTimeout is how long connecting to an SFTP server can take.
+const SFTPDialTimeout = 30 * time.Second
+
+// sftpUnsupportedChecks are the checks that can't verify keys on an SFTP
+// server, whose files have nothing but a size and a modification time.
+var sftpUnsupportedChecks = map[string]bool{
+	"etag":      true,
+	"versions":  true,
+	"metadata":  true,
+	"tags":      true,
+	"retention": true,
+}
+
+// errSFTPUnsupported is returned when asking an SFTP server for what it
+// doesn't have.
+var errSFTPUnsupported = errors.New("not supported by SFTP")
+
+// sftpConfig is set on a bucket that is a directory of a host served over
+// SFTP, such as the destination of exports. The access key and the secret
+// key of the bucket are the user and its password, and the name of the
+// bucket only names it in logs and reports.
+type sftpConfig struct {
+	// Host is the address of the server, with its port if it isn't 22.
+	Host string `json:"host"`
+	// Root is the directory holding the keys, each in the file at its name.
+	Root           string `json:"root"`
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	// KnownHostsFile has the keys of the server, ~/.ssh/known_hosts by
+	// default.
+	KnownHostsFile string `json:"known_hosts_file,omitempty"`
+}
+
+func loadSFTP(c *config, a awsConfig) error {
+	s := a.SFTP
+	switch {
+	case s.Host == "":
+		return fmt.Errorf("host is required")
+	case s.Root == "":
+		return fmt.Errorf("root is required")
+	case a.SecretKey == "" && s.PrivateKeyFile == "":
+		return fmt.Errorf("secret_key or private_key_file is required")
+	case len(a.Fallbacks) != 0 || a.DualStack || a.FIPS:
+		return fmt.Errorf("fallbacks, dual_stack and fips only apply to S3")
+	case c.SampleVersions || c.DeleteMarkers.Count != 0:
+		return fmt.Errorf("files have no versions to sample")
+	case c.Reconcile:
+		return fmt.Errorf("directories keep no statistics to reconcile")
+	}
+	if _, _, err := net.SplitHostPort(s.Host); err != nil {
+		s.Host = net.JoinHostPort(s.Host, "22")
+	}
+	if s.KnownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("known_hosts_file is required: %v", err)
+		}
+		s.KnownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	for _, name := range c.Checks {
+		if sftpUnsupportedChecks[name] {
+			return fmt.Errorf("check %q can't verify files", name)
+		}
+	}
+	return nil
+}
+
+// sftpBucket is a directory of a host served over SFTP. Listings walk the
+// directories under the root: keys are the paths of the files relative to
+// the root, and directories are the common prefixes of delimited listings.
+type sftpBucket struct {
+	name     string
+	user     string
+	password string
+	cfg      sftpConfig
+	// conn is shared by the copies of the bucket.
+	conn *sftpConn
+}
+
+// sftpConn is the connection to the server, opened on first use and opened
+// again after it failed.
+type sftpConn struct {
+	mu     sync.Mutex
+	ssh    *ssh.Client
+	client *sftp.Client
+}
+
+func newSFTPBucket(a awsConfig) sftpBucket {
+	return sftpBucket{
+		name:     a.Bucket,
+		user:     a.AccessKey,
+		password: a.SecretKey,
+		cfg:      *a.SFTP,
+		conn:     &sftpConn{},
+	}
+}
+
+// client returns the client of the connection to the server, connecting if
+// needed.
+func (b sftpBucket) client() (*sftp.Client, error) {
+	b.conn.mu.Lock()
+	defer b.conn.mu.Unlock()
+	if b.conn.client != nil {
+		return b.conn.client, nil
+	}
+	hostKeys, err := knownhosts.New(b.cfg.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read known hosts: %w", err)
+	}
+	cfg := &ssh.ClientConfig{
+		User:            b.user,
+		HostKeyCallback: hostKeys,
+		Timeout:         SFTPDialTimeout,
+	}
+	if b.cfg.PrivateKeyFile != "" {
+		pem, err := os.ReadFile(b.cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key %q: %v", b.cfg.PrivateKeyFile, err)
+		}
+		cfg.Auth = append(cfg.Auth, ssh.PublicKeys(signer))
+	}
+	if b.password != "" {
+		cfg.Auth = append(cfg.Auth, ssh.Password(b.password))
+	}
+	conn, err := ssh.Dial("tcp", b.cfg.Host, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: can't connect to %q: %w", ErrUnavailable, b.cfg.Host, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: can't start SFTP on %q: %w", ErrUnavailable, b.cfg.Host, err)
+	}
+	b.conn.ssh, b.conn.client = conn, client
+	return client, nil
+}
+
+// fail wraps an error returned by the server into the kind of error it
+// represents. Errors other than missing files and denied accesses are
+// failures of the connection, which is closed for the next request to
+// connect again.
+func (b sftpBucket) fail(client *sftp.Client, err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("%w: %w", ErrKeyMissing, err)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+	}
+	b.conn.mu.Lock()
+	defer b.conn.mu.Unlock()
+	if b.conn.client == client {
+		_ = b.conn.client.Close()
+		_ = b.conn.ssh.Close()
+		b.conn.ssh, b.conn.client = nil, nil
+	}
+	return fmt.Errorf("%w: %w", ErrUnavailable, err)
+}
+
+// path returns the path of the file of a key, or of a directory if the
+// name ends with a slash. Names escaping the root, with "..", are rejected.
+func (b sftpBucket) path(name string) (string, error) {
+	root := path.Clean(b.cfg.Root)
+	p := path.Join(root, name)
+	under := root
+	if !strings.HasSuffix(under, "/") {
+		under += "/"
+	}
+	if p != root && !strings.HasPrefix(p, under) {
+		return "", fmt.Errorf("key %q is out of root %q", name, b.cfg.Root)
+	}
+	return p, nil
+}
+
+// sftpEntry is a file or a directory of a listing, named after its key or
+// after its prefix.
+type sftpEntry struct {
+	name string
+	info fs.FileInfo
+}
+
+// readDir returns the entries of the directory of a prefix, by order of
+// name. A missing directory is empty, as prefixes that match no key.
+func (b sftpBucket) readDir(client *sftp.Client, dir string) ([]sftpEntry, error) {
+	dirPath, err := b.path(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := client.ReadDir(dirPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, b.fail(client, err)
+	}
+	entries := make([]sftpEntry, 0, len(infos))
+	for _, info := range infos {
+		e := sftpEntry{name: dir + info.Name(), info: info}
+		if info.IsDir() {
+			e.name += "/"
+		} else if !info.Mode().IsRegular() {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+func (e sftpEntry) key() listedKey {
+	return listedKey{
+		Key:          e.name,
+		LastModified: e.info.ModTime().UTC().Format(time.RFC3339Nano),
+		Size:         e.info.Size(),
+	}
+}
+
+func (b sftpBucket) Name() string { return b.name }
+
+// List has the semantics of S3's, but only supports slashes as delimiters.
+// Keys have no ETag.
+func (b sftpBucket) List(ctx context.Context, prefix, delim, marker string, max int) (*listResp, error) {
+	if delim != "" && delim != "/" {
+		return nil, fmt.Errorf("%w: delimiter %q", errSFTPUnsupported, delim)
+	}
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	list := &listResp{
+		Name:      b.name,
+		Prefix:    prefix,
+		Delimiter: delim,
+		Marker:    marker,
+		MaxKeys:   max,
+	}
+	dir, _ := path.Split(prefix)
+	if delim == "" {
+		return list, b.walk(client, dir, list)
+	}
+	entries, err := b.readDir(client, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.name, prefix) || e.name <= marker {
+			continue
+		}
+		if len(list.Contents)+len(list.CommonPrefixes) == max {
+			list.IsTruncated = true
+			break
+		}
+		if e.info.IsDir() {
+			list.CommonPrefixes = append(list.CommonPrefixes, e.name)
+		} else {
+			list.Contents = append(list.Contents, e.key())
+		}
+		list.NextMarker = e.name
+	}
+	return list, nil
+}
+
+// walk lists the keys under a directory, depth first, which lists them by
+// order of name since directories are named with a trailing slash.
+func (b sftpBucket) walk(client *sftp.Client, dir string, list *listResp) error {
+	entries, err := b.readDir(client, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.info.IsDir() {
+			// skip the directories out of the prefix, or before the marker
+			inPrefix := strings.HasPrefix(e.name, list.Prefix) || strings.HasPrefix(list.Prefix, e.name)
+			if !inPrefix || (e.name < list.Marker && !strings.HasPrefix(list.Marker, e.name)) {
+				continue
+			}
+			if err := b.walk(client, e.name, list); err != nil || list.IsTruncated {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(e.name, list.Prefix) || e.name <= list.Marker {
+			continue
+		}
+		if len(list.Contents) == list.MaxKeys {
+			list.IsTruncated = true
+			return nil
+		}
+		list.Contents = append(list.Contents, e.key())
+		list.NextMarker = e.name
+	}
+	return nil
+}
+
+func (b sftpBucket) ListVersions(ctx context.Context, prefix, delim, keyMarker, versionMarker string, max int) (*listVersionsResp, error) {
+	return nil, errSFTPUnsupported
+}
+
+func (b sftpBucket) GetReader(ctx context.Context, key, version string) (io.ReadCloser, error) {
+	if version != "" {
+		return nil, errSFTPUnsupported
+	}
+	keyPath, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(keyPath)
+	if err != nil {
+		return nil, b.fail(client, err)
+	}
+	return f, nil
+}
+
+func (b sftpBucket) Head(ctx context.Context, key, version string) (http.Header, error) {
+	return nil, errSFTPUnsupported
+}
+
+func (b sftpBucket) Tags(ctx context.Context, key, version string) (map[string]string, error) {
+	return nil, errSFTPUnsupported
+}
+
+func (b sftpBucket) Retention(ctx context.Context, key, version string) (*retention, error) {
+	return nil, errSFTPUnsupported
+}
+
+// Lifecycle returns no rules, files have no lifecycle.
+func (b sftpBucket) Lifecycle(ctx context.Context) ([]lifecycleRule, error) { return nil, nil }
+
+// SignedURL returns an empty URL, files can't be shared without
+// credentials.
+func (b sftpBucket) SignedURL(key, version string, expires time.Time) string { return "" }
+
+// put writes a key, creating its directory if needed.
+func (b sftpBucket) put(key string, data []byte) error {
+	keyPath, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	client, err := b.client()
+	if err != nil {
+		return err
+	}
+	if err := client.MkdirAll(path.Dir(keyPath)); err != nil {
+		return b.fail(client, err)
+	}
+	f, err := client.Create(keyPath)
+	if err != nil {
+		return b.fail(client, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return b.fail(client, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultBurnRateAlerts are the windows over which the error budget of a
+// namespace is watched, when its SLO doesn't name any. The short window
+// catches sudden breakages, the long one slow leaks that would exhaust the
+// budget of a month in about five days.
+var DefaultBurnRateAlerts = []burnRateAlert{
+	{Window: "1h", BurnRate: 14.4},
+	{Window: "6h", BurnRate: 6},
+}
+
+// slo is the objective of a namespace, as the rate of its keys that must
+// match. Rather than on mismatches, the namespace is alerted on when its
+// error budget, the rate of keys allowed to mismatch, is burnt too fast.
+type slo struct {
+	Objective float64         `json:"objective"`
+	Alerts    []burnRateAlert `json:"alerts,omitempty"`
+}
+
+// burnRateAlert alerts when the rate of mismatches over a rolling window is
+// more than BurnRate times the error budget.
+type burnRateAlert struct {
+	Window   string  `json:"window"`
+	BurnRate float64 `json:"burn_rate"`
+
+	window time.Duration
+}
+
+func loadSLO(s *slo) error {
+	if s.Objective <= 0 || s.Objective >= 1 {
+		return fmt.Errorf("slo.objective must be between 0 and 1, exclusive")
+	}
+	if len(s.Alerts) == 0 {
+		s.Alerts = append([]burnRateAlert(nil), DefaultBurnRateAlerts...)
+	}
+	for i := range s.Alerts {
+		a := &s.Alerts[i]
+		window, err := time.ParseDuration(a.Window)
+		if err != nil {
+			return fmt.Errorf("slo.alerts[%d].window: %v", i, err)
+		}
+		if window <= 0 {
+			return fmt.Errorf("slo.alerts[%d].window must be positive", i)
+		}
+		if a.BurnRate <= 0 {
+			return fmt.Errorf("slo.alerts[%d].burn_rate must be positive", i)
+		}
+		a.window = window
+	}
+	return nil
+}
+
+// longestWindow is how far back the rounds of a namespace are remembered.
+func (s slo) longestWindow() time.Duration {
+	var longest time.Duration
+	for _, a := range s.Alerts {
+		if a.window > longest {
+			longest = a.window
+		}
+	}
+	return longest
+}
+
+// roundTally is what the error budget remembers of a round.
+type roundTally struct {
+	at         time.Time
+	keys       int
+	mismatches int
+}
+
+// errorBudget tallies the keys of a namespace verified in the rounds of the
+// longest window of its SLO.
+type errorBudget struct {
+	rounds []roundTally
+}
+
+// add tallies the outcomes of a round, forgetting the rounds that are out
+// of every window.
+func (b *errorBudget) add(s slo, at time.Time, counts map[outcome]int) {
+	tally := roundTally{at: at, mismatches: counts[outcomeMismatch]}
+	for o, n := range counts {
+		if o != outcomeInconclusive {
+			tally.keys += n
+		}
+	}
+	b.rounds = append(b.rounds, tally)
+
+	oldest := at.Add(-s.longestWindow())
+	kept := b.rounds[:0]
+	for _, t := range b.rounds {
+		if t.at.After(oldest) {
+			kept = append(kept, t)
+		}
+	}
+	b.rounds = kept
+}
+
+// burnRate is the rate of mismatches over the window ending now, relative
+// to the error budget. At 1 the budget is used up exactly at the end of the
+// period of the SLO.
+func (b *errorBudget) burnRate(s slo, now time.Time, window time.Duration) float64 {
+	var keys, mismatches int
+	oldest := now.Add(-window)
+	for _, t := range b.rounds {
+		if t.at.After(oldest) && !t.at.After(now) {
+			keys += t.keys
+			mismatches += t.mismatches
+		}
+	}
+	if keys == 0 {
+		return 0
+	}
+	return float64(mismatches) / float64(keys) / (1 - s.Objective)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// keyOverhead estimates the memory held by a key besides its strings: the
+// entry of a map, the struct and its string headers.
+const keyOverhead = 200
+
+// keySize estimates the memory held by a key.
+func keySize(k listedKey) int64 {
+	return int64(len(k.Key)+len(k.LastModified)+len(k.ETag)+len(k.StorageClass)+
+		len(k.Owner.ID)+len(k.Owner.DisplayName)) + keyOverhead
+}
+
+// olderKey tells if a listing of a key was modified before another one. The
+// modification times must be valid.
+func olderKey(a, b listedKey) bool {
+	at, _ := time.Parse(time.RFC3339Nano, a.LastModified)
+	bt, _ := time.Parse(time.RFC3339Nano, b.LastModified)
+	return at.Before(bt)
+}
+
+// listingSorter sorts the keys of a listing by name, keeping the last
+// modified listing of keys listed more than once. When the keys it holds
+// take more memory than its budget, they're spilled sorted to a temporary
+// file, and the spilled runs are merged once all keys are added.
+type listingSorter struct {
+	// budget is 0 if the keys are always held in memory.
+	budget int64
+	used   int64
+	latest map[string]listedKey
+	runs   []*os.File
+}
+
+func newListingSorter(budget int64) *listingSorter {
+	return &listingSorter{budget: budget, latest: make(map[string]listedKey)}
+}
+
+func (s *listingSorter) add(k listedKey) error {
+	if prev, ok := s.latest[k.Key]; ok {
+		if olderKey(k, prev) {
+			return nil
+		}
+		s.used -= keySize(prev)
+	}
+	s.latest[k.Key] = k
+	s.used += keySize(k)
+	if s.budget > 0 && s.used > s.budget {
+		return s.spill()
+	}
+	return nil
+}
+
+// sorted returns the keys held in memory, sorted.
+func (s *listingSorter) sorted() []listedKey {
+	keys := make([]listedKey, 0, len(s.latest))
+	for _, k := range s.latest {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	return keys
+}
+
+// spill writes the keys held in memory to a run, and forgets them.
+func (s *listingSorter) spill() error {
+	f, err := os.CreateTemp("", "jag-listing-run-*.json")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f)
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	for _, k := range s.sorted() {
+		if err := enc.Encode(k); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"keys": len(s.latest),
+		"run":  f.Name(),
+	}).Debug("spilled keys of listing to disk")
+	s.latest = make(map[string]listedKey)
+	s.used = 0
+	return nil
+}
+
+// each calls emit with every key once, sorted by name, and returns how many
+// keys there were.
+func (s *listingSorter) each(emit func(listedKey) error) (int, error) {
+	if len(s.runs) == 0 {
+		keys := s.sorted()
+		for _, k := range keys {
+			if err := emit(k); err != nil {
+				return 0, err
+			}
+		}
+		return len(keys), nil
+	}
+	if len(s.latest) > 0 {
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	var runs runHeap
+	for _, f := range s.runs {
+		r := &runCursor{dec: json.NewDecoder(bufio.NewReader(f))}
+		ok, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			runs = append(runs, r)
+		}
+	}
+	heap.Init(&runs)
+	count := 0
+	for len(runs) > 0 {
+		latest := runs[0].key
+		// the same key can be in many runs, keep its last modified listing
+		for len(runs) > 0 && runs[0].key.Key == latest.Key {
+			r := runs[0]
+			if olderKey(latest, r.key) {
+				latest = r.key
+			}
+			ok, err := r.next()
+			if err != nil {
+				return count, err
+			}
+			if ok {
+				heap.Fix(&runs, 0)
+			} else {
+				heap.Pop(&runs)
+			}
+		}
+		if err := emit(latest); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// close removes the runs spilled to disk.
+func (s *listingSorter) close() {
+	for _, f := range s.runs {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+	s.runs = nil
+}
+
+// runCursor is the next key of a run.
+type runCursor struct {
+	dec *json.Decoder
+	key listedKey
+}
+
+// next reads the next key of the run, if there's one.
+func (r *runCursor) next() (bool, error) {
+	r.key = listedKey{}
+	err := r.dec.Decode(&r.key)
+	if err == io.EOF {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// runHeap are runs, by their next key.
+type runHeap []*runCursor
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].key.Key < h[j].key.Key }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runCursor)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Files kept in the state directory.
+const (
+	modelFile      = "model.json"
+	checkpointFile = "checkpoint.json"
+	historyFile    = "history.jsonl"
+	// reverseModelFile is the model of the destination of bidirectional
+	// audits.
+	reverseModelFile = "reverse-model.json"
+	// resultsFile is the history of the verification of each key.
+	resultsFile = "results.jsonl"
+	// suppressionsFile is the log of suppressed mismatches.
+	suppressionsFile = "suppressions.jsonl"
+	// fixityFile is the record of the fixity of the keys of fixity audits.
+	fixityFile = "fixity.jsonl"
+	// fixityDir is the state directory of fixity audits, apart from the
+	// state of the audits of the same config.
+	fixityDir = "fixity"
+	// actionsFile is the log of the actions of operators.
+	actionsFile = "actions.jsonl"
+	// queueFile is the journal of the keys queued, see queueJournal. It
+	// isn't archived, the keys being verified soon after they're queued.
+	queueFile = "queue.jsonl"
+	// configFileName is only found in state archives.
+	configFileName = "config.json"
+)
+
+// archivedFiles are the files of the state directory found in state
+// archives, by their slash-separated path in the directory. The fixity
+// records are kept in the state of the fixity audit, see withFixity.
+var archivedFiles = []string{
+	modelFile, reverseModelFile, checkpointFile, historyFile, resultsFile, suppressionsFile, actionsFile,
+	path.Join(fixityDir, modelFile), path.Join(fixityDir, checkpointFile), path.Join(fixityDir, fixityFile),
+}
+
+// stateDir is where jag keeps what it needs to resume auditing after a
+// restart, and a history of the rounds it performed.
+type stateDir string
+
+// checkpoint is what a verifier needs to resume where it left.
+type checkpoint struct {
+	Rounds    int        `json:"rounds"`
+	LastRound time.Time  `json:"last_round"`
+	FollowUps []followUp `json:"follow_ups"`
+	// LastInventoryDiff is when the inventories of the buckets were last
+	// diffed, see inventoryDiffConfig.
+	LastInventoryDiff time.Time `json:"last_inventory_diff"`
+	// Flapping are the keys whose alerts are debounced, see
+	// flappingConfig.
+	Flapping []flapState `json:"flapping,omitempty"`
+	// Degradation is the level the audit is degraded to, see
+	// degradationConfig.
+	Degradation *degradationState `json:"degradation,omitempty"`
+}
+
+// roundSummary is what the history remembers of each round.
+type roundSummary struct {
+	ID       roundID         `json:"id"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Counts   map[outcome]int `json:"counts"`
+	// Namespaces are the outcomes of the namespaces audited in the round.
+	Namespaces map[string]namespaceCounts `json:"namespaces,omitempty"`
+	// WritesPerHour are the rates of change of the prefixes estimated in
+	// the round, see hotConfig.
+	WritesPerHour map[string]float64 `json:"writes_per_hour,omitempty"`
+}
+
+// keyRecord is what the history remembers of the verification of a key.
+type keyRecord struct {
+	Round   time.Time `json:"round"`
+	RoundID roundID   `json:"round_id"`
+	Result
+}
+
+func openStateDir(dir string) (stateDir, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return stateDir(dir), nil
+}
+
+func (s stateDir) path(name string) string { return filepath.Join(string(s), name) }
+
+// writeFile atomically replaces a file of the state.
+func (s stateDir) writeFile(name string, data []byte) error {
+	tmp := s.path(name + ".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(name))
+}
+
+// saveModel saves a model to a file of the state, modelFile or
+// reverseModelFile.
+func (s stateDir) saveModel(name string, model *bucketModel) error {
+	data, err := model.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return s.writeFile(name, data)
+}
+
+func (s stateDir) saveCheckpoint(cp *checkpoint) error {
+	data, err := json.MarshalIndent(cp, "", "   ")
+	if err != nil {
+		return err
+	}
+	return s.writeFile(checkpointFile, data)
+}
+
+// loadCheckpoint returns the last checkpoint, or an empty one if there's
+// none yet.
+func (s stateDir) loadCheckpoint() (*checkpoint, error) {
+	cp := &checkpoint{}
+	data, err := os.ReadFile(s.path(checkpointFile))
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cp, json.Unmarshal(data, cp)
+}
+
+func (s stateDir) appendHistory(report *RoundReport) error {
+	f, err := os.OpenFile(s.path(historyFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(roundSummary{
+		ID:            report.ID,
+		Started:       report.Started,
+		Finished:      report.Finished,
+		Counts:        report.Counts,
+		Namespaces:    report.Namespaces,
+		WritesPerHour: prefixWritesPerHour(report.ChangeRate),
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readHistory returns the summaries of all the rounds recorded so far.
+func (s stateDir) readHistory() ([]roundSummary, error) {
+	f, err := os.Open(s.path(historyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var history []roundSummary
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		var summary roundSummary
+		if err := json.Unmarshal(scan.Bytes(), &summary); err != nil {
+			return nil, fmt.Errorf("corrupted history: %v", err)
+		}
+		history = append(history, summary)
+	}
+	return history, scan.Err()
+}
+
+// appendResults records the result of each key verified in a round.
+func (s stateDir) appendResults(report *RoundReport) error {
+	f, err := os.OpenFile(s.path(resultsFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, res := range report.Results {
+		if err = enc.Encode(keyRecord{Round: report.Started, RoundID: report.ID, Result: res}); err != nil {
+			break
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readResults returns the results of all the keys verified so far, oldest
+// first.
+func (s stateDir) readResults() ([]keyRecord, error) {
+	f, err := os.Open(s.path(resultsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var records []keyRecord
+	scan := bufio.NewScanner(f)
+	scan.Buffer(nil, 1<<20)
+	for scan.Scan() {
+		var rec keyRecord
+		if err := json.Unmarshal(scan.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("corrupted results history: %v", err)
+		}
+		records = append(records, rec)
+	}
+	return records, scan.Err()
+}
+
+// appendFixity records the fixity of a key.
+func (s stateDir) appendFixity(rec fixityRecord) error {
+	f, err := os.OpenFile(s.path(fixityFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(rec)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readFixity returns the records of the fixity of keys, oldest first.
+func (s stateDir) readFixity() ([]fixityRecord, error) {
+	f, err := os.Open(s.path(fixityFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var records []fixityRecord
+	scan := bufio.NewScanner(f)
+	scan.Buffer(nil, 1<<20)
+	for scan.Scan() {
+		var rec fixityRecord
+		if err := json.Unmarshal(scan.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("corrupted fixity records: %v", err)
+		}
+		records = append(records, rec)
+	}
+	return records, scan.Err()
+}
+
+// exportState writes a gzip'd tar archive containing the config and the
+// content of the state directory.
+func exportState(w io.Writer, cfg *config, s stateDir) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	addFile := func(name string, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+
+	data, err := cfg.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := addFile(configFileName, data); err != nil {
+		return err
+	}
+	for _, name := range archivedFiles {
+		data, err := os.ReadFile(s.path(name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := addFile(name, data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// readStateArchive reads an archive made by exportState, returning the
+// content of the files it contains by name.
+func readStateArchive(r io.Reader) (map[string][]byte, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != configFileName && !isArchivedFile(hdr.Name) {
+			return nil, fmt.Errorf("unexpected file %q in state archive", hdr.Name)
+		}
+		if files[hdr.Name], err = io.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isArchivedFile tells if a file of the state directory is found in state
+// archives.
+func isArchivedFile(name string) bool {
+	for _, archived := range archivedFiles {
+		if name == archived {
+			return true
+		}
+	}
+	return false
+}
+
+// restore writes the files of a state archive in the state directory.
+func (s stateDir) restore(files map[string][]byte) error {
+	for _, name := range archivedFiles {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(s.path(name)), 0755); err != nil {
+			return err
+		}
+		if err := s.writeFile(name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateArchiveRoundTrip(t *testing.T) {
+	files := map[string]string{
+		modelFile:                                `{"key_count":3}`,
+		checkpointFile:                           `{"round":2}`,
+		historyFile:                              "{\"id\":\"a\"}\n{\"id\":\"b\"}\n",
+		filepath.Join(fixityDir, modelFile):      `{"key_count":1}`,
+		filepath.Join(fixityDir, checkpointFile): `{"round":7}`,
+		filepath.Join(fixityDir, fixityFile):     "{\"key\":\"k\"}\n",
+		filepath.Join(fixityDir, historyFile):    "{\"id\":\"c\"}\n",
+	}
+	src := stateDir(t.TempDir())
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Dir(src.path(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(src.path(name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := exportState(&archive, &config{StateDir: string(src)}, src); err != nil {
+		t.Fatalf("can't export state: %v", err)
+	}
+	archived, err := readStateArchive(&archive)
+	if err != nil {
+		t.Fatalf("can't read state archive: %v", err)
+	}
+	if _, ok := archived[configFileName]; !ok {
+		t.Errorf("archive has no config")
+	}
+	dst := stateDir(t.TempDir())
+	if err := dst.restore(archived); err != nil {
+		t.Fatalf("can't restore state: %v", err)
+	}
+
+	for name, want := range files {
+		got, err := os.ReadFile(dst.path(name))
+		switch {
+		case !isArchivedFile(filepath.ToSlash(name)):
+			if err == nil {
+				t.Errorf("%s: restored, but isn't part of the state", name)
+			}
+		case err != nil:
+			t.Errorf("%s: not restored: %v", name, err)
+		case string(got) != want:
+			t.Errorf("%s: restored %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StatusPath is where the status of the audit is served as JSON, on the HTTP
+// endpoint of the audit command.
+const StatusPath = "/status"
+
+// auditStatus is what the audit is and how its last round went.
+type auditStatus struct {
+	Build   buildInfo         `json:"build"`
+	Audit   string            `json:"audit,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Started time.Time         `json:"started"`
+	// LastRound is nil until a round completes.
+	LastRound *roundStatus `json:"last_round,omitempty"`
+	// Endpoints are the health of the endpoints of the source and of the
+	// destination, telling which side fails.
+	Endpoints []endpointStatus `json:"endpoints,omitempty"`
+}
+
+type roundStatus struct {
+	ID       roundID         `json:"id"`
+	Finished time.Time       `json:"finished"`
+	Counts   map[outcome]int `json:"counts"`
+	// Degradation is the level of the checks of the round, and of the
+	// next one if it changes.
+	Degradation *degradationReport `json:"degradation,omitempty"`
+}
+
+// statusValues is the status of the audit served on the endpoint.
+var statusValues struct {
+	mu     sync.Mutex
+	status auditStatus
+}
+
+func init() {
+	http.HandleFunc(StatusPath, serveStatus)
+}
+
+// observeAudit sets the status and the build info metric of the audit, as
+// it starts.
+func observeAudit(cfg *config) {
+	statusValues.mu.Lock()
+	statusValues.status = auditStatus{
+		Build:   build,
+		Audit:   cfg.AuditName,
+		Labels:  cfg.Labels,
+		Started: time.Now().UTC(),
+	}
+	statusValues.mu.Unlock()
+	observeBuild(cfg)
+}
+
+// observeLastRound sets the last round of the status.
+func observeLastRound(r *RoundReport) {
+	statusValues.mu.Lock()
+	defer statusValues.mu.Unlock()
+	counts := make(map[outcome]int, len(r.Counts))
+	for o, n := range r.Counts {
+		counts[o] = n
+	}
+	statusValues.status.LastRound = &roundStatus{
+		ID:       r.ID,
+		Finished: r.Finished,
+		Counts:   counts,
+	}
+	if r.Degradation != nil {
+		d := *r.Degradation
+		statusValues.status.LastRound.Degradation = &d
+	}
+}
+
+// serveStatus serves the status of the audit.
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	statusValues.mu.Lock()
+	status := statusValues.status
+	statusValues.mu.Unlock()
+	status.Endpoints = endpointStatuses()
+	data, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(data, '\n'))
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// suppression is an operator's acknowledgement of a mismatch, which stops it
+// from being alerted on until it expires. Suppressions are recorded in an
+// append-only log in the state directory, so that the log doubles as an
+// audit trail of who suppressed what, and why.
+type suppression struct {
+	Key string `json:"key"`
+	// Check is the check whose mismatches are suppressed, or all of them if
+	// empty.
+	Check  string    `json:"check,omitempty"`
+	At     time.Time `json:"at"`
+	Until  time.Time `json:"until"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason"`
+}
+
+// suppressions are the entries of the suppression log, oldest first.
+type suppressions []suppression
+
+func (s stateDir) appendSuppression(sup suppression) error {
+	f, err := os.OpenFile(s.path(suppressionsFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(sup)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readSuppressions returns all the entries of the suppression log.
+func (s stateDir) readSuppressions() (suppressions, error) {
+	f, err := os.Open(s.path(suppressionsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var sups suppressions
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		var sup suppression
+		if err := json.Unmarshal(scan.Bytes(), &sup); err != nil {
+			return nil, fmt.Errorf("corrupted suppression log: %v", err)
+		}
+		sups = append(sups, sup)
+	}
+	return sups, scan.Err()
+}
+
+// find returns the suppression in effect for the mismatch of a check on a
+// key, if any. The latest entry for a key and check wins, which is how
+// suppressions are lifted before they expire.
+func (sups suppressions) find(key, check string, now time.Time) (suppression, bool) {
+	for i := len(sups) - 1; i >= 0; i-- {
+		sup := sups[i]
+		if sup.Key != key || (sup.Check != "" && sup.Check != check) {
+			continue
+		}
+		return sup, now.Before(sup.Until)
+	}
+	return suppression{}, false
+}
+
+// active returns the suppressions in effect.
+func (sups suppressions) active(now time.Time) suppressions {
+	var active suppressions
+	for i, sup := range sups {
+		if latest, ok := sups[i:].find(sup.Key, sup.Check, now); ok && latest == sup {
+			active = append(active, sup)
+		}
+	}
+	return active
+}
+
+func suppressCommand() cli.Command {
+	return cli.Command{
+		Name:  "suppress",
+		Usage: "Acknowledges mismatches so they stop being alerted on.",
+		Subcommands: []cli.Command{
+			suppressAddCommand(),
+			suppressLiftCommand(),
+			suppressListCommand(),
+		},
+	}
+}
+
+var (
+	suppressCfgFlag = cli.StringFlag{
+		Name:  "cfg",
+		Usage: "path to the JSON config file",
+	}
+	suppressKeyFlag = cli.StringFlag{
+		Name:  "key",
+		Usage: "key whose mismatches are acknowledged",
+	}
+	suppressCheckFlag = cli.StringFlag{
+		Name:  "check",
+		Usage: "check whose mismatches are acknowledged, all of them by default",
+	}
+	suppressByFlag = cli.StringFlag{
+		Name:  "by",
+		Usage: "who acknowledges the mismatches, the current user by default",
+		Value: currentUser(),
+	}
+	suppressReasonFlag = cli.StringFlag{
+		Name:  "reason",
+		Usage: "why the mismatches are acknowledged, e.g. an incident number",
+	}
+)
+
+// mustSuppressionState opens the state directory of the audit whose
+// suppressions are managed.
+func mustSuppressionState(ctx *cli.Context) stateDir {
+	cfg := mustConfig(ctx, suppressCfgFlag)
+	if cfg.StateDir == "" {
+		fail(ctx, "error: config doesn't have a state_dir, suppressions can't be recorded")
+	}
+	state, err := openStateDir(cfg.StateDir)
+	if err != nil {
+		fail(ctx, "error: can't open state directory %q: %v", cfg.StateDir, err)
+	}
+	return state
+}
+
+// mustRecordSuppression validates and records an entry in the suppression
+// log.
+func mustRecordSuppression(ctx *cli.Context, ttl time.Duration) suppression {
+	state := mustSuppressionState(ctx)
+	now := time.Now().UTC()
+	sup := suppression{
+		Key:    mustString(ctx, suppressKeyFlag),
+		Check:  ctx.String(suppressCheckFlag.Name),
+		At:     now,
+		Until:  now.Add(ttl),
+		By:     mustString(ctx, suppressByFlag),
+		Reason: mustString(ctx, suppressReasonFlag),
+	}
+	if _, ok := checksByName[sup.Check]; sup.Check != "" && !ok {
+		fail(ctx, "error: unknown check %q, valid checks are %s", sup.Check, checkNames())
+	}
+	if err := state.appendSuppression(sup); err != nil {
+		fail(ctx, "error: can't record suppression: %v", err)
+	}
+	action := operatorAction{
+		At:     now,
+		By:     sup.By,
+		Action: "suppress",
+		Details: log.Fields{
+			"key":    sup.Key,
+			"check":  sup.Check,
+			"until":  sup.Until,
+			"reason": sup.Reason,
+		},
+	}
+	if ttl == 0 {
+		action.Action = "lift_suppression"
+		delete(action.Details, "until")
+	}
+	if err := recordAction(state, action); err != nil {
+		fail(ctx, "error: can't record action: %v", err)
+	}
+	return sup
+}
+
+func suppressAddCommand() cli.Command {
+	ttlFlag := cli.DurationFlag{
+		Name:  "ttl",
+		Usage: "how long the mismatches aren't alerted on",
+		Value: 24 * time.Hour,
+	}
+
+	doAdd := func(ctx *cli.Context) {
+		ttl := ctx.Duration(ttlFlag.Name)
+		if ttl <= 0 {
+			fail(ctx, "error: flag %q must be positive", ttlFlag.Name)
+		}
+		sup := mustRecordSuppression(ctx, ttl)
+		log.WithFields(log.Fields{
+			"key":   sup.Key,
+			"check": sup.Check,
+			"until": sup.Until,
+		}).Info("mismatches suppressed")
+	}
+
+	return cli.Command{
+		Name:  "add",
+		Usage: "Stops alerting on the mismatches of a key for some time.",
+		Flags: []cli.Flag{
+			suppressCfgFlag, suppressKeyFlag, suppressCheckFlag, ttlFlag,
+			suppressByFlag, suppressReasonFlag,
+		},
+		Action: doAdd,
+	}
+}
+
+func suppressLiftCommand() cli.Command {
+	doLift := func(ctx *cli.Context) {
+		sup := mustRecordSuppression(ctx, 0)
+		log.WithFields(log.Fields{
+			"key":   sup.Key,
+			"check": sup.Check,
+		}).Info("suppression lifted")
+	}
+
+	return cli.Command{
+		Name:  "lift",
+		Usage: "Alerts on the mismatches of a key again.",
+		Flags: []cli.Flag{
+			suppressCfgFlag, suppressKeyFlag, suppressCheckFlag,
+			suppressByFlag, suppressReasonFlag,
+		},
+		Action: doLift,
+	}
+}
+
+func suppressListCommand() cli.Command {
+	allFlag := cli.BoolFlag{
+		Name:  "all",
+		Usage: "list the whole audit trail, not only the suppressions in effect",
+	}
+
+	doList := func(ctx *cli.Context) {
+		state := mustSuppressionState(ctx)
+		sups, err := state.readSuppressions()
+		if err != nil {
+			fail(ctx, "error: can't read suppressions: %v", err)
+		}
+		if !ctx.Bool(allFlag.Name) {
+			sups = sups.active(time.Now())
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tCHECK\tAT\tUNTIL\tBY\tREASON")
+		for _, sup := range sups {
+			check := sup.Check
+			if check == "" {
+				check = "*"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				sup.Key, check, sup.At.Format(time.RFC3339), sup.Until.Format(time.RFC3339),
+				sup.By, strings.ReplaceAll(sup.Reason, "\t", " "))
+		}
+		_ = tw.Flush()
+	}
+
+	return cli.Command{
+		Name:   "list",
+		Usage:  "Lists the suppressed mismatches.",
+		Flags:  []cli.Flag{suppressCfgFlag, allFlag},
+		Action: doList,
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// swiftUnsupportedChecks are the checks that can't verify keys in Swift
+// containers, which have no versions, tags nor retention.
+var swiftUnsupportedChecks = map[string]bool{
+	"versions":  true,
+	"tags":      true,
+	"retention": true,
+}
+
+// errSwiftUnsupported is returned when asking Swift for what it doesn't
+// have.
+var errSwiftUnsupported = errors.New("not supported by Swift")
+
+// swiftConfig is set on a bucket that is a container of OpenStack Swift. The
+// access key and the secret key of the bucket are the user and the password,
+// and the region of the bucket selects the endpoint in the catalog of
+// Keystone, if set.
+type swiftConfig struct {
+	AuthURL string `json:"auth_url"`
+	// AuthVersion is 3 for Keystone, or 1 for TempAuth.
+	AuthVersion int    `json:"auth_version,omitempty"`
+	Domain      string `json:"domain,omitempty"`
+	Project     string `json:"project,omitempty"`
+	// TempURLKey is the key signing the temporary URLs given to hooks.
+	TempURLKey string `json:"temp_url_key,omitempty"`
+}
+
+func loadSwift(c *config, a awsConfig) error {
+	s := a.Swift
+	if s.AuthURL == "" {
+		return fmt.Errorf("auth_url is required")
+	}
+	if s.AuthVersion == 0 {
+		s.AuthVersion = 3
+	}
+	switch {
+	case s.AuthVersion != 1 && s.AuthVersion != 3:
+		return fmt.Errorf("auth_version must be 1 or 3")
+	case s.AuthVersion == 3 && s.Project == "":
+		return fmt.Errorf("project is required by Keystone")
+	case len(a.Fallbacks) != 0 || a.DualStack || a.FIPS:
+		return fmt.Errorf("fallbacks, dual_stack and fips only apply to S3")
+	case c.SampleVersions || c.DeleteMarkers.Count != 0:
+		return fmt.Errorf("containers have no versions to sample")
+	}
+	for _, name := range c.Checks {
+		if swiftUnsupportedChecks[name] {
+			return fmt.Errorf("check %q can't verify keys in a container", name)
+		}
+	}
+	return nil
+}
+
+// swiftBucket is a container of OpenStack Swift. Large objects are stored
+// as manifests of segments, see resolveSegments.
+type swiftBucket struct {
+	container string
+	user      string
+	password  string
+	region    string
+	cfg       swiftConfig
+	// session is shared by the copies of the bucket.
+	session *swiftSession
+}
+
+// swiftSession is the token of the user, and the URL of its account.
+type swiftSession struct {
+	mu         sync.Mutex
+	token      string
+	storageURL string
+}
+
+func newSwiftBucket(a awsConfig) swiftBucket {
+	return swiftBucket{
+		container: a.Bucket,
+		user:      a.AccessKey,
+		password:  a.SecretKey,
+		region:    a.Region,
+		cfg:       *a.Swift,
+		session:   &swiftSession{},
+	}
+}
+
+// authenticate gets a new token, replacing the token that was rejected if
+// any.
+func (b swiftBucket) authenticate(rejected string) (token, storageURL string, err error) {
+	b.session.mu.Lock()
+	defer b.session.mu.Unlock()
+	if b.session.token != "" && b.session.token != rejected {
+		return b.session.token, b.session.storageURL, nil
+	}
+	if b.cfg.AuthVersion == 1 {
+		token, storageURL, err = b.authenticateV1()
+	} else {
+		token, storageURL, err = b.authenticateV3()
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("can't authenticate to Swift at %q: %w", b.cfg.AuthURL, err)
+	}
+	b.session.token, b.session.storageURL = token, storageURL
+	return token, storageURL, nil
+}
+
+func (b swiftBucket) authenticateV1() (string, string, error) {
+	req, err := http.NewRequest("GET", b.cfg.AuthURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("X-Auth-User", b.user)
+	req.Header.Set("X-Auth-Key", b.password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= 300 {
+		return "", "", swiftError(req, resp)
+	}
+	return resp.Header.Get("X-Auth-Token"), resp.Header.Get("X-Storage-Url"), nil
+}
+
+func (b swiftBucket) authenticateV3() (string, string, error) {
+	type name struct {
+		Name string `json:"name"`
+	}
+	var body struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string `json:"methods"`
+				Password struct {
+					User struct {
+						Name     string `json:"name"`
+						Domain   name   `json:"domain"`
+						Password string `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+			Scope struct {
+				Project struct {
+					Name   string `json:"name"`
+					Domain name   `json:"domain"`
+				} `json:"project"`
+			} `json:"scope"`
+		} `json:"auth"`
+	}
+	domain := b.cfg.Domain
+	if domain == "" {
+		domain = "Default"
+	}
+	id := &body.Auth.Identity
+	id.Methods = []string{"password"}
+	id.Password.User.Name = b.user
+	id.Password.User.Domain.Name = domain
+	id.Password.User.Password = b.password
+	body.Auth.Scope.Project.Name = b.cfg.Project
+	body.Auth.Scope.Project.Domain.Name = domain
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", "", err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(b.cfg.AuthURL, "/")+"/auth/tokens", bytes.NewReader(data))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= 300 {
+		return "", "", swiftError(req, resp)
+	}
+	var token struct {
+		Token struct {
+			Catalog []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Interface string `json:"interface"`
+					Region    string `json:"region"`
+					URL       string `json:"url"`
+				} `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", "", fmt.Errorf("invalid token: %v", err)
+	}
+	for _, service := range token.Token.Catalog {
+		if service.Type != "object-store" {
+			continue
+		}
+		for _, ep := range service.Endpoints {
+			if ep.Interface == "public" && (b.region == "" || ep.Region == b.region) {
+				return resp.Header.Get("X-Subject-Token"), ep.URL, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("no public object-store endpoint in region %q in the catalog", b.region)
+}
+
+// objectURL returns the URL of a key, or of the container if the key is
+// empty.
+func (b swiftBucket) objectURL(storageURL, key string, params url.Values) (*url.URL, error) {
+	u, err := url.Parse(storageURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage URL %q: %v", storageURL, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.container
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = ""
+	u.RawQuery = params.Encode()
+	return u, nil
+}
+
+// do performs an authenticated request on a key, or on the container if the
+// key is empty, authenticating again if the token expired. Unsuccessful
+// responses are returned as errors.
+func (b swiftBucket) do(ctx context.Context, method, key string, params url.Values, data []byte) (*http.Response, error) {
+	var rejected string
+	for {
+		token, storageURL, err := b.authenticate(rejected)
+		if err != nil {
+			return nil, err
+		}
+		u, err := b.objectURL(storageURL, key, params)
+		if err != nil {
+			return nil, err
+		}
+		var body io.Reader
+		if data != nil {
+			body = bytes.NewReader(data)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Auth-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && rejected == "" {
+			_ = resp.Body.Close()
+			rejected = token
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			defer func() { _ = resp.Body.Close() }()
+			return nil, swiftError(req, resp)
+		}
+		return resp, nil
+	}
+}
+
+// swiftError wraps the error of an unsuccessful response into the kind of
+// error it represents.
+func swiftError(req *http.Request, resp *http.Response) error {
+	err := fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	if msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512)); len(bytes.TrimSpace(msg)) != 0 {
+		err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(msg))
+	}
+	if id := resp.Header.Get("X-Trans-Id"); id != "" {
+		err = fmt.Errorf("%w (transaction %s)", err, id)
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == 498:
+		return fmt.Errorf("%w: %w", ErrThrottled, err)
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %w", ErrKeyMissing, err)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
+
+// swiftEntry is a key, or a prefix if Subdir is set, in the listing of a
+// container.
+type swiftEntry struct {
+	Name         string `json:"name"`
+	Hash         string `json:"hash"`
+	Bytes        int64  `json:"bytes"`
+	ContentType  string `json:"content_type"`
+	LastModified string `json:"last_modified"`
+	Subdir       string `json:"subdir"`
+}
+
+// swiftTime is the format of times in listings, in UTC.
+const swiftTime = "2006-01-02T15:04:05.999999"
+
+func (e swiftEntry) key() (listedKey, error) {
+	modtime, err := time.Parse(swiftTime, e.LastModified)
+	if err != nil {
+		return listedKey{}, fmt.Errorf("key %q: invalid last modification time: %v", e.Name, err)
+	}
+	k := listedKey{
+		Key:          e.Name,
+		LastModified: modtime.UTC().Format(time.RFC3339Nano),
+		Size:         e.Bytes,
+		ETag:         `"` + e.Hash + `"`,
+	}
+	// older versions of Swift list the manifests of static large objects
+	// with the size of the whole key in their content type
+	if _, params, err := mime.ParseMediaType(e.ContentType); err == nil && params["swift_bytes"] != "" {
+		if k.Size, err = strconv.ParseInt(params["swift_bytes"], 10, 64); err != nil {
+			return listedKey{}, fmt.Errorf("key %q: invalid size %q", e.Name, params["swift_bytes"])
+		}
+	}
+	return k, nil
+}
+
+func (b swiftBucket) Name() string { return b.container }
+
+// List has the semantics of S3's, but for IsTruncated which is set whenever
+// the listing is full.
+func (b swiftBucket) List(ctx context.Context, prefix, delim, marker string, max int) (*listResp, error) {
+	params := url.Values{}
+	params.Set("format", "json")
+	params.Set("prefix", prefix)
+	if delim != "" {
+		params.Set("delimiter", delim)
+	}
+	if marker != "" {
+		params.Set("marker", marker)
+	}
+	params.Set("limit", strconv.Itoa(max))
+	resp, err := b.do(ctx, "GET", "", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var entries []swiftEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("invalid listing of container %q: %v", b.container, err)
+	}
+
+	list := &listResp{
+		Name:        b.container,
+		Prefix:      prefix,
+		Delimiter:   delim,
+		Marker:      marker,
+		MaxKeys:     max,
+		IsTruncated: len(entries) == max,
+	}
+	for _, e := range entries {
+		if e.Subdir != "" {
+			list.CommonPrefixes = append(list.CommonPrefixes, e.Subdir)
+			list.NextMarker = e.Subdir
+			continue
+		}
+		k, err := e.key()
+		if err != nil {
+			return nil, err
+		}
+		list.Contents = append(list.Contents, k)
+		list.NextMarker = e.Name
+	}
+	return list, nil
+}
+
+func (b swiftBucket) ListVersions(ctx context.Context, prefix, delim, keyMarker, versionMarker string, max int) (*listVersionsResp, error) {
+	return nil, errSwiftUnsupported
+}
+
+func (b swiftBucket) GetReader(ctx context.Context, key, version string) (io.ReadCloser, error) {
+	if version != "" {
+		return nil, errSwiftUnsupported
+	}
+	resp, err := b.do(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Head returns the metadata of a key named as S3 names it, so that it can be
+// compared with the metadata of keys in S3.
+func (b swiftBucket) Head(ctx context.Context, key, version string) (http.Header, error) {
+	if version != "" {
+		return nil, errSwiftUnsupported
+	}
+	resp, err := b.do(ctx, "HEAD", key, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("HEAD on key %q in container %q: %w", key, b.container, err)
+	}
+	_ = resp.Body.Close()
+	meta := http.Header{}
+	for name := range resp.Header {
+		if name == "Content-Type" {
+			meta.Set(name, resp.Header.Get(name))
+		}
+		if suffix, ok := strings.CutPrefix(name, "X-Object-Meta-"); ok {
+			meta.Set("X-Amz-Meta-"+suffix, resp.Header.Get(name))
+		}
+	}
+	return meta, nil
+}
+
+func (b swiftBucket) Tags(ctx context.Context, key, version string) (map[string]string, error) {
+	return nil, errSwiftUnsupported
+}
+
+func (b swiftBucket) Retention(ctx context.Context, key, version string) (*retention, error) {
+	return nil, errSwiftUnsupported
+}
+
+// Lifecycle returns no rules, containers have no lifecycle configuration.
+func (b swiftBucket) Lifecycle(ctx context.Context) ([]lifecycleRule, error) { return nil, nil }
+
+// SignedURL returns a temporary URL of the key, or an empty URL if the
+// config has no key to sign it.
+func (b swiftBucket) SignedURL(key, version string, expires time.Time) string {
+	if b.cfg.TempURLKey == "" || version != "" {
+		return ""
+	}
+	_, storageURL, err := b.authenticate("")
+	if err != nil {
+		return ""
+	}
+	u, err := b.objectURL(storageURL, key, nil)
+	if err != nil {
+		return ""
+	}
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha1.New, []byte(b.cfg.TempURLKey))
+	_, _ = mac.Write([]byte("GET\n" + exp + "\n" + u.Path))
+	u.RawQuery = url.Values{
+		"temp_url_sig":     {hex.EncodeToString(mac.Sum(nil))},
+		"temp_url_expires": {exp},
+	}.Encode()
+	return u.String()
+}
+
+// put writes a key.
+func (b swiftBucket) put(key string, data []byte) error {
+	resp, err := b.do(context.Background(), "PUT", key, nil, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// resolveSegments tells if a key is a dynamic or a static large object, and
+// returns it with the size and the ETag of the whole key, which listings
+// don't always tell.
+func (b swiftBucket) resolveSegments(ctx context.Context, o object) (object, bool, error) {
+	resp, err := b.do(ctx, "HEAD", o.Key, nil, nil)
+	if err != nil {
+		return o, false, fmt.Errorf("HEAD on key %q in container %q: %w", o.Key, b.container, err)
+	}
+	_ = resp.Body.Close()
+	if resp.Header.Get("X-Object-Manifest") == "" && !strings.EqualFold(resp.Header.Get("X-Static-Large-Object"), "true") {
+		return o, false, nil
+	}
+	if o.Size, err = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err != nil {
+		return o, true, fmt.Errorf("key %q: invalid size: %v", o.Key, err)
+	}
+	o.ETag = resp.Header.Get("ETag")
+	if !strings.HasPrefix(o.ETag, `"`) {
+		o.ETag = `"` + o.ETag + `"`
+	}
+	return o, true, nil
+}
+
+// checksumOf returns the MD5 of the content of a key, which is its ETag
+// unless it is stored as segments, or an empty checksum otherwise.
+func (b swiftBucket) checksumOf(ctx context.Context, o object, algorithm string) (string, error) {
+	if algorithm != "md5" {
+		return "", nil
+	}
+	resp, err := b.do(ctx, "HEAD", o.Key, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("HEAD on key %q in container %q: %w", o.Key, b.container, err)
+	}
+	_ = resp.Body.Close()
+	if resp.Header.Get("X-Object-Manifest") != "" || strings.EqualFold(resp.Header.Get("X-Static-Large-Object"), "true") {
+		return "", nil
+	}
+	return strings.ToLower(strings.Trim(resp.Header.Get("ETag"), `"`)), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncsPath is where syncers, such as brigade, announce the prefixes they're
+// syncing on the HTTP endpoint of the audit command.
+const SyncsPath = "/debug/syncs"
+
+// MaxSyncWindow is the longest a sync window can last, so that a syncer
+// that dies doesn't stop the audit of a prefix for good.
+const MaxSyncWindow = 7 * 24 * time.Hour
+
+// syncWindow is a prefix a syncer copies until a time, such as during a
+// backfill. Until then, its keys are bound to mismatch: they aren't sampled,
+// and the mismatches of its keys verified anyway, such as follow-ups, are
+// pending instead of alerted on.
+type syncWindow struct {
+	Prefix string    `json:"prefix"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+	// By is the principal of the request that opened the window.
+	By string `json:"by"`
+}
+
+// syncWindows are the windows opened through the endpoint, by prefix.
+var syncWindows struct {
+	mu      sync.Mutex
+	windows map[string]syncWindow
+}
+
+func init() {
+	http.HandleFunc(SyncsPath, serveSyncs)
+}
+
+// activeSyncWindows returns the windows open at a time, by prefix, and
+// forgets those that closed.
+func activeSyncWindows(now time.Time) []syncWindow {
+	syncWindows.mu.Lock()
+	defer syncWindows.mu.Unlock()
+	active := make([]syncWindow, 0, len(syncWindows.windows))
+	for prefix, w := range syncWindows.windows {
+		if !now.Before(w.Until) {
+			delete(syncWindows.windows, prefix)
+			continue
+		}
+		active = append(active, w)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Prefix < active[j].Prefix })
+	return active
+}
+
+// syncWindowOf returns the window open at a time whose prefix a key is
+// under, if any.
+func syncWindowOf(key string, now time.Time) (syncWindow, bool) {
+	syncWindows.mu.Lock()
+	defer syncWindows.mu.Unlock()
+	for _, w := range syncWindows.windows {
+		if strings.HasPrefix(key, w.Prefix) && now.Before(w.Until) {
+			return w, true
+		}
+	}
+	return syncWindow{}, false
+}
+
+// serveSyncs returns the open sync windows as a JSON array. A window is
+// opened, or extended, on POST given an object like
+// {"prefix": "photos/", "until": "2006-01-02T15:04:05Z", "reason": "backfill"},
+// and closed on DELETE with the prefix as query parameter, as in
+// /debug/syncs?prefix=photos/.
+func serveSyncs(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req syncWindow
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid sync window: %v", err), http.StatusBadRequest)
+			return
+		}
+		if !req.Until.After(now) {
+			http.Error(w, "invalid sync window: until must be in the future", http.StatusBadRequest)
+			return
+		}
+		if req.Until.Sub(now) > MaxSyncWindow {
+			http.Error(w, fmt.Sprintf("invalid sync window: can't last longer than %v", MaxSyncWindow), http.StatusBadRequest)
+			return
+		}
+		req.Until, req.By = req.Until.UTC(), requestPrincipal(r)
+		syncWindows.mu.Lock()
+		if syncWindows.windows == nil {
+			syncWindows.windows = make(map[string]syncWindow)
+		}
+		syncWindows.windows[req.Prefix] = req
+		syncWindows.mu.Unlock()
+		recordRequestAction(r, "sync_window", log.Fields{
+			"prefix": req.Prefix,
+			"until":  req.Until,
+			"reason": req.Reason,
+		})
+	case http.MethodDelete:
+		prefix := r.URL.Query().Get("prefix")
+		syncWindows.mu.Lock()
+		_, ok := syncWindows.windows[prefix]
+		delete(syncWindows.windows, prefix)
+		syncWindows.mu.Unlock()
+		if !ok {
+			http.Error(w, fmt.Sprintf("no sync window of prefix %q", prefix), http.StatusNotFound)
+			return
+		}
+		recordRequestAction(r, "sync_window_closed", log.Fields{"prefix": prefix})
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(activeSyncWindows(now))
+}
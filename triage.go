@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// openMismatch is a key whose latest verification was a mismatch.
+type openMismatch struct {
+	last keyRecord
+	// since is when the key was first found mismatching in a row.
+	since time.Time
+}
+
+// openMismatches returns the keys whose latest verification was a mismatch,
+// by order of last verification.
+func openMismatches(records []keyRecord) []openMismatch {
+	byKey := make(map[string]*openMismatch)
+	for _, rec := range records {
+		switch rec.Outcome {
+		case outcomeMismatch, outcomeSuppressed, outcomePending:
+		case outcomeInconclusive:
+			// says nothing about whether the mismatch was fixed
+			continue
+		default:
+			delete(byKey, rec.Key)
+			continue
+		}
+		om, ok := byKey[rec.Key]
+		if !ok {
+			om = &openMismatch{since: rec.Round}
+			byKey[rec.Key] = om
+		}
+		om.last = rec
+	}
+	open := make([]openMismatch, 0, len(byKey))
+	for _, om := range byKey {
+		open = append(open, *om)
+	}
+	sort.Slice(open, func(i, j int) bool {
+		if !open[i].last.Round.Equal(open[j].last.Round) {
+			return open[i].last.Round.Before(open[j].last.Round)
+		}
+		return open[i].last.Key < open[j].last.Key
+	})
+	return open
+}
+
+func mismatchesCommand() cli.Command {
+	keyFlag := cli.StringFlag{
+		Name:  "key",
+		Usage: "show the audit history of this key instead",
+	}
+
+	doMismatches := func(ctx *cli.Context) {
+		state := mustSuppressionState(ctx)
+		records, err := state.readResults()
+		if err != nil {
+			fail(ctx, "error: can't read results history: %v", err)
+		}
+		sups, err := state.readSuppressions()
+		if err != nil {
+			fail(ctx, "error: can't read suppressions: %v", err)
+		}
+		now := time.Now()
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		defer func() { _ = tw.Flush() }()
+
+		if key := ctx.String(keyFlag.Name); key != "" {
+			fmt.Fprintln(tw, "ROUND\tOUTCOME\tCHECK\tDETAILS")
+			for _, rec := range records {
+				if rec.Key != key {
+					continue
+				}
+				details := fmt.Sprint(rec.Details)
+				if rec.Error != "" {
+					details = rec.Error
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", rec.RoundID, rec.Outcome, rec.Check, details)
+			}
+			for _, sup := range sups {
+				if sup.Key == key {
+					fmt.Fprintf(tw, "%s\t%s\t%s\tby %s until %s: %s\n",
+						sup.At.Format(time.RFC3339), "acknowledged", sup.Check,
+						sup.By, sup.Until.Format(time.RFC3339), sup.Reason)
+				}
+			}
+			return
+		}
+
+		fmt.Fprintln(tw, "KEY\tCHECK\tSINCE\tLAST SEEN\tACKNOWLEDGED")
+		for _, om := range openMismatches(records) {
+			acked := "no"
+			if sup, ok := sups.find(om.last.Key, om.last.Check, now); ok {
+				acked = fmt.Sprintf("by %s until %s", sup.By, sup.Until.Format(time.RFC3339))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+				om.last.Key, om.last.Check, om.since.Format(time.RFC3339),
+				om.last.Round.Format(time.RFC3339), acked)
+		}
+	}
+
+	return cli.Command{
+		Name:   "mismatches",
+		Usage:  "Lists the open mismatches, or the audit history of a key.",
+		Flags:  []cli.Flag{suppressCfgFlag, keyFlag},
+		Action: doMismatches,
+	}
+}
+
+func ackCommand() cli.Command {
+	ttlFlag := cli.DurationFlag{
+		Name:  "ttl",
+		Usage: "how long the mismatches of the key aren't alerted on",
+		Value: 7 * 24 * time.Hour,
+	}
+	undoFlag := cli.BoolFlag{
+		Name:  "undo",
+		Usage: "unacknowledge the mismatches of the key",
+	}
+
+	doAck := func(ctx *cli.Context) {
+		if ctx.Bool(undoFlag.Name) {
+			sup := mustRecordSuppression(ctx, 0)
+			log.WithField("key", sup.Key).Info("mismatches unacknowledged")
+			return
+		}
+		ttl := ctx.Duration(ttlFlag.Name)
+		if ttl <= 0 {
+			fail(ctx, "error: flag %q must be positive", ttlFlag.Name)
+		}
+		sup := mustRecordSuppression(ctx, ttl)
+		log.WithFields(log.Fields{
+			"key":   sup.Key,
+			"until": sup.Until,
+		}).Info("mismatches acknowledged")
+	}
+
+	return cli.Command{
+		Name:  "ack",
+		Usage: "Acknowledges or unacknowledges the mismatches of a key.",
+		Flags: []cli.Flag{
+			suppressCfgFlag, suppressKeyFlag, suppressCheckFlag, ttlFlag,
+			suppressByFlag, suppressReasonFlag, undoFlag,
+		},
+		Action: doAck,
+	}
+}
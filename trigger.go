@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+)
+
+// TriggerPath is where operators have the audit run a round right away on
+// the HTTP endpoint of the audit command.
+const TriggerPath = "/debug/round"
+
+// roundTrigger has the audit run a round right away, outside of its
+// schedule, for operators who just fixed the replication to see the fix
+// verified without waiting for the next round. Triggers not acted upon yet
+// are coalesced: a round run right away verifies the fixes of them all.
+var roundTrigger = make(chan string, 1)
+
+// triggersAccepted is set while the audit runs rounds continuously. Audits
+// running a single round, with --once or in a k8s-job, never act upon
+// triggers.
+var triggersAccepted atomic.Bool
+
+// triggerRound has the audit run a round right away, for a reason, returning
+// false if a round was already pending.
+func triggerRound(reason string) bool {
+	select {
+	case roundTrigger <- reason:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchTriggerSignals has the audit run a round right away whenever jag
+// receives one of triggerSignals.
+func watchTriggerSignals() {
+	if len(triggerSignals) == 0 {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, triggerSignals...)
+	go func() {
+		for s := range sig {
+			reason := "received " + signalName(s)
+			if !triggersAccepted.Load() {
+				log.WithField("reason", reason).Warn("rounds are only triggered when auditing continuously")
+				continue
+			}
+			if !triggerRound(reason) {
+				log.WithField("reason", reason).Info("a round is already pending")
+			}
+			recordServerAction("signal", "round_triggered", log.Fields{"reason": reason})
+		}
+	}()
+}
+
+func init() {
+	http.HandleFunc(TriggerPath, serveTrigger)
+}
+
+// triggerRequest has the audit run a round right away.
+type triggerRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+type triggerResponse struct {
+	// Pending is set if a round was already pending, which verifies the
+	// keys the triggered round would have.
+	Pending bool      `json:"pending"`
+	At      time.Time `json:"at"`
+}
+
+// serveTrigger has the audit run a round right away on POST, given an
+// optional object like {"reason": "deployed the fix of brigade"}. It
+// conflicts unless the audit runs rounds continuously.
+func serveTrigger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !triggersAccepted.Load() {
+		http.Error(w, "rounds are only triggered when auditing continuously", http.StatusConflict)
+		return
+	}
+	var req triggerRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid trigger: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	reason := req.Reason
+	if reason == "" {
+		reason = "requested by " + requestPrincipal(r)
+	}
+	pending := !triggerRound(reason)
+	recordRequestAction(r, "round_triggered", log.Fields{"reason": reason})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(triggerResponse{Pending: pending, At: time.Now().UTC()})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpdateTimeout is how long downloading a release can take.
+const UpdateTimeout = 5 * time.Minute
+
+// MaxReleaseSize is the largest release downloaded, well above the size of
+// jag binaries.
+const MaxReleaseSize = 256 << 20
+
+// ReleasePublicKey is the base64 encoded ed25519 public key the manifests of
+// releases are signed with, trusted unless another key is given. Releases
+// embed it with the linker, e.g.
+//
+//	go build -ldflags "-X main.ReleasePublicKey=$(cat release.pub)"
+var ReleasePublicKey = ""
+
+// release is the manifest of a release, served by a release endpoint with its
+// signature: the ed25519 signature of the manifest, base64 encoded, at the URL
+// of the manifest suffixed with ".sig". The manifest being signed, so are the
+// checksums of the binaries it lists, and its expiry, past which a manifest
+// can't be replayed to hold hosts back on its release.
+type release struct {
+	Version string    `json:"version"`
+	Expires time.Time `json:"expires"`
+	// Binaries are by platform, like linux-amd64.
+	Binaries map[string]releaseBinary `json:"binaries"`
+}
+
+type releaseBinary struct {
+	// URL is where the binary is, relative to the manifest or absolute.
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// releasePlatform is the platform jag runs on, as binaries are listed by
+// manifests.
+func releasePlatform() string { return runtime.GOOS + "-" + runtime.GOARCH }
+
+// download returns the content of a URL, which must be served over HTTPS.
+func download(client *http.Client, u string) ([]byte, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %v", u, err)
+	}
+	if parsed.Scheme != "https" {
+		return nil, fmt.Errorf("can't get %s: releases are only downloaded over https", u)
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't get %s: %s", u, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxReleaseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("can't get %s: %v", u, err)
+	}
+	if len(data) > MaxReleaseSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", u, MaxReleaseSize)
+	}
+	return data, nil
+}
+
+// fetchRelease returns the release of a manifest, once its signature is
+// verified with the public key, and if it hasn't expired by now.
+func fetchRelease(client *http.Client, manifestURL string, key ed25519.PublicKey, now time.Time) (*release, error) {
+	manifest, err := download(client, manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := download(client, manifestURL+".sig")
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	if !ed25519.Verify(key, manifest, sig) {
+		return nil, fmt.Errorf("signature of the manifest doesn't match the public key")
+	}
+	var r release
+	if err := json.Unmarshal(manifest, &r); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if r.Version == "" {
+		return nil, fmt.Errorf("invalid manifest: version is required")
+	}
+	if r.Expires.IsZero() {
+		return nil, fmt.Errorf("invalid manifest: expires is required")
+	}
+	if now.After(r.Expires) {
+		return nil, fmt.Errorf("manifest of release %s expired at %v", r.Version, r.Expires)
+	}
+	return &r, nil
+}
+
+// compareVersions compares versions made of dot separated numbers, like 0.2
+// or v1.10.3, returning -1, 0 or 1 if a is older, the same or newer than b.
+func compareVersions(a, b string) (int, error) {
+	parse := func(v string) ([]int, error) {
+		var nums []int
+		for _, part := range strings.Split(strings.TrimPrefix(v, "v"), ".") {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid version %q", v)
+			}
+			nums = append(nums, n)
+		}
+		return nums, nil
+	}
+	an, err := parse(a)
+	if err != nil {
+		return 0, err
+	}
+	bn, err := parse(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(an) || i < len(bn); i++ {
+		var x, y int
+		if i < len(an) {
+			x = an[i]
+		}
+		if i < len(bn) {
+			y = bn[i]
+		}
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// fetchBinary returns the binary of the release for the platform, once its
+// checksum is verified.
+func (r *release) fetchBinary(client *http.Client, manifestURL, platform string) ([]byte, error) {
+	bin, ok := r.Binaries[platform]
+	if !ok {
+		return nil, fmt.Errorf("release %s has no binary for %s", r.Version, platform)
+	}
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := url.Parse(bin.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL of binary: %v", err)
+	}
+	data, err := download(client, base.ResolveReference(ref).String())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), bin.SHA256) {
+		return nil, fmt.Errorf("checksum of the binary of %s doesn't match the manifest", platform)
+	}
+	return data, nil
+}
+
+// replaceExecutable replaces an executable by a new binary. The binary is
+// written next to it, then renamed over it, so that the executable is either
+// the old or the new one. Windows can't rename over a running executable,
+// which is moved aside first, to exe.old.
+func replaceExecutable(exe string, data []byte) error {
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(exe), "."+filepath.Base(exe)+".new-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() { _ = os.Remove(tmp) }()
+	_, err = f.Write(data)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		_ = os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, exe); err != nil {
+			_ = os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(tmp, exe)
+}
+
+func updateCommand() cli.Command {
+	urlFlag := cli.StringFlag{
+		Name:  "url",
+		Usage: "URL of the manifest of the release, whose signature is at the URL suffixed with .sig",
+	}
+	publicKeyFlag := cli.StringFlag{
+		Name:  "public-key",
+		Usage: "ed25519 public key the manifest is signed with, base64 encoded, the key embedded in jag by default",
+	}
+	checkFlag := cli.BoolFlag{
+		Name:  "check",
+		Usage: "only tell if the release is newer than this version",
+	}
+	forceFlag := cli.BoolFlag{
+		Name:  "force",
+		Usage: "install the release even if it's this version",
+	}
+	allowDowngradeFlag := cli.BoolFlag{
+		Name:  "allow-downgrade",
+		Usage: "install the release even if it's older than this version",
+	}
+
+	doUpdate := func(ctx *cli.Context) {
+		manifestURL := mustString(ctx, urlFlag)
+		encodedKey := ctx.String(publicKeyFlag.Name)
+		if encodedKey == "" {
+			encodedKey = ReleasePublicKey
+		}
+		if encodedKey == "" {
+			fail(ctx, "required: jag embeds no public key, flag %q must have a value", publicKeyFlag.Name)
+		}
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			fail(ctx, "error: public key must be a base64 encoded ed25519 public key")
+		}
+		client := &http.Client{Timeout: UpdateTimeout}
+		r, err := fetchRelease(client, manifestURL, ed25519.PublicKey(key), time.Now())
+		if err != nil {
+			fail(ctx, "error: can't fetch release: %v", err)
+		}
+		cmp, err := compareVersions(r.Version, Version)
+		if err != nil {
+			fail(ctx, "error: can't compare release %s to version %s: %v", r.Version, Version, err)
+		}
+		if ctx.Bool(checkFlag.Name) {
+			switch {
+			case cmp > 0:
+				fmt.Printf("version %s, release %s available\n", Version, r.Version)
+			case cmp < 0:
+				fmt.Printf("version %s, release %s is older\n", Version, r.Version)
+			default:
+				fmt.Printf("version %s is the release\n", Version)
+			}
+			return
+		}
+		if cmp == 0 && !ctx.Bool(forceFlag.Name) {
+			log.WithField("version", Version).Info("already at the version of the release")
+			return
+		}
+		if cmp < 0 && !ctx.Bool(allowDowngradeFlag.Name) {
+			fail(ctx, "error: release %s is older than version %s, flag %q installs it", r.Version, Version, allowDowngradeFlag.Name)
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			fail(ctx, "error: can't find the jag executable: %v", err)
+		}
+		if exe, err = filepath.EvalSymlinks(exe); err != nil {
+			fail(ctx, "error: can't find the jag executable: %v", err)
+		}
+		data, err := r.fetchBinary(client, manifestURL, releasePlatform())
+		if err != nil {
+			fail(ctx, "error: can't fetch release: %v", err)
+		}
+		if err := replaceExecutable(exe, data); err != nil {
+			fail(ctx, "error: can't replace %q: %v", exe, err)
+		}
+		log.WithFields(log.Fields{
+			"from": Version,
+			"to":   r.Version,
+			"path": exe,
+		}).Info("updated, restart running audits to use the release")
+	}
+
+	return cli.Command{
+		Name:  "update",
+		Usage: "Replaces jag by the release of a release endpoint.",
+		Description: strings.TrimSpace(`
+Replaces the running jag executable by the binary of a release, as listed by a
+manifest like:
+
+    {"version": "0.2", "expires": "2026-12-31T00:00:00Z", "binaries": {
+        "linux-amd64": {"url": "jag-linux-amd64", "sha256": "9f86d0..."}}}
+
+The manifest must be signed with the ed25519 key embedded in jag when it was
+built, or given with --public-key, its base64 encoded signature being at the
+URL of the manifest suffixed with .sig, and the checksum of the binary must
+match. Manifests past their expiry are rejected, and the manifest and the
+binary are only downloaded over https. The release is installed if its version
+is newer than this one, --allow-downgrade installing an older release to roll
+back. The executable is swapped by renaming the new binary over it, so that
+it's never partly written. Running audits keep running the old binary until
+they're restarted, e.g. by their service.`),
+		Flags:  []cli.Flag{urlFlag, publicKeyFlag, checkFlag, forceFlag, allowDowngradeFlag},
+		Action: doUpdate,
+	}
+}
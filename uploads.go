@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"time"
+)
+
+// DefaultMaxUploadAge is how long after it started an upload in parts is
+// still in flight, if the config doesn't say otherwise. Older uploads are
+// abandoned rather than about to complete.
+const DefaultMaxUploadAge = 24 * time.Hour
+
+// A multipartBucket tells the uploads in parts in progress of its keys, which
+// only show up in listings once the upload completes.
+type multipartBucket interface {
+	uploadsOf(ctx context.Context, key string) ([]multipartUpload, error)
+}
+
+// multipartUpload is an upload in parts in progress.
+type multipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+// uploadsOf lists the multipart uploads in progress of a key, leaving out
+// those of the keys it prefixes.
+func (b s3Bucket) uploadsOf(ctx context.Context, key string) ([]multipartUpload, error) {
+	in := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(b.name),
+		Prefix: aws.String(key),
+	}
+	var uploads []multipartUpload
+	for {
+		out, err := b.client.ListMultipartUploads(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("GET uploads of key %q in bucket %q: %w", key, b.Name(), s3Error(err))
+		}
+		for _, up := range out.Uploads {
+			if aws.ToString(up.Key) == key {
+				uploads = append(uploads, multipartUpload{
+					Key:       key,
+					UploadID:  aws.ToString(up.UploadId),
+					Initiated: aws.ToTime(up.Initiated),
+				})
+			}
+		}
+		if !aws.ToBool(out.IsTruncated) || aws.ToString(out.NextKeyMarker) > key {
+			return uploads, nil
+		}
+		in.KeyMarker, in.UploadIdMarker = out.NextKeyMarker, out.NextUploadIdMarker
+	}
+}
+
+func (b *failoverBucket) uploadsOf(ctx context.Context, key string) (uploads []multipartUpload, err error) {
+	err = b.try(func(bkt bucket) error {
+		mb, ok := bkt.(multipartBucket)
+		if !ok {
+			return fmt.Errorf("bucket %q has no multipart uploads", bkt.Name())
+		}
+		uploads, err = mb.uploadsOf(ctx, key)
+		return err
+	})
+	return uploads, err
+}
+
+func (b *endpointBucket) uploadsOf(ctx context.Context, key string) (uploads []multipartUpload, err error) {
+	mb, ok := b.bkt.(multipartBucket)
+	if !ok {
+		return nil, fmt.Errorf("bucket %q has no multipart uploads", b.Name())
+	}
+	err = b.try(func(bucket) error {
+		uploads, err = mb.uploadsOf(ctx, key)
+		return err
+	})
+	return uploads, err
+}
+
+// inFlightUpload has the mismatch of a key pending if the key is being
+// uploaded in parts to the source, since the destination can't have it
+// before the upload completes. Uploads started more than MaxUploadAge ago
+// are abandoned and don't count. Mismatches are kept if the uploads can't be
+// listed.
+func (v *verifier) inFlightUpload(ctx context.Context, res *Result) {
+	uploads, err := v.uploads.uploadsOf(ctx, res.Key)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"key":   res.Key,
+		}).Warn("can't tell if key is being uploaded to source, keeping its mismatch")
+		return
+	}
+	// the upload that started last is the one the key will end up with
+	var last *multipartUpload
+	for i, up := range uploads {
+		if last == nil || up.Initiated.After(last.Initiated) {
+			last = &uploads[i]
+		}
+	}
+	if last == nil {
+		return
+	}
+	if age := time.Since(last.Initiated); age > v.cfg.MaxUploadAge {
+		log.WithFields(log.Fields{
+			"key":       res.Key,
+			"upload_id": last.UploadID,
+			"age":       age,
+		}).Debug("key has an upload in parts too old to be in flight, keeping its mismatch")
+		return
+	}
+	if res.Details == nil {
+		res.Details = log.Fields{}
+	}
+	res.Outcome = outcomePending
+	res.Details["upload_id"] = last.UploadID
+	res.Details["upload_initiated"] = last.Initiated
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"launchpad.net/goamz/aws"
-	"launchpad.net/goamz/s3"
+	"hash/fnv"
 	"math/rand"
 	"path"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,39 +18,257 @@ const (
 	// prefix.
 	MaxList    = 10000
 	RetryLimit = 10
+	// MaxSampleWorkers and MaxVerifyWorkers bound the default number of
+	// concurrent walks and verifications.
+	MaxSampleWorkers = 32
+	MaxVerifyWorkers = 8
+	// MaxFollowUps is the number of rounds in which a key whose verification
+	// was inconclusive is verified again, before giving up on it.
+	MaxFollowUps = 3
 )
 
-func awsBucket(a awsConfig) *s3.Bucket {
-	return s3.New(
-		aws.Auth{
-			AccessKey: a.AccessKey,
-			SecretKey: a.SecretKey,
-		}, aws.Regions[a.Region],
-	).Bucket(a.Bucket)
-}
-
 type verifier struct {
 	cfg   *config
 	abort <-chan struct{}
-	src   *s3.Bucket
-	dst   *s3.Bucket
+	src   bucket
+	dst   bucket
+
+	model   bucketModel
+	sampler Sampler
+	// bootstrap is nil unless the model was bootstrapped without a
+	// listing of the bucket, and is refined after each round.
+	bootstrap *modelBootstrap
+	// checks are those of the level the audit is degraded to, allChecks
+	// those of the config.
+	checks    []Check
+	allChecks []Check
+	// lifecycle are the rules of the destination explaining mismatches.
+	lifecycle []lifecycleRule
+	// autotuner is nil unless the concurrency is adjusted automatically.
+	autotuner *autotuner
+
+	// constraint and ignoreMismatch are nil unless configured.
+	constraint     *expression
+	ignoreMismatch *expression
+
+	// reportFile, if set, is where the report of each round is written.
+	reportFile string
+	// statusFile, if set, is where the summary of each round is written,
+	// see statusFile.
+	statusFile string
+
+	// followUps are keys to verify again at the start of the next round,
+	// since their last verification was inconclusive.
+	followUps []followUp
+
+	// suppressions are reloaded at the start of each round, since they're
+	// recorded by operators while the audit runs.
+	suppressions suppressions
+
+	// reverse, if set, verifies keys sampled from the destination against
+	// the source in each round.
+	reverse *verifier
+	// namespaces audit groups of prefixes apart from the whole bucket.
+	namespaces []namespaceAudit
+	// hot is nil unless the prefixes written to the most are prioritized.
+	hot *hotAudit
+	// prefixes, if set, are the only prefixes whose keys are sampled.
+	prefixes []string
+	// started is when the verifier was created.
+	started time.Time
+	// flaps is nil unless alerts on keys are debounced. flapOffset is
+	// where the keys tracked are verified from in the next round, when
+	// the queue doesn't verify them all. flapped are the hashes of the
+	// identities of the keys tracked verified in the current round, which
+	// aren't verified again if sampled.
+	flaps      *flapTracker
+	flapOffset int
+	flapped    map[uint64]struct{}
+	// uploads is nil unless the mismatches of keys being uploaded in
+	// parts to the source are pending, see inFlightUpload.
+	uploads multipartBucket
+	// inventories are where the inventories of the source and of the
+	// destination are published, if they're diffed.
+	inventories [2]inventoryLocation
+	// asOf, if set, is when the source was snapshotted. The ages of the
+	// keys sampled from the snapshot are as of then, see withSnapshot.
+	asOf time.Time
+
+	// exporter is nil unless the rounds are exported.
+	exporter *exporter
+	// profiler is nil unless the profiles of slow rounds are kept.
+	profiler *profiler
+	// claims is nil unless the keys syncers claim to have copied are
+	// verified.
+	claims *claimTailer
+	// events is nil unless keys written according to events are
+	// verified.
+	events *eventConsumer
+	// manual is nil unless the keys queued by operators are verified,
+	// which only the verifier of the audit command does.
+	manual *keyQueue
+	// journal is nil unless the state is persisted.
+	journal *queueJournal
+	// ladder is nil unless the audit degrades while the destination
+	// fails, level being the level of the current round.
+	ladder *degradationLadder
+	level  degradationLevel
+
+	// resultHandlers are called with the result of each key.
+	resultHandlers []func(Result)
+
+	// state is empty if the state isn't persisted.
+	state      stateDir
+	checkpoint *checkpoint
+}
 
-	model bucketModel
+type followUp struct {
+	Key      object `json:"key"`
+	Attempts int    `json:"attempts"`
 }
 
-func newVerifier(cfg *config, model bucketModel, abort <-chan struct{}) (*verifier, error) {
+func newVerifier(cfg *config, model bucketModel, src, dst bucket, abort <-chan struct{}) (*verifier, error) {
 	if model.name != cfg.Source.Bucket {
-		return nil, fmt.Errorf("can't verify bucket %q with a model built for bucket %q",
-			cfg.Source.Bucket, model.name)
+		return nil, fmt.Errorf("%w: can't verify bucket %q with a model built for bucket %q",
+			ErrModelMismatch, cfg.Source.Bucket, model.name)
+	}
+
+	checks, err := lookupChecks(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sampler, err := lookupSampler(cfg, samplerSource{bkt: src, model: model, abort: abort})
+	if err != nil {
+		return nil, err
+	}
+
+	lifecycle, err := loadLifecycle(cfg.Lifecycle, dst)
+	if err != nil {
+		return nil, err
 	}
 
-	return &verifier{
-		cfg:   cfg,
-		abort: abort,
-		src:   awsBucket(cfg.Source),
-		dst:   awsBucket(cfg.Destination),
-		model: model,
-	}, nil
+	v := &verifier{
+		cfg:       cfg,
+		abort:     abort,
+		src:       src,
+		dst:       dst,
+		model:     model,
+		sampler:   sampler,
+		checks:    checks,
+		allChecks: checks,
+		lifecycle: lifecycle,
+		started:   time.Now().UTC(),
+	}
+	if cfg.Constraint != "" {
+		if v.constraint, err = compileExpr(cfg.Constraint); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.IgnoreMismatch != "" {
+		if v.ignoreMismatch, err = compileExpr(cfg.IgnoreMismatch); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Autotune != nil {
+		v.autotuner = newAutotuner(*cfg.Autotune, cfg.SampleWorkers, cfg.VerifyWorkers)
+	}
+	for _, rule := range cfg.Ignore {
+		if !rule.Expires.IsZero() && time.Now().After(rule.Expires) {
+			log.WithFields(log.Fields{
+				"rule":    rule.Name,
+				"expires": rule.Expires,
+			}).Warn("ignore rule has expired, its mismatches are reported again")
+		}
+	}
+	if cfg.Flapping != nil {
+		v.flaps = newFlapTracker(*cfg.Flapping)
+	}
+	if cfg.Degradation != nil {
+		v.ladder = newDegradationLadder(*cfg.Degradation, v.started)
+	}
+	if mb, ok := src.(multipartBucket); ok && cfg.InFlightUploads {
+		v.uploads = mb
+	}
+	if err := v.newNamespaceAudits(); err != nil {
+		return nil, err
+	}
+	if cfg.HotPrefixes != nil {
+		if err := v.newHotAudit(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.InventoryDiff != nil {
+		for i, side := range []struct {
+			a     awsConfig
+			s3url string
+		}{{cfg.Source, cfg.InventoryDiff.Source}, {cfg.Destination, cfg.InventoryDiff.Destination}} {
+			if v.inventories[i], err = newInventoryLocation(side.a, side.s3url); err != nil {
+				return nil, err
+			}
+		}
+	}
+	v.checkpoint = &checkpoint{}
+	if cfg.StateDir != "" {
+		if v.state, err = openStateDir(cfg.StateDir); err != nil {
+			return nil, err
+		}
+		if v.checkpoint, err = v.state.loadCheckpoint(); err != nil {
+			return nil, fmt.Errorf("can't load checkpoint: %v", err)
+		}
+		v.followUps = v.checkpoint.FollowUps
+		if v.ladder != nil {
+			v.ladder.restore(v.checkpoint.Degradation)
+		}
+		if v.flaps != nil {
+			v.flaps.restore(v.checkpoint.Flapping, func(st flapState) bool {
+				return !st.Reverse && st.Namespace == "" && !st.Hot
+			})
+			for _, na := range v.namespaces {
+				name := na.Name
+				na.v.flaps.restore(v.checkpoint.Flapping, func(st flapState) bool { return st.Namespace == name })
+			}
+			if v.hot != nil {
+				v.hot.v.flaps.restore(v.checkpoint.Flapping, func(st flapState) bool { return st.Hot })
+			}
+		}
+		history, err := v.state.readHistory()
+		if err != nil {
+			return nil, fmt.Errorf("can't load history: %v", err)
+		}
+		v.restoreBudgets(history)
+		if v.hot != nil {
+			v.hot.restore(history)
+		}
+		if v.journal, err = v.state.openQueueJournal(); err != nil {
+			return nil, fmt.Errorf("can't open queue journal: %v", err)
+		}
+	}
+	if cfg.Export != nil {
+		if v.exporter, err = newExporter(cfg.Destination, *cfg.Export); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Profiling.SlowRound > 0 {
+		v.profiler = newProfiler(cfg.Profiling, cfg.identity(), v.state)
+	}
+	if cfg.Claims != nil {
+		v.claims = newClaimTailer(*cfg.Claims)
+		if v.journal != nil {
+			v.journal.restore(sourceClaims, v.claims.keyQueue)
+		}
+		go v.claims.tail(abort)
+	}
+	if cfg.Events != nil {
+		if v.events, err = newEventConsumer(*cfg.Events, cfg.Source); err != nil {
+			return nil, err
+		}
+		if v.journal != nil {
+			v.journal.restore(sourceEvents, v.events.keyQueue)
+		}
+		go v.events.consume(abort)
+	}
+	return v, nil
 }
 
 func (v *verifier) execute() error {
@@ -57,10 +276,10 @@ func (v *verifier) execute() error {
 	r := rand.New(rand.NewSource(v.cfg.RandomSeed))
 
 	log.Info("starting verifier")
+	triggersAccepted.Store(true)
+	defer triggersAccepted.Store(false)
 	for {
-		now := time.Now()
-		log.Info("starting an audit")
-		if err := v.verifySamples(r, now); err != nil {
+		if _, err := v.round(v.newRoundID(time.Now(), r)); err != nil {
 			return err
 		}
 		select {
@@ -68,15 +287,278 @@ func (v *verifier) execute() error {
 			log.Warn("verifier aborting")
 			return nil
 		case <-tick.C:
+		case reason := <-roundTrigger:
+			log.WithField("reason", reason).Info("auditing a round right away, outside of the schedule")
+			// the schedule resumes from the round triggered
+			tick.Reset(v.cfg.CheckFrequency)
+		}
+	}
+}
+
+// once performs a single round. Its seed mixes the seed of the config with
+// the time, so that rounds audited by successive runs sample other keys.
+func (v *verifier) once() (*RoundReport, error) {
+	now := time.Now()
+	r := rand.New(rand.NewSource(v.cfg.RandomSeed ^ now.UnixNano()))
+	return v.round(v.newRoundID(now, r))
+}
+
+// newRoundID identifies a round starting now, with a seed of its own if the
+// audit is partitioned.
+func (v *verifier) newRoundID(now time.Time, r *rand.Rand) roundID {
+	seed := r.Int63()
+	if v.cfg.Partition != nil {
+		seed = v.cfg.Partition.seed(seed)
+	}
+	return newRoundID(now, seed)
+}
+
+// sampledKeys returns how many keys of the model can be sampled, which
+// leaves the placeholders out with skip_placeholders.
+func (v *verifier) sampledKeys() int {
+	if v.cfg.SkipPlaceholders {
+		return v.model.keyCount - v.model.placeholders
+	}
+	return v.model.keyCount
+}
+
+func (v *verifier) verifySamples(r *rand.Rand, now time.Time) (*RoundReport, error) {
+	var constraint func(object) bool
+	var rate *changeRateEstimator
+	if v.asOf.IsZero() {
+		accept := keyConstraint(v.cfg, v.constraint, v.prefixes, now)
+		rate = newChangeRateEstimator(now, v.cfg.CheckYoungest, v.cfg.SkipPlaceholders)
+		constraint = func(k object) bool {
+			rate.observe(k)
+			return accept(k)
+		}
+	} else {
+		// the rate of change is unknown since the snapshot
+		constraint = keyConstraint(v.cfg, v.constraint, v.prefixes, v.asOf)
+	}
+
+	report := newRoundReport(now)
+	report.Audit, report.Labels = v.cfg.AuditName, v.cfg.Labels
+	report.Maintenance = v.currentMaintenance()
+	report.Partition = v.cfg.Partition
+	if v.level != levelFull {
+		report.Degradation = &degradationReport{Level: v.level.String()}
+	}
+	v.flapped = nil
+	v.verifyQueue(report)
+
+	log.Infof("randomly sampling %d keys from bucket %q, verifying them in bucket %q",
+		v.cfg.CheckCount, v.src.Name(), v.dst.Name())
+	// keys are verified as soon as they're sampled
+	keyc := make(chan object, v.verifyWorkers())
+	errc := make(chan error, 1)
+	go func() { errc <- v.sampleKeysWithConstraint(r, constraint, keyc, &report.Sampling) }()
+	var (
+		verify     <-chan object = keyc
+		backlog    []object
+		backlogged <-chan struct{}
+	)
+	if v.level == levelBacklog {
+		verify, backlogged = v.probeSamples(keyc, &backlog)
+	}
+	v.verifyKeysMatch(verify, func(res Result) {
+		v.addResult(report, res)
+		if res.Outcome == outcomeInconclusive {
+			v.followUps = append(v.followUps, followUp{Key: res.want, Attempts: 1})
+		}
+		if rate != nil && res.Outcome == outcomeMatch && res.got != nil {
+			rate.observeLag(res.want, *res.got)
 		}
+	})
+	if err := <-errc; err != nil {
+		log.WithField("error", err).Error("couldn't sample keys from source bucket")
+		return nil, err
+	}
+	if backlogged != nil {
+		<-backlogged
+		v.recordBacklog(report, backlog)
+	}
+	if rate != nil {
+		report.ChangeRate = rate.estimate(v.sampledKeys())
+	}
+
+	if v.reverse != nil {
+		if err := v.verifyReverse(r, now, report); err != nil {
+			log.WithField("error", err).Error("couldn't sample keys from destination bucket")
+			return nil, err
+		}
+	}
+
+	if v.hot != nil {
+		if err := v.auditHot(r, now, report); err != nil {
+			log.WithField("error", err).Error("couldn't sample keys from hot prefixes")
+			return nil, err
+		}
+	}
+
+	if err := v.auditNamespaces(r, now, report); err != nil {
+		log.WithField("error", err).Error("couldn't sample keys from namespace")
+		return nil, err
+	}
+
+	if v.cfg.DeleteMarkers.Count > 0 {
+		v.auditDeleteMarkers(r, now, report)
+	}
+	if v.inventoryDiffDue(now) {
+		report.InventoryDiff = v.diffInventories(now, report)
+	}
+	if v.cfg.Reconcile {
+		report.Reconciliation = reconcile(v.src, v.dst)
+	}
+	if v.cfg.Risk != nil {
+		v.scoreRisk(report)
+	}
+	for _, bkt := range []bucket{v.src, v.dst} {
+		fb, ok := bkt.(*failoverBucket)
+		if !ok {
+			continue
+		}
+		if endpoint, degraded := fb.degraded(); degraded {
+			log.WithFields(log.Fields{
+				"bucket":   bkt.Name(),
+				"endpoint": endpoint,
+			}).Warn("audit is running in degraded mode, bucket failed over")
+			if report.Degraded == nil {
+				report.Degraded = make(map[string]string)
+			}
+			report.Degraded[bkt.Name()] = endpoint
+		}
+	}
+	report.Finished = time.Now()
+	return report, nil
+}
+
+// reversibleChecks are the checks that hold both ways, and are performed
+// on keys sampled from the destination in bidirectional audits.
+var reversibleChecks = map[string]bool{
+	"existence": true,
+	"etag":      true,
+	"size":      true,
+	"metadata":  true,
+	"content":   true,
+	"sha1":      true,
+	"versions":  true,
+	"tags":      true,
+}
+
+// makeBidirectional splits the keys sampled in each round between both
+// buckets, the keys of the destination being sampled with a model of the
+// destination and verified against the source.
+func (v *verifier) makeBidirectional(model bucketModel) error {
+	half := v.cfg.CheckCount / 2
+	rev := v.subConfig()
+	rev.CheckCount = half
+	rev.Source, rev.Destination = v.cfg.Destination, v.cfg.Source
+	rev.Checks = reverseChecks(v.cfg.Checks)
+
+	reverse, err := newVerifier(&rev, model, v.dst, v.src, v.abort)
+	if err != nil {
+		return fmt.Errorf("can't verify destination against source: %w", err)
+	}
+	if reverse.flaps != nil {
+		reverse.flaps.restore(v.checkpoint.Flapping, func(st flapState) bool { return st.Reverse })
+	}
+	// the keys of the destination are uploaded to the source all the same
+	reverse.uploads = v.uploads
+	fwd := *v.cfg
+	fwd.CheckCount -= half
+	v.cfg = &fwd
+	v.reverse = reverse
+	return nil
+}
+
+// auditSnapshot makes the verifier audit keys sampled from a snapshot of
+// the source taken at a point in time.
+func (v *verifier) auditSnapshot(at time.Time) {
+	v.asOf = at
+	for _, ns := range v.namespaces {
+		ns.v.asOf = at
+	}
+	if v.hot != nil {
+		v.hot.v.asOf = at
 	}
 }
 
-func (v *verifier) verifySamples(r *rand.Rand, now time.Time) error {
-	oldest := now.Add(-v.cfg.CheckOldest)
-	youngest := now.Add(-v.cfg.CheckYoungest)
+// reverseChecks are the checks verifying keys of the destination against the
+// source: those of checks that can, or at least the existence of the keys.
+func reverseChecks(checks []string) []string {
+	var rev []string
+	for _, name := range checks {
+		if reversibleChecks[name] {
+			rev = append(rev, name)
+		}
+	}
+	if len(rev) == 0 {
+		rev = []string{"existence"}
+	}
+	return rev
+}
+
+// subConfig is the config of a verifier auditing part of the keys of each
+// round on behalf of this one. What's done once per round is left to this
+// verifier.
+func (v *verifier) subConfig() config {
+	cfg := *v.cfg
+	cfg.Bidirectional = false
+	cfg.Namespaces = nil
+	cfg.HotPrefixes = nil
+	cfg.WarmUpKeys = 0
+	cfg.DeleteMarkers = deleteMarkersConfig{}
+	cfg.Reconcile = false
+	cfg.InventoryDiff = nil
+	cfg.Risk = nil
+	cfg.Lifecycle = lifecycleConfig{}
+	cfg.Autotune = nil
+	cfg.Profiling = profilingConfig{}
+	cfg.StateDir = ""
+	cfg.Export = nil
+	cfg.Claims = nil
+	cfg.Events = nil
+	return cfg
+}
 
-	constraint := func(k s3.Key) bool {
+// verifyReverse verifies keys sampled from the destination against the
+// source, adding their results to the report of the round.
+func (v *verifier) verifyReverse(r *rand.Rand, now time.Time, report *RoundReport) error {
+	return v.verifyWith(v.reverse, r, now, report, func(res *Result) {
+		res.Reverse = true
+	})
+}
+
+// verifyWith verifies the keys sampled by another verifier, adding their
+// results to the report of the round once marked by mark.
+func (v *verifier) verifyWith(sub *verifier, r *rand.Rand, now time.Time, report *RoundReport, mark func(*Result)) error {
+	sub.suppressions = v.suppressions
+	sub.resultHandlers = []func(Result){func(res Result) {
+		mark(&res)
+		v.addResult(report, res)
+	}}
+	subReport, err := sub.verifySamples(r, now)
+	if err != nil {
+		return err
+	}
+	report.Sampling.Walks += subReport.Sampling.Walks
+	report.Sampling.Duplicates += subReport.Sampling.Duplicates
+	if subReport.Degradation != nil && report.Degradation != nil {
+		report.Degradation.Backlogged += subReport.Degradation.Backlogged
+	}
+	return nil
+}
+
+// keyConstraint accepts the keys whose age as of now is in the window of the
+// config, under the prefixes if any, selected by the preset of the config if
+// any, outside of the sync windows open now, that satisfy the constraint if
+// any.
+func keyConstraint(cfg *config, constraint *expression, prefixes []string, now time.Time) func(object) bool {
+	oldest := now.Add(-cfg.CheckOldest)
+	youngest := now.Add(-cfg.CheckYoungest)
+
+	return func(k object) bool {
 		modtime, err := time.Parse(time.RFC3339Nano, k.LastModified)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -85,7 +567,7 @@ func (v *verifier) verifySamples(r *rand.Rand, now time.Time) error {
 			}).Error("couldn't parse LastModified time for this key")
 			return false
 		}
-		llog := log.WithField("modtime", modtime)
+		llog := samplerLog.WithFields(log.Fields{"key": k.Key, "modtime": modtime})
 		if !modtime.After(oldest) {
 			llog.Debug("decided it's too old")
 			return false
@@ -95,258 +577,748 @@ func (v *verifier) verifySamples(r *rand.Rand, now time.Time) error {
 			return false
 		}
 		llog.Debug("right time range")
-		return true
-	}
-
-	log.Infof("randomly sampling %d keys from bucket %q", v.cfg.CheckCount, v.src.Name)
-	keys, err := v.sampleKeysWithConstraint(r, constraint)
-	if err != nil {
-		log.WithField("error", err).Error("couldn't sample keys from source bucket")
-		return err
-	}
-
-	log.Infof("verifying all keys match in bucket %q", v.dst.Name)
-	if err := v.verifyKeysMatch(keys); err != nil {
-		log.WithField("error", err).Error("couldn't sample keys from source bucket")
-		return err
+		if cfg.SkipPlaceholders && isPlaceholder(k.Key, k.Size) {
+			llog.Debug("decided it's a placeholder")
+			return false
+		}
+		if k.Size < cfg.MinSize || (cfg.MaxSize != 0 && k.Size > cfg.MaxSize) {
+			llog.WithField("size", k.Size).Debug("decided it's outside the size range")
+			return false
+		}
+		if cfg.Owners != nil && !cfg.Owners.allows(k.Owner.ID) {
+			llog.WithField("owner", k.Owner.ID).Debug("decided it's another owner's")
+			return false
+		}
+		if prefixes != nil && !(namespace{Prefixes: prefixes}).contains(k.Key) {
+			llog.Debug("decided it's outside the namespace")
+			return false
+		}
+		if cfg.Partition != nil && !cfg.Partition.contains(k.Key) {
+			llog.Debug("decided it's another instance's")
+			return false
+		}
+		if cfg.Preset != nil && !cfg.Preset.matches(k.Key) {
+			llog.Debug("decided it's outside the preset")
+			return false
+		}
+		if w, ok := syncWindowOf(k.Key, now); ok {
+			llog.WithField("prefix", w.Prefix).Debug("decided it's being synced")
+			return false
+		}
+		if constraint == nil {
+			return true
+		}
+		ok, err := constraint.evalBool(keyVars(k, now))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"key":   k.Key,
+			}).Error("couldn't evaluate constraint for this key")
+			return false
+		}
+		return ok
 	}
-	return nil
 }
 
-func (v *verifier) sampleKeysWithConstraint(r *rand.Rand, accept func(s3.Key) bool) ([]s3.Key, error) {
+// sampleKeysWithConstraint sends CheckCount distinct random keys on out as
+// soon as they're sampled, then closes it. Keys are sampled in batches, each
+// batch sampling only as many keys as are still missing. Sampling stops
+// short of CheckCount keys once a batch samples no new key, as when fewer
+// keys than that are accepted in the bucket.
+//
+// Keys aren't kept once sent, only a hash of their identity is remembered to
+// recognize duplicates, so that memory stays small even when sampling many
+// keys.
+func (v *verifier) sampleKeysWithConstraint(r *rand.Rand, accept func(object) bool, out chan<- object, stats *samplingStats) error {
+	defer close(out)
 	count := v.cfg.CheckCount
-	set := make(map[s3.Key]struct{}, count)
-
-	for len(set) != count {
-		var wg sync.WaitGroup
-		sampleC := make(chan s3.Key, count)
-		errC := make(chan error, count)
+	seen := make(map[uint64]struct{}, count)
 
+	for len(seen) < count {
 		select {
 		case <-v.abort:
 			log.Warn("verifier: aborting keys sampling")
-			return nil, nil
+			return nil
 		default:
 		}
-		for i := 0; i < count; i++ {
+
+		before, shortfall := len(seen), count-len(seen)
+		stats.Walks += shortfall
+		var (
+			wg      sync.WaitGroup
+			errOnce sync.Once
+			err     error
+		)
+		// a rand.Rand can't be shared by goroutines, each walk gets its own
+		seeds := make([]int64, shortfall)
+		for i := range seeds {
+			seeds[i] = r.Int63()
+		}
+		// walks stop being queued after one failed
+		queue := make(chan int64)
+		failed := make(chan struct{})
+		go func() {
+			defer close(queue)
+			for _, seed := range seeds {
+				select {
+				case queue <- seed:
+				case <-failed:
+					return
+				}
+			}
+		}()
+
+		sampleC := make(chan object)
+		for i := 0; i < v.sampleWorkers(); i++ {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				log.WithField("samples", len(set)).Debug("sampling a random key")
-				sample, err := v.sampleRandomKey(r, accept)
-				if err != nil {
-					errC <- err
-				} else {
+				for seed := range queue {
+					samplerLog.Debug("sampling a random key")
+					r := rand.New(rand.NewSource(seed))
+					sample, serr := v.sampler.Sample(r, accept)
+					if serr == nil && v.cfg.SampleVersions {
+						sample, serr = v.sampleVersion(r, sample)
+					}
+					if serr != nil {
+						errOnce.Do(func() {
+							err = serr
+							close(failed)
+						})
+						continue
+					}
 					sampleC <- *sample
 				}
 			}()
 		}
+		go func() {
+			wg.Wait()
+			close(sampleC)
+		}()
 
-		wg.Wait()
-		close(sampleC)
-		close(errC)
+		duplicates := 0
 		for sample := range sampleC {
-			set[sample] = struct{}{}
+			id := identify(sample).hash()
+			if _, ok := seen[id]; ok {
+				duplicates++
+				continue
+			}
+			// debounced keys are judged once a round
+			if _, ok := v.flapped[id]; ok {
+				duplicates++
+				continue
+			}
+			seen[id] = struct{}{}
+			select {
+			case out <- sample:
+			case <-v.abort:
+				// drain the pending samples
+			}
 		}
 
-		if err := <-errC; err != nil {
-			return nil, err
+		stats.Duplicates += duplicates
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"samples":    len(seen),
+			"duplicates": duplicates,
+		}).Debug("found samples")
+		if len(seen) == before {
+			stats.Shortfall = count - len(seen)
+			log.WithFields(log.Fields{
+				"samples": len(seen),
+				"missing": count - len(seen),
+			}).Warn("verifier: stopping sampling, no new key found")
+			return nil
 		}
-		log.WithField("samples", len(set)).Debug("found samples")
-
-	}
-	keys := make([]s3.Key, 0, count)
-	for k := range set {
-		keys = append(keys, k)
 	}
-	return keys, nil
+	return nil
 }
 
-func (v *verifier) sampleRandomKey(r *rand.Rand, accept func(s3.Key) bool) (*s3.Key, error) {
+// keyID identifies a key in a bucket. Two listings of the same key are the
+// same key even if their other attributes differ, e.g. their owner.
+type keyID struct {
+	Name string
+	// Version is empty unless the bucket is versioned.
+	Version string
+}
 
-	// TODO: find a real answer to the question
-	//   - How to uniformly select a random node in a tree without knowing in
-	//     advance the structure of the tree, and if it's not practical to
-	//     traverse the whole tree?
-	maybePickKey := func(depth int, key s3.Key) bool {
-		p := v.probThatKeyAtDepth(depth)
-		dice := r.Float64()
-		accepted := dice <= p
-		log.WithFields(log.Fields{
-			"dice":     dice,
-			"p":        p,
-			"accepted": accepted,
-		}).Warn("rolling dice")
-		return accepted
-	}
+func identify(o object) keyID {
+	return keyID{Name: o.Key, Version: o.VersionID}
+}
 
-	var walkNode func(depth int, prefix string) (*s3.Key, bool, error)
+// hash of the identity, used to remember many keys in little memory.
+func (id keyID) hash() uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(id.Name))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(id.Version))
+	return h.Sum64()
+}
 
-	walkNode = func(depth int, prefix string) (*s3.Key, bool, error) {
+// samplingStats describe the work done to sample the keys of a round.
+type samplingStats struct {
+	// Walks is the number of random walks of the bucket that were started.
+	Walks int `json:"walks"`
+	// Duplicates is the number of walks that sampled a key that was already
+	// sampled.
+	Duplicates int `json:"duplicates"`
+	// Shortfall is the number of keys missing from the sample once batches
+	// of walks stopped finding new keys.
+	Shortfall int `json:"shortfall,omitempty"`
+}
 
-		select {
-		case <-v.abort:
-			log.WithField("depth", depth).Warn("verifier: aborting bucket random walk")
-			return nil, false, nil
-		default:
-		}
-		log.WithFields(log.Fields{
-			"depth":  depth,
-			"prefix": prefix,
-		}).Debug("walking a depth")
+// sampleVersion picks a random version of a sampled key.
+func (v *verifier) sampleVersion(r *rand.Rand, o *object) (*object, error) {
+	chain, err := versionChain(context.Background(), v.src, o.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		// the key was deleted since it was listed
+		return o, nil
+	}
+	version := chain[r.Intn(len(chain))].object()
+	log.WithFields(log.Fields{
+		"key":      version.Key,
+		"version":  version.VersionID,
+		"versions": len(chain),
+	}).Debug("sampled a version of the key")
+	return &version, nil
+}
 
-		// enumerate the keys and the children from here
-		resp, err := listBkt(v.src, normalizePath(prefix), MaxList)
+// round performs an audit round, reporting and recording its results.
+func (v *verifier) round(id roundID) (*RoundReport, error) {
+	log.WithField("round", id).Info("starting an audit")
+	if v.state != "" {
+		sups, err := v.state.readSuppressions()
 		if err != nil {
-			return nil, false, err
+			log.WithField("error", err).Error("couldn't load suppressions")
+		} else {
+			v.suppressions = sups
 		}
-
-		candidates, err := filterKeys(resp.Contents, accept)
-		if err != nil {
-			return nil, false, err
+	}
+	if v.ladder != nil {
+		v.degradeTo(v.ladder.level)
+	}
+	if v.profiler != nil {
+		v.profiler.start()
+	}
+	report, err := v.sampleRound(id)
+	if v.profiler != nil {
+		v.profiler.stop(report)
+	}
+	if err != nil {
+		observeRoundFailure(v.cfg)
+		v.writeStatus(id, nil, err)
+		return nil, err
+	}
+	if v.ladder != nil {
+		v.degrade(report)
+	}
+	report.logSummary()
+	observeRound(v.cfg, report, v.sampledKeys())
+	if v.reportFile != "" {
+		if err := report.writeFile(v.reportFile); err != nil {
+			log.WithField("error", err).Error("couldn't write report")
 		}
-		shuffleKeys(r, candidates)
-
-		log.WithFields(log.Fields{
-			"initial": len(resp.Contents),
-			"left":    len(candidates),
-		}).Debug("applied constraint")
-
-		// maybe stop recursing
-		for _, key := range candidates {
-			if picked := maybePickKey(depth, key); picked {
-				return &key, true, nil
-			}
+	}
+	v.writeStatus(id, report, nil)
+	if v.exporter != nil {
+		if err := v.exporter.export(report); err != nil {
+			log.WithField("error", err).Error("couldn't export round")
 		}
-		log.WithFields(log.Fields{
-			"depth":  depth,
-			"prefix": prefix,
-		}).Debug("rejected all candidates")
-
-		// otherwise traverse to a random children
-		shuffle(r, resp.CommonPrefixes)
-		for _, pfx := range resp.CommonPrefixes {
-			key, found, err := walkNode(depth+1, pfx)
-			if err != nil {
-				return nil, false, err
-			}
-			if found {
-				return key, true, err
-			}
+	}
+	if v.autotuner != nil {
+		v.autotuner.adjust(report)
+	}
+	v.saveState(report)
+	if v.bootstrap != nil {
+		v.refineModel(v.state, modelFile)
+	}
+	if v.reverse != nil && v.reverse.bootstrap != nil {
+		v.reverse.refineModel(v.state, reverseModelFile)
+	}
+	return report, nil
+}
+
+// replay verifies the keys sampled by a past round again, to debug its
+// results. Only the keys still in the source bucket can be sampled again.
+// Nothing is recorded in the state.
+func (v *verifier) replay(id roundID) (*RoundReport, error) {
+	log.WithField("round", id).Info("replaying an audit round")
+	v.followUps = nil
+	report, err := v.sampleRound(id)
+	if err != nil {
+		v.writeStatus(id, nil, err)
+		return nil, err
+	}
+	report.logSummary()
+	if v.reportFile != "" {
+		if err := report.writeFile(v.reportFile); err != nil {
+			log.WithField("error", err).Error("couldn't write report")
 		}
-		return nil, false, nil
 	}
+	v.writeStatus(id, report, nil)
+	return report, nil
+}
 
-	k, found, err := walkNode(0, "/")
+// writeStatus writes the summary of a round to the status file, if any.
+func (v *verifier) writeStatus(id roundID, report *RoundReport, roundErr error) {
+	if v.statusFile == "" {
+		return
+	}
+	if err := writeStatusFile(v.statusFile, id, report, roundErr); err != nil {
+		log.WithField("error", err).Error("couldn't write status file")
+	}
+}
+
+// sampleRound verifies the keys sampled as of the start of a round, with the
+// round's seed.
+func (v *verifier) sampleRound(id roundID) (*RoundReport, error) {
+	started, seed, err := id.parse()
 	if err != nil {
 		return nil, err
 	}
-	if !found {
-		return nil, errors.New("traversed whole bucket without choosing a key")
+	report, err := v.verifySamples(rand.New(rand.NewSource(seed)), started)
+	if err != nil {
+		return nil, err
+	}
+	report.ID = id
+	return report, nil
+}
+
+// saveState records the round in the history, and checkpoints what's needed
+// to resume after it.
+func (v *verifier) saveState(report *RoundReport) {
+	v.checkpoint.Rounds++
+	v.checkpoint.LastRound = report.Started
+	v.checkpoint.FollowUps = v.followUps
+	v.checkpoint.Flapping = v.flapStates()
+	if v.ladder != nil {
+		v.checkpoint.Degradation = v.ladder.state()
+	}
+	if v.state == "" {
+		return
+	}
+	if err := v.state.appendHistory(report); err != nil {
+		log.WithField("error", err).Error("couldn't record round in history")
+	}
+	resultsSaved := true
+	if err := v.state.appendResults(report); err != nil {
+		log.WithField("error", err).Error("couldn't record results in history")
+		resultsSaved = false
+	}
+	if err := v.state.saveCheckpoint(v.checkpoint); err != nil {
+		log.WithField("error", err).Error("couldn't save checkpoint")
+	}
+	if v.journal != nil {
+		// keys dequeued stay journaled until their results are saved
+		queues := v.journaledQueues()
+		if resultsSaved {
+			for _, q := range queues {
+				q.settle()
+			}
+		}
+		v.journal.compact(queues)
 	}
-	return k, nil
 }
 
-func (v *verifier) verifyKeysMatch(keys []s3.Key) error {
-	for _, key := range keys {
+// verifyFollowUps verifies again n of the keys that were inconclusive in
+// previous rounds, the oldest first, keeping the others for the next round.
+// Keys still inconclusive are kept for the next round, until they've been
+// attempted MaxFollowUps times.
+func (v *verifier) verifyFollowUps(report *RoundReport, n int) {
+	if n == 0 {
+		return
+	}
+	log.Infof("verifying %d keys that were inconclusive in previous rounds", n)
+	followUps := v.followUps[:n]
+	v.followUps = append([]followUp(nil), v.followUps[n:]...)
+	for _, fu := range followUps {
 		select {
 		case <-v.abort:
-			log.Warn("verifier: aborting verification that keys match")
-			return nil
+			log.Warn("verifier: aborting verification of follow ups")
+			v.followUps = append(v.followUps, fu)
+			continue
 		default:
 		}
-		if err := v.verifyKey(key); err != nil {
-			return err
+
+		// the key may have changed or disappeared since it was sampled,
+		// unlike versions of keys
+		want, err := &fu.Key, error(nil)
+		if fu.Key.VersionID == "" {
+			want, err = findKey(context.Background(), v.src, fu.Key.Key)
+		}
+		var res Result
+		switch {
+		case err != nil:
+			res = inconclusiveResult(fu.Key.Key, err)
+			res.want = fu.Key
+		case want == nil:
+			log.WithField("key", fu.Key.Key).Info("dropping follow up, key was removed from source")
+			continue
+		default:
+			res = v.verifyKeyWithDeadline(*want)
+		}
+		res.FollowUp = true
+		v.addResult(report, res)
+
+		if res.Outcome != outcomeInconclusive {
+			continue
+		}
+		fu.Key = res.want
+		fu.Attempts++
+		if fu.Attempts >= MaxFollowUps {
+			log.WithFields(log.Fields{
+				"key":      fu.Key.Key,
+				"attempts": fu.Attempts,
+			}).Error("giving up on key, verification was inconclusive too many times")
+			continue
 		}
+		v.followUps = append(v.followUps, fu)
+	}
+}
+
+// onResult registers a function called with the result of each key as soon
+// as it's verified, such as publishResult streaming results on the HTTP
+// endpoint. Handlers are called one at a time, and slow down the audit while
+// they run.
+func (v *verifier) onResult(handler func(Result)) {
+	v.resultHandlers = append(v.resultHandlers, handler)
+}
+
+// addResult adds the result of a key to the report of the round, and hands
+// it to the result handlers.
+func (v *verifier) addResult(report *RoundReport, res Result) {
+	report.add(res)
+	for _, handler := range v.resultHandlers {
+		handler(res)
+	}
+}
+
+// verifyWorkers is the number of keys to verify concurrently.
+func (v *verifier) verifyWorkers() int {
+	if v.autotuner != nil {
+		_, workers := v.autotuner.concurrency()
+		return workers
+	}
+	return v.cfg.VerifyWorkers
+}
+
+// sampleWorkers is the number of walks to run concurrently.
+func (v *verifier) sampleWorkers() int {
+	if v.autotuner != nil {
+		walks, _ := v.autotuner.concurrency()
+		return walks
+	}
+	return v.cfg.SampleWorkers
+}
+
+// verifyKeysMatch verifies the keys received on keys with verifyWorkers
+// concurrent workers, until keys is closed. Results are handed to add one at
+// a time, as soon as they're known.
+func (v *verifier) verifyKeysMatch(keys <-chan object, add func(Result)) {
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for i := 0; i < v.verifyWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				select {
+				case <-v.abort:
+					log.Warn("verifier: aborting verification that keys match")
+					return
+				default:
+				}
+				res := v.verifyKeyWithDeadline(key)
+				mu.Lock()
+				add(res)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// verifyKeyWithDeadline verifies a key, giving up if it takes longer than
+// the configured timeout. The requests of a verification that timed out are
+// canceled, and its result is discarded.
+func (v *verifier) verifyKeyWithDeadline(want object) Result {
+	ctx, cancel := context.WithTimeout(context.Background(), v.cfg.KeyTimeout)
+	defer cancel()
+	resc := make(chan Result, 1)
+	go func() { resc <- v.verifyKey(ctx, want) }()
+
+	select {
+	case res := <-resc:
+		return res
+	case <-ctx.Done():
+		log.WithFields(log.Fields{
+			"key":     want.Key,
+			"timeout": v.cfg.KeyTimeout,
+		}).Warn("verification of key is inconclusive, took too long")
+		res := inconclusiveResult(want.Key, fmt.Errorf("%w: verification took longer than %v", ErrTimeout, v.cfg.KeyTimeout))
+		res.want = want
+		return res
 	}
-	return nil
 }
 
-func listBkt(bkt *s3.Bucket, path string, limit int) (*s3.ListResp, error) {
-	var resp *s3.ListResp
+func listBkt(ctx context.Context, bkt bucket, path string, limit int) (*listResp, error) {
+	var resp *listResp
 	var err error
 	for i := 0; i < RetryLimit; i++ {
-		resp, err = bkt.List(path, "/", "", limit)
-		if err != nil {
-			return resp, err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		resp, err = bkt.List(ctx, path, "/", "", limit)
+		if err == nil {
+			return resp, nil
+		}
+		if !isRetryable(err) {
+			return nil, err
+		}
+		log.WithFields(log.Fields{
+			"error":   err,
+			"attempt": i + 1,
+		}).Warn("retrying LIST on bucket")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(i+1) * 100 * time.Millisecond):
 		}
 	}
-	return resp, err
+	return nil, err
 }
 
-func (v *verifier) verifyKey(want s3.Key) error {
-	log.WithField("key", want.Key).Debug("verifying a key")
+func (v *verifier) verifyKey(ctx context.Context, want object) Result {
+	res := v.checkKey(ctx, want)
+	res.Version, res.Size = want.VersionID, want.Size
+	res.want = want
+	if v.flaps != nil {
+		v.flaps.judge(&res, time.Now())
+	}
+	if res.Outcome == outcomeMismatch {
+		if w, ok := syncWindowOf(res.Key, time.Now()); ok {
+			if res.Details == nil {
+				res.Details = log.Fields{}
+			}
+			res.Outcome = outcomePending
+			res.Details["synced_until"] = w.Until
+			res.Details["synced_by"] = w.By
+		}
+	}
+	if res.Outcome == outcomeMismatch && v.uploads != nil {
+		v.inFlightUpload(ctx, &res)
+	}
+	return res
+}
+
+func (v *verifier) checkKey(ctx context.Context, want object) Result {
+	verifierLog.WithField("key", want.Key).Debug("verifying a key")
 
-	res, err := listBkt(v.dst, want.Key, 1)
+	got, err := v.findCounterpart(ctx, want)
 	if err != nil {
-		return err
+		res := inconclusiveResult(want.Key, err)
+		log.WithFields(res.requestIDs.fields(log.Fields{
+			"error": err,
+			"key":   want.Key,
+		})).Warn("verification of key is inconclusive, can't find it in destination")
+		return res
 	}
-	if len(res.Contents) == 0 {
-
+	p := &keyPair{ctx: ctx, src: v.src, dst: v.dst, want: want, got: got}
+	if err := p.resolveSegments(); err != nil {
+		res := inconclusiveResult(want.Key, err)
+		log.WithFields(log.Fields{
+			"error": err,
+			"key":   want.Key,
+		}).Warn("verification of key is inconclusive, can't resolve its segments")
+		return res
 	}
-	switch {
-	case len(res.Contents) == 0:
-		log.WithField("key", want.Key).Error("mismatch at key, no match in destination")
-		return nil
-
-	case len(res.Contents) > 1:
-		log.WithField("key", want.Key).Error("mismatch at key, more than one match in destination")
-		return nil
+	for _, check := range v.checks {
+		mismatch, err := check.Check(p)
+		if errors.Is(err, errNotApplicable) {
+			log.WithFields(log.Fields{
+				"error": err,
+				"key":   want.Key,
+				"check": check.Name(),
+			}).Debug("check doesn't apply to key, skipping it")
+			continue
+		}
+		if err != nil && got != nil {
+			// transitioned keys can't always be read anymore
+			if res, ok := v.lifecycleResult(want, got, check, nil); ok {
+				return res
+			}
+		}
+		if err != nil {
+			res := inconclusiveResult(want.Key, err)
+			res.Check = check.Name()
+			log.WithFields(res.requestIDs.fields(log.Fields{
+				"error": err,
+				"key":   want.Key,
+				"check": check.Name(),
+			})).Warn("verification of key is inconclusive, check failed")
+			return res
+		}
+		if len(mismatch) != 0 {
+			res := Result{
+				Key:     want.Key,
+				Outcome: outcomeMismatch,
+				Check:   check.Name(),
+				Details: mismatch,
+			}
+			if res, ok := v.lifecycleResult(want, got, check, mismatch); ok {
+				return res
+			}
+			mismatch["key"] = want.Key
+			mismatch["check"] = check.Name()
+			res.requestIDs = v.traceMismatch(ctx, want, got)
+			res.requestIDs.fields(mismatch)
+			if sup, ok := v.suppressions.find(want.Key, check.Name(), time.Now()); ok {
+				res.Outcome = outcomeSuppressed
+				res.Details["suppressed_by"] = sup.By
+				res.Details["suppressed_until"] = sup.Until
+				res.Details["suppressed_reason"] = sup.Reason
+				log.WithFields(mismatch).Info("mismatch at key is suppressed")
+				return res
+			}
+			if by := v.ignoredBy(want, check); by != "" {
+				mismatch["ignored_by"] = by
+				log.WithFields(mismatch).Info("ignoring mismatch at key, per policy")
+				res.Outcome = outcomeIgnored
+				res.IgnoredBy = by
+				return res
+			}
+			log.WithFields(mismatch).Error("mismatch at key")
+			return res
+		}
 	}
+	return Result{Key: want.Key, Outcome: outcomeMatch, got: got}
+}
 
-	got := res.Contents[0]
-	logFields := log.Fields{}
-	if want.ETag != got.ETag {
-		logFields["want.etag"] = want.ETag
-		logFields["got.etag"] = got.ETag
+// traceMismatch requests a mismatching key from the destination again, for
+// the IDs of the request to be reported.
+func (v *verifier) traceMismatch(ctx context.Context, want object, got *object) requestIDs {
+	tracer, ok := v.dst.(requestTracer)
+	if !ok {
+		return requestIDs{}
 	}
-	if want.Size != got.Size {
-		logFields["want.size"] = want.Size
-		logFields["got.size"] = got.Size
+	key, version := want.Key, ""
+	if got != nil {
+		key, version = got.Key, got.VersionID
 	}
-	if len(logFields) != 0 {
-		logFields["key"] = want.Key
-		log.WithFields(logFields).Error("mismatch at key, different properties")
+	ids, err := tracer.traceKey(ctx, key, version)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"key":   key,
+		}).Warn("couldn't trace request for mismatching key")
 	}
-	return nil
+	return ids
 }
 
-func (v *verifier) probThatKeyAtDepth(depth int) float64 {
-	if depth >= len(v.model.depths) {
-		log.WithField("depth", depth).Warn("depth not predictable by model")
-		return 0.0
+// ignoredBy returns the name of the ignore rule or policy tolerating the
+// mismatch of a check on a key, or an empty string if it isn't tolerated.
+func (v *verifier) ignoredBy(k object, check Check) string {
+	now := time.Now()
+	for _, rule := range v.cfg.Ignore {
+		if rule.matches(k.Key, check.Name(), now) {
+			return rule.Name
+		}
+	}
+	if v.ignoreMismatch == nil {
+		return ""
 	}
-	keysAtDepth := v.model.depths[depth]
-	return float64(keysAtDepth) / float64(v.model.keyCount)
+	vars := keyVars(k, now)
+	vars["check"] = check.Name()
+	ignore, err := v.ignoreMismatch.evalBool(vars)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"key":   k.Key,
+		}).Error("couldn't evaluate mismatch policy for this key")
+		return ""
+	}
+	if !ignore {
+		return ""
+	}
+	return "ignore_mismatch"
 }
 
-func normalizePath(p string) string {
-	if path.IsAbs(p) {
-		return p[1:]
+// keyVars are the variables describing a key in constraint and mismatch
+// policy expressions.
+func keyVars(k object, now time.Time) map[string]interface{} {
+	vars := map[string]interface{}{
+		"key":           k.Key,
+		"version":       k.VersionID,
+		"size":          float64(k.Size),
+		"etag":          k.ETag,
+		"storage_class": k.StorageClass,
+		"owner":         k.Owner.ID,
+		"depth":         float64(strings.Count(k.Key, "/")),
+		"age":           0.0,
 	}
-	return p
+	if modtime, err := time.Parse(time.RFC3339Nano, k.LastModified); err == nil {
+		vars["age"] = now.Sub(modtime).Seconds()
+	}
+	return vars
 }
 
-func filterKeys(candidates []s3.Key, accept func(s3.Key) bool) ([]s3.Key, error) {
-	var valids []s3.Key
-	for _, k := range candidates {
-		if ok := accept(k); ok {
-			valids = append(valids, k)
-		}
+// findKey returns the key with exactly this name in the bucket, or nil if
+// there's none.
+func findKey(ctx context.Context, bkt bucket, key string) (*object, error) {
+	res, err := listBkt(ctx, bkt, key, 1)
+	if err != nil {
+		return nil, err
 	}
-	return valids, nil
+	if len(res.Contents) == 0 || res.Contents[0].Key != key {
+		return nil, nil
+	}
+	o := objectOf(res.Contents[0])
+	return &o, nil
 }
 
-func shuffle(r *rand.Rand, arr []string) {
-	for i := range arr {
-		j := r.Intn(i + 1)
-		arr[i], arr[j] = arr[j], arr[i]
+// findCounterpart returns the object in the destination that is a copy of
+// the object in the source, or nil if there's none. Copies of versions get
+// new version IDs, so a version is matched with the version at the same
+// position in the destination's chain of versions of the key, named as
+// normalized by the destination.
+func (v *verifier) findCounterpart(ctx context.Context, want object) (*object, error) {
+	if want.VersionID == "" {
+		return v.findDestinationKey(ctx, want.Key)
 	}
+	srcChain, err := versionChain(ctx, v.src, want.Key)
+	if err != nil {
+		return nil, err
+	}
+	pos := -1
+	for i, kv := range srcChain {
+		if kv.VersionId == want.VersionID {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		return nil, fmt.Errorf("%w: version %q of key %q in source", ErrKeyMissing, want.VersionID, want.Key)
+	}
+	dstChain, err := versionChain(ctx, v.dst, v.cfg.destinationKey(want.Key))
+	if err != nil {
+		return nil, err
+	}
+	if pos >= len(dstChain) {
+		return nil, nil
+	}
+	got := dstChain[pos].object()
+	return &got, nil
 }
 
-func shuffleKeys(r *rand.Rand, arr []s3.Key) {
-	for i := range arr {
-		j := r.Intn(i + 1)
-		arr[i], arr[j] = arr[j], arr[i]
+func normalizePath(p string) string {
+	if path.IsAbs(p) {
+		return p[1:]
 	}
+	return p
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"math/rand"
+	"time"
+)
+
+// warmUpHints tell operators what to look into when the warm-up round fails
+// with a kind of error, see errorKind.
+var warmUpHints = map[string]string{
+	"config_invalid": "fix the config",
+	"model_mismatch": "build a model of the source bucket with --build-model",
+	"model_stale":    "build the model again with --build-model, or widen the filters of the config",
+	"throttled":      "lower sample_workers and verify_workers, or the rate limits of the buckets",
+	"key_missing":    "check the names and regions of the buckets",
+	"access_denied":  "check the credentials of the buckets and the policies granting them access",
+	"unavailable":    "check the endpoints of the buckets and that they're reachable",
+	"timeout":        "check that the endpoints of the buckets are reachable, or raise key_timeout",
+}
+
+// warmUpError tells what failed in the warm-up round, and what to look into.
+func warmUpError(err error, format string, args ...interface{}) error {
+	what := fmt.Sprintf(format, args...)
+	if hint, ok := warmUpHints[errorKind(err)]; ok {
+		return fmt.Errorf("warm-up round failed %s, %s: %w", what, hint, err)
+	}
+	return fmt.Errorf("warm-up round failed %s: %w", what, err)
+}
+
+// resultError is the error that left a key unverified, as recorded in its
+// result, still of the kind it was classified as.
+type resultError struct {
+	msg  string
+	kind error
+}
+
+func newResultError(res Result) error {
+	err := resultError{msg: res.Error}
+	for _, kind := range errorKinds {
+		if kind.name == res.ErrorKind {
+			err.kind = kind.err
+		}
+	}
+	return err
+}
+
+func (e resultError) Error() string { return e.msg }
+func (e resultError) Unwrap() error { return e.kind }
+
+// warmUp verifies a few keys before the first round, so that an audit that
+// can't work, for lack of credentials, of a model of the bucket or of a way
+// to reach the buckets, fails right away rather than at the end of its first
+// round. Keys that can't be verified fail it, mismatches are left to the
+// rounds. Nothing is reported, alerted on or recorded in the state.
+func (v *verifier) warmUp() error {
+	if v.cfg.WarmUpKeys == 0 {
+		return nil
+	}
+	sides := []*verifier{v}
+	if v.reverse != nil {
+		sides = append(sides, v.reverse)
+	}
+	for _, side := range sides {
+		if err := side.warmUpWith(v.cfg.WarmUpKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmUpWith verifies n keys sampled from the source of the verifier, by a
+// verifier of their own.
+func (v *verifier) warmUpWith(n int) error {
+	cfg := v.subConfig()
+	cfg.CheckCount = n
+	cfg.SampleWorkers, cfg.VerifyWorkers = defaultWorkers(n)
+	cfg.Flapping = nil
+	cfg.Degradation = nil
+	sub, err := newVerifier(&cfg, v.model, v.src, v.dst, v.abort)
+	if err != nil {
+		return warmUpError(err, "creating a verifier")
+	}
+	sub.lifecycle = v.lifecycle
+	sub.asOf = v.asOf
+
+	log.WithFields(log.Fields{
+		"keys":        n,
+		"source":      v.src.Name(),
+		"destination": v.dst.Name(),
+	}).Info("warming up, verifying a few keys before the first round")
+	now := time.Now()
+	report, err := sub.verifySamples(rand.New(rand.NewSource(now.UnixNano())), now)
+	if err != nil {
+		return warmUpError(err, "sampling keys from bucket %q", v.src.Name())
+	}
+	for _, res := range report.Results {
+		if res.Outcome != outcomeInconclusive {
+			continue
+		}
+		return warmUpError(newResultError(res), "verifying key %q in bucket %q", res.Key, v.dst.Name())
+	}
+	log.WithField("verified", len(report.Results)).Info("warmed up")
+	return nil
+}